@@ -7,14 +7,23 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
-	"time"
 
 	"github.com/pushlab/backend/internal/api"
+	"github.com/pushlab/backend/internal/api/handlers"
+	"github.com/pushlab/backend/internal/api/middleware"
+	"github.com/pushlab/backend/internal/apns"
 	"github.com/pushlab/backend/internal/auth"
 	"github.com/pushlab/backend/internal/config"
 	"github.com/pushlab/backend/internal/db"
+	"github.com/pushlab/backend/internal/keystore"
+	"github.com/pushlab/backend/internal/mail"
+	"github.com/pushlab/backend/internal/models"
 	"github.com/pushlab/backend/internal/queue"
+	"github.com/pushlab/backend/internal/ratelimit"
+	"github.com/pushlab/backend/internal/repository"
+	"github.com/redis/go-redis/v9"
 )
 
 func main() {
@@ -57,19 +66,88 @@ func main() {
 	publisher := queue.NewPublisher(rmq)
 
 	// Initialize JWT service
-	jwtService := auth.NewJWTService(cfg.JWT.Secret, cfg.JWT.ExpiryHours, cfg.JWT.Issuer)
+	jwtService := auth.NewJWTService(cfg.JWT.Secret, cfg.JWT.ExpiryHours, cfg.JWT.Issuer, cfg.JWT.RefreshTokenTTL)
 
-	// Create certs directory
-	certsDir := os.Getenv("CERTS_DIR")
-	if certsDir == "" {
-		certsDir = "/var/lib/pushlab/certs"
+	// Load master key for encrypting APNs keys at rest
+	ks, err := keystore.Load(cfg.Encryption.MasterKey, cfg.Encryption.MasterKeyFile)
+	if err != nil {
+		log.Fatalf("Failed to load master key: %v", err)
 	}
-	if err := os.MkdirAll(certsDir, 0700); err != nil {
-		log.Fatalf("Failed to create certs directory: %v", err)
+
+	// Load asymmetric JWT signing keys and keep rotating them
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	if auth.IsAsymmetric(cfg.JWT.Algorithm) {
+		keyManager := auth.NewKeyManager(
+			repository.NewSigningKeyRepository(database.Pool), ks, jwtService,
+			cfg.JWT.Algorithm, cfg.JWT.RotationInterval,
+		)
+		if err := keyManager.Load(ctx); err != nil {
+			log.Fatalf("Failed to load JWT signing keys: %v", err)
+		}
+		keyManager.Start(ctx)
+		log.Printf("Signing access tokens with %s", cfg.JWT.Algorithm)
 	}
 
 	// Create API server
-	server := api.NewServer(database, jwtService, publisher, certsDir)
+	healthPolicy := apns.HealthPolicy{
+		ErrorThreshold: cfg.APNs.CredentialHealth.ErrorThreshold,
+		ExpiryWarning:  cfg.APNs.CredentialHealth.ExpiryWarning,
+	}
+	var oidcProvider *auth.OIDCProvider
+	if cfg.OIDC.Enabled {
+		oidcProvider = auth.NewOIDCProvider(cfg.OIDC)
+		log.Printf("OIDC single sign-on enabled with %s", cfg.OIDC.IssuerURL)
+	}
+	mailer, err := mail.New(cfg.Mail)
+	if err != nil {
+		log.Fatalf("Failed to configure mail: %v", err)
+	}
+	accountPolicy := handlers.AccountPolicy{
+		PasswordResetTTL:     cfg.Accounts.PasswordResetTTL,
+		EmailVerificationTTL: cfg.Accounts.EmailVerificationTTL,
+		PublicURL:            strings.TrimSuffix(cfg.Mail.PublicURL, "/"),
+		MaxAccountFailures:   cfg.Accounts.Lockout.MaxAccountFailures,
+		MaxIPFailures:        cfg.Accounts.Lockout.MaxIPFailures,
+		LockoutWindow:        cfg.Accounts.Lockout.Window,
+	}
+
+	// Rate limit buckets are shared through Redis when it is enabled and kept
+	// in memory otherwise, or while Redis is unreachable
+	var limiter ratelimit.Limiter = ratelimit.NewMemory()
+	if cfg.Redis.Enabled {
+		redisClient := redis.NewClient(&redis.Options{
+			Addr:     cfg.Redis.Addr(),
+			Password: cfg.Redis.Password,
+			DB:       cfg.Redis.DB,
+		})
+		defer redisClient.Close()
+
+		if err := redisClient.Ping(ctx).Err(); err != nil {
+			log.Printf("Redis is not reachable, rate limiting in memory until it is: %v", err)
+		} else {
+			log.Println("Connected to Redis")
+		}
+		limiter = ratelimit.Fallback(ratelimit.NewRedis(redisClient), limiter)
+	}
+	rateLimitPolicy := middleware.RateLimitPolicy{
+		Default: ratelimit.Limit{PerMinute: cfg.RateLimit.Default.RequestsPerMinute, Burst: cfg.RateLimit.Default.Burst},
+		Routes:  make(map[string]ratelimit.Limit),
+	}
+	for route, limit := range cfg.RateLimit.Routes {
+		rateLimitPolicy.Routes[route] = ratelimit.Limit{PerMinute: limit.RequestsPerMinute, Burst: limit.Burst}
+	}
+	quotas := models.Quotas{Daily: cfg.Quotas.Daily, Monthly: cfg.Quotas.Monthly}
+	lifecycle := models.LifecyclePolicy{
+		StaleAfterDays:         cfg.Devices.Lifecycle.StaleAfterDays,
+		DeleteInvalidAfterDays: cfg.Devices.Lifecycle.DeleteInvalidAfterDays,
+	}
+
+	server := api.NewServer(
+		database, jwtService, publisher, ks, healthPolicy, oidcProvider, mailer, accountPolicy,
+		limiter, rateLimitPolicy, quotas, lifecycle,
+	)
 
 	// HTTP server
 	addr := fmt.Sprintf(":%d", cfg.Server.APIPort)
@@ -96,10 +174,10 @@ func main() {
 	log.Println("Shutting down server...")
 
 	// Graceful shutdown
-	ctx, cancel := context.WithTimeout(context.Background(), cfg.Server.ShutdownTimeout)
-	defer cancel()
+	shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), cfg.Server.ShutdownTimeout)
+	defer shutdownCancel()
 
-	if err := httpServer.Shutdown(ctx); err != nil {
+	if err := httpServer.Shutdown(shutdownCtx); err != nil {
 		log.Printf("Server forced to shutdown: %v", err)
 	}
 
@@ -0,0 +1,325 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/pushlab/backend/internal/apns"
+	"github.com/pushlab/backend/internal/auth"
+	"github.com/pushlab/backend/internal/config"
+	"github.com/pushlab/backend/internal/db"
+	"github.com/pushlab/backend/internal/keystore"
+	"github.com/pushlab/backend/internal/models"
+	"github.com/pushlab/backend/internal/repository"
+)
+
+const usage = `Usage: pushlab <command> [flags]
+
+Commands:
+  keys generate-master            Print a new random master key
+  keys rotate-master -new-key K   Re-encrypt stored keys under a new master key
+  keys import-files               Encrypt APNs keys still stored as .p8 files
+  keys rotate-jwt                 Create a new JWT signing key now
+  users grant-admin USERNAME      Make a user an instance administrator
+  users revoke-admin USERNAME     Take instance administration away
+`
+
+func main() {
+	if len(os.Args) < 3 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	switch os.Args[1] {
+	case "keys":
+		keysCommand()
+	case "users":
+		usersCommand()
+	default:
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+}
+
+func keysCommand() {
+	switch os.Args[2] {
+	case "generate-master":
+		key, err := keystore.GenerateMasterKey()
+		if err != nil {
+			log.Fatalf("Failed to generate master key: %v", err)
+		}
+		fmt.Println(key)
+	case "rotate-master":
+		rotateMaster(os.Args[3:])
+	case "import-files":
+		importFiles(os.Args[3:])
+	case "rotate-jwt":
+		rotateJWT()
+	default:
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+}
+
+func usersCommand() {
+	switch os.Args[2] {
+	case "grant-admin", "revoke-admin":
+		if len(os.Args) != 4 {
+			fmt.Fprint(os.Stderr, usage)
+			os.Exit(2)
+		}
+		setAdmin(os.Args[3], os.Args[2] == "grant-admin")
+	default:
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+}
+
+// setAdmin grants or revokes instance administration. Admin sessions pick
+// the change up on their next request.
+func setAdmin(username string, admin bool) {
+	_, database := connect()
+	defer database.Close()
+
+	updated, err := repository.NewUserRepository(database.Pool).SetAdmin(context.Background(), username, admin)
+	if err != nil {
+		log.Fatalf("Failed to update user %s: %v", username, err)
+	}
+	if !updated {
+		log.Fatalf("User %s not found", username)
+	}
+
+	if admin {
+		log.Printf("%s is now an administrator", username)
+	} else {
+		log.Printf("%s is no longer an administrator", username)
+	}
+}
+
+// rotateMaster re-wraps every data key under a new master key. Secrets
+// themselves are not re-encrypted. Update encryption.master_key to the new key
+// and restart the API and workers afterwards.
+func rotateMaster(args []string) {
+	fs := flag.NewFlagSet("rotate-master", flag.ExitOnError)
+	newKey := fs.String("new-key", "", "new base64 master key")
+	newKeyFile := fs.String("new-key-file", "", "file containing the new base64 master key")
+	fs.Parse(args)
+
+	cfg, database := connect()
+	defer database.Close()
+
+	current, err := keystore.Load(cfg.Encryption.MasterKey, cfg.Encryption.MasterKeyFile)
+	if err != nil {
+		log.Fatalf("Failed to load current master key: %v", err)
+	}
+
+	next, err := keystore.Load(*newKey, *newKeyFile)
+	if err != nil {
+		log.Fatalf("Failed to load new master key: %v", err)
+	}
+
+	ctx := context.Background()
+	apnsRepo := repository.NewAPNsRepository(database.Pool)
+
+	credentials, err := apnsRepo.GetAll(ctx)
+	if err != nil {
+		log.Fatalf("Failed to load credentials: %v", err)
+	}
+
+	// Re-wrap everything before writing so a bad key leaves the database untouched
+	var rotated []models.APNsCredential
+	for _, cred := range credentials {
+		if cred.PrivateKeyCiphertext == nil || (cred.KEKID != nil && *cred.KEKID == next.KEKID()) {
+			continue
+		}
+
+		sealed, err := current.Rewrap(apns.SealedKey(&cred), next)
+		if err != nil {
+			log.Fatalf("Failed to re-wrap key for credential %s: %v", cred.ID, err)
+		}
+		apns.SetSealedKey(&cred, sealed)
+		rotated = append(rotated, cred)
+	}
+
+	signingKeyRepo := repository.NewSigningKeyRepository(database.Pool)
+	signingKeys, err := signingKeyRepo.GetAll(ctx)
+	if err != nil {
+		log.Fatalf("Failed to load JWT signing keys: %v", err)
+	}
+
+	var rotatedSigningKeys []models.JWTSigningKey
+	for _, key := range signingKeys {
+		if key.KEKID == next.KEKID() {
+			continue
+		}
+
+		sealed, err := current.Rewrap(&keystore.Sealed{
+			Ciphertext: key.PrivateKeyCiphertext,
+			WrappedDEK: key.PrivateKeyDEK,
+			KEKID:      key.KEKID,
+		}, next)
+		if err != nil {
+			log.Fatalf("Failed to re-wrap JWT signing key %s: %v", key.KID, err)
+		}
+		key.PrivateKeyDEK = sealed.WrappedDEK
+		key.KEKID = sealed.KEKID
+		rotatedSigningKeys = append(rotatedSigningKeys, key)
+	}
+
+	mfaRepo := repository.NewMFARepository(database.Pool)
+	enrollments, err := mfaRepo.GetAllTOTP(ctx)
+	if err != nil {
+		log.Fatalf("Failed to load TOTP secrets: %v", err)
+	}
+
+	var rotatedTOTP []models.UserTOTP
+	for _, totp := range enrollments {
+		if totp.KEKID == next.KEKID() {
+			continue
+		}
+
+		sealed, err := current.Rewrap(&keystore.Sealed{
+			Ciphertext: totp.SecretCiphertext,
+			WrappedDEK: totp.SecretDEK,
+			KEKID:      totp.KEKID,
+		}, next)
+		if err != nil {
+			log.Fatalf("Failed to re-wrap TOTP secret of user %s: %v", totp.UserID, err)
+		}
+		totp.SecretDEK = sealed.WrappedDEK
+		totp.KEKID = sealed.KEKID
+		rotatedTOTP = append(rotatedTOTP, totp)
+	}
+
+	// Store everything in one transaction so a failure leaves every secret
+	// under the current key
+	tx, err := database.Pool.Begin(ctx)
+	if err != nil {
+		log.Fatalf("Failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback(ctx)
+
+	if err := apnsRepo.UpdateKeyMaterialBatch(ctx, tx, rotated); err != nil {
+		log.Fatalf("Failed to store re-encrypted keys: %v", err)
+	}
+	if err := signingKeyRepo.UpdateKeyMaterialBatch(ctx, tx, rotatedSigningKeys); err != nil {
+		log.Fatalf("Failed to store re-encrypted JWT signing keys: %v", err)
+	}
+	if err := mfaRepo.UpdateTOTPKeyMaterialBatch(ctx, tx, rotatedTOTP); err != nil {
+		log.Fatalf("Failed to store re-encrypted TOTP secrets: %v", err)
+	}
+	if err := tx.Commit(ctx); err != nil {
+		log.Fatalf("Failed to commit re-encrypted keys: %v", err)
+	}
+
+	log.Printf("Re-encrypted %d APNs keys, %d JWT signing keys and %d TOTP secrets under master key %s",
+		len(rotated), len(rotatedSigningKeys), len(rotatedTOTP), next.KEKID())
+}
+
+// rotateJWT creates a new JWT signing key ahead of schedule, e.g. after a key
+// may have leaked. Running API instances pick it up within a minute and start
+// signing with it shortly after; tokens signed with the old key stay valid
+// until they expire.
+func rotateJWT() {
+	cfg, database := connect()
+	defer database.Close()
+
+	if !auth.IsAsymmetric(cfg.JWT.Algorithm) {
+		log.Fatalf("jwt.algorithm is %s; key rotation applies to RS256 and ES256", cfg.JWT.Algorithm)
+	}
+
+	ks, err := keystore.Load(cfg.Encryption.MasterKey, cfg.Encryption.MasterKeyFile)
+	if err != nil {
+		log.Fatalf("Failed to load master key: %v", err)
+	}
+
+	jwtService := auth.NewJWTService(cfg.JWT.Secret, cfg.JWT.ExpiryHours, cfg.JWT.Issuer, cfg.JWT.RefreshTokenTTL)
+	keyManager := auth.NewKeyManager(
+		repository.NewSigningKeyRepository(database.Pool), ks, jwtService,
+		cfg.JWT.Algorithm, cfg.JWT.RotationInterval,
+	)
+	if _, err := keyManager.Rotate(context.Background(), true); err != nil {
+		log.Fatalf("Failed to rotate JWT signing key: %v", err)
+	}
+}
+
+// importFiles encrypts keys uploaded before encryption at rest into the
+// database and removes the plaintext files
+func importFiles(args []string) {
+	fs := flag.NewFlagSet("import-files", flag.ExitOnError)
+	keepFiles := fs.Bool("keep-files", false, "do not delete the .p8 files after import")
+	fs.Parse(args)
+
+	cfg, database := connect()
+	defer database.Close()
+
+	ks, err := keystore.Load(cfg.Encryption.MasterKey, cfg.Encryption.MasterKeyFile)
+	if err != nil {
+		log.Fatalf("Failed to load master key: %v", err)
+	}
+
+	ctx := context.Background()
+	apnsRepo := repository.NewAPNsRepository(database.Pool)
+
+	credentials, err := apnsRepo.GetAll(ctx)
+	if err != nil {
+		log.Fatalf("Failed to load credentials: %v", err)
+	}
+
+	imported := 0
+	for i := range credentials {
+		cred := &credentials[i]
+		if cred.PrivateKeyCiphertext != nil || cred.PrivateKeyPath == "" {
+			continue
+		}
+
+		keyPath := cred.PrivateKeyPath
+		keyData, err := os.ReadFile(keyPath)
+		if err != nil {
+			log.Printf("Skipping credential %s: %v", cred.ID, err)
+			continue
+		}
+
+		sealed, err := ks.Seal(keyData)
+		if err != nil {
+			log.Fatalf("Failed to encrypt key for credential %s: %v", cred.ID, err)
+		}
+		apns.SetSealedKey(cred, sealed)
+		cred.PrivateKeyPath = ""
+
+		if err := apnsRepo.UpdateKeyMaterial(ctx, cred); err != nil {
+			log.Fatalf("Failed to update credential %s: %v", cred.ID, err)
+		}
+
+		if !*keepFiles {
+			if err := os.Remove(keyPath); err != nil {
+				log.Printf("Failed to remove %s: %v", keyPath, err)
+			}
+		}
+		imported++
+	}
+
+	log.Printf("Imported %d APNs key files", imported)
+}
+
+func connect() (*config.Config, *db.DB) {
+	configPath := os.Getenv("CONFIG_PATH")
+	if configPath == "" {
+		configPath = "config/config.yaml"
+	}
+
+	cfg, err := config.Load(configPath)
+	if err != nil {
+		log.Fatalf("Failed to load config: %v", err)
+	}
+
+	database, err := db.Connect(cfg.Database)
+	if err != nil {
+		log.Fatalf("Failed to connect to database: %v", err)
+	}
+
+	return cfg, database
+}
@@ -10,7 +10,9 @@ import (
 	"github.com/pushlab/backend/internal/apns"
 	"github.com/pushlab/backend/internal/config"
 	"github.com/pushlab/backend/internal/db"
+	"github.com/pushlab/backend/internal/keystore"
 	"github.com/pushlab/backend/internal/queue"
+	"github.com/pushlab/backend/internal/repository"
 	"github.com/pushlab/backend/internal/worker"
 )
 
@@ -50,20 +52,66 @@ func main() {
 
 	log.Println("Connected to RabbitMQ")
 
+	// Load master key for encrypted APNs keys
+	ks, err := keystore.Load(cfg.Encryption.MasterKey, cfg.Encryption.MasterKeyFile)
+	if err != nil {
+		log.Fatalf("Failed to load master key: %v", err)
+	}
+
 	// Create APNs client
-	apnsClient := apns.NewClient()
+	apnsClient := apns.NewClient(ks)
 	defer apnsClient.Close()
 
+	// Create circuit breaker and publisher for deferred jobs
+	breakerCfg := cfg.APNs.CircuitBreaker
+	breaker := apns.NewCircuitBreaker(apns.BreakerConfig{
+		FailureThreshold:    breakerCfg.FailureThreshold,
+		OpenTimeout:         breakerCfg.OpenTimeout,
+		HalfOpenMaxRequests: breakerCfg.HalfOpenMaxRequests,
+	})
+	publisher := queue.NewPublisher(rmq)
+
 	// Create processor
-	processor := worker.NewProcessor(database.Pool, apnsClient)
+	processor := worker.NewProcessor(database.Pool, apnsClient, breaker, publisher, cfg.APNs)
 
 	// Create consumer
 	consumer := queue.NewConsumer(rmq, processor.ProcessNotification, cfg.RabbitMQ.PrefetchCount)
 
-	// Start consumer
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
+	// Evict cached APNs clients on credential changes and when idle
+	worker.NewCredentialWatcher(database.Pool, apnsClient, cfg.RabbitMQ.ReconnectDelay).Start(ctx)
+	apnsClient.StartIdleEviction(ctx, cfg.APNs.ClientIdleTTL)
+
+	// Warn owners about expiring APNs certificates
+	ownerNotifier := worker.NewOwnerNotifier(
+		repository.NewNotificationRepository(database.Pool),
+		repository.NewDeviceRepository(database.Pool),
+		publisher,
+	)
+	worker.NewCertificateMonitor(repository.NewAPNsRepository(database.Pool), ownerNotifier, cfg.APNs.CredentialHealth).Start(ctx)
+
+	// Mark stale and delete dead devices
+	if cfg.Devices.Lifecycle.Enabled {
+		worker.NewDeviceJanitor(
+			repository.NewDeviceRepository(database.Pool),
+			repository.NewAuditRepository(database.Pool),
+			ownerNotifier,
+			cfg.Devices.Lifecycle,
+		).Start(ctx)
+		log.Printf("Device janitor enabled: stale after %d days, deleted after %d days without a valid token",
+			cfg.Devices.Lifecycle.StaleAfterDays, cfg.Devices.Lifecycle.DeleteInvalidAfterDays)
+	}
+
+	// Alert owners about devices that missed their heartbeat
+	if cfg.Devices.Heartbeat.Enabled {
+		worker.NewHeartbeatMonitor(repository.NewDeviceRepository(database.Pool), ownerNotifier, cfg.Devices.Heartbeat).Start(ctx)
+		log.Println("Heartbeat monitor enabled")
+	}
+
+	// Start consumer
+
 	if err := consumer.Start(ctx); err != nil {
 		log.Fatalf("Failed to start consumer: %v", err)
 	}
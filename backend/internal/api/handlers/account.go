@@ -0,0 +1,301 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/pushlab/backend/internal/api/middleware"
+	"github.com/pushlab/backend/internal/auth"
+	"github.com/pushlab/backend/internal/mail"
+	"github.com/pushlab/backend/internal/models"
+	"github.com/pushlab/backend/internal/repository"
+)
+
+// mailTimeout bounds the delivery of a single account email
+const mailTimeout = 30 * time.Second
+
+// AccountPolicy configures account recovery and login lockout
+type AccountPolicy struct {
+	PasswordResetTTL     time.Duration
+	EmailVerificationTTL time.Duration
+	// PublicURL is where users reach the API, for links in emails
+	PublicURL          string
+	MaxAccountFailures int
+	MaxIPFailures      int
+	LockoutWindow      time.Duration
+}
+
+// AccountHandler handles password resets and email verification, and
+// tracks failed logins for the login handlers
+type AccountHandler struct {
+	accountRepo *repository.AccountRepository
+	userRepo    *repository.UserRepository
+	sessionRepo *repository.SessionRepository
+	mailer      mail.Mailer
+	auditor     *Auditor
+	policy      AccountPolicy
+}
+
+func NewAccountHandler(
+	accountRepo *repository.AccountRepository,
+	userRepo *repository.UserRepository,
+	sessionRepo *repository.SessionRepository,
+	mailer mail.Mailer,
+	auditor *Auditor,
+	policy AccountPolicy,
+) *AccountHandler {
+	return &AccountHandler{
+		accountRepo: accountRepo,
+		userRepo:    userRepo,
+		sessionRepo: sessionRepo,
+		mailer:      mailer,
+		auditor:     auditor,
+		policy:      policy,
+	}
+}
+
+// ForgotPassword emails a password reset token. It responds the same way
+// whether or not the address belongs to an account.
+func (h *AccountHandler) ForgotPassword(w http.ResponseWriter, r *http.Request) {
+	var req models.ForgotPasswordRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if req.Email == "" {
+		http.Error(w, "Email is required", http.StatusBadRequest)
+		return
+	}
+
+	user, err := h.userRepo.GetByEmail(r.Context(), req.Email)
+	if err == nil && user.IsActive {
+		if err := h.sendPasswordReset(r.Context(), user); err != nil {
+			log.Printf("Failed to start password reset for user %s: %v", user.ID, err)
+		}
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// ResetPassword sets a new password with a reset token and signs the user
+// out everywhere
+func (h *AccountHandler) ResetPassword(w http.ResponseWriter, r *http.Request) {
+	var req models.ResetPasswordRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if req.Token == "" || req.Password == "" {
+		http.Error(w, "Token and password are required", http.StatusBadRequest)
+		return
+	}
+
+	passwordHash, err := auth.HashPassword(req.Password)
+	if err != nil {
+		http.Error(w, "Failed to hash password", http.StatusInternalServerError)
+		return
+	}
+
+	userID, err := h.accountRepo.ResetPassword(r.Context(), auth.HashToken(req.Token), passwordHash)
+	if err != nil {
+		if errors.Is(err, repository.ErrTokenUnavailable) {
+			http.Error(w, "Invalid or expired reset token", http.StatusBadRequest)
+			return
+		}
+		http.Error(w, "Failed to reset password", http.StatusInternalServerError)
+		return
+	}
+
+	if err := h.sessionRepo.RevokeAllForUser(r.Context(), userID); err != nil {
+		log.Printf("Failed to revoke sessions of user %s after password reset: %v", userID, err)
+	}
+	if user, err := h.userRepo.GetByID(r.Context(), userID); err == nil {
+		h.loginSucceeded(r.Context(), user.Username)
+		h.auditor.Record(r, AuditEntry{
+			Action:     models.AuditPasswordReset,
+			TargetType: models.AuditTargetUser,
+			TargetID:   user.ID.String(),
+			Actor:      user,
+			Account:    true,
+		})
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// VerifyEmail confirms the user's address with the token from the
+// verification email. GET serves the link in the email; POST takes the
+// token in a JSON body.
+func (h *AccountHandler) VerifyEmail(w http.ResponseWriter, r *http.Request) {
+	token := r.URL.Query().Get("token")
+	if r.Method == http.MethodPost {
+		var req models.VerifyEmailRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		token = req.Token
+	}
+
+	if token == "" {
+		http.Error(w, "Token is required", http.StatusBadRequest)
+		return
+	}
+
+	userID, email, err := h.accountRepo.ConsumeEmailVerification(r.Context(), auth.HashToken(token))
+	if err != nil {
+		if errors.Is(err, repository.ErrTokenUnavailable) {
+			http.Error(w, "Verification link is invalid or has expired", http.StatusBadRequest)
+			return
+		}
+		http.Error(w, "Failed to verify email", http.StatusInternalServerError)
+		return
+	}
+
+	verified, err := h.userRepo.MarkEmailVerified(r.Context(), userID, email)
+	if err != nil {
+		http.Error(w, "Failed to verify email", http.StatusInternalServerError)
+		return
+	}
+	if !verified {
+		http.Error(w, "The email address was changed after this link was sent", http.StatusConflict)
+		return
+	}
+
+	if r.Method == http.MethodGet {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		fmt.Fprintln(w, "Your email address is verified. You can close this page.")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// ResendVerification emails a new verification link to the current user
+func (h *AccountHandler) ResendVerification(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value(middleware.UserContextKey).(*models.User)
+
+	if user.EmailVerifiedAt != nil {
+		http.Error(w, "Email address is already verified", http.StatusConflict)
+		return
+	}
+
+	if err := h.sendVerification(r.Context(), user); err != nil {
+		http.Error(w, "Failed to send verification email", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// sendVerification creates a verification token and emails the link
+func (h *AccountHandler) sendVerification(ctx context.Context, user *models.User) error {
+	token, err := auth.GenerateSecret()
+	if err != nil {
+		return err
+	}
+
+	if err := h.accountRepo.CreateEmailVerification(ctx, user.ID, user.Email, auth.HashToken(token), h.policy.EmailVerificationTTL); err != nil {
+		return err
+	}
+
+	link := h.policy.PublicURL + "/api/v1/auth/email/verify?" + url.Values{"token": {token}}.Encode()
+	h.deliver(mail.Message{
+		To:      user.Email,
+		Subject: "Verify your PushLab email address",
+		Body: fmt.Sprintf("Hi %s,\n\nPlease confirm your email address by opening this link within %s:\n\n%s\n\n"+
+			"If you did not create a PushLab account, you can ignore this email.\n",
+			user.Username, formatTTL(h.policy.EmailVerificationTTL), link),
+	})
+	return nil
+}
+
+// sendPasswordReset creates a reset token and emails it
+func (h *AccountHandler) sendPasswordReset(ctx context.Context, user *models.User) error {
+	token, err := auth.GenerateSecret()
+	if err != nil {
+		return err
+	}
+
+	if err := h.accountRepo.CreatePasswordReset(ctx, user.ID, auth.HashToken(token), h.policy.PasswordResetTTL); err != nil {
+		return err
+	}
+
+	h.deliver(mail.Message{
+		To:      user.Email,
+		Subject: "Reset your PushLab password",
+		Body: fmt.Sprintf("Hi %s,\n\nSomeone asked to reset the password of your PushLab account. "+
+			"Use this reset token within %s to choose a new password:\n\n%s\n\n"+
+			"If this was not you, you can ignore this email; your password stays the same.\n",
+			user.Username, formatTTL(h.policy.PasswordResetTTL), token),
+	})
+	return nil
+}
+
+// deliver sends the message in the background, so slow mail servers neither
+// delay the response nor reveal whether an account exists
+func (h *AccountHandler) deliver(msg mail.Message) {
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), mailTimeout)
+		defer cancel()
+
+		if err := h.mailer.Send(ctx, msg); err != nil {
+			log.Printf("Failed to send mail to %s: %v", msg.To, err)
+		}
+	}()
+}
+
+// loginLocked reports whether logins for the username or from the client
+// are locked after too many failures. It sets Retry-After when they are.
+func (h *AccountHandler) loginLocked(w http.ResponseWriter, r *http.Request, username string) (bool, error) {
+	accountFailures, ipFailures, err := h.accountRepo.CountLoginFailures(r.Context(), username, clientAddr(r), h.policy.LockoutWindow)
+	if err != nil {
+		return false, err
+	}
+
+	if accountFailures >= h.policy.MaxAccountFailures || ipFailures >= h.policy.MaxIPFailures {
+		w.Header().Set("Retry-After", strconv.Itoa(int(h.policy.LockoutWindow.Seconds())))
+		return true, nil
+	}
+	return false, nil
+}
+
+// loginFailed counts a wrong password or second factor
+func (h *AccountHandler) loginFailed(r *http.Request, username string) {
+	if err := h.accountRepo.RecordLoginFailure(r.Context(), username, clientAddr(r)); err != nil {
+		log.Printf("Failed to record login failure for %s: %v", username, err)
+	}
+}
+
+// loginSucceeded lifts the lockout of the username
+func (h *AccountHandler) loginSucceeded(ctx context.Context, username string) {
+	if err := h.accountRepo.ClearLoginFailures(ctx, username); err != nil {
+		log.Printf("Failed to clear login failures for %s: %v", username, err)
+	}
+}
+
+func clientAddr(r *http.Request) string {
+	if ip := middleware.ClientIP(r); ip != nil {
+		return ip.String()
+	}
+	return r.RemoteAddr
+}
+
+// formatTTL renders a token lifetime for emails, e.g. "1 hour"
+func formatTTL(d time.Duration) string {
+	if d >= time.Hour && d%time.Hour == 0 {
+		if d == time.Hour {
+			return "1 hour"
+		}
+		return fmt.Sprintf("%d hours", int(d.Hours()))
+	}
+	return fmt.Sprintf("%d minutes", int(d.Minutes()))
+}
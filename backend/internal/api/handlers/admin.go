@@ -0,0 +1,385 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+	"github.com/pushlab/backend/internal/api/middleware"
+	"github.com/pushlab/backend/internal/auth"
+	"github.com/pushlab/backend/internal/models"
+	"github.com/pushlab/backend/internal/repository"
+)
+
+const (
+	adminDefaultLimit = 50
+	adminMaxLimit     = 500
+	// impersonationTTL is how long a support session acting as a user lasts
+	impersonationTTL = 30 * time.Minute
+)
+
+// AdminHandler lets instance administrators manage users across
+// organizations
+type AdminHandler struct {
+	userRepo    *repository.UserRepository
+	apiKeyRepo  *repository.APIKeyRepository
+	sessionRepo *repository.SessionRepository
+	limitsRepo  *repository.LimitsRepository
+	auditor     *Auditor
+	jwtService  *auth.JWTService
+	quotas      models.Quotas
+}
+
+func NewAdminHandler(
+	userRepo *repository.UserRepository,
+	apiKeyRepo *repository.APIKeyRepository,
+	sessionRepo *repository.SessionRepository,
+	limitsRepo *repository.LimitsRepository,
+	auditor *Auditor,
+	jwtService *auth.JWTService,
+	quotas models.Quotas,
+) *AdminHandler {
+	return &AdminHandler{
+		userRepo:    userRepo,
+		apiKeyRepo:  apiKeyRepo,
+		sessionRepo: sessionRepo,
+		limitsRepo:  limitsRepo,
+		auditor:     auditor,
+		jwtService:  jwtService,
+		quotas:      quotas,
+	}
+}
+
+// ListUsers returns users, oldest first. q searches usernames and email
+// addresses; active=true or active=false filters by status.
+func (h *AdminHandler) ListUsers(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	filter := models.UserFilter{
+		Query: query.Get("q"),
+		Limit: adminDefaultLimit,
+	}
+
+	if active := query.Get("active"); active != "" {
+		value, err := strconv.ParseBool(active)
+		if err != nil {
+			http.Error(w, "Active must be true or false", http.StatusBadRequest)
+			return
+		}
+		filter.Active = &value
+	}
+
+	if limit := query.Get("limit"); limit != "" {
+		l, err := strconv.Atoi(limit)
+		if err != nil || l <= 0 || l > adminMaxLimit {
+			http.Error(w, fmt.Sprintf("Limit must be between 1 and %d", adminMaxLimit), http.StatusBadRequest)
+			return
+		}
+		filter.Limit = l
+	}
+
+	if offset := query.Get("offset"); offset != "" {
+		o, err := strconv.Atoi(offset)
+		if err != nil || o < 0 {
+			http.Error(w, "Invalid offset", http.StatusBadRequest)
+			return
+		}
+		filter.Offset = o
+	}
+
+	users, err := h.userRepo.List(r.Context(), filter)
+	if err != nil {
+		http.Error(w, "Failed to fetch users", http.StatusInternalServerError)
+		return
+	}
+
+	for i := range users {
+		users[i].PasswordHash = ""
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(users)
+}
+
+func (h *AdminHandler) GetUser(w http.ResponseWriter, r *http.Request) {
+	user, ok := h.targetUser(w, r)
+	if !ok {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(user)
+}
+
+// DeactivateUser blocks the user from signing in and ends their sessions.
+// Their API keys stop working while the account is inactive.
+func (h *AdminHandler) DeactivateUser(w http.ResponseWriter, r *http.Request) {
+	admin := r.Context().Value(middleware.UserContextKey).(*models.User)
+
+	user, ok := h.targetUser(w, r)
+	if !ok {
+		return
+	}
+
+	if user.ID == admin.ID {
+		http.Error(w, "You cannot deactivate your own account", http.StatusBadRequest)
+		return
+	}
+
+	h.setActive(w, r, user, false)
+}
+
+// ReactivateUser lets a deactivated user sign in again
+func (h *AdminHandler) ReactivateUser(w http.ResponseWriter, r *http.Request) {
+	user, ok := h.targetUser(w, r)
+	if !ok {
+		return
+	}
+
+	h.setActive(w, r, user, true)
+}
+
+func (h *AdminHandler) setActive(w http.ResponseWriter, r *http.Request, user *models.User, active bool) {
+	changed, err := h.userRepo.SetActive(r.Context(), user.ID, active)
+	if err != nil {
+		http.Error(w, "Failed to update user", http.StatusInternalServerError)
+		return
+	}
+
+	if changed {
+		action := models.AuditUserReactivated
+		if !active {
+			action = models.AuditUserDeactivated
+			if err := h.sessionRepo.RevokeAllForUser(r.Context(), user.ID); err != nil {
+				log.Printf("Failed to revoke sessions of deactivated user %s: %v", user.ID, err)
+			}
+		}
+
+		h.auditor.Record(r, AuditEntry{
+			Action:     action,
+			TargetType: models.AuditTargetUser,
+			TargetID:   user.ID.String(),
+			Before:     map[string]bool{"is_active": user.IsActive},
+			After:      map[string]bool{"is_active": active},
+		})
+		user.IsActive = active
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(user)
+}
+
+// ResetAPIKeys revokes all of the user's API keys in every organization
+func (h *AdminHandler) ResetAPIKeys(w http.ResponseWriter, r *http.Request) {
+	user, ok := h.targetUser(w, r)
+	if !ok {
+		return
+	}
+
+	revoked, err := h.apiKeyRepo.RevokeAllForUser(r.Context(), user.ID)
+	if err != nil {
+		http.Error(w, "Failed to revoke API keys", http.StatusInternalServerError)
+		return
+	}
+
+	h.auditor.Record(r, AuditEntry{
+		Action:     models.AuditUserAPIKeysReset,
+		TargetType: models.AuditTargetUser,
+		TargetID:   user.ID.String(),
+		After:      map[string]int64{"revoked": revoked},
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(models.ResetAPIKeysResponse{Revoked: int(revoked)})
+}
+
+// Usage summarizes the user's organizations, devices, keys and sending
+func (h *AdminHandler) Usage(w http.ResponseWriter, r *http.Request) {
+	user, ok := h.targetUser(w, r)
+	if !ok {
+		return
+	}
+
+	usage, err := h.userRepo.GetUsage(r.Context(), user.ID)
+	if err != nil {
+		http.Error(w, "Failed to fetch usage", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(usage)
+}
+
+// GetLimits shows the user's rate limit and quota overrides, the quotas in
+// effect and how much of them is used
+func (h *AdminHandler) GetLimits(w http.ResponseWriter, r *http.Request) {
+	user, ok := h.targetUser(w, r)
+	if !ok {
+		return
+	}
+
+	limits, err := h.limitsRepo.GetUserLimits(r.Context(), user.ID)
+	if err != nil {
+		http.Error(w, "Failed to fetch limits", http.StatusInternalServerError)
+		return
+	}
+
+	h.writeLimits(w, r, limits)
+}
+
+// UpdateLimits replaces the user's overrides. Null fields fall back to the
+// configured defaults; a quota of 0 means unlimited. The rate limit
+// override applies to every route and takes effect within a minute.
+func (h *AdminHandler) UpdateLimits(w http.ResponseWriter, r *http.Request) {
+	user, ok := h.targetUser(w, r)
+	if !ok {
+		return
+	}
+
+	var req models.UpdateUserLimitsRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if (req.RequestsPerMinute != nil && *req.RequestsPerMinute <= 0) || (req.Burst != nil && *req.Burst <= 0) {
+		http.Error(w, "Requests per minute and burst must be positive", http.StatusBadRequest)
+		return
+	}
+	if (req.DailyQuota != nil && *req.DailyQuota < 0) || (req.MonthlyQuota != nil && *req.MonthlyQuota < 0) {
+		http.Error(w, "Quotas cannot be negative", http.StatusBadRequest)
+		return
+	}
+
+	before, err := h.limitsRepo.GetUserLimits(r.Context(), user.ID)
+	if err != nil {
+		http.Error(w, "Failed to fetch limits", http.StatusInternalServerError)
+		return
+	}
+
+	limits := &models.UserLimits{
+		UserID:            user.ID,
+		RequestsPerMinute: req.RequestsPerMinute,
+		Burst:             req.Burst,
+		DailyQuota:        req.DailyQuota,
+		MonthlyQuota:      req.MonthlyQuota,
+	}
+	if err := h.limitsRepo.SetUserLimits(r.Context(), limits); err != nil {
+		http.Error(w, "Failed to update limits", http.StatusInternalServerError)
+		return
+	}
+
+	h.auditor.Record(r, AuditEntry{
+		Action:     models.AuditUserLimitsUpdated,
+		TargetType: models.AuditTargetUser,
+		TargetID:   user.ID.String(),
+		Before:     before,
+		After:      limits,
+	})
+
+	h.writeLimits(w, r, limits)
+}
+
+func (h *AdminHandler) writeLimits(w http.ResponseWriter, r *http.Request, limits *models.UserLimits) {
+	today, thisMonth, err := h.limitsRepo.GetSendUsage(r.Context(), limits.UserID, time.Now())
+	if err != nil {
+		http.Error(w, "Failed to fetch send usage", http.StatusInternalServerError)
+		return
+	}
+
+	quotas := limits.Quotas(h.quotas)
+	response := models.UserLimitsResponse{
+		Overrides:     *limits,
+		DailyQuota:    quotas.Daily,
+		MonthlyQuota:  quotas.Monthly,
+		SentToday:     today,
+		SentThisMonth: thisMonth,
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// Impersonate issues a short-lived token that acts as the user for support.
+// The token can only read: it is limited to GET requests and read scopes,
+// and stops working if the admin loses admin rights. The session shows up
+// in the user's own audit log.
+func (h *AdminHandler) Impersonate(w http.ResponseWriter, r *http.Request) {
+	admin := r.Context().Value(middleware.UserContextKey).(*models.User)
+
+	user, ok := h.targetUser(w, r)
+	if !ok {
+		return
+	}
+
+	if user.ID == admin.ID {
+		http.Error(w, "You cannot impersonate yourself", http.StatusBadRequest)
+		return
+	}
+
+	if !user.IsActive {
+		http.Error(w, "User account is inactive", http.StatusConflict)
+		return
+	}
+
+	// The session row lets the user end it with logout-all; its refresh
+	// token is never handed out
+	secret, err := auth.GenerateSecret()
+	if err != nil {
+		http.Error(w, "Failed to start impersonation", http.StatusInternalServerError)
+		return
+	}
+	session := &models.RefreshToken{
+		UserID:    user.ID,
+		FamilyID:  uuid.New(),
+		TokenHash: auth.HashToken(secret),
+	}
+	if err := h.sessionRepo.CreateRefreshToken(r.Context(), session, impersonationTTL); err != nil {
+		http.Error(w, "Failed to start impersonation", http.StatusInternalServerError)
+		return
+	}
+
+	token, err := h.jwtService.GenerateImpersonationToken(user.ID, user.Username, session.FamilyID, admin.ID, impersonationTTL)
+	if err != nil {
+		http.Error(w, "Failed to generate token", http.StatusInternalServerError)
+		return
+	}
+
+	h.auditor.Record(r, AuditEntry{
+		Action:     models.AuditImpersonationStarted,
+		TargetType: models.AuditTargetUser,
+		TargetID:   user.ID.String(),
+		After:      map[string]any{"session_id": session.FamilyID, "expires_in": impersonationTTL.String()},
+	})
+
+	response := models.ImpersonationResponse{
+		Token:     token,
+		ExpiresAt: time.Now().Add(impersonationTTL),
+		User:      *user,
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(response)
+}
+
+// targetUser loads the user named in the URL
+func (h *AdminHandler) targetUser(w http.ResponseWriter, r *http.Request) (*models.User, bool) {
+	userID, err := uuid.Parse(chi.URLParam(r, "id"))
+	if err != nil {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return nil, false
+	}
+
+	user, err := h.userRepo.GetByID(r.Context(), userID)
+	if err != nil {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return nil, false
+	}
+	user.PasswordHash = ""
+	return user, true
+}
@@ -0,0 +1,314 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+	"github.com/pushlab/backend/internal/api/middleware"
+	"github.com/pushlab/backend/internal/auth"
+	"github.com/pushlab/backend/internal/models"
+	"github.com/pushlab/backend/internal/repository"
+)
+
+type APIKeyHandler struct {
+	apiKeyRepo *repository.APIKeyRepository
+	auditor    *Auditor
+}
+
+func NewAPIKeyHandler(apiKeyRepo *repository.APIKeyRepository, auditor *Auditor) *APIKeyHandler {
+	return &APIKeyHandler{apiKeyRepo: apiKeyRepo, auditor: auditor}
+}
+
+func (h *APIKeyHandler) Create(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value(middleware.UserContextKey).(*models.User)
+	org := middleware.OrgFromContext(r.Context())
+
+	var req models.CreateAPIKeyRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if req.Name == "" {
+		http.Error(w, "Name is required", http.StatusBadRequest)
+		return
+	}
+
+	if req.ExpiresAt != nil && !req.ExpiresAt.After(time.Now()) {
+		http.Error(w, "Expiry must be in the future", http.StatusBadRequest)
+		return
+	}
+
+	key := &models.APIKey{
+		OrgID:       org.OrgID,
+		UserID:      user.ID,
+		Name:        req.Name,
+		ExpiresAt:   req.ExpiresAt,
+		Scopes:      req.Scopes,
+		AllowedTags: req.AllowedTags,
+	}
+
+	if msg := validateScopes(key.Scopes); msg != "" {
+		http.Error(w, msg, http.StatusBadRequest)
+		return
+	}
+
+	if !canGrant(r.Context(), key.Scopes) {
+		http.Error(w, "Cannot grant scopes beyond your own role or API key", http.StatusForbidden)
+		return
+	}
+
+	allowedIPs, msg := normalizeAllowedIPs(req.AllowedIPs)
+	if msg != "" {
+		http.Error(w, msg, http.StatusBadRequest)
+		return
+	}
+	key.AllowedIPs = allowedIPs
+
+	if !canRestrict(r.Context(), key.AllowedTags, key.AllowedIPs) {
+		http.Error(w, "Cannot allow tags or IPs beyond your API key's own", http.StatusForbidden)
+		return
+	}
+
+	response, err := issueAPIKey(r.Context(), h.apiKeyRepo, key)
+	if err != nil {
+		http.Error(w, "Failed to create API key", http.StatusInternalServerError)
+		return
+	}
+
+	h.auditor.Record(r, AuditEntry{
+		Action:     models.AuditAPIKeyCreated,
+		TargetType: models.AuditTargetAPIKey,
+		TargetID:   key.ID.String(),
+		After:      key,
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(response)
+}
+
+func (h *APIKeyHandler) List(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value(middleware.UserContextKey).(*models.User)
+	org := middleware.OrgFromContext(r.Context())
+
+	keys, err := h.apiKeyRepo.GetByUserAndOrg(r.Context(), user.ID, org.OrgID)
+	if err != nil {
+		http.Error(w, "Failed to fetch API keys", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(keys)
+}
+
+func (h *APIKeyHandler) Get(w http.ResponseWriter, r *http.Request) {
+	key, ok := h.ownedKey(w, r)
+	if !ok {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(key)
+}
+
+func (h *APIKeyHandler) Update(w http.ResponseWriter, r *http.Request) {
+	key, ok := h.ownedKey(w, r)
+	if !ok {
+		return
+	}
+
+	var req models.UpdateAPIKeyRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	before := *key
+
+	if req.Name != nil {
+		if *req.Name == "" {
+			http.Error(w, "Name cannot be empty", http.StatusBadRequest)
+			return
+		}
+		key.Name = *req.Name
+	}
+
+	if req.Scopes != nil {
+		if msg := validateScopes(*req.Scopes); msg != "" {
+			http.Error(w, msg, http.StatusBadRequest)
+			return
+		}
+		if !canGrant(r.Context(), *req.Scopes) {
+			http.Error(w, "Cannot grant scopes beyond your own role or API key", http.StatusForbidden)
+			return
+		}
+		key.Scopes = *req.Scopes
+	}
+
+	if req.AllowedTags != nil {
+		key.AllowedTags = *req.AllowedTags
+	}
+
+	if req.AllowedIPs != nil {
+		allowedIPs, msg := normalizeAllowedIPs(*req.AllowedIPs)
+		if msg != "" {
+			http.Error(w, msg, http.StatusBadRequest)
+			return
+		}
+		key.AllowedIPs = allowedIPs
+	}
+
+	if (req.AllowedTags != nil || req.AllowedIPs != nil) && !canRestrict(r.Context(), key.AllowedTags, key.AllowedIPs) {
+		http.Error(w, "Cannot allow tags or IPs beyond your API key's own", http.StatusForbidden)
+		return
+	}
+
+	if err := h.apiKeyRepo.Update(r.Context(), key); err != nil {
+		http.Error(w, "Failed to update API key", http.StatusInternalServerError)
+		return
+	}
+
+	h.auditor.Record(r, AuditEntry{
+		Action:     models.AuditAPIKeyUpdated,
+		TargetType: models.AuditTargetAPIKey,
+		TargetID:   key.ID.String(),
+		Before:     before,
+		After:      key,
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(key)
+}
+
+// Delete revokes the key; it stays listed with its revocation time
+func (h *APIKeyHandler) Delete(w http.ResponseWriter, r *http.Request) {
+	key, ok := h.ownedKey(w, r)
+	if !ok {
+		return
+	}
+
+	if err := h.apiKeyRepo.Revoke(r.Context(), key.ID); err != nil {
+		http.Error(w, "Failed to revoke API key", http.StatusInternalServerError)
+		return
+	}
+
+	h.auditor.Record(r, AuditEntry{
+		Action:     models.AuditAPIKeyRevoked,
+		TargetType: models.AuditTargetAPIKey,
+		TargetID:   key.ID.String(),
+		Before:     key,
+	})
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// ownedKey loads the key named in the URL and checks it is the user's key for
+// the selected organization
+func (h *APIKeyHandler) ownedKey(w http.ResponseWriter, r *http.Request) (*models.APIKey, bool) {
+	user := r.Context().Value(middleware.UserContextKey).(*models.User)
+	org := middleware.OrgFromContext(r.Context())
+	keyID, err := uuid.Parse(chi.URLParam(r, "id"))
+	if err != nil {
+		http.Error(w, "Invalid API key ID", http.StatusBadRequest)
+		return nil, false
+	}
+
+	key, err := h.apiKeyRepo.GetByID(r.Context(), keyID)
+	if err != nil || key.UserID != user.ID || key.OrgID != org.OrgID {
+		http.Error(w, "API key not found", http.StatusNotFound)
+		return nil, false
+	}
+
+	return key, true
+}
+
+// issueAPIKey generates the secret for key, stores it and returns the
+// plaintext once
+func issueAPIKey(ctx context.Context, repo *repository.APIKeyRepository, key *models.APIKey) (*models.CreateAPIKeyResponse, error) {
+	plaintext, prefix, hash, err := auth.GenerateAPIKey()
+	if err != nil {
+		return nil, err
+	}
+
+	key.Prefix = prefix
+	key.KeyHash = hash
+	if err := repo.Create(ctx, key); err != nil {
+		return nil, err
+	}
+
+	return &models.CreateAPIKeyResponse{APIKey: *key, Key: plaintext}, nil
+}
+
+// fullAccessKey describes a key with every scope the user's role grants in
+// the organization, as issued at registration
+func fullAccessKey(userID uuid.UUID, org *models.OrgMembership, name string) *models.APIKey {
+	return &models.APIKey{
+		OrgID:  org.OrgID,
+		UserID: userID,
+		Name:   name,
+		Scopes: models.RoleScopes(org.Role),
+	}
+}
+
+// canGrant reports whether the caller may hand out the scopes: only scopes
+// their role grants, and for API keys only scopes the key holds itself
+func canGrant(ctx context.Context, scopes []string) bool {
+	org := middleware.OrgFromContext(ctx)
+	caller := middleware.APIKeyFromContext(ctx)
+	for _, scope := range scopes {
+		if !models.RoleHasScope(org.Role, scope) {
+			return false
+		}
+		if caller != nil && !caller.HasScope(scope) {
+			return false
+		}
+	}
+	return true
+}
+
+// canRestrict reports whether the caller may give a key these restrictions:
+// for API keys, only tags and networks within the key's own, so that a
+// restricted key cannot issue or turn itself into a less restricted one
+func canRestrict(ctx context.Context, allowedTags, allowedIPs []string) bool {
+	caller := middleware.APIKeyFromContext(ctx)
+	return caller == nil || (caller.AllowsTags(allowedTags) && caller.AllowsNetworks(allowedIPs))
+}
+
+func validateScopes(scopes []string) string {
+	if len(scopes) == 0 {
+		return "At least one scope is required"
+	}
+	for _, scope := range scopes {
+		if !models.IsValidScope(scope) {
+			return "Unknown scope: " + scope
+		}
+	}
+	return ""
+}
+
+// normalizeAllowedIPs accepts addresses or CIDRs and returns them as CIDRs
+func normalizeAllowedIPs(values []string) ([]string, string) {
+	cidrs := make([]string, 0, len(values))
+	for _, value := range values {
+		if _, network, err := net.ParseCIDR(value); err == nil {
+			cidrs = append(cidrs, network.String())
+			continue
+		}
+		ip := net.ParseIP(value)
+		if ip == nil {
+			return nil, "Invalid IP address or CIDR: " + value
+		}
+		bits := 128
+		if ip.To4() != nil {
+			ip, bits = ip.To4(), 32
+		}
+		cidrs = append(cidrs, (&net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}).String())
+	}
+	return cidrs, ""
+}
@@ -1,35 +1,42 @@
 package handlers
 
 import (
+	"encoding/base64"
 	"encoding/json"
-	"fmt"
 	"net/http"
 	"os"
-	"path/filepath"
+	"time"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/google/uuid"
 	"github.com/pushlab/backend/internal/api/middleware"
+	"github.com/pushlab/backend/internal/apns"
+	"github.com/pushlab/backend/internal/keystore"
 	"github.com/pushlab/backend/internal/models"
 	"github.com/pushlab/backend/internal/repository"
 )
 
 type APNsHandler struct {
-	apnsRepo *repository.APNsRepository
-	certsDir string
+	apnsRepo     *repository.APNsRepository
+	apnsClient   *apns.Client
+	keystore     *keystore.Keystore
+	healthPolicy apns.HealthPolicy
+	auditor      *Auditor
 }
 
-func NewAPNsHandler(apnsRepo *repository.APNsRepository, certsDir string) *APNsHandler {
-	// Create certs directory if it doesn't exist
-	os.MkdirAll(certsDir, 0700)
+func NewAPNsHandler(apnsRepo *repository.APNsRepository, apnsClient *apns.Client, ks *keystore.Keystore, healthPolicy apns.HealthPolicy, auditor *Auditor) *APNsHandler {
 	return &APNsHandler{
-		apnsRepo: apnsRepo,
-		certsDir: certsDir,
+		apnsRepo:     apnsRepo,
+		apnsClient:   apnsClient,
+		keystore:     ks,
+		healthPolicy: healthPolicy,
+		auditor:      auditor,
 	}
 }
 
 func (h *APNsHandler) Create(w http.ResponseWriter, r *http.Request) {
 	user := r.Context().Value(middleware.UserContextKey).(*models.User)
+	org := middleware.OrgFromContext(r.Context())
 
 	var req models.CreateAPNsCredentialRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
@@ -37,7 +44,16 @@ func (h *APNsHandler) Create(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if req.TeamID == "" || req.KeyID == "" || req.BundleID == "" || req.Environment == "" || req.PrivateKey == "" {
+	if req.AuthType == "" {
+		req.AuthType = models.APNsAuthToken
+	}
+
+	if req.AuthType != models.APNsAuthToken && req.AuthType != models.APNsAuthCertificate {
+		http.Error(w, "Auth type must be 'token' or 'certificate'", http.StatusBadRequest)
+		return
+	}
+
+	if req.BundleID == "" || req.Environment == "" {
 		http.Error(w, "All fields are required", http.StatusBadRequest)
 		return
 	}
@@ -47,89 +63,174 @@ func (h *APNsHandler) Create(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Save private key to file
-	filename := fmt.Sprintf("%s_%s_%s_%s.p8", user.ID, req.BundleID, req.Environment, req.KeyID)
-	keyPath := filepath.Join(h.certsDir, filename)
+	cred := &models.APNsCredential{
+		OrgID:       org.OrgID,
+		UserID:      user.ID,
+		AuthType:    req.AuthType,
+		BundleID:    req.BundleID,
+		Environment: req.Environment,
+		IsActive:    true,
+	}
 
-	if err := os.WriteFile(keyPath, []byte(req.PrivateKey), 0600); err != nil {
-		http.Error(w, "Failed to save private key", http.StatusInternalServerError)
-		return
+	var keyMaterial []byte
+	if req.AuthType == models.APNsAuthCertificate {
+		if req.Certificate == "" {
+			http.Error(w, "Certificate is required for certificate authentication", http.StatusBadRequest)
+			return
+		}
+
+		p12, err := base64.StdEncoding.DecodeString(req.Certificate)
+		if err != nil {
+			http.Error(w, "Certificate must be a base64-encoded .p12 file", http.StatusBadRequest)
+			return
+		}
+
+		pemData, expiresAt, err := apns.ParseCertificate(p12, req.Passphrase, req.BundleID)
+		if err != nil {
+			http.Error(w, "Invalid certificate: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		keyMaterial = pemData
+		cred.CertificateExpiresAt = &expiresAt
+	} else {
+		if req.TeamID == "" || req.KeyID == "" || req.PrivateKey == "" {
+			http.Error(w, "All fields are required", http.StatusBadRequest)
+			return
+		}
+
+		if !apns.ValidTeamID(req.TeamID) {
+			http.Error(w, "Team ID must be 10 uppercase letters or digits", http.StatusBadRequest)
+			return
+		}
+
+		if !apns.ValidKeyID(req.KeyID) {
+			http.Error(w, "Key ID must be 10 uppercase letters or digits", http.StatusBadRequest)
+			return
+		}
+
+		if _, err := apns.ParseAuthKey([]byte(req.PrivateKey)); err != nil {
+			http.Error(w, "Invalid private key, expected the contents of an APNs .p8 file: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		keyMaterial = []byte(req.PrivateKey)
+		cred.TeamID = req.TeamID
+		cred.KeyID = req.KeyID
 	}
 
-	cred := &models.APNsCredential{
-		UserID:         user.ID,
-		TeamID:         req.TeamID,
-		KeyID:          req.KeyID,
-		BundleID:       req.BundleID,
-		Environment:    req.Environment,
-		PrivateKeyPath: keyPath,
-		IsActive:       true,
+	// Encrypt key material; it is only ever decrypted in memory by the worker
+	sealed, err := h.keystore.Seal(keyMaterial)
+	if err != nil {
+		http.Error(w, "Failed to encrypt private key", http.StatusInternalServerError)
+		return
 	}
+	apns.SetSealedKey(cred, sealed)
 
 	if err := h.apnsRepo.Create(r.Context(), cred); err != nil {
-		// Clean up file on error
-		os.Remove(keyPath)
 		http.Error(w, "Failed to create credentials: "+err.Error(), http.StatusInternalServerError)
 		return
 	}
 
+	h.auditor.Record(r, AuditEntry{
+		Action:     models.AuditCredentialCreated,
+		TargetType: models.AuditTargetCredential,
+		TargetID:   cred.ID.String(),
+		After:      cred,
+	})
+
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusCreated)
 	json.NewEncoder(w).Encode(cred)
 }
 
 func (h *APNsHandler) List(w http.ResponseWriter, r *http.Request) {
-	user := r.Context().Value(middleware.UserContextKey).(*models.User)
+	org := middleware.OrgFromContext(r.Context())
 
-	credentials, err := h.apnsRepo.GetByUserID(r.Context(), user.ID)
+	credentials, err := h.apnsRepo.GetByOrgID(r.Context(), org.OrgID)
 	if err != nil {
 		http.Error(w, "Failed to fetch credentials", http.StatusInternalServerError)
 		return
 	}
 
+	now := time.Now()
+	for i := range credentials {
+		credentials[i].Health = h.healthPolicy.Evaluate(&credentials[i], now)
+	}
+
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(credentials)
 }
 
 func (h *APNsHandler) Delete(w http.ResponseWriter, r *http.Request) {
-	user := r.Context().Value(middleware.UserContextKey).(*models.User)
+	org := middleware.OrgFromContext(r.Context())
 	credID, err := uuid.Parse(chi.URLParam(r, "id"))
 	if err != nil {
 		http.Error(w, "Invalid credential ID", http.StatusBadRequest)
 		return
 	}
 
-	// Get credential to verify ownership
-	credentials, err := h.apnsRepo.GetByUserID(r.Context(), user.ID)
-	if err != nil {
-		http.Error(w, "Failed to fetch credentials", http.StatusInternalServerError)
-		return
-	}
-
-	found := false
-	var keyPath string
-	for _, cred := range credentials {
-		if cred.ID == credID {
-			found = true
-			keyPath = cred.PrivateKeyPath
-			break
-		}
-	}
-
-	if !found {
+	// Get credential to verify it belongs to the organization
+	cred, err := h.apnsRepo.GetByID(r.Context(), credID)
+	if err != nil || cred.OrgID != org.OrgID {
 		http.Error(w, "Credential not found", http.StatusNotFound)
 		return
 	}
+	keyPath := cred.PrivateKeyPath
 
 	if err := h.apnsRepo.Delete(r.Context(), credID); err != nil {
 		http.Error(w, "Failed to delete credential", http.StatusInternalServerError)
 		return
 	}
 
-	// Delete the private key file
+	h.auditor.Record(r, AuditEntry{
+		Action:     models.AuditCredentialDeleted,
+		TargetType: models.AuditTargetCredential,
+		TargetID:   cred.ID.String(),
+		Before:     cred,
+	})
+
+	// Delete the private key file of credentials stored before encryption at rest
 	if keyPath != "" {
 		os.Remove(keyPath)
 	}
 
 	w.WriteHeader(http.StatusNoContent)
 }
+
+// Verify signs a provider token with the credential and optionally sends a
+// silent probe push to a device token, returning Apple's verdict
+func (h *APNsHandler) Verify(w http.ResponseWriter, r *http.Request) {
+	org := middleware.OrgFromContext(r.Context())
+	credID, err := uuid.Parse(chi.URLParam(r, "id"))
+	if err != nil {
+		http.Error(w, "Invalid credential ID", http.StatusBadRequest)
+		return
+	}
+
+	var req models.VerifyAPNsCredentialRequest
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+	}
+
+	cred, err := h.apnsRepo.GetByID(r.Context(), credID)
+	if err != nil || cred.OrgID != org.OrgID {
+		http.Error(w, "Credential not found", http.StatusNotFound)
+		return
+	}
+
+	result := h.apnsClient.Verify(r.Context(), cred, req.DeviceToken)
+
+	h.auditor.Record(r, AuditEntry{
+		Action:     models.AuditCredentialVerified,
+		TargetType: models.AuditTargetCredential,
+		TargetID:   cred.ID.String(),
+		After:      result,
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
@@ -0,0 +1,359 @@
+package handlers
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/pushlab/backend/internal/api/middleware"
+	"github.com/pushlab/backend/internal/models"
+	"github.com/pushlab/backend/internal/repository"
+)
+
+const (
+	auditDefaultLimit = 100
+	auditMaxLimit     = 500
+	// auditExportBatch is how many events an export reads per query
+	auditExportBatch = 1000
+)
+
+// AuditEntry describes an action to record. The actor, organization and
+// client are taken from the request.
+type AuditEntry struct {
+	Action     string
+	TargetType string
+	TargetID   string
+	// Before and After are the target before and after the action; only
+	// the fields that differ are stored. Either is nil when the target was
+	// created or deleted.
+	Before any
+	After  any
+	// Actor overrides the authenticated user, e.g. for logins
+	Actor *models.User
+	// OrgID names the organization for requests that do not select one
+	// through the middleware, such as membership changes
+	OrgID *uuid.UUID
+	// Account marks an event about the actor's own account rather than an
+	// organization's resources
+	Account bool
+}
+
+// Auditor records audit events. A failure to record is logged but does not
+// fail the request.
+type Auditor struct {
+	auditRepo *repository.AuditRepository
+}
+
+func NewAuditor(auditRepo *repository.AuditRepository) *Auditor {
+	return &Auditor{auditRepo: auditRepo}
+}
+
+func (a *Auditor) Record(r *http.Request, entry AuditEntry) {
+	event := &models.AuditEvent{
+		Action:     entry.Action,
+		TargetType: entry.TargetType,
+	}
+	if entry.TargetID != "" {
+		event.TargetID = &entry.TargetID
+	}
+
+	ip := clientAddr(r)
+	event.IP = &ip
+	if userAgent := r.UserAgent(); userAgent != "" {
+		event.UserAgent = &userAgent
+	}
+
+	actor := entry.Actor
+	if actor == nil {
+		actor, _ = r.Context().Value(middleware.UserContextKey).(*models.User)
+	}
+	if actor != nil {
+		event.ActorUserID = &actor.ID
+		event.ActorUsername = &actor.Username
+	}
+	if key := middleware.APIKeyFromContext(r.Context()); key != nil {
+		event.ActorAPIKeyID = &key.ID
+	}
+	if entry.OrgID != nil {
+		event.OrgID = entry.OrgID
+	} else if org := middleware.OrgFromContext(r.Context()); org != nil && !entry.Account {
+		event.OrgID = &org.OrgID
+	}
+
+	var err error
+	event.Before, event.After, err = auditDiff(entry.Before, entry.After)
+	if err == nil {
+		err = a.auditRepo.Create(r.Context(), event)
+	}
+	if err != nil {
+		log.Printf("Failed to record audit event %s on %s %s: %v", entry.Action, entry.TargetType, entry.TargetID, err)
+	}
+}
+
+// auditDiff encodes the fields of before and after that differ. Fields
+// hidden from JSON, such as secrets, are never stored.
+func auditDiff(before, after any) (json.RawMessage, json.RawMessage, error) {
+	beforeFields, err := auditFields(before)
+	if err != nil {
+		return nil, nil, err
+	}
+	afterFields, err := auditFields(after)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if beforeFields != nil && afterFields != nil {
+		for field, value := range beforeFields {
+			if other, ok := afterFields[field]; ok && reflect.DeepEqual(value, other) {
+				delete(beforeFields, field)
+				delete(afterFields, field)
+			}
+		}
+	}
+
+	return encodeAuditFields(beforeFields), encodeAuditFields(afterFields), nil
+}
+
+func auditFields(v any) (map[string]any, error) {
+	if v == nil {
+		return nil, nil
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var fields map[string]any
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil, err
+	}
+	return fields, nil
+}
+
+func encodeAuditFields(fields map[string]any) json.RawMessage {
+	if fields == nil {
+		return nil
+	}
+	data, _ := json.Marshal(fields)
+	return data
+}
+
+// AuditHandler lists audit events
+type AuditHandler struct {
+	auditRepo *repository.AuditRepository
+}
+
+func NewAuditHandler(auditRepo *repository.AuditRepository) *AuditHandler {
+	return &AuditHandler{auditRepo: auditRepo}
+}
+
+// List returns the organization's events, newest first. Pass the last
+// event's ID as before_id to get the next page.
+func (h *AuditHandler) List(w http.ResponseWriter, r *http.Request) {
+	org := middleware.OrgFromContext(r.Context())
+
+	filter, msg := parseAuditFilter(r)
+	if msg != "" {
+		http.Error(w, msg, http.StatusBadRequest)
+		return
+	}
+	filter.OrgID = &org.OrgID
+
+	h.list(w, r, filter)
+}
+
+// ListAccount returns events about the user's own account, such as logins
+func (h *AuditHandler) ListAccount(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value(middleware.UserContextKey).(*models.User)
+
+	filter, msg := parseAuditFilter(r)
+	if msg != "" {
+		http.Error(w, msg, http.StatusBadRequest)
+		return
+	}
+	filter.AccountUserID = &user.ID
+
+	h.list(w, r, filter)
+}
+
+func (h *AuditHandler) list(w http.ResponseWriter, r *http.Request, filter models.AuditFilter) {
+	events, err := h.auditRepo.List(r.Context(), filter)
+	if err != nil {
+		http.Error(w, "Failed to fetch audit events", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(events)
+}
+
+// Export streams all of the organization's events matching the filters as
+// CSV (the default) or as newline-delimited JSON with format=ndjson
+func (h *AuditHandler) Export(w http.ResponseWriter, r *http.Request) {
+	org := middleware.OrgFromContext(r.Context())
+
+	filter, msg := parseAuditFilter(r)
+	if msg != "" {
+		http.Error(w, msg, http.StatusBadRequest)
+		return
+	}
+	filter.OrgID = &org.OrgID
+	filter.Limit = auditExportBatch
+
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = "csv"
+	}
+
+	var write func(models.AuditEvent) error
+	var flush func() error
+	switch format {
+	case "csv":
+		w.Header().Set("Content-Type", "text/csv")
+		cw := csv.NewWriter(w)
+		cw.Write([]string{
+			"id", "created_at", "action", "actor_user_id", "actor_username", "actor_api_key_id",
+			"target_type", "target_id", "ip", "user_agent", "before", "after",
+		})
+		write = func(event models.AuditEvent) error {
+			return cw.Write(auditCSVRecord(event))
+		}
+		flush = func() error {
+			cw.Flush()
+			return cw.Error()
+		}
+	case "ndjson":
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		enc := json.NewEncoder(w)
+		write = func(event models.AuditEvent) error {
+			return enc.Encode(event)
+		}
+		flush = func() error { return nil }
+	default:
+		http.Error(w, "Format must be csv or ndjson", http.StatusBadRequest)
+		return
+	}
+
+	filename := fmt.Sprintf("audit-%s-%s.%s", org.OrgID, time.Now().UTC().Format("20060102"), format)
+	w.Header().Set("Content-Disposition", `attachment; filename="`+filename+`"`)
+
+	if err := h.export(r.Context(), filter, write); err != nil {
+		// Headers are sent; all we can do is cut the download short
+		log.Printf("Audit export of organization %s failed: %v", org.OrgID, err)
+		return
+	}
+	if err := flush(); err != nil {
+		log.Printf("Audit export of organization %s failed: %v", org.OrgID, err)
+	}
+}
+
+// export pages through the events matching filter
+func (h *AuditHandler) export(ctx context.Context, filter models.AuditFilter, write func(models.AuditEvent) error) error {
+	for {
+		events, err := h.auditRepo.List(ctx, filter)
+		if err != nil {
+			return err
+		}
+		for _, event := range events {
+			if err := write(event); err != nil {
+				return err
+			}
+		}
+		if len(events) < filter.Limit {
+			return nil
+		}
+		filter.BeforeID = events[len(events)-1].ID
+	}
+}
+
+func auditCSVRecord(event models.AuditEvent) []string {
+	optional := func(s *string) string {
+		if s == nil {
+			return ""
+		}
+		return *s
+	}
+	optionalID := func(id *uuid.UUID) string {
+		if id == nil {
+			return ""
+		}
+		return id.String()
+	}
+
+	record := []string{
+		strconv.FormatInt(event.ID, 10),
+		event.CreatedAt.UTC().Format(time.RFC3339),
+		event.Action,
+		optionalID(event.ActorUserID),
+		optional(event.ActorUsername),
+		optionalID(event.ActorAPIKeyID),
+		event.TargetType,
+		optional(event.TargetID),
+		optional(event.IP),
+		optional(event.UserAgent),
+		string(event.Before),
+		string(event.After),
+	}
+
+	// Keep spreadsheets from evaluating user-controlled cells as formulas
+	for i, cell := range record {
+		if cell != "" && strings.ContainsRune("=+-@\t\r", rune(cell[0])) {
+			record[i] = "'" + cell
+		}
+	}
+	return record
+}
+
+// parseAuditFilter reads the filters shared by listing and export
+func parseAuditFilter(r *http.Request) (models.AuditFilter, string) {
+	query := r.URL.Query()
+	filter := models.AuditFilter{
+		Action:     query.Get("action"),
+		TargetType: query.Get("target_type"),
+		TargetID:   query.Get("target_id"),
+		Limit:      auditDefaultLimit,
+	}
+
+	if actor := query.Get("actor_id"); actor != "" {
+		id, err := uuid.Parse(actor)
+		if err != nil {
+			return filter, "Invalid actor_id"
+		}
+		filter.ActorUserID = &id
+	}
+
+	for name, dst := range map[string]**time.Time{"since": &filter.Since, "until": &filter.Until} {
+		if value := query.Get(name); value != "" {
+			t, err := time.Parse(time.RFC3339, value)
+			if err != nil {
+				return filter, "Invalid " + name + ", expected RFC 3339 time"
+			}
+			*dst = &t
+		}
+	}
+
+	if before := query.Get("before_id"); before != "" {
+		id, err := strconv.ParseInt(before, 10, 64)
+		if err != nil || id <= 0 {
+			return filter, "Invalid before_id"
+		}
+		filter.BeforeID = id
+	}
+
+	if limit := query.Get("limit"); limit != "" {
+		l, err := strconv.Atoi(limit)
+		if err != nil || l <= 0 || l > auditMaxLimit {
+			return filter, fmt.Sprintf("Limit must be between 1 and %d", auditMaxLimit)
+		}
+		filter.Limit = l
+	}
+
+	return filter, ""
+}
@@ -1,9 +1,13 @@
 package handlers
 
 import (
+	"context"
 	"encoding/json"
+	"log"
 	"net/http"
+	"time"
 
+	"github.com/google/uuid"
 	"github.com/pushlab/backend/internal/auth"
 	"github.com/pushlab/backend/internal/models"
 	"github.com/pushlab/backend/internal/repository"
@@ -11,14 +15,35 @@ import (
 )
 
 type AuthHandler struct {
-	userRepo   *repository.UserRepository
-	jwtService *auth.JWTService
+	userRepo    *repository.UserRepository
+	apiKeyRepo  *repository.APIKeyRepository
+	orgRepo     *repository.OrgRepository
+	sessionRepo *repository.SessionRepository
+	mfaRepo     *repository.MFARepository
+	accounts    *AccountHandler
+	auditor     *Auditor
+	jwtService  *auth.JWTService
 }
 
-func NewAuthHandler(userRepo *repository.UserRepository, jwtService *auth.JWTService) *AuthHandler {
+func NewAuthHandler(
+	userRepo *repository.UserRepository,
+	apiKeyRepo *repository.APIKeyRepository,
+	orgRepo *repository.OrgRepository,
+	sessionRepo *repository.SessionRepository,
+	mfaRepo *repository.MFARepository,
+	accounts *AccountHandler,
+	auditor *Auditor,
+	jwtService *auth.JWTService,
+) *AuthHandler {
 	return &AuthHandler{
-		userRepo:   userRepo,
-		jwtService: jwtService,
+		userRepo:    userRepo,
+		apiKeyRepo:  apiKeyRepo,
+		orgRepo:     orgRepo,
+		sessionRepo: sessionRepo,
+		mfaRepo:     mfaRepo,
+		accounts:    accounts,
+		auditor:     auditor,
+		jwtService:  jwtService,
 	}
 }
 
@@ -40,17 +65,10 @@ func (h *AuthHandler) Register(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	apiKey, err := auth.GenerateAPIKey()
-	if err != nil {
-		http.Error(w, "Failed to generate API key", http.StatusInternalServerError)
-		return
-	}
-
 	user := &models.User{
 		Username:     req.Username,
 		Email:        req.Email,
 		PasswordHash: passwordHash,
-		APIKey:       apiKey,
 	}
 
 	if err := h.userRepo.Create(r.Context(), user); err != nil {
@@ -58,8 +76,26 @@ func (h *AuthHandler) Register(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	org, err := h.orgRepo.CreatePersonal(r.Context(), user)
+	if err != nil {
+		http.Error(w, "Failed to create personal organization", http.StatusInternalServerError)
+		return
+	}
+
+	if err := h.accounts.sendVerification(r.Context(), user); err != nil {
+		log.Printf("Failed to send verification email to user %s: %v", user.ID, err)
+	}
+
+	owner := &models.OrgMembership{OrgID: org.ID, OrgName: org.Name, Personal: true, UserID: user.ID, Role: models.RoleOwner}
+	apiKey, err := issueAPIKey(r.Context(), h.apiKeyRepo, fullAccessKey(user.ID, owner, "Default"))
+	if err != nil {
+		http.Error(w, "Failed to generate API key", http.StatusInternalServerError)
+		return
+	}
+	user.APIKey = apiKey.Key
+
 	// Generate JWT token
-	token, err := h.jwtService.GenerateToken(user.ID, user.Username)
+	token, refreshToken, err := h.issueTokens(r.Context(), user, uuid.New())
 	if err != nil {
 		http.Error(w, "Failed to generate token", http.StatusInternalServerError)
 		return
@@ -67,8 +103,9 @@ func (h *AuthHandler) Register(w http.ResponseWriter, r *http.Request) {
 
 	user.PasswordHash = "" // Don't send password hash
 	response := models.LoginResponse{
-		Token: token,
-		User:  *user,
+		Token:        token,
+		RefreshToken: refreshToken,
+		User:         *user,
 	}
 
 	w.Header().Set("Content-Type", "application/json")
@@ -83,13 +120,28 @@ func (h *AuthHandler) Login(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Checked before the password so a locked account gives nothing away
+	locked, err := h.accounts.loginLocked(w, r, req.Username)
+	if err != nil {
+		http.Error(w, "Failed to sign in", http.StatusInternalServerError)
+		return
+	}
+	if locked {
+		http.Error(w, "Too many failed login attempts, try again later", http.StatusTooManyRequests)
+		return
+	}
+
 	user, err := h.userRepo.GetByUsername(r.Context(), req.Username)
 	if err != nil {
+		h.accounts.loginFailed(r, req.Username)
+		h.auditLoginFailed(r, nil, req.Username, "password")
 		http.Error(w, "Invalid username or password", http.StatusUnauthorized)
 		return
 	}
 
 	if err := auth.ComparePassword(user.PasswordHash, req.Password); err != nil {
+		h.accounts.loginFailed(r, req.Username)
+		h.auditLoginFailed(r, user, req.Username, "password")
 		http.Error(w, "Invalid username or password", http.StatusUnauthorized)
 		return
 	}
@@ -99,7 +151,20 @@ func (h *AuthHandler) Login(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	token, err := h.jwtService.GenerateToken(user.ID, user.Username)
+	mfaEnabled, err := h.mfaRepo.IsTOTPEnabled(r.Context(), user.ID)
+	if err != nil {
+		http.Error(w, "Failed to sign in", http.StatusInternalServerError)
+		return
+	}
+	if mfaEnabled {
+		// Failures are only cleared once the second factor is verified
+		h.startMFAChallenge(w, r, user)
+		return
+	}
+	h.accounts.loginSucceeded(r.Context(), user.Username)
+	h.auditLogin(r, user, "password")
+
+	token, refreshToken, err := h.issueTokens(r.Context(), user, uuid.New())
 	if err != nil {
 		http.Error(w, "Failed to generate token", http.StatusInternalServerError)
 		return
@@ -107,30 +172,241 @@ func (h *AuthHandler) Login(w http.ResponseWriter, r *http.Request) {
 
 	user.PasswordHash = ""
 	response := models.LoginResponse{
-		Token: token,
-		User:  *user,
+		Token:        token,
+		RefreshToken: refreshToken,
+		User:         *user,
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// startMFAChallenge answers a correct password with a short-lived MFA token
+// instead of session tokens; the login completes at /api/v1/auth/mfa/verify
+func (h *AuthHandler) startMFAChallenge(w http.ResponseWriter, r *http.Request, user *models.User) {
+	secret, err := auth.GenerateSecret()
+	if err != nil {
+		http.Error(w, "Failed to start MFA challenge", http.StatusInternalServerError)
+		return
+	}
+
+	challenge := &models.MFAChallenge{
+		TokenHash: auth.HashToken(secret),
+		UserID:    user.ID,
+	}
+	if err := h.mfaRepo.CreateChallenge(r.Context(), challenge, mfaChallengeTTL); err != nil {
+		http.Error(w, "Failed to start MFA challenge", http.StatusInternalServerError)
+		return
+	}
+
+	response := models.MFAChallengeResponse{
+		MFARequired: true,
+		MFAToken:    secret,
+		ExpiresAt:   challenge.ExpiresAt,
 	}
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(response)
 }
 
+// Refresh exchanges a refresh token for a new access token and a new refresh
+// token. Each refresh token can be used once; presenting one again means it
+// was stolen, and the whole session is revoked.
+func (h *AuthHandler) Refresh(w http.ResponseWriter, r *http.Request) {
+	var req models.RefreshRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if req.RefreshToken == "" {
+		http.Error(w, "Refresh token is required", http.StatusBadRequest)
+		return
+	}
+
+	stored, err := h.sessionRepo.GetRefreshToken(r.Context(), auth.HashToken(req.RefreshToken))
+	if err != nil || stored.RevokedAt != nil || stored.Expired {
+		http.Error(w, "Invalid or expired refresh token", http.StatusUnauthorized)
+		return
+	}
+
+	consumed, err := h.sessionRepo.MarkRefreshTokenUsed(r.Context(), stored.ID)
+	if err != nil {
+		http.Error(w, "Failed to refresh session", http.StatusInternalServerError)
+		return
+	}
+	if !consumed {
+		log.Printf("Refresh token reuse detected for user %s, revoking session %s", stored.UserID, stored.FamilyID)
+		if err := h.sessionRepo.RevokeFamily(r.Context(), stored.FamilyID); err != nil {
+			log.Printf("Failed to revoke session %s: %v", stored.FamilyID, err)
+		}
+		h.auditor.Record(r, AuditEntry{
+			Action:     models.AuditRefreshTokenReused,
+			TargetType: models.AuditTargetUser,
+			TargetID:   stored.UserID.String(),
+			After:      map[string]any{"session_id": stored.FamilyID},
+			Account:    true,
+		})
+		http.Error(w, "Invalid or expired refresh token", http.StatusUnauthorized)
+		return
+	}
+
+	user, err := h.userRepo.GetByID(r.Context(), stored.UserID)
+	if err != nil || !user.IsActive {
+		http.Error(w, "User account is inactive", http.StatusUnauthorized)
+		return
+	}
+
+	token, refreshToken, err := h.issueTokens(r.Context(), user, stored.FamilyID)
+	if err != nil {
+		http.Error(w, "Failed to generate token", http.StatusInternalServerError)
+		return
+	}
+
+	response := models.RefreshResponse{
+		Token:        token,
+		RefreshToken: refreshToken,
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// Logout revokes the current access token and its session's refresh tokens
+func (h *AuthHandler) Logout(w http.ResponseWriter, r *http.Request) {
+	claims := r.Context().Value(middleware.ClaimsContextKey).(*auth.Claims)
+
+	if jti, err := uuid.Parse(claims.ID); err == nil {
+		if err := h.sessionRepo.RevokeAccessToken(r.Context(), jti, claims.ExpiresAt.Time); err != nil {
+			http.Error(w, "Failed to revoke token", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	if err := h.sessionRepo.RevokeFamily(r.Context(), claims.SessionID); err != nil {
+		http.Error(w, "Failed to revoke session", http.StatusInternalServerError)
+		return
+	}
+
+	h.auditor.Record(r, AuditEntry{
+		Action:     models.AuditLogout,
+		TargetType: models.AuditTargetUser,
+		TargetID:   claims.UserID.String(),
+		After:      map[string]any{"session_id": claims.SessionID},
+		Account:    true,
+	})
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// LogoutAll revokes every session of the user, on all devices. Access tokens
+// stop working immediately because they are tied to their session.
+func (h *AuthHandler) LogoutAll(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value(middleware.UserContextKey).(*models.User)
+
+	if err := h.sessionRepo.RevokeAllForUser(r.Context(), user.ID); err != nil {
+		http.Error(w, "Failed to revoke sessions", http.StatusInternalServerError)
+		return
+	}
+
+	h.auditor.Record(r, AuditEntry{
+		Action:     models.AuditLogoutAll,
+		TargetType: models.AuditTargetUser,
+		TargetID:   user.ID.String(),
+		Account:    true,
+	})
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// JWKS publishes the public keys that verify access tokens, so other
+// services can accept PushLab tokens without the signing secret
+func (h *AuthHandler) JWKS(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "public, max-age=60")
+	json.NewEncoder(w).Encode(h.jwtService.JWKS())
+}
+
+// issueTokens creates an access token and a refresh token in the session
+func (h *AuthHandler) issueTokens(ctx context.Context, user *models.User, sessionID uuid.UUID) (string, string, error) {
+	secret, err := auth.GenerateSecret()
+	if err != nil {
+		return "", "", err
+	}
+
+	refresh := &models.RefreshToken{
+		UserID:    user.ID,
+		FamilyID:  sessionID,
+		TokenHash: auth.HashToken(secret),
+	}
+	if err := h.sessionRepo.CreateRefreshToken(ctx, refresh, h.jwtService.RefreshTokenTTL()); err != nil {
+		return "", "", err
+	}
+
+	token, err := h.jwtService.GenerateToken(user.ID, user.Username, sessionID)
+	if err != nil {
+		return "", "", err
+	}
+	return token, secret, nil
+}
+
+// GenerateAPIKey creates an additional API key. Existing keys keep working;
+// manage them with the /api/v1/auth/apikeys endpoints.
 func (h *AuthHandler) GenerateAPIKey(w http.ResponseWriter, r *http.Request) {
 	user := r.Context().Value(middleware.UserContextKey).(*models.User)
 
-	apiKey, err := auth.GenerateAPIKey()
+	name := "Generated " + time.Now().UTC().Format("2006-01-02 15:04")
+	key := fullAccessKey(user.ID, middleware.OrgFromContext(r.Context()), name)
+
+	// A key generated with an API key inherits that key's restrictions
+	if caller := middleware.APIKeyFromContext(r.Context()); caller != nil {
+		key.Scopes = caller.Scopes
+		key.AllowedTags = caller.AllowedTags
+		key.AllowedIPs = caller.AllowedIPs
+	}
+
+	apiKey, err := issueAPIKey(r.Context(), h.apiKeyRepo, key)
 	if err != nil {
 		http.Error(w, "Failed to generate API key", http.StatusInternalServerError)
 		return
 	}
 
-	if err := h.userRepo.UpdateAPIKey(r.Context(), user.ID, apiKey); err != nil {
-		http.Error(w, "Failed to update API key", http.StatusInternalServerError)
-		return
-	}
+	h.auditor.Record(r, AuditEntry{
+		Action:     models.AuditAPIKeyCreated,
+		TargetType: models.AuditTargetAPIKey,
+		TargetID:   key.ID.String(),
+		After:      key,
+	})
 
-	response := models.APIKeyResponse{APIKey: apiKey}
+	response := models.APIKeyResponse{APIKey: apiKey.Key}
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(response)
 }
+
+// auditLogin records a completed login; method is how the user signed in
+func (h *AuthHandler) auditLogin(r *http.Request, user *models.User, method string) {
+	h.auditor.Record(r, AuditEntry{
+		Action:     models.AuditLogin,
+		TargetType: models.AuditTargetUser,
+		TargetID:   user.ID.String(),
+		After:      map[string]any{"method": method},
+		Actor:      user,
+		Account:    true,
+	})
+}
+
+// auditLoginFailed records a wrong password or second factor. user is nil
+// when the username does not exist.
+func (h *AuthHandler) auditLoginFailed(r *http.Request, user *models.User, username, method string) {
+	entry := AuditEntry{
+		Action:     models.AuditLoginFailed,
+		TargetType: models.AuditTargetUser,
+		After:      map[string]any{"method": method, "username": username},
+		Account:    true,
+	}
+	if user != nil {
+		entry.TargetID = user.ID.String()
+	}
+	h.auditor.Record(r, entry)
+}
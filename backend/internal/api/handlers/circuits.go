@@ -0,0 +1,31 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/pushlab/backend/internal/api/middleware"
+	"github.com/pushlab/backend/internal/repository"
+)
+
+type CircuitHandler struct {
+	circuitRepo *repository.CircuitRepository
+}
+
+func NewCircuitHandler(circuitRepo *repository.CircuitRepository) *CircuitHandler {
+	return &CircuitHandler{circuitRepo: circuitRepo}
+}
+
+// List returns the circuit state of the organization's credentials
+func (h *CircuitHandler) List(w http.ResponseWriter, r *http.Request) {
+	org := middleware.OrgFromContext(r.Context())
+
+	states, err := h.circuitRepo.GetByOrgID(r.Context(), org.OrgID)
+	if err != nil {
+		http.Error(w, "Failed to fetch circuit states", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(states)
+}
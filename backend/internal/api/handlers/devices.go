@@ -1,26 +1,41 @@
 package handlers
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/google/uuid"
 	"github.com/pushlab/backend/internal/api/middleware"
+	"github.com/pushlab/backend/internal/auth"
 	"github.com/pushlab/backend/internal/models"
 	"github.com/pushlab/backend/internal/repository"
 )
 
+// pruneReportSample is how many devices a prune report lists per policy
+const pruneReportSample = 100
+
 type DeviceHandler struct {
 	deviceRepo *repository.DeviceRepository
+	auditor    *Auditor
+	lifecycle  models.LifecyclePolicy
 }
 
-func NewDeviceHandler(deviceRepo *repository.DeviceRepository) *DeviceHandler {
-	return &DeviceHandler{deviceRepo: deviceRepo}
+func NewDeviceHandler(deviceRepo *repository.DeviceRepository, auditor *Auditor, lifecycle models.LifecyclePolicy) *DeviceHandler {
+	return &DeviceHandler{deviceRepo: deviceRepo, auditor: auditor, lifecycle: lifecycle}
 }
 
 func (h *DeviceHandler) Register(w http.ResponseWriter, r *http.Request) {
 	user := r.Context().Value(middleware.UserContextKey).(*models.User)
+	org := middleware.OrgFromContext(r.Context())
 
 	var req models.RegisterDeviceRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
@@ -33,6 +48,11 @@ func (h *DeviceHandler) Register(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if err := req.DeviceMetadata.Validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
 	if req.Environment == "" {
 		req.Environment = "production"
 	}
@@ -42,22 +62,39 @@ func (h *DeviceHandler) Register(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Check if device already exists
-	existingDevice, err := h.deviceRepo.GetByUserAndIdentifier(r.Context(), user.ID, req.DeviceIdentifier)
+	existingDevice, err := h.deviceRepo.GetByOrgAndIdentifier(r.Context(), org.OrgID, req.DeviceIdentifier)
 	if err == nil && existingDevice != nil {
+		if !canUpdateDevice(r.Context(), existingDevice, req.Tags) {
+			http.Error(w, "Cannot update devices or tags outside your API key's allowed tags", http.StatusForbidden)
+			return
+		}
+
+		// Assign the token first so a token held by someone else leaves the
+		// device unchanged
+		if !h.assignToken(w, r, existingDevice, req.DeviceToken, req.Environment, req.BundleID, req.TransferToken) {
+			return
+		}
+
 		// Update existing device
+		before := *existingDevice
 		existingDevice.DeviceName = req.DeviceName
 		existingDevice.Tags = req.Tags
+		existingDevice.Merge(req.DeviceMetadata)
 
 		if err := h.deviceRepo.Update(r.Context(), existingDevice); err != nil {
 			http.Error(w, "Failed to update device", http.StatusInternalServerError)
 			return
 		}
 
-		// Update device token
-		if err := h.deviceRepo.UpdateToken(r.Context(), existingDevice.ID, req.DeviceToken, req.Environment, req.BundleID); err != nil {
-			http.Error(w, "Failed to update device token", http.StatusInternalServerError)
-			return
-		}
+		h.touchDevice(r, existingDevice.ID)
+
+		h.auditor.Record(r, AuditEntry{
+			Action:     models.AuditDeviceRegistered,
+			TargetType: models.AuditTargetDevice,
+			TargetID:   existingDevice.ID.String(),
+			Before:     before,
+			After:      existingDevice,
+		})
 
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(existingDevice)
@@ -66,10 +103,12 @@ func (h *DeviceHandler) Register(w http.ResponseWriter, r *http.Request) {
 
 	// Create new device
 	device := &models.Device{
+		OrgID:            org.OrgID,
 		UserID:           user.ID,
 		DeviceName:       req.DeviceName,
 		DeviceIdentifier: req.DeviceIdentifier,
 		Tags:             req.Tags,
+		DeviceMetadata:   req.DeviceMetadata,
 	}
 
 	if err := h.deviceRepo.Create(r.Context(), device); err != nil {
@@ -77,29 +116,86 @@ func (h *DeviceHandler) Register(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Create device token
-	token := &models.DeviceToken{
-		DeviceID:    device.ID,
-		Token:       req.DeviceToken,
-		Environment: req.Environment,
-		BundleID:    req.BundleID,
-		IsValid:     true,
-	}
-
-	if err := h.deviceRepo.CreateToken(r.Context(), token); err != nil {
-		http.Error(w, "Failed to create device token", http.StatusInternalServerError)
+	if !h.assignToken(w, r, device, req.DeviceToken, req.Environment, req.BundleID, req.TransferToken) {
+		if err := h.deviceRepo.Delete(r.Context(), device.ID); err != nil {
+			log.Printf("Failed to remove device %s without token: %v", device.ID, err)
+		}
 		return
 	}
 
+	h.touchDevice(r, device.ID)
+
+	h.auditor.Record(r, AuditEntry{
+		Action:     models.AuditDeviceRegistered,
+		TargetType: models.AuditTargetDevice,
+		TargetID:   device.ID.String(),
+		After:      device,
+	})
+
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusCreated)
 	json.NewEncoder(w).Encode(device)
 }
 
+// canUpdateDevice reports whether the caller may update the device and, unless
+// tags is nil, set its tags. A tag-restricted API key may only update devices
+// it can notify and only give them its own tags, so it cannot pull other
+// devices into its reach.
+func canUpdateDevice(ctx context.Context, device *models.Device, tags []string) bool {
+	key := middleware.APIKeyFromContext(ctx)
+	return key == nil || (key.AllowsDevice(device.Tags) && (tags == nil || key.AllowsTags(tags)))
+}
+
+// assignToken makes the token active on the device, writing the error
+// response if it cannot. A token taken over from another user's device is
+// audited in both organizations.
+func (h *DeviceHandler) assignToken(w http.ResponseWriter, r *http.Request, device *models.Device, tokenStr, environment, bundleID string, transfer bool) bool {
+	token, previous, err := h.deviceRepo.AssignToken(r.Context(), device, tokenStr, environment, bundleID, transfer)
+	if errors.Is(err, repository.ErrTokenInUse) {
+		http.Error(w, "Device token is registered to another user's device; set transfer_token to take it over", http.StatusConflict)
+		return false
+	}
+	if err != nil {
+		log.Printf("Failed to assign token to device %s: %v", device.ID, err)
+		http.Error(w, "Failed to update device token", http.StatusInternalServerError)
+		return false
+	}
+
+	if previous != nil && (previous.UserID != device.UserID || previous.OrgID != device.OrgID) {
+		h.auditor.Record(r, AuditEntry{
+			Action:     models.AuditDeviceTokenTransferred,
+			TargetType: models.AuditTargetDevice,
+			TargetID:   previous.DeviceID.String(),
+			Before:     map[string]any{"token_id": previous.TokenID, "active": true},
+			After:      map[string]any{"token_id": previous.TokenID, "active": false},
+			OrgID:      &previous.OrgID,
+		})
+		h.auditor.Record(r, AuditEntry{
+			Action:     models.AuditDeviceTokenTransferred,
+			TargetType: models.AuditTargetDevice,
+			TargetID:   device.ID.String(),
+			After: map[string]any{
+				"token_id":    token.ID,
+				"environment": token.Environment,
+				"bundle_id":   token.BundleID,
+			},
+		})
+	}
+	return true
+}
+
+// touchDevice records that the device checked in, e.g. for targeting devices
+// seen recently
+func (h *DeviceHandler) touchDevice(r *http.Request, deviceID uuid.UUID) {
+	if err := h.deviceRepo.UpdateLastSeen(r.Context(), deviceID); err != nil {
+		log.Printf("Failed to update last seen of device %s: %v", deviceID, err)
+	}
+}
+
 func (h *DeviceHandler) List(w http.ResponseWriter, r *http.Request) {
-	user := r.Context().Value(middleware.UserContextKey).(*models.User)
+	org := middleware.OrgFromContext(r.Context())
 
-	devices, err := h.deviceRepo.GetByUserID(r.Context(), user.ID)
+	devices, err := h.deviceRepo.GetByOrgID(r.Context(), org.OrgID)
 	if err != nil {
 		http.Error(w, "Failed to fetch devices", http.StatusInternalServerError)
 		return
@@ -109,8 +205,49 @@ func (h *DeviceHandler) List(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(devices)
 }
 
+// PruneReport is a dry run of the device lifecycle policy for the caller's
+// organization: it lists the devices that would be marked stale and those
+// that would be deleted. The stale_after_days and delete_invalid_after_days
+// query parameters try out a different policy.
+func (h *DeviceHandler) PruneReport(w http.ResponseWriter, r *http.Request) {
+	org := middleware.OrgFromContext(r.Context())
+
+	policy := h.lifecycle
+	for param, days := range map[string]*int{
+		"stale_after_days":          &policy.StaleAfterDays,
+		"delete_invalid_after_days": &policy.DeleteInvalidAfterDays,
+	} {
+		if v := r.URL.Query().Get(param); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n <= 0 {
+				http.Error(w, param+" must be a positive number of days", http.StatusBadRequest)
+				return
+			}
+			*days = n
+		}
+	}
+
+	report := models.PruneReport{Policy: policy}
+	var err error
+	staleCutoff := time.Now().AddDate(0, 0, -policy.StaleAfterDays)
+	report.StaleCount, report.Stale, err = h.deviceRepo.GetUnseen(r.Context(), org.OrgID, staleCutoff, pruneReportSample)
+	if err != nil {
+		http.Error(w, "Failed to fetch stale devices", http.StatusInternalServerError)
+		return
+	}
+	deleteCutoff := time.Now().AddDate(0, 0, -policy.DeleteInvalidAfterDays)
+	report.DeleteCount, report.Delete, err = h.deviceRepo.GetInvalid(r.Context(), org.OrgID, deleteCutoff, pruneReportSample)
+	if err != nil {
+		http.Error(w, "Failed to fetch invalid devices", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
+
 func (h *DeviceHandler) Get(w http.ResponseWriter, r *http.Request) {
-	user := r.Context().Value(middleware.UserContextKey).(*models.User)
+	org := middleware.OrgFromContext(r.Context())
 	deviceID, err := uuid.Parse(chi.URLParam(r, "id"))
 	if err != nil {
 		http.Error(w, "Invalid device ID", http.StatusBadRequest)
@@ -123,7 +260,7 @@ func (h *DeviceHandler) Get(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if device.UserID != user.ID {
+	if device.OrgID != org.OrgID {
 		http.Error(w, "Forbidden", http.StatusForbidden)
 		return
 	}
@@ -133,7 +270,7 @@ func (h *DeviceHandler) Get(w http.ResponseWriter, r *http.Request) {
 }
 
 func (h *DeviceHandler) Update(w http.ResponseWriter, r *http.Request) {
-	user := r.Context().Value(middleware.UserContextKey).(*models.User)
+	org := middleware.OrgFromContext(r.Context())
 	deviceID, err := uuid.Parse(chi.URLParam(r, "id"))
 	if err != nil {
 		http.Error(w, "Invalid device ID", http.StatusBadRequest)
@@ -146,7 +283,7 @@ func (h *DeviceHandler) Update(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if device.UserID != user.ID {
+	if device.OrgID != org.OrgID {
 		http.Error(w, "Forbidden", http.StatusForbidden)
 		return
 	}
@@ -157,24 +294,49 @@ func (h *DeviceHandler) Update(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if !canUpdateDevice(r.Context(), device, req.Tags) {
+		http.Error(w, "Cannot update devices or tags outside your API key's allowed tags", http.StatusForbidden)
+		return
+	}
+
+	before := *device
 	if req.DeviceName != "" {
 		device.DeviceName = req.DeviceName
 	}
 	if req.Tags != nil {
 		device.Tags = req.Tags
 	}
+	if req.HeartbeatWindowMinutes != nil {
+		switch window := *req.HeartbeatWindowMinutes; {
+		case window == 0:
+			device.HeartbeatWindowMinutes = nil
+		case window > 0 && window <= models.MaxHeartbeatWindowMinutes:
+			device.HeartbeatWindowMinutes = &window
+		default:
+			http.Error(w, fmt.Sprintf("Heartbeat window must be 1-%d minutes, or 0 to stop monitoring", models.MaxHeartbeatWindowMinutes), http.StatusBadRequest)
+			return
+		}
+	}
 
 	if err := h.deviceRepo.Update(r.Context(), device); err != nil {
 		http.Error(w, "Failed to update device", http.StatusInternalServerError)
 		return
 	}
 
+	h.auditor.Record(r, AuditEntry{
+		Action:     models.AuditDeviceUpdated,
+		TargetType: models.AuditTargetDevice,
+		TargetID:   device.ID.String(),
+		Before:     before,
+		After:      device,
+	})
+
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(device)
 }
 
 func (h *DeviceHandler) Delete(w http.ResponseWriter, r *http.Request) {
-	user := r.Context().Value(middleware.UserContextKey).(*models.User)
+	org := middleware.OrgFromContext(r.Context())
 	deviceID, err := uuid.Parse(chi.URLParam(r, "id"))
 	if err != nil {
 		http.Error(w, "Invalid device ID", http.StatusBadRequest)
@@ -187,7 +349,7 @@ func (h *DeviceHandler) Delete(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if device.UserID != user.ID {
+	if device.OrgID != org.OrgID {
 		http.Error(w, "Forbidden", http.StatusForbidden)
 		return
 	}
@@ -197,44 +359,208 @@ func (h *DeviceHandler) Delete(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	h.auditor.Record(r, AuditEntry{
+		Action:     models.AuditDeviceDeleted,
+		TargetType: models.AuditTargetDevice,
+		TargetID:   device.ID.String(),
+		Before:     device,
+	})
+
 	w.WriteHeader(http.StatusNoContent)
 }
 
+// UpdateToken adds or replaces the device's token for a bundle ID and
+// environment. The token it replaces is kept in the device's token history.
 func (h *DeviceHandler) UpdateToken(w http.ResponseWriter, r *http.Request) {
-	user := r.Context().Value(middleware.UserContextKey).(*models.User)
-	deviceID, err := uuid.Parse(chi.URLParam(r, "id"))
+	device, ok := h.orgDevice(w, r)
+	if !ok {
+		return
+	}
+
+	var req models.UpdateTokenRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if req.DeviceToken == "" || req.Environment == "" || req.BundleID == "" {
+		http.Error(w, "Device token, environment, and bundle ID are required", http.StatusBadRequest)
+		return
+	}
+
+	if !h.assignToken(w, r, device, req.DeviceToken, req.Environment, req.BundleID, req.TransferToken) {
+		return
+	}
+
+	h.auditor.Record(r, AuditEntry{
+		Action:     models.AuditDeviceTokenUpdated,
+		TargetType: models.AuditTargetDevice,
+		TargetID:   device.ID.String(),
+		After:      map[string]string{"environment": req.Environment, "bundle_id": req.BundleID},
+	})
+
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(`{"message": "Token updated successfully"}`))
+}
+
+// IssueHeartbeatToken creates a token with which the device can check in,
+// replacing its previous one
+func (h *DeviceHandler) IssueHeartbeatToken(w http.ResponseWriter, r *http.Request) {
+	device, ok := h.orgDevice(w, r)
+	if !ok {
+		return
+	}
+
+	token, hash, err := auth.GenerateHeartbeatToken()
 	if err != nil {
-		http.Error(w, "Invalid device ID", http.StatusBadRequest)
+		http.Error(w, "Failed to generate heartbeat token", http.StatusInternalServerError)
+		return
+	}
+	if err := h.deviceRepo.SetHeartbeatToken(r.Context(), device.ID, hash); err != nil {
+		http.Error(w, "Failed to store heartbeat token", http.StatusInternalServerError)
 		return
 	}
 
-	device, err := h.deviceRepo.GetByID(r.Context(), deviceID)
+	h.auditor.Record(r, AuditEntry{
+		Action:     models.AuditDeviceHeartbeatTokenIssued,
+		TargetType: models.AuditTargetDevice,
+		TargetID:   device.ID.String(),
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(models.HeartbeatTokenResponse{DeviceID: device.ID, HeartbeatToken: token})
+}
+
+func (h *DeviceHandler) RevokeHeartbeatToken(w http.ResponseWriter, r *http.Request) {
+	device, ok := h.orgDevice(w, r)
+	if !ok {
+		return
+	}
+
+	if err := h.deviceRepo.SetHeartbeatToken(r.Context(), device.ID, nil); err != nil {
+		http.Error(w, "Failed to revoke heartbeat token", http.StatusInternalServerError)
+		return
+	}
+
+	h.auditor.Record(r, AuditEntry{
+		Action:     models.AuditDeviceHeartbeatTokenRevoked,
+		TargetType: models.AuditTargetDevice,
+		TargetID:   device.ID.String(),
+	})
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Heartbeat records that the device is alive. It is authenticated with the
+// device's heartbeat token rather than a user's credentials, and may report
+// updated app metadata in the body.
+func (h *DeviceHandler) Heartbeat(w http.ResponseWriter, r *http.Request) {
+	deviceID, err := uuid.Parse(chi.URLParam(r, "id"))
 	if err != nil {
-		http.Error(w, "Device not found", http.StatusNotFound)
+		http.Error(w, "Invalid device ID", http.StatusBadRequest)
 		return
 	}
 
-	if device.UserID != user.ID {
-		http.Error(w, "Forbidden", http.StatusForbidden)
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || token == "" {
+		http.Error(w, "Heartbeat token required", http.StatusUnauthorized)
+		return
+	}
+	hash, err := h.deviceRepo.GetHeartbeatTokenHash(r.Context(), deviceID)
+	if err != nil || !auth.CompareHeartbeatToken(token, hash) {
+		http.Error(w, "Invalid heartbeat token", http.StatusUnauthorized)
 		return
 	}
 
-	var req models.UpdateTokenRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+	var metadata models.DeviceMetadata
+	if err := json.NewDecoder(r.Body).Decode(&metadata); err != nil && !errors.Is(err, io.EOF) {
 		http.Error(w, "Invalid request body", http.StatusBadRequest)
 		return
 	}
+	if err := metadata.Validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
-	if req.DeviceToken == "" || req.Environment == "" || req.BundleID == "" {
-		http.Error(w, "Device token, environment, and bundle ID are required", http.StatusBadRequest)
+	if err := h.deviceRepo.Heartbeat(r.Context(), deviceID, metadata); err != nil {
+		http.Error(w, "Failed to record heartbeat", http.StatusInternalServerError)
 		return
 	}
 
-	if err := h.deviceRepo.UpdateToken(r.Context(), deviceID, req.DeviceToken, req.Environment, req.BundleID); err != nil {
-		http.Error(w, "Failed to update token", http.StatusInternalServerError)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// ListTokens returns the device's token history, newest first. Active tokens
+// have is_valid set.
+func (h *DeviceHandler) ListTokens(w http.ResponseWriter, r *http.Request) {
+	device, ok := h.orgDevice(w, r)
+	if !ok {
 		return
 	}
 
-	w.WriteHeader(http.StatusOK)
-	w.Write([]byte(`{"message": "Token updated successfully"}`))
+	tokens, err := h.deviceRepo.GetTokenHistory(r.Context(), device.ID)
+	if err != nil {
+		http.Error(w, "Failed to fetch device tokens", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(tokens)
+}
+
+// RemoveToken retires one of the device's active tokens
+func (h *DeviceHandler) RemoveToken(w http.ResponseWriter, r *http.Request) {
+	device, ok := h.orgDevice(w, r)
+	if !ok {
+		return
+	}
+
+	tokenID, err := uuid.Parse(chi.URLParam(r, "token_id"))
+	if err != nil {
+		http.Error(w, "Invalid token ID", http.StatusBadRequest)
+		return
+	}
+
+	removed, err := h.deviceRepo.RemoveToken(r.Context(), device.ID, tokenID)
+	if err != nil {
+		http.Error(w, "Failed to remove device token", http.StatusInternalServerError)
+		return
+	}
+	if !removed {
+		http.Error(w, "Active token not found", http.StatusNotFound)
+		return
+	}
+
+	h.auditor.Record(r, AuditEntry{
+		Action:     models.AuditDeviceTokenRemoved,
+		TargetType: models.AuditTargetDevice,
+		TargetID:   device.ID.String(),
+		Before:     map[string]any{"token_id": tokenID},
+	})
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// orgDevice loads the device named by the id URL parameter from the caller's
+// organization
+func (h *DeviceHandler) orgDevice(w http.ResponseWriter, r *http.Request) (*models.Device, bool) {
+	org := middleware.OrgFromContext(r.Context())
+	deviceID, err := uuid.Parse(chi.URLParam(r, "id"))
+	if err != nil {
+		http.Error(w, "Invalid device ID", http.StatusBadRequest)
+		return nil, false
+	}
+
+	device, err := h.deviceRepo.GetByID(r.Context(), deviceID)
+	if err != nil {
+		http.Error(w, "Device not found", http.StatusNotFound)
+		return nil, false
+	}
+
+	if device.OrgID != org.OrgID {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return nil, false
+	}
+	return device, true
 }
@@ -5,19 +5,30 @@ import (
 	"net/http"
 
 	"github.com/pushlab/backend/internal/db"
+	"github.com/pushlab/backend/internal/repository"
 )
 
 type HealthHandler struct {
-	db *db.DB
+	db          *db.DB
+	circuitRepo *repository.CircuitRepository
 }
 
-func NewHealthHandler(database *db.DB) *HealthHandler {
-	return &HealthHandler{db: database}
+func NewHealthHandler(database *db.DB, circuitRepo *repository.CircuitRepository) *HealthHandler {
+	return &HealthHandler{
+		db:          database,
+		circuitRepo: circuitRepo,
+	}
 }
 
 type HealthResponse struct {
-	Status   string `json:"status"`
-	Database string `json:"database"`
+	Status   string      `json:"status"`
+	Database string      `json:"database"`
+	APNs     *APNsHealth `json:"apns,omitempty"`
+}
+
+type APNsHealth struct {
+	OpenCircuits     int `json:"open_circuits"`
+	HalfOpenCircuits int `json:"half_open_circuits"`
 }
 
 func (h *HealthHandler) Check(w http.ResponseWriter, r *http.Request) {
@@ -29,6 +40,14 @@ func (h *HealthHandler) Check(w http.ResponseWriter, r *http.Request) {
 	if err := h.db.Health(r.Context()); err != nil {
 		response.Database = "error"
 		response.Status = "degraded"
+	} else if counts, err := h.circuitRepo.CountByState(r.Context()); err == nil {
+		response.APNs = &APNsHealth{
+			OpenCircuits:     counts["open"],
+			HalfOpenCircuits: counts["half_open"],
+		}
+		if response.APNs.OpenCircuits > 0 {
+			response.Status = "degraded"
+		}
 	}
 
 	w.Header().Set("Content-Type", "application/json")
@@ -0,0 +1,372 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/pushlab/backend/internal/api/middleware"
+	"github.com/pushlab/backend/internal/auth"
+	"github.com/pushlab/backend/internal/keystore"
+	"github.com/pushlab/backend/internal/models"
+	"github.com/pushlab/backend/internal/repository"
+)
+
+const (
+	// mfaChallengeTTL is how long the user has to enter the second factor
+	// after a correct password
+	mfaChallengeTTL = 5 * time.Minute
+	// mfaMaxAttempts wrong codes invalidate the challenge, so a stolen
+	// password alone cannot be used to guess codes
+	mfaMaxAttempts = 5
+	// recoveryCodeCount is how many recovery codes a user gets at a time
+	recoveryCodeCount = 10
+	// totpIssuer is the account label shown in authenticator apps
+	totpIssuer = "PushLab"
+)
+
+// MFAHandler manages TOTP two-factor authentication and completes logins
+// that require it
+type MFAHandler struct {
+	mfaRepo     *repository.MFARepository
+	userRepo    *repository.UserRepository
+	keystore    *keystore.Keystore
+	authHandler *AuthHandler
+}
+
+func NewMFAHandler(
+	mfaRepo *repository.MFARepository,
+	userRepo *repository.UserRepository,
+	ks *keystore.Keystore,
+	authHandler *AuthHandler,
+) *MFAHandler {
+	return &MFAHandler{
+		mfaRepo:     mfaRepo,
+		userRepo:    userRepo,
+		keystore:    ks,
+		authHandler: authHandler,
+	}
+}
+
+// Enroll creates a new TOTP secret. It takes effect once confirmed with a
+// code at /api/v1/auth/mfa/totp/activate.
+func (h *MFAHandler) Enroll(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value(middleware.UserContextKey).(*models.User)
+
+	enabled, err := h.mfaRepo.IsTOTPEnabled(r.Context(), user.ID)
+	if err != nil {
+		http.Error(w, "Failed to enroll", http.StatusInternalServerError)
+		return
+	}
+	if enabled {
+		http.Error(w, "Two-factor authentication is already enabled", http.StatusConflict)
+		return
+	}
+
+	secret, err := auth.GenerateTOTPSecret()
+	if err != nil {
+		http.Error(w, "Failed to generate secret", http.StatusInternalServerError)
+		return
+	}
+
+	sealed, err := h.keystore.Seal([]byte(secret))
+	if err != nil {
+		http.Error(w, "Failed to encrypt secret", http.StatusInternalServerError)
+		return
+	}
+
+	totp := &models.UserTOTP{
+		UserID:           user.ID,
+		SecretCiphertext: sealed.Ciphertext,
+		SecretDEK:        sealed.WrappedDEK,
+		KEKID:            sealed.KEKID,
+	}
+	if err := h.mfaRepo.SaveTOTP(r.Context(), totp); err != nil {
+		http.Error(w, "Failed to enroll", http.StatusInternalServerError)
+		return
+	}
+
+	response := models.TOTPEnrollResponse{
+		Secret:          secret,
+		ProvisioningURI: auth.TOTPProvisioningURI(secret, totpIssuer, user.Email),
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(response)
+}
+
+// Activate confirms the enrollment with a code from the authenticator app
+// and returns the recovery codes
+func (h *MFAHandler) Activate(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value(middleware.UserContextKey).(*models.User)
+
+	var req models.TOTPCodeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	totp, err := h.mfaRepo.GetTOTP(r.Context(), user.ID)
+	if err != nil {
+		http.Error(w, "No TOTP enrollment in progress", http.StatusNotFound)
+		return
+	}
+	if totp.EnabledAt != nil {
+		http.Error(w, "Two-factor authentication is already enabled", http.StatusConflict)
+		return
+	}
+
+	if !h.checkTOTP(w, r, totp, req.Code) {
+		return
+	}
+
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		http.Error(w, "Failed to generate recovery codes", http.StatusInternalServerError)
+		return
+	}
+
+	if err := h.mfaRepo.EnableTOTP(r.Context(), user.ID, hashes); err != nil {
+		http.Error(w, "Failed to enable two-factor authentication", http.StatusInternalServerError)
+		return
+	}
+	h.audit(r, user, models.AuditMFAEnabled)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(models.RecoveryCodesResponse{RecoveryCodes: codes})
+}
+
+// Disable turns two-factor authentication off. It requires a current code,
+// so a hijacked session alone cannot remove the second factor.
+func (h *MFAHandler) Disable(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value(middleware.UserContextKey).(*models.User)
+
+	var req models.TOTPCodeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	totp, ok := h.enabledTOTP(w, r, user)
+	if !ok || !h.checkTOTP(w, r, totp, req.Code) {
+		return
+	}
+
+	if err := h.mfaRepo.DisableTOTP(r.Context(), user.ID); err != nil {
+		http.Error(w, "Failed to disable two-factor authentication", http.StatusInternalServerError)
+		return
+	}
+	h.audit(r, user, models.AuditMFADisabled)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// RegenerateRecoveryCodes replaces all recovery codes, used or not
+func (h *MFAHandler) RegenerateRecoveryCodes(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value(middleware.UserContextKey).(*models.User)
+
+	var req models.TOTPCodeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	totp, ok := h.enabledTOTP(w, r, user)
+	if !ok || !h.checkTOTP(w, r, totp, req.Code) {
+		return
+	}
+
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		http.Error(w, "Failed to generate recovery codes", http.StatusInternalServerError)
+		return
+	}
+
+	if err := h.mfaRepo.ReplaceRecoveryCodes(r.Context(), user.ID, hashes); err != nil {
+		http.Error(w, "Failed to store recovery codes", http.StatusInternalServerError)
+		return
+	}
+	h.audit(r, user, models.AuditRecoveryCodesRegenerated)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(models.RecoveryCodesResponse{RecoveryCodes: codes})
+}
+
+// Verify completes a password login with a TOTP code or a recovery code and
+// issues the session tokens
+func (h *MFAHandler) Verify(w http.ResponseWriter, r *http.Request) {
+	var req models.MFAVerifyRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if req.MFAToken == "" || (req.Code == "") == (req.RecoveryCode == "") {
+		http.Error(w, "MFA token and either code or recovery_code are required", http.StatusBadRequest)
+		return
+	}
+
+	tokenHash := auth.HashToken(req.MFAToken)
+	challenge, err := h.mfaRepo.GetChallenge(r.Context(), tokenHash)
+	if err != nil {
+		http.Error(w, "Invalid or expired MFA token", http.StatusUnauthorized)
+		return
+	}
+
+	user, err := h.userRepo.GetByID(r.Context(), challenge.UserID)
+	if err != nil || !user.IsActive {
+		http.Error(w, "User account is inactive", http.StatusUnauthorized)
+		return
+	}
+
+	// Wrong codes count towards the account lockout, so new challenges do
+	// not give an attacker who knows the password more guesses
+	locked, err := h.authHandler.accounts.loginLocked(w, r, user.Username)
+	if err != nil {
+		http.Error(w, "Failed to verify code", http.StatusInternalServerError)
+		return
+	}
+	if locked {
+		http.Error(w, "Too many failed login attempts, try again later", http.StatusTooManyRequests)
+		return
+	}
+
+	// A recovery code is used up together with the challenge, so that a
+	// verification losing the race for the challenge does not burn it
+	var valid, consumed bool
+	if req.RecoveryCode != "" {
+		valid, err = h.mfaRepo.UseRecoveryCode(r.Context(), tokenHash, user.ID, auth.HashRecoveryCode(req.RecoveryCode))
+		consumed = valid
+	} else {
+		valid, err = h.validateTOTP(r.Context(), user.ID, req.Code)
+	}
+	if errors.Is(err, repository.ErrChallengeUnavailable) {
+		http.Error(w, "Invalid or expired MFA token", http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to verify second factor of user %s: %v", user.ID, err)
+		http.Error(w, "Failed to verify code", http.StatusInternalServerError)
+		return
+	}
+	if !valid {
+		h.authHandler.accounts.loginFailed(r, user.Username)
+		h.authHandler.auditLoginFailed(r, user, user.Username, "mfa")
+		if err := h.mfaRepo.RecordFailedAttempt(r.Context(), tokenHash, mfaMaxAttempts); err != nil {
+			log.Printf("Failed to record MFA attempt of user %s: %v", user.ID, err)
+		}
+		http.Error(w, "Invalid code", http.StatusUnauthorized)
+		return
+	}
+
+	// The challenge is single-use; a concurrent verification may have won
+	if !consumed {
+		consumed, err = h.mfaRepo.DeleteChallenge(r.Context(), tokenHash)
+		if err != nil || !consumed {
+			http.Error(w, "Invalid or expired MFA token", http.StatusUnauthorized)
+			return
+		}
+	}
+	h.authHandler.accounts.loginSucceeded(r.Context(), user.Username)
+	h.authHandler.auditLogin(r, user, "mfa")
+
+	token, refreshToken, err := h.authHandler.issueTokens(r.Context(), user, uuid.New())
+	if err != nil {
+		http.Error(w, "Failed to generate token", http.StatusInternalServerError)
+		return
+	}
+
+	user.PasswordHash = ""
+	response := models.LoginResponse{
+		Token:        token,
+		RefreshToken: refreshToken,
+		User:         *user,
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+func (h *MFAHandler) audit(r *http.Request, user *models.User, action string) {
+	h.authHandler.auditor.Record(r, AuditEntry{
+		Action:     action,
+		TargetType: models.AuditTargetUser,
+		TargetID:   user.ID.String(),
+		Account:    true,
+	})
+}
+
+// enabledTOTP loads the user's confirmed enrollment, or responds 404
+func (h *MFAHandler) enabledTOTP(w http.ResponseWriter, r *http.Request, user *models.User) (*models.UserTOTP, bool) {
+	totp, err := h.mfaRepo.GetTOTP(r.Context(), user.ID)
+	if err != nil || totp.EnabledAt == nil {
+		http.Error(w, "Two-factor authentication is not enabled", http.StatusNotFound)
+		return nil, false
+	}
+	return totp, true
+}
+
+// checkTOTP validates a code for a signed-in user, or responds with an error
+func (h *MFAHandler) checkTOTP(w http.ResponseWriter, r *http.Request, totp *models.UserTOTP, code string) bool {
+	valid, err := h.matchTOTP(r.Context(), totp, code)
+	if err != nil {
+		log.Printf("Failed to verify TOTP code of user %s: %v", totp.UserID, err)
+		http.Error(w, "Failed to verify code", http.StatusInternalServerError)
+		return false
+	}
+	if !valid {
+		http.Error(w, "Invalid code", http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
+
+// validateTOTP checks a code against the user's confirmed enrollment
+func (h *MFAHandler) validateTOTP(ctx context.Context, userID uuid.UUID, code string) (bool, error) {
+	totp, err := h.mfaRepo.GetTOTP(ctx, userID)
+	if err != nil {
+		return false, err
+	}
+	if totp.EnabledAt == nil {
+		return false, nil
+	}
+	return h.matchTOTP(ctx, totp, code)
+}
+
+// matchTOTP checks the code and records its time step, so each code works
+// only once
+func (h *MFAHandler) matchTOTP(ctx context.Context, totp *models.UserTOTP, code string) (bool, error) {
+	secret, err := h.keystore.Open(&keystore.Sealed{
+		Ciphertext: totp.SecretCiphertext,
+		WrappedDEK: totp.SecretDEK,
+		KEKID:      totp.KEKID,
+	})
+	if err != nil {
+		return false, err
+	}
+
+	step, ok := auth.ValidateTOTP(string(secret), code, time.Now())
+	if !ok {
+		return false, nil
+	}
+	return h.mfaRepo.UseTOTPStep(ctx, totp.UserID, step)
+}
+
+// newRecoveryCodes returns fresh recovery codes and their hashes for storage
+func newRecoveryCodes() ([]string, [][]byte, error) {
+	codes, err := auth.GenerateRecoveryCodes(recoveryCodeCount)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	hashes := make([][]byte, len(codes))
+	for i, code := range codes {
+		hashes[i] = auth.HashRecoveryCode(code)
+	}
+	return codes, hashes, nil
+}
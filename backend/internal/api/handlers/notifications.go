@@ -2,8 +2,13 @@ package handlers
 
 import (
 	"encoding/json"
+	"fmt"
+	"log"
+	"math"
 	"net/http"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/google/uuid"
@@ -11,28 +16,45 @@ import (
 	"github.com/pushlab/backend/internal/models"
 	"github.com/pushlab/backend/internal/queue"
 	"github.com/pushlab/backend/internal/repository"
+	"github.com/pushlab/backend/internal/targeting"
 )
 
 type NotificationHandler struct {
-	notifRepo  *repository.NotificationRepository
-	deviceRepo *repository.DeviceRepository
-	publisher  *queue.Publisher
+	notifRepo   *repository.NotificationRepository
+	deviceRepo  *repository.DeviceRepository
+	segmentRepo *repository.SegmentRepository
+	topicRepo   *repository.TopicRepository
+	limitsRepo  *repository.LimitsRepository
+	publisher   *queue.Publisher
+	auditor     *Auditor
+	quotas      models.Quotas
 }
 
 func NewNotificationHandler(
 	notifRepo *repository.NotificationRepository,
 	deviceRepo *repository.DeviceRepository,
+	segmentRepo *repository.SegmentRepository,
+	topicRepo *repository.TopicRepository,
+	limitsRepo *repository.LimitsRepository,
 	publisher *queue.Publisher,
+	auditor *Auditor,
+	quotas models.Quotas,
 ) *NotificationHandler {
 	return &NotificationHandler{
-		notifRepo:  notifRepo,
-		deviceRepo: deviceRepo,
-		publisher:  publisher,
+		notifRepo:   notifRepo,
+		deviceRepo:  deviceRepo,
+		segmentRepo: segmentRepo,
+		topicRepo:   topicRepo,
+		limitsRepo:  limitsRepo,
+		publisher:   publisher,
+		auditor:     auditor,
+		quotas:      quotas,
 	}
 }
 
 func (h *NotificationHandler) Send(w http.ResponseWriter, r *http.Request) {
 	user := r.Context().Value(middleware.UserContextKey).(*models.User)
+	org := middleware.OrgFromContext(r.Context())
 
 	var req models.SendNotificationRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
@@ -45,42 +67,49 @@ func (h *NotificationHandler) Send(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if req.Priority == "" {
-		req.Priority = "normal"
+	var target targeting.Expr
+	if req.Target != nil {
+		if len(req.Tags) > 0 {
+			http.Error(w, "Specify either tags or target, not both", http.StatusBadRequest)
+			return
+		}
+		var ok bool
+		if target, ok = h.resolveTarget(w, r, org.OrgID, req.Target); !ok {
+			return
+		}
 	}
 
-	if req.Sound == "" {
-		req.Sound = "default"
+	// Tag-restricted keys may use a target, which then only reaches devices
+	// with one of the allowed tags
+	key := middleware.APIKeyFromContext(r.Context())
+	if key != nil && target == nil && !key.AllowsTags(req.Tags) {
+		http.Error(w, "API key may only target tags: "+strings.Join(key.AllowedTags, ", "), http.StatusForbidden)
+		return
 	}
 
-	// Create notification record
-	dataJSON, _ := json.Marshal(req.Data)
-	notification := &models.Notification{
-		UserID:   user.ID,
-		Title:    req.Title,
-		Body:     req.Body,
-		Data:     dataJSON,
-		Badge:    req.Badge,
-		Sound:    req.Sound,
-		Category: req.Category,
-		Priority: req.Priority,
-		Tags:     req.Tags,
-		Status:   "queued",
+	if req.Priority == "" {
+		req.Priority = "normal"
 	}
 
-	if err := h.notifRepo.Create(r.Context(), notification); err != nil {
-		http.Error(w, "Failed to create notification", http.StatusInternalServerError)
-		return
+	if req.Sound == "" {
+		req.Sound = "default"
 	}
 
 	// Get device tokens to send to
 	var deviceTokens []models.DeviceToken
 	var err error
 
-	if len(req.Tags) > 0 {
-		deviceTokens, err = h.deviceRepo.GetTokensByUserAndTags(r.Context(), user.ID, req.Tags)
-	} else {
-		deviceTokens, err = h.deviceRepo.GetTokensByUserID(r.Context(), user.ID)
+	switch {
+	case target != nil:
+		var allowedTags []string
+		if key != nil {
+			allowedTags = key.AllowedTags
+		}
+		deviceTokens, err = h.deviceRepo.GetTokensByOrgAndTarget(r.Context(), org.OrgID, target, allowedTags)
+	case len(req.Tags) > 0:
+		deviceTokens, err = h.deviceRepo.GetTokensByOrgAndTags(r.Context(), org.OrgID, req.Tags)
+	default:
+		deviceTokens, err = h.deviceRepo.GetTokensByOrgID(r.Context(), org.OrgID)
 	}
 
 	if err != nil {
@@ -93,34 +122,32 @@ func (h *NotificationHandler) Send(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Extract device token IDs
-	tokenIDs := make([]uuid.UUID, len(deviceTokens))
-	for i, token := range deviceTokens {
-		tokenIDs[i] = token.ID
-	}
-
-	// Create notification job
-	job := &models.NotificationJob{
-		NotificationID: notification.ID,
-		UserID:         user.ID,
-		DeviceTokenIDs: tokenIDs,
-		Payload: models.NotificationPayload{
-			Title:    req.Title,
-			Body:     req.Body,
-			Badge:    req.Badge,
-			Sound:    req.Sound,
-			Category: req.Category,
-			Priority: req.Priority,
-			Data:     req.Data,
-		},
+	notification := newNotification(org.OrgID, user.ID, &req)
+	notification.Tags = req.Tags
+	if req.Target != nil {
+		notification.Target = &req.Target.Expression
+		if req.Target.Segment != "" {
+			notification.Segment = &req.Target.Segment
+		}
 	}
 
-	// Publish to queue
-	if err := h.publisher.PublishNotification(r.Context(), job); err != nil {
-		http.Error(w, "Failed to queue notification", http.StatusInternalServerError)
+	if !h.enqueue(w, r, notification, &req, deviceTokens) {
 		return
 	}
 
+	h.auditor.Record(r, AuditEntry{
+		Action:     models.AuditNotifySent,
+		TargetType: models.AuditTargetNotify,
+		TargetID:   notification.ID.String(),
+		After: map[string]any{
+			"title":          req.Title,
+			"tags":           req.Tags,
+			"target":         notification.Target,
+			"segment":        notification.Segment,
+			"target_devices": len(deviceTokens),
+		},
+	})
+
 	response := models.SendNotificationResponse{
 		NotificationID: notification.ID,
 		TargetDevices:  len(deviceTokens),
@@ -134,6 +161,7 @@ func (h *NotificationHandler) Send(w http.ResponseWriter, r *http.Request) {
 
 func (h *NotificationHandler) SendToDevice(w http.ResponseWriter, r *http.Request) {
 	user := r.Context().Value(middleware.UserContextKey).(*models.User)
+	org := middleware.OrgFromContext(r.Context())
 	deviceID, err := uuid.Parse(chi.URLParam(r, "device_id"))
 	if err != nil {
 		http.Error(w, "Invalid device ID", http.StatusBadRequest)
@@ -158,14 +186,23 @@ func (h *NotificationHandler) SendToDevice(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
-	if device.UserID != user.ID {
+	if device.OrgID != org.OrgID {
 		http.Error(w, "Forbidden", http.StatusForbidden)
 		return
 	}
 
-	// Get device token
-	deviceToken, err := h.deviceRepo.GetTokenByDeviceID(r.Context(), deviceID)
+	if key := middleware.APIKeyFromContext(r.Context()); key != nil && !key.AllowsDevice(device.Tags) {
+		http.Error(w, "API key may only target tags: "+strings.Join(key.AllowedTags, ", "), http.StatusForbidden)
+		return
+	}
+
+	// Get the device's active tokens
+	deviceTokens, err := h.deviceRepo.GetTokensByDeviceID(r.Context(), deviceID)
 	if err != nil {
+		http.Error(w, "Failed to fetch device tokens", http.StatusInternalServerError)
+		return
+	}
+	if len(deviceTokens) == 0 {
 		http.Error(w, "Device token not found", http.StatusNotFound)
 		return
 	}
@@ -178,10 +215,137 @@ func (h *NotificationHandler) SendToDevice(w http.ResponseWriter, r *http.Reques
 		req.Sound = "default"
 	}
 
-	// Create notification record
+	notification := newNotification(org.OrgID, user.ID, &req)
+	if !h.enqueue(w, r, notification, &req, deviceTokens) {
+		return
+	}
+
+	h.auditor.Record(r, AuditEntry{
+		Action:     models.AuditNotifySent,
+		TargetType: models.AuditTargetNotify,
+		TargetID:   notification.ID.String(),
+		After: map[string]any{
+			"title":     req.Title,
+			"device_id": deviceID,
+		},
+	})
+
+	response := models.SendNotificationResponse{
+		NotificationID: notification.ID,
+		TargetDevices:  1,
+		Status:         "queued",
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(response)
+}
+
+// Publish sends to the devices subscribed to a topic, creating the topic on
+// first use. The message is kept in the topic's history even if no device is
+// subscribed yet.
+func (h *NotificationHandler) Publish(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value(middleware.UserContextKey).(*models.User)
+	org := middleware.OrgFromContext(r.Context())
+
+	name := chi.URLParam(r, "name")
+	if !models.IsValidTopicName(name) {
+		http.Error(w, "Topic names are 1-64 letters, digits, dashes and underscores", http.StatusBadRequest)
+		return
+	}
+
+	var req models.SendNotificationRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if req.Body == "" {
+		http.Error(w, "Body is required", http.StatusBadRequest)
+		return
+	}
+
+	if len(req.Tags) > 0 || req.Target != nil {
+		http.Error(w, "Topic messages go to the topic's subscribers and cannot have tags or a target", http.StatusBadRequest)
+		return
+	}
+
+	if key := middleware.APIKeyFromContext(r.Context()); key != nil && len(key.AllowedTags) > 0 {
+		http.Error(w, "API keys restricted to tags cannot publish to topics", http.StatusForbidden)
+		return
+	}
+
+	topic, err := h.topicRepo.GetOrCreate(r.Context(), org.OrgID, name)
+	if err != nil {
+		http.Error(w, "Failed to get topic", http.StatusInternalServerError)
+		return
+	}
+
+	allowed, err := topicAllows(r, h.topicRepo, topic, true)
+	if err != nil {
+		http.Error(w, "Failed to check topic access", http.StatusInternalServerError)
+		return
+	}
+	if !allowed {
+		http.Error(w, "You may not publish to this topic", http.StatusForbidden)
+		return
+	}
+
+	deviceTokens, err := h.deviceRepo.GetTokensByTopic(r.Context(), topic.ID)
+	if err != nil {
+		http.Error(w, "Failed to get device tokens", http.StatusInternalServerError)
+		return
+	}
+
+	if req.Priority == "" {
+		req.Priority = "normal"
+	}
+
+	if req.Sound == "" {
+		req.Sound = "default"
+	}
+
+	notification := newNotification(org.OrgID, user.ID, &req)
+	notification.TopicID = &topic.ID
+
+	if len(deviceTokens) == 0 {
+		// Nothing to deliver; only keep the message in the history
+		notification.Status = "sent"
+		if err := h.notifRepo.Create(r.Context(), notification); err != nil {
+			http.Error(w, "Failed to create notification", http.StatusInternalServerError)
+			return
+		}
+	} else if !h.enqueue(w, r, notification, &req, deviceTokens) {
+		return
+	}
+
+	h.auditor.Record(r, AuditEntry{
+		Action:     models.AuditNotifySent,
+		TargetType: models.AuditTargetNotify,
+		TargetID:   notification.ID.String(),
+		After: map[string]any{
+			"title":          req.Title,
+			"topic":          topic.Name,
+			"target_devices": len(deviceTokens),
+		},
+	})
+
+	response := models.SendNotificationResponse{
+		NotificationID: notification.ID,
+		TargetDevices:  len(deviceTokens),
+		Status:         notification.Status,
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(response)
+}
+
+func newNotification(orgID, userID uuid.UUID, req *models.SendNotificationRequest) *models.Notification {
 	dataJSON, _ := json.Marshal(req.Data)
-	notification := &models.Notification{
-		UserID:   user.ID,
+	return &models.Notification{
+		OrgID:    orgID,
+		UserID:   userID,
 		Title:    req.Title,
 		Body:     req.Body,
 		Data:     dataJSON,
@@ -191,17 +355,32 @@ func (h *NotificationHandler) SendToDevice(w http.ResponseWriter, r *http.Reques
 		Priority: req.Priority,
 		Status:   "queued",
 	}
+}
+
+// enqueue counts the pushes against the sender's quotas, stores the
+// notification and queues it for delivery to the tokens. On failure it
+// answers the request itself and returns false.
+func (h *NotificationHandler) enqueue(w http.ResponseWriter, r *http.Request, notification *models.Notification, req *models.SendNotificationRequest, deviceTokens []models.DeviceToken) bool {
+	if !h.reserveSends(w, r, notification.UserID, len(deviceTokens)) {
+		return false
+	}
 
 	if err := h.notifRepo.Create(r.Context(), notification); err != nil {
+		h.releaseSends(r, notification.UserID, len(deviceTokens))
 		http.Error(w, "Failed to create notification", http.StatusInternalServerError)
-		return
+		return false
+	}
+
+	tokenIDs := make([]uuid.UUID, len(deviceTokens))
+	for i, token := range deviceTokens {
+		tokenIDs[i] = token.ID
 	}
 
-	// Create notification job
 	job := &models.NotificationJob{
 		NotificationID: notification.ID,
-		UserID:         user.ID,
-		DeviceTokenIDs: []uuid.UUID{deviceToken.ID},
+		OrgID:          notification.OrgID,
+		UserID:         notification.UserID,
+		DeviceTokenIDs: tokenIDs,
 		Payload: models.NotificationPayload{
 			Title:    req.Title,
 			Body:     req.Body,
@@ -213,25 +392,83 @@ func (h *NotificationHandler) SendToDevice(w http.ResponseWriter, r *http.Reques
 		},
 	}
 
-	// Publish to queue
 	if err := h.publisher.PublishNotification(r.Context(), job); err != nil {
+		h.releaseSends(r, notification.UserID, len(deviceTokens))
 		http.Error(w, "Failed to queue notification", http.StatusInternalServerError)
-		return
+		return false
 	}
+	return true
+}
 
-	response := models.SendNotificationResponse{
-		NotificationID: notification.ID,
-		TargetDevices:  1,
-		Status:         "queued",
+// resolveTarget parses the target expression, or that of the named segment,
+// which it then stores in the target for the notification record
+func (h *NotificationHandler) resolveTarget(w http.ResponseWriter, r *http.Request, orgID uuid.UUID, t *models.Target) (targeting.Expr, bool) {
+	if (t.Expression == "") == (t.Segment == "") {
+		http.Error(w, "Target needs either an expression or a segment", http.StatusBadRequest)
+		return nil, false
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusAccepted)
-	json.NewEncoder(w).Encode(response)
+	if t.Segment != "" {
+		segment, err := h.segmentRepo.GetByName(r.Context(), orgID, t.Segment)
+		if err != nil {
+			http.Error(w, "Segment not found: "+t.Segment, http.StatusNotFound)
+			return nil, false
+		}
+		t.Expression = segment.Expression
+	}
+
+	target, err := targeting.Parse(t.Expression)
+	if err != nil {
+		http.Error(w, "Invalid target: "+err.Error(), http.StatusBadRequest)
+		return nil, false
+	}
+	return target, true
+}
+
+// reserveSends counts n pushes against the user's send quotas. When a quota
+// is used up it answers 429, with Retry-After set to when the quota resets.
+func (h *NotificationHandler) reserveSends(w http.ResponseWriter, r *http.Request, userID uuid.UUID, n int) bool {
+	limits, err := h.limitsRepo.GetUserLimits(r.Context(), userID)
+	if err != nil {
+		http.Error(w, "Failed to check send quota", http.StatusInternalServerError)
+		return false
+	}
+
+	now := time.Now()
+	exceeded, err := h.limitsRepo.ConsumeSends(r.Context(), userID, n, limits.Quotas(h.quotas), now)
+	if err != nil {
+		http.Error(w, "Failed to check send quota", http.StatusInternalServerError)
+		return false
+	}
+	if exceeded == "" {
+		return true
+	}
+
+	resetAt := time.Date(now.UTC().Year(), now.UTC().Month(), now.UTC().Day()+1, 0, 0, 0, 0, time.UTC)
+	if exceeded == models.QuotaMonth {
+		resetAt = time.Date(now.UTC().Year(), now.UTC().Month()+1, 1, 0, 0, 0, 0, time.UTC)
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(resetAt.Sub(now).Seconds()))))
+	http.Error(w, fmt.Sprintf("The %s send quota would be exceeded by %d pushes", exceededLabel(exceeded), n), http.StatusTooManyRequests)
+	return false
+}
+
+// releaseSends gives back reserved pushes that were not queued
+func (h *NotificationHandler) releaseSends(r *http.Request, userID uuid.UUID, n int) {
+	if err := h.limitsRepo.RefundSends(r.Context(), userID, n, time.Now()); err != nil {
+		log.Printf("Failed to refund %d sends of user %s: %v", n, userID, err)
+	}
+}
+
+func exceededLabel(period string) string {
+	if period == models.QuotaMonth {
+		return "monthly"
+	}
+	return "daily"
 }
 
 func (h *NotificationHandler) List(w http.ResponseWriter, r *http.Request) {
-	user := r.Context().Value(middleware.UserContextKey).(*models.User)
+	org := middleware.OrgFromContext(r.Context())
 
 	limit := 50
 	offset := 0
@@ -248,7 +485,7 @@ func (h *NotificationHandler) List(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	notifications, err := h.notifRepo.GetByUserID(r.Context(), user.ID, limit, offset)
+	notifications, err := h.notifRepo.GetByOrgID(r.Context(), org.OrgID, limit, offset)
 	if err != nil {
 		http.Error(w, "Failed to fetch notifications", http.StatusInternalServerError)
 		return
@@ -259,7 +496,7 @@ func (h *NotificationHandler) List(w http.ResponseWriter, r *http.Request) {
 }
 
 func (h *NotificationHandler) Get(w http.ResponseWriter, r *http.Request) {
-	user := r.Context().Value(middleware.UserContextKey).(*models.User)
+	org := middleware.OrgFromContext(r.Context())
 	notifID, err := uuid.Parse(chi.URLParam(r, "id"))
 	if err != nil {
 		http.Error(w, "Invalid notification ID", http.StatusBadRequest)
@@ -272,7 +509,7 @@ func (h *NotificationHandler) Get(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if notification.UserID != user.ID {
+	if notification.OrgID != org.OrgID {
 		http.Error(w, "Forbidden", http.StatusForbidden)
 		return
 	}
@@ -0,0 +1,281 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/pushlab/backend/internal/auth"
+	"github.com/pushlab/backend/internal/models"
+	"github.com/pushlab/backend/internal/repository"
+	"golang.org/x/oauth2"
+)
+
+// oidcLoginTTL is how long the user has to complete the login at the provider
+const oidcLoginTTL = 10 * time.Minute
+
+var (
+	errOIDCNoAccount  = errors.New("no PushLab account is linked to this identity")
+	errOIDCEmailTaken = errors.New("an account with this email already exists; it can only be linked once both PushLab and the identity provider have verified the email")
+	errOIDCNoEmail    = errors.New("the identity provider did not return an email address")
+)
+
+// OIDCHandler signs users in through an OpenID Connect provider and issues
+// the same tokens as a password login
+type OIDCHandler struct {
+	provider     *auth.OIDCProvider
+	identityRepo *repository.IdentityRepository
+	userRepo     *repository.UserRepository
+	orgRepo      *repository.OrgRepository
+	authHandler  *AuthHandler
+}
+
+func NewOIDCHandler(
+	provider *auth.OIDCProvider,
+	identityRepo *repository.IdentityRepository,
+	userRepo *repository.UserRepository,
+	orgRepo *repository.OrgRepository,
+	authHandler *AuthHandler,
+) *OIDCHandler {
+	return &OIDCHandler{
+		provider:     provider,
+		identityRepo: identityRepo,
+		userRepo:     userRepo,
+		orgRepo:      orgRepo,
+		authHandler:  authHandler,
+	}
+}
+
+// Login redirects to the provider. Clients that cannot read the callback's
+// JSON response, such as the iOS app, pass an allowed redirect_uri to receive
+// the tokens in its URL fragment instead.
+func (h *OIDCHandler) Login(w http.ResponseWriter, r *http.Request) {
+	redirectURI := r.URL.Query().Get("redirect_uri")
+	if redirectURI != "" && !h.provider.AllowsRedirect(redirectURI) {
+		http.Error(w, "redirect_uri is not allowed", http.StatusBadRequest)
+		return
+	}
+
+	state, err := auth.GenerateSecret()
+	if err != nil {
+		http.Error(w, "Failed to start login", http.StatusInternalServerError)
+		return
+	}
+	nonce, err := auth.GenerateSecret()
+	if err != nil {
+		http.Error(w, "Failed to start login", http.StatusInternalServerError)
+		return
+	}
+
+	loginState := &models.OIDCLoginState{
+		StateHash:    auth.HashToken(state),
+		CodeVerifier: oauth2.GenerateVerifier(),
+		Nonce:        nonce,
+	}
+	if redirectURI != "" {
+		loginState.RedirectURI = &redirectURI
+	}
+
+	authURL, err := h.provider.AuthCodeURL(r.Context(), state, nonce, loginState.CodeVerifier)
+	if err != nil {
+		log.Printf("OIDC login failed: %v", err)
+		http.Error(w, "Identity provider unavailable", http.StatusBadGateway)
+		return
+	}
+
+	if err := h.identityRepo.CreateLoginState(r.Context(), loginState, oidcLoginTTL); err != nil {
+		http.Error(w, "Failed to start login", http.StatusInternalServerError)
+		return
+	}
+
+	http.Redirect(w, r, authURL, http.StatusFound)
+}
+
+// Callback completes the login: it verifies the provider's response, finds
+// or provisions the user and issues PushLab tokens
+func (h *OIDCHandler) Callback(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	state := query.Get("state")
+	if state == "" {
+		http.Error(w, "Missing state", http.StatusBadRequest)
+		return
+	}
+
+	loginState, err := h.identityRepo.ConsumeLoginState(r.Context(), auth.HashToken(state))
+	if err != nil {
+		http.Error(w, "Login expired or already completed", http.StatusBadRequest)
+		return
+	}
+
+	if providerErr := query.Get("error"); providerErr != "" {
+		http.Error(w, "Login failed at identity provider: "+providerErr, http.StatusUnauthorized)
+		return
+	}
+
+	identity, err := h.provider.Exchange(r.Context(), query.Get("code"), loginState.CodeVerifier, loginState.Nonce)
+	if err != nil {
+		log.Printf("OIDC callback failed: %v", err)
+		http.Error(w, "Failed to verify login with identity provider", http.StatusUnauthorized)
+		return
+	}
+
+	user, err := h.resolveUser(r.Context(), identity)
+	if err != nil {
+		switch {
+		case errors.Is(err, errOIDCNoAccount):
+			http.Error(w, err.Error(), http.StatusForbidden)
+		case errors.Is(err, errOIDCEmailTaken):
+			http.Error(w, err.Error(), http.StatusConflict)
+		case errors.Is(err, errOIDCNoEmail):
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		default:
+			log.Printf("Failed to resolve OIDC user %s/%s: %v", identity.Issuer, identity.Subject, err)
+			http.Error(w, "Failed to sign in", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	if !user.IsActive {
+		http.Error(w, "User account is inactive", http.StatusUnauthorized)
+		return
+	}
+
+	h.authHandler.auditLogin(r, user, "oidc")
+
+	token, refreshToken, err := h.authHandler.issueTokens(r.Context(), user, uuid.New())
+	if err != nil {
+		http.Error(w, "Failed to generate token", http.StatusInternalServerError)
+		return
+	}
+
+	if loginState.RedirectURI != nil {
+		fragment := url.Values{
+			"token":         {token},
+			"refresh_token": {refreshToken},
+		}
+		http.Redirect(w, r, *loginState.RedirectURI+"#"+fragment.Encode(), http.StatusFound)
+		return
+	}
+
+	user.PasswordHash = ""
+	response := models.LoginResponse{
+		Token:        token,
+		RefreshToken: refreshToken,
+		User:         *user,
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// resolveUser maps the identity to a user: a linked identity first, then an
+// existing account with the same verified email, which gets linked, and
+// finally a newly provisioned account
+func (h *OIDCHandler) resolveUser(ctx context.Context, identity *auth.OIDCIdentity) (*models.User, error) {
+	var email *string
+	if identity.Email != "" {
+		email = &identity.Email
+	}
+
+	linked, err := h.identityRepo.GetByIssuerAndSubject(ctx, identity.Issuer, identity.Subject)
+	if err == nil {
+		if err := h.identityRepo.RecordLogin(ctx, linked.ID, email); err != nil {
+			log.Printf("Failed to record login of identity %s: %v", linked.ID, err)
+		}
+		return h.userRepo.GetByID(ctx, linked.UserID)
+	}
+
+	if identity.Email == "" {
+		return nil, errOIDCNoEmail
+	}
+
+	// Linking by email requires both sides to have verified it; otherwise
+	// whoever registered the address first would get the other's account
+	user, err := h.userRepo.GetByEmail(ctx, identity.Email)
+	if err == nil {
+		if !identity.EmailVerified || user.EmailVerifiedAt == nil {
+			return nil, errOIDCEmailTaken
+		}
+	} else {
+		if !h.provider.AutoProvision() {
+			return nil, errOIDCNoAccount
+		}
+		if user, err = h.provision(ctx, identity); err != nil {
+			return nil, err
+		}
+	}
+
+	link := &models.UserIdentity{
+		UserID:  user.ID,
+		Issuer:  identity.Issuer,
+		Subject: identity.Subject,
+		Email:   email,
+	}
+	if err := h.identityRepo.Create(ctx, link); err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+// provision creates a password-less user with a personal organization. The
+// email counts as verified if the provider verified it.
+func (h *OIDCHandler) provision(ctx context.Context, identity *auth.OIDCIdentity) (*models.User, error) {
+	username, err := h.availableUsername(ctx, identity)
+	if err != nil {
+		return nil, err
+	}
+
+	user := &models.User{
+		Username: username,
+		Email:    identity.Email,
+	}
+	if err := h.userRepo.Create(ctx, user); err != nil {
+		return nil, err
+	}
+
+	if identity.EmailVerified {
+		if _, err := h.userRepo.MarkEmailVerified(ctx, user.ID, user.Email); err != nil {
+			return nil, err
+		}
+	}
+
+	if _, err := h.orgRepo.CreatePersonal(ctx, user); err != nil {
+		return nil, err
+	}
+
+	log.Printf("Provisioned user %s (%s) from %s", user.Username, user.ID, identity.Issuer)
+	return user, nil
+}
+
+// availableUsername derives a username from the identity, adding a numeric
+// suffix if it is taken
+func (h *OIDCHandler) availableUsername(ctx context.Context, identity *auth.OIDCIdentity) (string, error) {
+	base := identity.PreferredUsername
+	if base == "" {
+		base, _, _ = strings.Cut(identity.Email, "@")
+	}
+
+	for i := 1; i <= 20; i++ {
+		candidate := base
+		if i > 1 {
+			candidate = fmt.Sprintf("%s-%d", base, i)
+		}
+
+		exists, err := h.userRepo.UsernameExists(ctx, candidate)
+		if err != nil {
+			return "", err
+		}
+		if !exists {
+			return candidate, nil
+		}
+	}
+	return "", fmt.Errorf("no free username for %q", base)
+}
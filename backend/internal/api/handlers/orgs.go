@@ -0,0 +1,412 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+	"github.com/pushlab/backend/internal/api/middleware"
+	"github.com/pushlab/backend/internal/auth"
+	"github.com/pushlab/backend/internal/models"
+	"github.com/pushlab/backend/internal/repository"
+)
+
+// invitationTTL is how long an invitation token can be accepted
+const invitationTTL = 7 * 24 * time.Hour
+
+type OrgHandler struct {
+	orgRepo *repository.OrgRepository
+	auditor *Auditor
+}
+
+func NewOrgHandler(orgRepo *repository.OrgRepository, auditor *Auditor) *OrgHandler {
+	return &OrgHandler{orgRepo: orgRepo, auditor: auditor}
+}
+
+func (h *OrgHandler) Create(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value(middleware.UserContextKey).(*models.User)
+
+	var req models.CreateOrgRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" {
+		http.Error(w, "Name is required", http.StatusBadRequest)
+		return
+	}
+
+	org := &models.Organization{Name: req.Name}
+	if err := h.orgRepo.Create(r.Context(), org, user.ID); err != nil {
+		http.Error(w, "Failed to create organization", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(org)
+}
+
+// List returns the organizations the user belongs to, with their role in each
+func (h *OrgHandler) List(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value(middleware.UserContextKey).(*models.User)
+
+	memberships, err := h.orgRepo.GetByUserID(r.Context(), user.ID)
+	if err != nil {
+		http.Error(w, "Failed to fetch organizations", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(memberships)
+}
+
+func (h *OrgHandler) ListMembers(w http.ResponseWriter, r *http.Request) {
+	caller, ok := h.membership(w, r, models.RoleViewer)
+	if !ok {
+		return
+	}
+
+	members, err := h.orgRepo.GetMembers(r.Context(), caller.OrgID)
+	if err != nil {
+		http.Error(w, "Failed to fetch members", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(members)
+}
+
+// UpdateMember changes a member's role. Only owners can grant or take away
+// the owner role, and the last owner cannot be demoted.
+func (h *OrgHandler) UpdateMember(w http.ResponseWriter, r *http.Request) {
+	caller, ok := h.membership(w, r, models.RoleAdmin)
+	if !ok {
+		return
+	}
+
+	target, ok := h.member(w, r, caller.OrgID)
+	if !ok {
+		return
+	}
+
+	var req models.UpdateMemberRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if !models.IsValidRole(req.Role) {
+		http.Error(w, "Role must be one of owner, admin, sender or viewer", http.StatusBadRequest)
+		return
+	}
+
+	if (req.Role == models.RoleOwner || target.Role == models.RoleOwner) && caller.Role != models.RoleOwner {
+		http.Error(w, "Only owners can change the owner role", http.StatusForbidden)
+		return
+	}
+
+	if target.Role == models.RoleOwner && req.Role != models.RoleOwner {
+		if !h.hasOtherOwner(w, r, caller.OrgID) {
+			return
+		}
+	}
+
+	if err := h.orgRepo.UpdateRole(r.Context(), caller.OrgID, target.UserID, req.Role); err != nil {
+		http.Error(w, "Failed to update member", http.StatusInternalServerError)
+		return
+	}
+	before := *target
+	target.Role = req.Role
+
+	h.auditor.Record(r, AuditEntry{
+		Action:     models.AuditMemberUpdated,
+		TargetType: models.AuditTargetMember,
+		TargetID:   target.UserID.String(),
+		Before:     before,
+		After:      target,
+		OrgID:      &caller.OrgID,
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(target)
+}
+
+// RemoveMember removes a member from the organization. Members can always
+// leave; removing someone else requires admin, or owner to remove an owner.
+func (h *OrgHandler) RemoveMember(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value(middleware.UserContextKey).(*models.User)
+
+	caller, ok := h.membership(w, r, models.RoleViewer)
+	if !ok {
+		return
+	}
+
+	target, ok := h.member(w, r, caller.OrgID)
+	if !ok {
+		return
+	}
+
+	if target.UserID != user.ID {
+		if !models.RoleAtLeast(caller.Role, models.RoleAdmin) {
+			http.Error(w, "Insufficient role", http.StatusForbidden)
+			return
+		}
+		if target.Role == models.RoleOwner && caller.Role != models.RoleOwner {
+			http.Error(w, "Only owners can remove an owner", http.StatusForbidden)
+			return
+		}
+	}
+
+	if target.Role == models.RoleOwner && !h.hasOtherOwner(w, r, caller.OrgID) {
+		return
+	}
+
+	if err := h.orgRepo.RemoveMember(r.Context(), caller.OrgID, target.UserID); err != nil {
+		http.Error(w, "Failed to remove member", http.StatusInternalServerError)
+		return
+	}
+
+	h.auditor.Record(r, AuditEntry{
+		Action:     models.AuditMemberRemoved,
+		TargetType: models.AuditTargetMember,
+		TargetID:   target.UserID.String(),
+		Before:     target,
+		OrgID:      &caller.OrgID,
+	})
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Invite creates an invitation for an email address. The returned token is
+// passed to the invitee out of band and accepted with AcceptInvitation.
+func (h *OrgHandler) Invite(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value(middleware.UserContextKey).(*models.User)
+
+	caller, ok := h.membership(w, r, models.RoleAdmin)
+	if !ok {
+		return
+	}
+
+	var req models.InviteMemberRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	req.Email = strings.TrimSpace(req.Email)
+	if req.Email == "" {
+		http.Error(w, "Email is required", http.StatusBadRequest)
+		return
+	}
+
+	if req.Role == "" {
+		req.Role = models.RoleViewer
+	}
+	if !models.IsValidRole(req.Role) {
+		http.Error(w, "Role must be one of owner, admin, sender or viewer", http.StatusBadRequest)
+		return
+	}
+
+	if req.Role == models.RoleOwner && caller.Role != models.RoleOwner {
+		http.Error(w, "Only owners can invite owners", http.StatusForbidden)
+		return
+	}
+
+	token, err := auth.GenerateSecret()
+	if err != nil {
+		http.Error(w, "Failed to generate invitation token", http.StatusInternalServerError)
+		return
+	}
+
+	invitation := models.OrgInvitation{
+		OrgID:     caller.OrgID,
+		Email:     req.Email,
+		Role:      req.Role,
+		TokenHash: auth.HashToken(token),
+		InvitedBy: &user.ID,
+		ExpiresAt: time.Now().Add(invitationTTL),
+	}
+
+	if err := h.orgRepo.CreateInvitation(r.Context(), &invitation); err != nil {
+		http.Error(w, "Failed to create invitation", http.StatusInternalServerError)
+		return
+	}
+
+	h.auditor.Record(r, AuditEntry{
+		Action:     models.AuditInvitationCreated,
+		TargetType: models.AuditTargetInvitation,
+		TargetID:   invitation.ID.String(),
+		After:      invitation,
+		OrgID:      &caller.OrgID,
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(models.InvitationResponse{OrgInvitation: invitation, Token: token})
+}
+
+func (h *OrgHandler) ListInvitations(w http.ResponseWriter, r *http.Request) {
+	caller, ok := h.membership(w, r, models.RoleAdmin)
+	if !ok {
+		return
+	}
+
+	invitations, err := h.orgRepo.GetPendingInvitations(r.Context(), caller.OrgID)
+	if err != nil {
+		http.Error(w, "Failed to fetch invitations", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(invitations)
+}
+
+func (h *OrgHandler) DeleteInvitation(w http.ResponseWriter, r *http.Request) {
+	caller, ok := h.membership(w, r, models.RoleAdmin)
+	if !ok {
+		return
+	}
+
+	id, err := uuid.Parse(chi.URLParam(r, "invitation_id"))
+	if err != nil {
+		http.Error(w, "Invalid invitation ID", http.StatusBadRequest)
+		return
+	}
+
+	deleted, err := h.orgRepo.DeleteInvitation(r.Context(), id, caller.OrgID)
+	if err != nil {
+		http.Error(w, "Failed to delete invitation", http.StatusInternalServerError)
+		return
+	}
+	if !deleted {
+		http.Error(w, "Invitation not found", http.StatusNotFound)
+		return
+	}
+
+	h.auditor.Record(r, AuditEntry{
+		Action:     models.AuditInvitationDeleted,
+		TargetType: models.AuditTargetInvitation,
+		TargetID:   id.String(),
+		OrgID:      &caller.OrgID,
+	})
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// AcceptInvitation adds the user to the inviting organization. The
+// invitation must have been sent to the user's email address.
+func (h *OrgHandler) AcceptInvitation(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value(middleware.UserContextKey).(*models.User)
+
+	var req models.AcceptInvitationRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if req.Token == "" {
+		http.Error(w, "Token is required", http.StatusBadRequest)
+		return
+	}
+
+	// Invitations are addressed by email, so the address must be proven
+	if user.EmailVerifiedAt == nil {
+		http.Error(w, "Verify your email address before accepting invitations", http.StatusForbidden)
+		return
+	}
+
+	invitation, err := h.orgRepo.GetInvitationByTokenHash(r.Context(), auth.HashToken(req.Token))
+	if err != nil || !strings.EqualFold(invitation.Email, user.Email) {
+		http.Error(w, "Invitation not found", http.StatusNotFound)
+		return
+	}
+
+	if err := h.orgRepo.AcceptInvitation(r.Context(), invitation, user.ID); err != nil {
+		if errors.Is(err, repository.ErrInvitationUnavailable) {
+			http.Error(w, "Invitation has expired or was already accepted", http.StatusGone)
+			return
+		}
+		http.Error(w, "Failed to accept invitation", http.StatusInternalServerError)
+		return
+	}
+
+	membership, err := h.orgRepo.GetMembership(r.Context(), invitation.OrgID, user.ID)
+	if err != nil {
+		http.Error(w, "Failed to fetch membership", http.StatusInternalServerError)
+		return
+	}
+
+	h.auditor.Record(r, AuditEntry{
+		Action:     models.AuditInvitationAccepted,
+		TargetType: models.AuditTargetInvitation,
+		TargetID:   invitation.ID.String(),
+		After:      membership,
+		OrgID:      &invitation.OrgID,
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(membership)
+}
+
+// membership loads the caller's membership in the organization named in the
+// URL and checks it has at least the given role. Non-members get a 404 so
+// organization IDs cannot be probed.
+func (h *OrgHandler) membership(w http.ResponseWriter, r *http.Request, minRole string) (*models.OrgMembership, bool) {
+	user := r.Context().Value(middleware.UserContextKey).(*models.User)
+
+	orgID, err := uuid.Parse(chi.URLParam(r, "id"))
+	if err != nil {
+		http.Error(w, "Invalid organization ID", http.StatusBadRequest)
+		return nil, false
+	}
+
+	membership, err := h.orgRepo.GetMembership(r.Context(), orgID, user.ID)
+	if err != nil {
+		http.Error(w, "Organization not found", http.StatusNotFound)
+		return nil, false
+	}
+
+	if !models.RoleAtLeast(membership.Role, minRole) {
+		http.Error(w, "Insufficient role", http.StatusForbidden)
+		return nil, false
+	}
+	return membership, true
+}
+
+// member loads the membership of the user named in the URL
+func (h *OrgHandler) member(w http.ResponseWriter, r *http.Request, orgID uuid.UUID) (*models.OrgMembership, bool) {
+	userID, err := uuid.Parse(chi.URLParam(r, "user_id"))
+	if err != nil {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return nil, false
+	}
+
+	membership, err := h.orgRepo.GetMembership(r.Context(), orgID, userID)
+	if err != nil {
+		http.Error(w, "Member not found", http.StatusNotFound)
+		return nil, false
+	}
+	return membership, true
+}
+
+// hasOtherOwner checks that removing one owner still leaves the organization
+// with an owner
+func (h *OrgHandler) hasOtherOwner(w http.ResponseWriter, r *http.Request, orgID uuid.UUID) bool {
+	owners, err := h.orgRepo.CountOwners(r.Context(), orgID)
+	if err != nil {
+		http.Error(w, "Failed to check owners", http.StatusInternalServerError)
+		return false
+	}
+	if owners <= 1 {
+		http.Error(w, "An organization must keep at least one owner", http.StatusConflict)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,248 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+	"github.com/pushlab/backend/internal/api/middleware"
+	"github.com/pushlab/backend/internal/models"
+	"github.com/pushlab/backend/internal/repository"
+	"github.com/pushlab/backend/internal/targeting"
+)
+
+// segmentSampleSize is how many matching devices a preview lists
+const segmentSampleSize = 10
+
+type SegmentHandler struct {
+	segmentRepo *repository.SegmentRepository
+	deviceRepo  *repository.DeviceRepository
+	auditor     *Auditor
+}
+
+func NewSegmentHandler(segmentRepo *repository.SegmentRepository, deviceRepo *repository.DeviceRepository, auditor *Auditor) *SegmentHandler {
+	return &SegmentHandler{segmentRepo: segmentRepo, deviceRepo: deviceRepo, auditor: auditor}
+}
+
+func (h *SegmentHandler) Create(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value(middleware.UserContextKey).(*models.User)
+	org := middleware.OrgFromContext(r.Context())
+
+	var req models.CreateSegmentRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	segment := &models.Segment{
+		OrgID:       org.OrgID,
+		UserID:      &user.ID,
+		Name:        req.Name,
+		Description: strings.TrimSpace(req.Description),
+		Expression:  req.Expression,
+	}
+	if msg := validateSegment(segment); msg != "" {
+		http.Error(w, msg, http.StatusBadRequest)
+		return
+	}
+
+	if err := h.segmentRepo.Create(r.Context(), segment); err != nil {
+		if errors.Is(err, repository.ErrSegmentNameTaken) {
+			http.Error(w, "A segment with this name already exists", http.StatusConflict)
+			return
+		}
+		http.Error(w, "Failed to create segment", http.StatusInternalServerError)
+		return
+	}
+
+	h.auditor.Record(r, AuditEntry{
+		Action:     models.AuditSegmentCreated,
+		TargetType: models.AuditTargetSegment,
+		TargetID:   segment.ID.String(),
+		After:      segment,
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(segment)
+}
+
+func (h *SegmentHandler) List(w http.ResponseWriter, r *http.Request) {
+	org := middleware.OrgFromContext(r.Context())
+
+	segments, err := h.segmentRepo.GetByOrgID(r.Context(), org.OrgID)
+	if err != nil {
+		http.Error(w, "Failed to fetch segments", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(segments)
+}
+
+func (h *SegmentHandler) Get(w http.ResponseWriter, r *http.Request) {
+	segment, ok := h.orgSegment(w, r)
+	if !ok {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(segment)
+}
+
+func (h *SegmentHandler) Update(w http.ResponseWriter, r *http.Request) {
+	segment, ok := h.orgSegment(w, r)
+	if !ok {
+		return
+	}
+
+	var req models.UpdateSegmentRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	before := *segment
+	if req.Name != nil {
+		segment.Name = *req.Name
+	}
+	if req.Description != nil {
+		segment.Description = strings.TrimSpace(*req.Description)
+	}
+	if req.Expression != nil {
+		segment.Expression = *req.Expression
+	}
+	if msg := validateSegment(segment); msg != "" {
+		http.Error(w, msg, http.StatusBadRequest)
+		return
+	}
+
+	if err := h.segmentRepo.Update(r.Context(), segment); err != nil {
+		if errors.Is(err, repository.ErrSegmentNameTaken) {
+			http.Error(w, "A segment with this name already exists", http.StatusConflict)
+			return
+		}
+		http.Error(w, "Failed to update segment", http.StatusInternalServerError)
+		return
+	}
+
+	h.auditor.Record(r, AuditEntry{
+		Action:     models.AuditSegmentUpdated,
+		TargetType: models.AuditTargetSegment,
+		TargetID:   segment.ID.String(),
+		Before:     before,
+		After:      segment,
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(segment)
+}
+
+func (h *SegmentHandler) Delete(w http.ResponseWriter, r *http.Request) {
+	segment, ok := h.orgSegment(w, r)
+	if !ok {
+		return
+	}
+
+	deleted, err := h.segmentRepo.Delete(r.Context(), segment.ID, segment.OrgID)
+	if err != nil {
+		http.Error(w, "Failed to delete segment", http.StatusInternalServerError)
+		return
+	}
+	if !deleted {
+		http.Error(w, "Segment not found", http.StatusNotFound)
+		return
+	}
+
+	h.auditor.Record(r, AuditEntry{
+		Action:     models.AuditSegmentDeleted,
+		TargetType: models.AuditTargetSegment,
+		TargetID:   segment.ID.String(),
+		Before:     segment,
+	})
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Preview shows which devices a notification to the saved segment would
+// currently reach
+func (h *SegmentHandler) Preview(w http.ResponseWriter, r *http.Request) {
+	segment, ok := h.orgSegment(w, r)
+	if !ok {
+		return
+	}
+
+	target, err := targeting.Parse(segment.Expression)
+	if err != nil {
+		http.Error(w, "Invalid segment expression: "+err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	h.preview(w, r, target)
+}
+
+// PreviewExpression previews an unsaved expression, e.g. while editing a
+// segment
+func (h *SegmentHandler) PreviewExpression(w http.ResponseWriter, r *http.Request) {
+	var req models.PreviewSegmentRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	target, err := targeting.Parse(req.Expression)
+	if err != nil {
+		http.Error(w, "Invalid expression: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	h.preview(w, r, target)
+}
+
+// preview limits tag-restricted API keys to the devices they could notify
+func (h *SegmentHandler) preview(w http.ResponseWriter, r *http.Request, target targeting.Expr) {
+	org := middleware.OrgFromContext(r.Context())
+
+	var allowedTags []string
+	if key := middleware.APIKeyFromContext(r.Context()); key != nil {
+		allowedTags = key.AllowedTags
+	}
+
+	count, sample, err := h.deviceRepo.PreviewTarget(r.Context(), org.OrgID, target, allowedTags, segmentSampleSize)
+	if err != nil {
+		http.Error(w, "Failed to preview segment", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(models.SegmentPreview{MatchingDevices: count, Sample: sample})
+}
+
+// orgSegment loads the segment named by the id URL parameter from the
+// caller's organization
+func (h *SegmentHandler) orgSegment(w http.ResponseWriter, r *http.Request) (*models.Segment, bool) {
+	org := middleware.OrgFromContext(r.Context())
+	segmentID, err := uuid.Parse(chi.URLParam(r, "id"))
+	if err != nil {
+		http.Error(w, "Invalid segment ID", http.StatusBadRequest)
+		return nil, false
+	}
+
+	segment, err := h.segmentRepo.GetByID(r.Context(), segmentID, org.OrgID)
+	if err != nil {
+		http.Error(w, "Segment not found", http.StatusNotFound)
+		return nil, false
+	}
+	return segment, true
+}
+
+func validateSegment(segment *models.Segment) string {
+	if !models.IsValidSegmentName(segment.Name) {
+		return "Name must be 1-100 lowercase letters, digits, dots, dashes or underscores"
+	}
+	if _, err := targeting.Parse(segment.Expression); err != nil {
+		return "Invalid expression: " + err.Error()
+	}
+	return ""
+}
@@ -0,0 +1,455 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+	"github.com/pushlab/backend/internal/api/middleware"
+	"github.com/pushlab/backend/internal/models"
+	"github.com/pushlab/backend/internal/repository"
+)
+
+type TopicHandler struct {
+	topicRepo  *repository.TopicRepository
+	deviceRepo *repository.DeviceRepository
+	notifRepo  *repository.NotificationRepository
+	orgRepo    *repository.OrgRepository
+	auditor    *Auditor
+}
+
+func NewTopicHandler(
+	topicRepo *repository.TopicRepository,
+	deviceRepo *repository.DeviceRepository,
+	notifRepo *repository.NotificationRepository,
+	orgRepo *repository.OrgRepository,
+	auditor *Auditor,
+) *TopicHandler {
+	return &TopicHandler{
+		topicRepo:  topicRepo,
+		deviceRepo: deviceRepo,
+		notifRepo:  notifRepo,
+		orgRepo:    orgRepo,
+		auditor:    auditor,
+	}
+}
+
+func (h *TopicHandler) List(w http.ResponseWriter, r *http.Request) {
+	org := middleware.OrgFromContext(r.Context())
+
+	topics, err := h.topicRepo.GetByOrgID(r.Context(), org.OrgID)
+	if err != nil {
+		http.Error(w, "Failed to fetch topics", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(topics)
+}
+
+func (h *TopicHandler) Get(w http.ResponseWriter, r *http.Request) {
+	topic, ok := h.orgTopic(w, r)
+	if !ok {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(topic)
+}
+
+func (h *TopicHandler) Update(w http.ResponseWriter, r *http.Request) {
+	topic, ok := h.orgTopic(w, r)
+	if !ok {
+		return
+	}
+
+	var req models.UpdateTopicRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	before := *topic
+	if req.Description != nil {
+		topic.Description = strings.TrimSpace(*req.Description)
+	}
+	if req.DefaultAccess != nil {
+		if !models.IsValidTopicAccess(*req.DefaultAccess) {
+			http.Error(w, "Access must be read-write, read-only, write-only or deny", http.StatusBadRequest)
+			return
+		}
+		topic.DefaultAccess = *req.DefaultAccess
+	}
+	if req.MessageRetentionHours != nil {
+		if *req.MessageRetentionHours <= 0 {
+			http.Error(w, "Message retention must be at least one hour", http.StatusBadRequest)
+			return
+		}
+		topic.MessageRetentionHours = *req.MessageRetentionHours
+	}
+
+	if err := h.topicRepo.Update(r.Context(), topic); err != nil {
+		http.Error(w, "Failed to update topic", http.StatusInternalServerError)
+		return
+	}
+
+	h.auditor.Record(r, AuditEntry{
+		Action:     models.AuditTopicUpdated,
+		TargetType: models.AuditTargetTopic,
+		TargetID:   topic.ID.String(),
+		Before:     before,
+		After:      topic,
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(topic)
+}
+
+// Delete removes the topic, its subscriptions and ACL. Publishing to the name
+// again starts a new topic.
+func (h *TopicHandler) Delete(w http.ResponseWriter, r *http.Request) {
+	topic, ok := h.orgTopic(w, r)
+	if !ok {
+		return
+	}
+
+	if err := h.topicRepo.Delete(r.Context(), topic.ID); err != nil {
+		http.Error(w, "Failed to delete topic", http.StatusInternalServerError)
+		return
+	}
+
+	h.auditor.Record(r, AuditEntry{
+		Action:     models.AuditTopicDeleted,
+		TargetType: models.AuditTargetTopic,
+		TargetID:   topic.ID.String(),
+		Before:     topic,
+	})
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *TopicHandler) ListACL(w http.ResponseWriter, r *http.Request) {
+	topic, ok := h.orgTopic(w, r)
+	if !ok {
+		return
+	}
+
+	entries, err := h.topicRepo.GetACL(r.Context(), topic.ID)
+	if err != nil {
+		http.Error(w, "Failed to fetch topic ACL", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(entries)
+}
+
+// SetAccess overrides the topic's default access for a member
+func (h *TopicHandler) SetAccess(w http.ResponseWriter, r *http.Request) {
+	topic, ok := h.orgTopic(w, r)
+	if !ok {
+		return
+	}
+
+	userID, err := uuid.Parse(chi.URLParam(r, "user_id"))
+	if err != nil {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+
+	var req models.SetTopicAccessRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if !models.IsValidTopicAccess(req.Access) {
+		http.Error(w, "Access must be read-write, read-only, write-only or deny", http.StatusBadRequest)
+		return
+	}
+
+	if _, err := h.orgRepo.GetMembership(r.Context(), topic.OrgID, userID); err != nil {
+		http.Error(w, "Member not found", http.StatusNotFound)
+		return
+	}
+
+	before, _, err := h.topicRepo.GetAccess(r.Context(), topic.ID, userID)
+	if err != nil {
+		http.Error(w, "Failed to check topic access", http.StatusInternalServerError)
+		return
+	}
+
+	if err := h.topicRepo.SetAccess(r.Context(), topic.ID, userID, req.Access); err != nil {
+		http.Error(w, "Failed to update topic access", http.StatusInternalServerError)
+		return
+	}
+
+	h.auditor.Record(r, AuditEntry{
+		Action:     models.AuditTopicAccessUpdated,
+		TargetType: models.AuditTargetTopic,
+		TargetID:   topic.ID.String(),
+		Before:     map[string]any{"user_id": userID, "access": before},
+		After:      map[string]any{"user_id": userID, "access": req.Access},
+	})
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// RemoveAccess returns a member to the topic's default access
+func (h *TopicHandler) RemoveAccess(w http.ResponseWriter, r *http.Request) {
+	topic, ok := h.orgTopic(w, r)
+	if !ok {
+		return
+	}
+
+	userID, err := uuid.Parse(chi.URLParam(r, "user_id"))
+	if err != nil {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+
+	removed, err := h.topicRepo.RemoveAccess(r.Context(), topic.ID, userID)
+	if err != nil {
+		http.Error(w, "Failed to update topic access", http.StatusInternalServerError)
+		return
+	}
+	if !removed {
+		http.Error(w, "ACL entry not found", http.StatusNotFound)
+		return
+	}
+
+	h.auditor.Record(r, AuditEntry{
+		Action:     models.AuditTopicAccessUpdated,
+		TargetType: models.AuditTargetTopic,
+		TargetID:   topic.ID.String(),
+		Before:     map[string]any{"user_id": userID},
+	})
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Messages returns the topic's retained messages, newest first. An optional
+// since (RFC 3339) narrows them further, e.g. to what a device missed.
+func (h *TopicHandler) Messages(w http.ResponseWriter, r *http.Request) {
+	topic, ok := h.orgTopic(w, r)
+	if !ok {
+		return
+	}
+
+	allowed, err := topicAllows(r, h.topicRepo, topic, false)
+	if err != nil {
+		http.Error(w, "Failed to check topic access", http.StatusInternalServerError)
+		return
+	}
+	if !allowed {
+		http.Error(w, "You may not read this topic", http.StatusForbidden)
+		return
+	}
+
+	since := time.Now().Add(-time.Duration(topic.MessageRetentionHours) * time.Hour)
+	if s := r.URL.Query().Get("since"); s != "" {
+		t, err := time.Parse(time.RFC3339, s)
+		if err != nil {
+			http.Error(w, "Invalid since: use RFC 3339", http.StatusBadRequest)
+			return
+		}
+		if t.After(since) {
+			since = t
+		}
+	}
+
+	limit := 50
+	if limitStr := r.URL.Query().Get("limit"); limitStr != "" {
+		if l, err := strconv.Atoi(limitStr); err == nil && l > 0 && l <= 100 {
+			limit = l
+		}
+	}
+
+	messages, err := h.notifRepo.GetByTopic(r.Context(), topic.ID, since, limit)
+	if err != nil {
+		http.Error(w, "Failed to fetch messages", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(messages)
+}
+
+// Subscribe subscribes a device to a topic, creating the topic on first use
+func (h *TopicHandler) Subscribe(w http.ResponseWriter, r *http.Request) {
+	device, ok := h.orgDevice(w, r)
+	if !ok {
+		return
+	}
+
+	var req models.SubscribeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if !models.IsValidTopicName(req.Topic) {
+		http.Error(w, "Topic names are 1-64 letters, digits, dashes and underscores", http.StatusBadRequest)
+		return
+	}
+
+	// Check access before creating anything; a new topic gets the default
+	// access
+	topic, err := h.topicRepo.GetByName(r.Context(), device.OrgID, req.Topic)
+	if errors.Is(err, repository.ErrTopicNotFound) {
+		if !h.canSubscribe(w, r, &models.Topic{OrgID: device.OrgID, Name: req.Topic, DefaultAccess: models.TopicAccessReadWrite}) {
+			return
+		}
+		topic, err = h.topicRepo.GetOrCreate(r.Context(), device.OrgID, req.Topic)
+	}
+	if err != nil {
+		http.Error(w, "Failed to get topic", http.StatusInternalServerError)
+		return
+	}
+
+	// Check the stored topic, which another request may have created with
+	// other access in the meantime
+	if !h.canSubscribe(w, r, topic) {
+		return
+	}
+
+	created, err := h.topicRepo.Subscribe(r.Context(), topic.ID, device.ID)
+	if err != nil {
+		http.Error(w, "Failed to subscribe", http.StatusInternalServerError)
+		return
+	}
+
+	status := http.StatusOK
+	if created {
+		status = http.StatusCreated
+		h.auditor.Record(r, AuditEntry{
+			Action:     models.AuditDeviceSubscribed,
+			TargetType: models.AuditTargetDevice,
+			TargetID:   device.ID.String(),
+			After:      map[string]any{"topic": topic.Name},
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(models.TopicSubscription{TopicID: topic.ID, Topic: topic.Name, DeviceID: device.ID})
+}
+
+func (h *TopicHandler) Unsubscribe(w http.ResponseWriter, r *http.Request) {
+	device, ok := h.orgDevice(w, r)
+	if !ok {
+		return
+	}
+
+	topic, err := h.topicRepo.GetByName(r.Context(), device.OrgID, chi.URLParam(r, "topic"))
+	if err != nil {
+		http.Error(w, "Subscription not found", http.StatusNotFound)
+		return
+	}
+
+	removed, err := h.topicRepo.Unsubscribe(r.Context(), topic.ID, device.ID)
+	if err != nil {
+		http.Error(w, "Failed to unsubscribe", http.StatusInternalServerError)
+		return
+	}
+	if !removed {
+		http.Error(w, "Subscription not found", http.StatusNotFound)
+		return
+	}
+
+	h.auditor.Record(r, AuditEntry{
+		Action:     models.AuditDeviceUnsubscribed,
+		TargetType: models.AuditTargetDevice,
+		TargetID:   device.ID.String(),
+		Before:     map[string]any{"topic": topic.Name},
+	})
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *TopicHandler) ListSubscriptions(w http.ResponseWriter, r *http.Request) {
+	device, ok := h.orgDevice(w, r)
+	if !ok {
+		return
+	}
+
+	subscriptions, err := h.topicRepo.GetSubscriptions(r.Context(), device.ID)
+	if err != nil {
+		http.Error(w, "Failed to fetch subscriptions", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(subscriptions)
+}
+
+// orgTopic loads the topic named by the name URL parameter from the caller's
+// organization
+func (h *TopicHandler) orgTopic(w http.ResponseWriter, r *http.Request) (*models.Topic, bool) {
+	org := middleware.OrgFromContext(r.Context())
+	topic, err := h.topicRepo.GetByName(r.Context(), org.OrgID, chi.URLParam(r, "name"))
+	if err != nil {
+		http.Error(w, "Topic not found", http.StatusNotFound)
+		return nil, false
+	}
+	return topic, true
+}
+
+// canSubscribe checks that the caller may subscribe devices to topic, writing
+// the error response if not
+func (h *TopicHandler) canSubscribe(w http.ResponseWriter, r *http.Request, topic *models.Topic) bool {
+	allowed, err := topicAllows(r, h.topicRepo, topic, false)
+	if err != nil {
+		http.Error(w, "Failed to check topic access", http.StatusInternalServerError)
+		return false
+	}
+	if !allowed {
+		http.Error(w, "You may not subscribe to this topic", http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// orgDevice loads the device named by the id URL parameter from the caller's
+// organization
+func (h *TopicHandler) orgDevice(w http.ResponseWriter, r *http.Request) (*models.Device, bool) {
+	org := middleware.OrgFromContext(r.Context())
+	deviceID, err := uuid.Parse(chi.URLParam(r, "id"))
+	if err != nil {
+		http.Error(w, "Invalid device ID", http.StatusBadRequest)
+		return nil, false
+	}
+
+	device, err := h.deviceRepo.GetByID(r.Context(), deviceID)
+	if err != nil {
+		http.Error(w, "Device not found", http.StatusNotFound)
+		return nil, false
+	}
+	if device.OrgID != org.OrgID {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return nil, false
+	}
+	return device, true
+}
+
+// topicAllows reports whether the caller may read (subscribe devices and
+// see the history) or, if write, publish to the topic. Callers that may
+// administer topics are not limited by the ACL.
+func topicAllows(r *http.Request, topicRepo *repository.TopicRepository, topic *models.Topic, write bool) (bool, error) {
+	if canGrant(r.Context(), []string{models.ScopeTopicsAdmin}) {
+		return true, nil
+	}
+
+	user := r.Context().Value(middleware.UserContextKey).(*models.User)
+	access, ok, err := topicRepo.GetAccess(r.Context(), topic.ID, user.ID)
+	if err != nil {
+		return false, err
+	}
+	if !ok {
+		access = topic.DefaultAccess
+	}
+	return models.TopicAccessAllows(access, write), nil
+}
@@ -0,0 +1,127 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+	"github.com/pushlab/backend/internal/api/middleware"
+	"github.com/pushlab/backend/internal/auth"
+	"github.com/pushlab/backend/internal/events"
+	"github.com/pushlab/backend/internal/models"
+	"github.com/pushlab/backend/internal/repository"
+)
+
+type WebhookHandler struct {
+	webhookRepo *repository.WebhookRepository
+	auditor     *Auditor
+}
+
+func NewWebhookHandler(webhookRepo *repository.WebhookRepository, auditor *Auditor) *WebhookHandler {
+	return &WebhookHandler{webhookRepo: webhookRepo, auditor: auditor}
+}
+
+func (h *WebhookHandler) Create(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value(middleware.UserContextKey).(*models.User)
+	org := middleware.OrgFromContext(r.Context())
+
+	var req models.CreateWebhookRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	u, err := url.Parse(req.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		http.Error(w, "A valid http(s) URL is required", http.StatusBadRequest)
+		return
+	}
+
+	if len(req.Events) == 0 {
+		req.Events = events.Types
+	}
+	for _, eventType := range req.Events {
+		if !events.IsValidType(eventType) {
+			http.Error(w, "Unknown event type: "+eventType, http.StatusBadRequest)
+			return
+		}
+	}
+
+	secret, err := auth.GenerateSecret()
+	if err != nil {
+		http.Error(w, "Failed to generate webhook secret", http.StatusInternalServerError)
+		return
+	}
+
+	webhook := &models.Webhook{
+		OrgID:  org.OrgID,
+		UserID: user.ID,
+		URL:    req.URL,
+		Secret: secret,
+		Events: req.Events,
+	}
+
+	if err := h.webhookRepo.Create(r.Context(), webhook); err != nil {
+		http.Error(w, "Failed to create webhook", http.StatusInternalServerError)
+		return
+	}
+
+	// Leave the signing secret out of the audit log
+	h.auditor.Record(r, AuditEntry{
+		Action:     models.AuditWebhookCreated,
+		TargetType: models.AuditTargetWebhook,
+		TargetID:   webhook.ID.String(),
+		After:      map[string]any{"url": webhook.URL, "events": webhook.Events},
+	})
+
+	// The secret is only returned once, on creation
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(webhook)
+}
+
+func (h *WebhookHandler) List(w http.ResponseWriter, r *http.Request) {
+	org := middleware.OrgFromContext(r.Context())
+
+	webhooks, err := h.webhookRepo.GetByOrgID(r.Context(), org.OrgID)
+	if err != nil {
+		http.Error(w, "Failed to fetch webhooks", http.StatusInternalServerError)
+		return
+	}
+
+	for i := range webhooks {
+		webhooks[i].Secret = ""
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(webhooks)
+}
+
+func (h *WebhookHandler) Delete(w http.ResponseWriter, r *http.Request) {
+	org := middleware.OrgFromContext(r.Context())
+	webhookID, err := uuid.Parse(chi.URLParam(r, "id"))
+	if err != nil {
+		http.Error(w, "Invalid webhook ID", http.StatusBadRequest)
+		return
+	}
+
+	deleted, err := h.webhookRepo.Delete(r.Context(), webhookID, org.OrgID)
+	if err != nil {
+		http.Error(w, "Failed to delete webhook", http.StatusInternalServerError)
+		return
+	}
+	if !deleted {
+		http.Error(w, "Webhook not found", http.StatusNotFound)
+		return
+	}
+
+	h.auditor.Record(r, AuditEntry{
+		Action:     models.AuditWebhookDeleted,
+		TargetType: models.AuditTargetWebhook,
+		TargetID:   webhookID.String(),
+	})
+
+	w.WriteHeader(http.StatusNoContent)
+}
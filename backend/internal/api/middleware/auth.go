@@ -2,40 +2,77 @@ package middleware
 
 import (
 	"context"
+	"log"
 	"net/http"
 	"strings"
+	"time"
 
+	"github.com/google/uuid"
 	"github.com/pushlab/backend/internal/auth"
+	"github.com/pushlab/backend/internal/models"
 	"github.com/pushlab/backend/internal/repository"
 )
 
 type contextKey string
 
-const UserContextKey contextKey = "user"
+const (
+	UserContextKey contextKey = "user"
+	// APIKeyContextKey holds the *models.APIKey used to authenticate, if any
+	APIKeyContextKey contextKey = "api_key"
+	// OrgContextKey holds the *models.OrgMembership of the selected organization
+	OrgContextKey contextKey = "org"
+	// ClaimsContextKey holds the *auth.Claims of a JWT session
+	ClaimsContextKey contextKey = "claims"
+)
 
 type AuthMiddleware struct {
-	jwtService *auth.JWTService
-	userRepo   *repository.UserRepository
+	jwtService  *auth.JWTService
+	userRepo    *repository.UserRepository
+	apiKeyRepo  *repository.APIKeyRepository
+	orgRepo     *repository.OrgRepository
+	sessionRepo *repository.SessionRepository
 }
 
-func NewAuthMiddleware(jwtService *auth.JWTService, userRepo *repository.UserRepository) *AuthMiddleware {
+func NewAuthMiddleware(
+	jwtService *auth.JWTService,
+	userRepo *repository.UserRepository,
+	apiKeyRepo *repository.APIKeyRepository,
+	orgRepo *repository.OrgRepository,
+	sessionRepo *repository.SessionRepository,
+) *AuthMiddleware {
 	return &AuthMiddleware{
-		jwtService: jwtService,
-		userRepo:   userRepo,
+		jwtService:  jwtService,
+		userRepo:    userRepo,
+		apiKeyRepo:  apiKeyRepo,
+		orgRepo:     orgRepo,
+		sessionRepo: sessionRepo,
 	}
 }
 
 func (m *AuthMiddleware) Authenticate(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		// Check for API key first
-		apiKey := r.Header.Get("X-API-Key")
-		if apiKey != "" {
-			user, err := m.userRepo.GetByAPIKey(r.Context(), apiKey)
-			if err == nil && user != nil {
-				ctx := context.WithValue(r.Context(), UserContextKey, user)
-				next.ServeHTTP(w, r.WithContext(ctx))
+		if apiKey := r.Header.Get("X-API-Key"); apiKey != "" {
+			key, user, ok := m.authenticateAPIKey(r.Context(), apiKey)
+			if !ok {
+				http.Error(w, "Invalid API key", http.StatusUnauthorized)
+				return
+			}
+			if !user.IsActive {
+				http.Error(w, "User account is inactive", http.StatusUnauthorized)
+				return
+			}
+			if !key.AllowsIP(ClientIP(r)) {
+				http.Error(w, "API key not allowed from this address", http.StatusForbidden)
 				return
 			}
+			if err := m.apiKeyRepo.UpdateLastUsed(r.Context(), key.ID); err != nil {
+				log.Printf("Failed to update last use of API key %s: %v", key.ID, err)
+			}
+			ctx := context.WithValue(r.Context(), UserContextKey, user)
+			ctx = context.WithValue(ctx, APIKeyContextKey, key)
+			next.ServeHTTP(w, r.WithContext(ctx))
+			return
 		}
 
 		// Check for JWT token
@@ -57,6 +94,11 @@ func (m *AuthMiddleware) Authenticate(next http.Handler) http.Handler {
 			return
 		}
 
+		if !m.tokenActive(r.Context(), claims) {
+			http.Error(w, "Token has been revoked", http.StatusUnauthorized)
+			return
+		}
+
 		user, err := m.userRepo.GetByID(r.Context(), claims.UserID)
 		if err != nil {
 			http.Error(w, "User not found", http.StatusUnauthorized)
@@ -68,7 +110,70 @@ func (m *AuthMiddleware) Authenticate(next http.Handler) http.Handler {
 			return
 		}
 
+		if claims.ImpersonatorID != nil {
+			if !m.impersonatorActive(r.Context(), *claims.ImpersonatorID) {
+				http.Error(w, "Impersonation has ended", http.StatusUnauthorized)
+				return
+			}
+			if r.Method != http.MethodGet && r.Method != http.MethodHead {
+				http.Error(w, "Impersonation sessions are read-only", http.StatusForbidden)
+				return
+			}
+		}
+
 		ctx := context.WithValue(r.Context(), UserContextKey, user)
+		ctx = context.WithValue(ctx, ClaimsContextKey, claims)
 		next.ServeHTTP(w, r.WithContext(ctx))
 	})
 }
+
+// Impersonating reports whether the request uses an admin's read-only
+// impersonation token
+func Impersonating(ctx context.Context) bool {
+	claims, _ := ctx.Value(ClaimsContextKey).(*auth.Claims)
+	return claims != nil && claims.ImpersonatorID != nil
+}
+
+// tokenActive checks the access token against the denylist and its session.
+// Tokens without an ID or session cannot be revoked and are not accepted.
+func (m *AuthMiddleware) tokenActive(ctx context.Context, claims *auth.Claims) bool {
+	jti, err := uuid.Parse(claims.ID)
+	if err != nil || claims.SessionID == uuid.Nil {
+		return false
+	}
+
+	revoked, err := m.sessionRepo.IsAccessTokenRevoked(ctx, jti, claims.SessionID)
+	if err != nil {
+		log.Printf("Failed to check token revocation: %v", err)
+		return false
+	}
+	return !revoked
+}
+
+// impersonatorActive checks that the admin behind an impersonation token is
+// still an active admin
+func (m *AuthMiddleware) impersonatorActive(ctx context.Context, id uuid.UUID) bool {
+	admin, err := m.userRepo.GetByID(ctx, id)
+	return err == nil && admin.IsActive && admin.IsAdmin
+}
+
+// authenticateAPIKey looks the key up by its prefix and compares hashes in
+// constant time. The caller checks that the owner is active.
+func (m *AuthMiddleware) authenticateAPIKey(ctx context.Context, apiKey string) (*models.APIKey, *models.User, bool) {
+	prefix, ok := auth.APIKeyPrefix(apiKey)
+	if !ok {
+		return nil, nil, false
+	}
+
+	key, err := m.apiKeyRepo.GetByPrefix(ctx, prefix)
+	if err != nil || !auth.CompareAPIKey(apiKey, key.KeyHash) || !key.Usable(time.Now()) {
+		return nil, nil, false
+	}
+
+	user, err := m.userRepo.GetByID(ctx, key.UserID)
+	if err != nil {
+		return nil, nil, false
+	}
+
+	return key, user, true
+}
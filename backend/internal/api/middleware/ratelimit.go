@@ -0,0 +1,168 @@
+package middleware
+
+import (
+	"context"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+	"github.com/pushlab/backend/internal/models"
+	"github.com/pushlab/backend/internal/ratelimit"
+	"github.com/pushlab/backend/internal/repository"
+)
+
+const (
+	// limitsCacheTTL is how long per-user overrides are cached; admin
+	// changes take effect within it
+	limitsCacheTTL = 30 * time.Second
+	// limitsCacheSize bounds the override cache
+	limitsCacheSize = 10000
+)
+
+// RateLimitPolicy sets the token bucket each route is limited by
+type RateLimitPolicy struct {
+	Default ratelimit.Limit
+	// Routes overrides Default by method and route pattern, e.g.
+	// "POST /api/v1/notify"
+	Routes map[string]ratelimit.Limit
+}
+
+// RateLimiter limits requests per API key, or per user for sessions, with a
+// bucket for each route
+type RateLimiter struct {
+	limiter    ratelimit.Limiter
+	policy     RateLimitPolicy
+	limitsRepo *repository.LimitsRepository
+
+	mu    sync.Mutex
+	cache map[uuid.UUID]cachedLimits
+}
+
+type cachedLimits struct {
+	limits  *models.UserLimits
+	expires time.Time
+}
+
+func NewRateLimiter(limiter ratelimit.Limiter, policy RateLimitPolicy, limitsRepo *repository.LimitsRepository) *RateLimiter {
+	return &RateLimiter{
+		limiter:    limiter,
+		policy:     policy,
+		limitsRepo: limitsRepo,
+		cache:      make(map[uuid.UUID]cachedLimits),
+	}
+}
+
+// Limit rejects requests beyond the limit with 429 and reports the bucket in
+// X-RateLimit-* headers. Must run after Authenticate, inside a route group
+// so the route is known.
+func (l *RateLimiter) Limit(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user := r.Context().Value(UserContextKey).(*models.User)
+
+		route := r.Method + " " + chi.RouteContext(r.Context()).RoutePattern()
+		limit := l.limitFor(r.Context(), user.ID, route)
+
+		subject := "user:" + user.ID.String()
+		if key := APIKeyFromContext(r.Context()); key != nil {
+			subject = "key:" + key.ID.String()
+		}
+
+		l.apply(w, r, next, subject+":"+route, limit)
+	})
+}
+
+// LimitByIP is Limit for unauthenticated routes: it limits requests per
+// client address, without per-user overrides
+func (l *RateLimiter) LimitByIP(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route := r.Method + " " + chi.RouteContext(r.Context()).RoutePattern()
+		limit := l.policy.Default
+		if routeLimit, ok := l.policy.Routes[route]; ok {
+			limit = routeLimit
+		}
+
+		subject := "ip:" + r.RemoteAddr
+		if ip := ClientIP(r); ip != nil {
+			subject = "ip:" + ip.String()
+		}
+
+		l.apply(w, r, next, subject+":"+route, limit)
+	})
+}
+
+// apply takes a token from the bucket and serves the request if one was left
+func (l *RateLimiter) apply(w http.ResponseWriter, r *http.Request, next http.Handler, bucket string, limit ratelimit.Limit) {
+	res, err := l.limiter.Allow(r.Context(), bucket, limit)
+	if err != nil {
+		// Availability wins over limiting
+		log.Printf("Failed to apply rate limit: %v", err)
+		next.ServeHTTP(w, r)
+		return
+	}
+
+	w.Header().Set("X-RateLimit-Limit", strconv.Itoa(res.Limit))
+	w.Header().Set("X-RateLimit-Remaining", strconv.Itoa(res.Remaining))
+	w.Header().Set("X-RateLimit-Reset", strconv.Itoa(ceilSeconds(res.ResetAfter)))
+
+	if !res.Allowed {
+		w.Header().Set("Retry-After", strconv.Itoa(ceilSeconds(res.RetryAfter)))
+		http.Error(w, "Rate limit exceeded, try again later", http.StatusTooManyRequests)
+		return
+	}
+	next.ServeHTTP(w, r)
+}
+
+// limitFor returns the route's limit, replaced by the user's override if an
+// admin set one
+func (l *RateLimiter) limitFor(ctx context.Context, userID uuid.UUID, route string) ratelimit.Limit {
+	limit := l.policy.Default
+	if routeLimit, ok := l.policy.Routes[route]; ok {
+		limit = routeLimit
+	}
+
+	overrides := l.userLimits(ctx, userID)
+	if overrides == nil {
+		return limit
+	}
+	if overrides.RequestsPerMinute != nil {
+		limit.PerMinute = *overrides.RequestsPerMinute
+	}
+	if overrides.Burst != nil {
+		limit.Burst = *overrides.Burst
+	}
+	return limit
+}
+
+func (l *RateLimiter) userLimits(ctx context.Context, userID uuid.UUID) *models.UserLimits {
+	now := time.Now()
+
+	l.mu.Lock()
+	cached, ok := l.cache[userID]
+	l.mu.Unlock()
+	if ok && now.Before(cached.expires) {
+		return cached.limits
+	}
+
+	limits, err := l.limitsRepo.GetUserLimits(ctx, userID)
+	if err != nil {
+		log.Printf("Failed to load limits of user %s: %v", userID, err)
+		return nil
+	}
+
+	l.mu.Lock()
+	if len(l.cache) >= limitsCacheSize {
+		l.cache = make(map[uuid.UUID]cachedLimits)
+	}
+	l.cache[userID] = cachedLimits{limits: limits, expires: now.Add(limitsCacheTTL)}
+	l.mu.Unlock()
+	return limits
+}
+
+func ceilSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
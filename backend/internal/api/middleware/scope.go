@@ -0,0 +1,48 @@
+package middleware
+
+import (
+	"context"
+	"net"
+	"net/http"
+
+	"github.com/pushlab/backend/internal/models"
+)
+
+// APIKeyFromContext returns the API key the request was authenticated with,
+// or nil for JWT sessions
+func APIKeyFromContext(ctx context.Context) *models.APIKey {
+	key, _ := ctx.Value(APIKeyContextKey).(*models.APIKey)
+	return key
+}
+
+// RequireScope rejects requests whose role in the selected organization does
+// not grant the scope, or whose API key lacks it. Impersonation sessions only
+// get read scopes. Must run after ResolveOrg.
+func RequireScope(scope string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if Impersonating(r.Context()) && !models.IsReadScope(scope) {
+				http.Error(w, "Impersonation sessions are read-only", http.StatusForbidden)
+				return
+			}
+			if membership := OrgFromContext(r.Context()); membership == nil || !models.RoleHasScope(membership.Role, scope) {
+				http.Error(w, "Your role in this organization does not allow: "+scope, http.StatusForbidden)
+				return
+			}
+			if key := APIKeyFromContext(r.Context()); key != nil && !key.HasScope(scope) {
+				http.Error(w, "API key lacks required scope: "+scope, http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// ClientIP returns the address of the directly connected client
+func ClientIP(r *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return net.ParseIP(host)
+}
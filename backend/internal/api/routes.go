@@ -4,9 +4,14 @@ import (
 	"github.com/go-chi/chi/v5"
 	"github.com/pushlab/backend/internal/api/handlers"
 	"github.com/pushlab/backend/internal/api/middleware"
+	"github.com/pushlab/backend/internal/apns"
 	"github.com/pushlab/backend/internal/auth"
 	"github.com/pushlab/backend/internal/db"
+	"github.com/pushlab/backend/internal/keystore"
+	"github.com/pushlab/backend/internal/mail"
+	"github.com/pushlab/backend/internal/models"
 	"github.com/pushlab/backend/internal/queue"
+	"github.com/pushlab/backend/internal/ratelimit"
 	"github.com/pushlab/backend/internal/repository"
 )
 
@@ -17,23 +22,78 @@ type Server struct {
 	notifHandler   *handlers.NotificationHandler
 	apnsHandler    *handlers.APNsHandler
 	healthHandler  *handlers.HealthHandler
+	circuitHandler *handlers.CircuitHandler
+	webhookHandler *handlers.WebhookHandler
+	segmentHandler *handlers.SegmentHandler
+	topicHandler   *handlers.TopicHandler
+	apiKeyHandler  *handlers.APIKeyHandler
+	orgHandler     *handlers.OrgHandler
+	oidcHandler    *handlers.OIDCHandler
+	mfaHandler     *handlers.MFAHandler
+	auditHandler   *handlers.AuditHandler
+	adminHandler   *handlers.AdminHandler
+	accountHandler *handlers.AccountHandler
 	authMiddleware *middleware.AuthMiddleware
+	rateLimiter    *middleware.RateLimiter
 }
 
-func NewServer(database *db.DB, jwtService *auth.JWTService, publisher *queue.Publisher, certsDir string) *Server {
+func NewServer(
+	database *db.DB,
+	jwtService *auth.JWTService,
+	publisher *queue.Publisher,
+	ks *keystore.Keystore,
+	healthPolicy apns.HealthPolicy,
+	oidcProvider *auth.OIDCProvider,
+	mailer mail.Mailer,
+	accountPolicy handlers.AccountPolicy,
+	limiter ratelimit.Limiter,
+	rateLimitPolicy middleware.RateLimitPolicy,
+	quotas models.Quotas,
+	lifecycle models.LifecyclePolicy,
+) *Server {
 	userRepo := repository.NewUserRepository(database.Pool)
 	deviceRepo := repository.NewDeviceRepository(database.Pool)
 	notifRepo := repository.NewNotificationRepository(database.Pool)
 	apnsRepo := repository.NewAPNsRepository(database.Pool)
+	circuitRepo := repository.NewCircuitRepository(database.Pool)
+	webhookRepo := repository.NewWebhookRepository(database.Pool)
+	apiKeyRepo := repository.NewAPIKeyRepository(database.Pool)
+	orgRepo := repository.NewOrgRepository(database.Pool)
+	sessionRepo := repository.NewSessionRepository(database.Pool)
+	mfaRepo := repository.NewMFARepository(database.Pool)
+	accountRepo := repository.NewAccountRepository(database.Pool)
+	auditRepo := repository.NewAuditRepository(database.Pool)
+	limitsRepo := repository.NewLimitsRepository(database.Pool)
+	segmentRepo := repository.NewSegmentRepository(database.Pool)
+	topicRepo := repository.NewTopicRepository(database.Pool)
+
+	auditor := handlers.NewAuditor(auditRepo)
+	accountHandler := handlers.NewAccountHandler(accountRepo, userRepo, sessionRepo, mailer, auditor, accountPolicy)
 
 	s := &Server{
 		router:         chi.NewRouter(),
-		authHandler:    handlers.NewAuthHandler(userRepo, jwtService),
-		deviceHandler:  handlers.NewDeviceHandler(deviceRepo),
-		notifHandler:   handlers.NewNotificationHandler(notifRepo, deviceRepo, publisher),
-		apnsHandler:    handlers.NewAPNsHandler(apnsRepo, certsDir),
-		healthHandler:  handlers.NewHealthHandler(database),
-		authMiddleware: middleware.NewAuthMiddleware(jwtService, userRepo),
+		authHandler:    handlers.NewAuthHandler(userRepo, apiKeyRepo, orgRepo, sessionRepo, mfaRepo, accountHandler, auditor, jwtService),
+		accountHandler: accountHandler,
+		deviceHandler:  handlers.NewDeviceHandler(deviceRepo, auditor, lifecycle),
+		notifHandler:   handlers.NewNotificationHandler(notifRepo, deviceRepo, segmentRepo, topicRepo, limitsRepo, publisher, auditor, quotas),
+		apnsHandler:    handlers.NewAPNsHandler(apnsRepo, apns.NewClient(ks), ks, healthPolicy, auditor),
+		healthHandler:  handlers.NewHealthHandler(database, circuitRepo),
+		circuitHandler: handlers.NewCircuitHandler(circuitRepo),
+		webhookHandler: handlers.NewWebhookHandler(webhookRepo, auditor),
+		segmentHandler: handlers.NewSegmentHandler(segmentRepo, deviceRepo, auditor),
+		topicHandler:   handlers.NewTopicHandler(topicRepo, deviceRepo, notifRepo, orgRepo, auditor),
+		apiKeyHandler:  handlers.NewAPIKeyHandler(apiKeyRepo, auditor),
+		orgHandler:     handlers.NewOrgHandler(orgRepo, auditor),
+		auditHandler:   handlers.NewAuditHandler(auditRepo),
+		adminHandler:   handlers.NewAdminHandler(userRepo, apiKeyRepo, sessionRepo, limitsRepo, auditor, jwtService, quotas),
+		authMiddleware: middleware.NewAuthMiddleware(jwtService, userRepo, apiKeyRepo, orgRepo, sessionRepo),
+		rateLimiter:    middleware.NewRateLimiter(limiter, rateLimitPolicy, limitsRepo),
+	}
+	s.mfaHandler = handlers.NewMFAHandler(mfaRepo, userRepo, ks, s.authHandler)
+
+	if oidcProvider != nil {
+		identityRepo := repository.NewIdentityRepository(database.Pool)
+		s.oidcHandler = handlers.NewOIDCHandler(oidcProvider, identityRepo, userRepo, orgRepo, s.authHandler)
 	}
 
 	s.setupRoutes()
@@ -48,35 +108,169 @@ func (s *Server) setupRoutes() {
 	// Health check
 	s.router.Get("/health", s.healthHandler.Check)
 
+	// Public keys for verifying access tokens
+	s.router.Get("/.well-known/jwks.json", s.authHandler.JWKS)
+
 	// Public routes
 	s.router.Post("/api/v1/auth/register", s.authHandler.Register)
 	s.router.Post("/api/v1/auth/login", s.authHandler.Login)
+	s.router.Post("/api/v1/auth/refresh", s.authHandler.Refresh)
+	s.router.Post("/api/v1/auth/mfa/verify", s.mfaHandler.Verify)
+	s.router.Post("/api/v1/auth/password/forgot", s.accountHandler.ForgotPassword)
+	s.router.Post("/api/v1/auth/password/reset", s.accountHandler.ResetPassword)
+	s.router.Get("/api/v1/auth/email/verify", s.accountHandler.VerifyEmail)
+	s.router.Post("/api/v1/auth/email/verify", s.accountHandler.VerifyEmail)
+
+	// Device check-ins, authenticated with the device's heartbeat token and
+	// limited per client address
+	s.router.With(s.rateLimiter.LimitByIP).Post("/api/v1/devices/{id}/heartbeat", s.deviceHandler.Heartbeat)
+
+	// Single sign-on, when configured
+	if s.oidcHandler != nil {
+		s.router.Get("/api/v1/auth/oidc/login", s.oidcHandler.Login)
+		s.router.Get("/api/v1/auth/oidc/callback", s.oidcHandler.Callback)
+	}
 
 	// Protected routes
 	s.router.Group(func(r chi.Router) {
 		r.Use(s.authMiddleware.Authenticate)
+		r.Use(s.rateLimiter.Limit)
+
+		// Sessions, two-factor authentication and organizations are managed
+		// with a user session
+		r.Group(func(r chi.Router) {
+			r.Use(middleware.RequireSession)
+			r.Post("/api/v1/auth/logout", s.authHandler.Logout)
+			r.Post("/api/v1/auth/logout-all", s.authHandler.LogoutAll)
+			r.Post("/api/v1/auth/email/verification", s.accountHandler.ResendVerification)
+			r.Post("/api/v1/auth/mfa/totp/enroll", s.mfaHandler.Enroll)
+			r.Post("/api/v1/auth/mfa/totp/activate", s.mfaHandler.Activate)
+			r.Post("/api/v1/auth/mfa/totp/disable", s.mfaHandler.Disable)
+			r.Post("/api/v1/auth/mfa/recovery-codes", s.mfaHandler.RegenerateRecoveryCodes)
+			r.Get("/api/v1/auth/audit", s.auditHandler.ListAccount)
+			r.Post("/api/v1/orgs", s.orgHandler.Create)
+			r.Get("/api/v1/orgs", s.orgHandler.List)
+			r.Get("/api/v1/orgs/{id}/members", s.orgHandler.ListMembers)
+			r.Patch("/api/v1/orgs/{id}/members/{user_id}", s.orgHandler.UpdateMember)
+			r.Delete("/api/v1/orgs/{id}/members/{user_id}", s.orgHandler.RemoveMember)
+			r.Post("/api/v1/orgs/{id}/invitations", s.orgHandler.Invite)
+			r.Get("/api/v1/orgs/{id}/invitations", s.orgHandler.ListInvitations)
+			r.Delete("/api/v1/orgs/{id}/invitations/{invitation_id}", s.orgHandler.DeleteInvitation)
+			r.Post("/api/v1/invitations/accept", s.orgHandler.AcceptInvitation)
+		})
+
+		// Instance administration
+		r.Group(func(r chi.Router) {
+			r.Use(middleware.RequireAdmin)
+			r.Get("/api/v1/admin/users", s.adminHandler.ListUsers)
+			r.Get("/api/v1/admin/users/{id}", s.adminHandler.GetUser)
+			r.Get("/api/v1/admin/users/{id}/usage", s.adminHandler.Usage)
+			r.Post("/api/v1/admin/users/{id}/deactivate", s.adminHandler.DeactivateUser)
+			r.Post("/api/v1/admin/users/{id}/reactivate", s.adminHandler.ReactivateUser)
+			r.Post("/api/v1/admin/users/{id}/apikeys/reset", s.adminHandler.ResetAPIKeys)
+			r.Get("/api/v1/admin/users/{id}/limits", s.adminHandler.GetLimits)
+			r.Put("/api/v1/admin/users/{id}/limits", s.adminHandler.UpdateLimits)
+			r.Post("/api/v1/admin/users/{id}/impersonate", s.adminHandler.Impersonate)
+		})
+	})
+
+	// Organization resources; access is limited by the member's role and, for
+	// API keys, the key's scopes
+	s.router.Group(func(r chi.Router) {
+		r.Use(s.authMiddleware.Authenticate)
+		r.Use(s.rateLimiter.Limit)
+		r.Use(s.authMiddleware.ResolveOrg)
 
 		// Auth
-		r.Get("/api/v1/auth/apikey", s.authHandler.GenerateAPIKey)
+		r.Group(func(r chi.Router) {
+			r.Use(middleware.RequireScope(models.ScopeKeysAdmin))
+			r.Get("/api/v1/auth/apikey", s.authHandler.GenerateAPIKey)
+			r.Post("/api/v1/auth/apikeys", s.apiKeyHandler.Create)
+			r.Get("/api/v1/auth/apikeys", s.apiKeyHandler.List)
+			r.Get("/api/v1/auth/apikeys/{id}", s.apiKeyHandler.Get)
+			r.Patch("/api/v1/auth/apikeys/{id}", s.apiKeyHandler.Update)
+			r.Delete("/api/v1/auth/apikeys/{id}", s.apiKeyHandler.Delete)
+		})
 
 		// Devices
-		r.Post("/api/v1/devices", s.deviceHandler.Register)
-		r.Get("/api/v1/devices", s.deviceHandler.List)
-		r.Get("/api/v1/devices/{id}", s.deviceHandler.Get)
-		r.Put("/api/v1/devices/{id}", s.deviceHandler.Update)
-		r.Delete("/api/v1/devices/{id}", s.deviceHandler.Delete)
-		r.Put("/api/v1/devices/{id}/token", s.deviceHandler.UpdateToken)
+		r.Group(func(r chi.Router) {
+			r.Use(middleware.RequireScope(models.ScopeDevicesRead))
+			r.Get("/api/v1/devices", s.deviceHandler.List)
+			r.Get("/api/v1/devices/prune-report", s.deviceHandler.PruneReport)
+			r.Get("/api/v1/devices/{id}", s.deviceHandler.Get)
+			r.Get("/api/v1/devices/{id}/tokens", s.deviceHandler.ListTokens)
+			r.Get("/api/v1/devices/{id}/subscriptions", s.topicHandler.ListSubscriptions)
+			r.Get("/api/v1/segments", s.segmentHandler.List)
+			r.Get("/api/v1/segments/{id}", s.segmentHandler.Get)
+			r.Get("/api/v1/segments/{id}/preview", s.segmentHandler.Preview)
+			r.Post("/api/v1/segments/preview", s.segmentHandler.PreviewExpression)
+		})
+		r.Group(func(r chi.Router) {
+			r.Use(middleware.RequireScope(models.ScopeDevicesWrite))
+			r.Post("/api/v1/devices", s.deviceHandler.Register)
+			r.Put("/api/v1/devices/{id}", s.deviceHandler.Update)
+			r.Delete("/api/v1/devices/{id}", s.deviceHandler.Delete)
+			r.Put("/api/v1/devices/{id}/token", s.deviceHandler.UpdateToken)
+			r.Delete("/api/v1/devices/{id}/tokens/{token_id}", s.deviceHandler.RemoveToken)
+			r.Post("/api/v1/devices/{id}/heartbeat-token", s.deviceHandler.IssueHeartbeatToken)
+			r.Delete("/api/v1/devices/{id}/heartbeat-token", s.deviceHandler.RevokeHeartbeatToken)
+			r.Post("/api/v1/devices/{id}/subscriptions", s.topicHandler.Subscribe)
+			r.Delete("/api/v1/devices/{id}/subscriptions/{topic}", s.topicHandler.Unsubscribe)
+			r.Post("/api/v1/segments", s.segmentHandler.Create)
+			r.Patch("/api/v1/segments/{id}", s.segmentHandler.Update)
+			r.Delete("/api/v1/segments/{id}", s.segmentHandler.Delete)
+		})
 
 		// Notifications
-		r.Post("/api/v1/notify", s.notifHandler.Send)
-		r.Post("/api/v1/notify/device/{device_id}", s.notifHandler.SendToDevice)
-		r.Get("/api/v1/notifications", s.notifHandler.List)
-		r.Get("/api/v1/notifications/{id}", s.notifHandler.Get)
+		r.Group(func(r chi.Router) {
+			r.Use(middleware.RequireScope(models.ScopeNotifySend))
+			r.Post("/api/v1/notify", s.notifHandler.Send)
+			r.Post("/api/v1/notify/device/{device_id}", s.notifHandler.SendToDevice)
+			r.Post("/api/v1/topics/{name}", s.notifHandler.Publish)
+		})
+		r.Group(func(r chi.Router) {
+			r.Use(middleware.RequireScope(models.ScopeNotifyRead))
+			r.Get("/api/v1/notifications", s.notifHandler.List)
+			r.Get("/api/v1/notifications/{id}", s.notifHandler.Get)
+			r.Get("/api/v1/topics", s.topicHandler.List)
+			r.Get("/api/v1/topics/{name}", s.topicHandler.Get)
+			r.Get("/api/v1/topics/{name}/messages", s.topicHandler.Messages)
+		})
 
 		// APNs Credentials
-		r.Post("/api/v1/credentials/apns", s.apnsHandler.Create)
-		r.Get("/api/v1/credentials/apns", s.apnsHandler.List)
-		r.Delete("/api/v1/credentials/apns/{id}", s.apnsHandler.Delete)
+		r.Group(func(r chi.Router) {
+			r.Use(middleware.RequireScope(models.ScopeCredentialsAdmin))
+			r.Post("/api/v1/credentials/apns", s.apnsHandler.Create)
+			r.Get("/api/v1/credentials/apns", s.apnsHandler.List)
+			r.Delete("/api/v1/credentials/apns/{id}", s.apnsHandler.Delete)
+			r.Post("/api/v1/credentials/apns/{id}/verify", s.apnsHandler.Verify)
+			r.Get("/api/v1/credentials/apns/circuits", s.circuitHandler.List)
+		})
+
+		// Webhooks
+		r.Group(func(r chi.Router) {
+			r.Use(middleware.RequireScope(models.ScopeWebhooksAdmin))
+			r.Post("/api/v1/webhooks", s.webhookHandler.Create)
+			r.Get("/api/v1/webhooks", s.webhookHandler.List)
+			r.Delete("/api/v1/webhooks/{id}", s.webhookHandler.Delete)
+		})
+
+		// Topic settings and ACLs
+		r.Group(func(r chi.Router) {
+			r.Use(middleware.RequireScope(models.ScopeTopicsAdmin))
+			r.Patch("/api/v1/topics/{name}", s.topicHandler.Update)
+			r.Delete("/api/v1/topics/{name}", s.topicHandler.Delete)
+			r.Get("/api/v1/topics/{name}/acl", s.topicHandler.ListACL)
+			r.Put("/api/v1/topics/{name}/acl/{user_id}", s.topicHandler.SetAccess)
+			r.Delete("/api/v1/topics/{name}/acl/{user_id}", s.topicHandler.RemoveAccess)
+		})
+
+		// Audit log
+		r.Group(func(r chi.Router) {
+			r.Use(middleware.RequireScope(models.ScopeAuditRead))
+			r.Get("/api/v1/audit", s.auditHandler.List)
+			r.Get("/api/v1/audit/export", s.auditHandler.Export)
+		})
 	})
 }
 
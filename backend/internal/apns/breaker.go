@@ -0,0 +1,245 @@
+package apns
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// ErrCircuitOpen is returned when a push is attempted while the circuit for
+// the credential and environment is open.
+var ErrCircuitOpen = errors.New("apns circuit open")
+
+type CircuitState string
+
+const (
+	CircuitClosed   CircuitState = "closed"
+	CircuitOpen     CircuitState = "open"
+	CircuitHalfOpen CircuitState = "half_open"
+)
+
+type BreakerConfig struct {
+	FailureThreshold    int
+	OpenTimeout         time.Duration
+	HalfOpenMaxRequests int
+}
+
+// CircuitSnapshot is a point-in-time view of a single circuit
+type CircuitSnapshot struct {
+	CredentialID        uuid.UUID
+	Environment         string
+	State               CircuitState
+	ConsecutiveFailures int
+	OpenedAt            *time.Time
+	UpdatedAt           time.Time
+}
+
+type circuit struct {
+	credentialID     uuid.UUID
+	environment      string
+	state            CircuitState
+	failures         int
+	openedAt         time.Time
+	halfOpenInFlight int
+	updatedAt        time.Time
+}
+
+// CircuitBreaker tracks APNs health per credential and environment so that a
+// degraded endpoint is not hammered by every queued job.
+type CircuitBreaker struct {
+	cfg      BreakerConfig
+	circuits map[string]*circuit
+	onChange func(CircuitSnapshot)
+	mu       sync.Mutex
+}
+
+func NewCircuitBreaker(cfg BreakerConfig) *CircuitBreaker {
+	if cfg.FailureThreshold <= 0 {
+		cfg.FailureThreshold = 5
+	}
+	if cfg.OpenTimeout <= 0 {
+		cfg.OpenTimeout = 30 * time.Second
+	}
+	if cfg.HalfOpenMaxRequests <= 0 {
+		cfg.HalfOpenMaxRequests = 1
+	}
+	return &CircuitBreaker{
+		cfg:      cfg,
+		circuits: make(map[string]*circuit),
+	}
+}
+
+// OnStateChange registers a callback invoked after every state transition
+func (b *CircuitBreaker) OnStateChange(fn func(CircuitSnapshot)) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.onChange = fn
+}
+
+// Restore seeds circuits from persisted state, e.g. at startup. Half-open
+// circuits come back open, as their probes ended with the previous process,
+// and are probed again once the open timeout has elapsed.
+func (b *CircuitBreaker) Restore(snapshots []CircuitSnapshot) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for _, s := range snapshots {
+		if s.State == CircuitClosed {
+			continue
+		}
+		c := b.get(s.CredentialID, s.Environment)
+		c.state = CircuitOpen
+		c.failures = s.ConsecutiveFailures
+		c.halfOpenInFlight = 0
+		c.openedAt = s.UpdatedAt
+		if s.OpenedAt != nil {
+			c.openedAt = *s.OpenedAt
+		}
+		c.updatedAt = s.UpdatedAt
+	}
+}
+
+// Allow reports whether a push may be attempted for the credential. It returns
+// ErrCircuitOpen while the circuit is open, and moves an open circuit to
+// half-open once the open timeout has elapsed.
+func (b *CircuitBreaker) Allow(credentialID uuid.UUID, environment string) error {
+	b.mu.Lock()
+	c := b.get(credentialID, environment)
+
+	switch c.state {
+	case CircuitOpen:
+		if time.Since(c.openedAt) < b.cfg.OpenTimeout {
+			b.mu.Unlock()
+			return ErrCircuitOpen
+		}
+		b.transition(c, CircuitHalfOpen)
+		c.halfOpenInFlight = 1
+		snapshot, notify := b.snapshot(c), b.onChange
+		b.mu.Unlock()
+		if notify != nil {
+			notify(snapshot)
+		}
+		return nil
+	case CircuitHalfOpen:
+		if c.halfOpenInFlight >= b.cfg.HalfOpenMaxRequests {
+			b.mu.Unlock()
+			return ErrCircuitOpen
+		}
+		c.halfOpenInFlight++
+	}
+
+	b.mu.Unlock()
+	return nil
+}
+
+// Release returns a slot reserved by Allow when no request was sent, e.g.
+// because the client could not be built, so a half-open circuit can still be
+// probed
+func (b *CircuitBreaker) Release(credentialID uuid.UUID, environment string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	c := b.get(credentialID, environment)
+	if c.state == CircuitHalfOpen && c.halfOpenInFlight > 0 {
+		c.halfOpenInFlight--
+	}
+}
+
+// RecordSuccess closes the circuit after a request reached APNs
+func (b *CircuitBreaker) RecordSuccess(credentialID uuid.UUID, environment string) {
+	b.mu.Lock()
+	c := b.get(credentialID, environment)
+	c.failures = 0
+
+	if c.state == CircuitClosed {
+		b.mu.Unlock()
+		return
+	}
+
+	b.transition(c, CircuitClosed)
+	snapshot, notify := b.snapshot(c), b.onChange
+	b.mu.Unlock()
+	if notify != nil {
+		notify(snapshot)
+	}
+}
+
+// RecordFailure counts a transport error or 5xx response. The circuit opens
+// once the failure threshold is reached, or immediately when a half-open probe
+// fails.
+func (b *CircuitBreaker) RecordFailure(credentialID uuid.UUID, environment string) {
+	b.mu.Lock()
+	c := b.get(credentialID, environment)
+	c.failures++
+	c.updatedAt = time.Now()
+
+	if c.state == CircuitOpen ||
+		(c.state == CircuitClosed && c.failures < b.cfg.FailureThreshold) {
+		b.mu.Unlock()
+		return
+	}
+
+	b.transition(c, CircuitOpen)
+	snapshot, notify := b.snapshot(c), b.onChange
+	b.mu.Unlock()
+	if notify != nil {
+		notify(snapshot)
+	}
+}
+
+// Snapshot returns the current state of every known circuit
+func (b *CircuitBreaker) Snapshot() []CircuitSnapshot {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	snapshots := make([]CircuitSnapshot, 0, len(b.circuits))
+	for _, c := range b.circuits {
+		snapshots = append(snapshots, b.snapshot(c))
+	}
+	return snapshots
+}
+
+func (b *CircuitBreaker) get(credentialID uuid.UUID, environment string) *circuit {
+	key := circuitKey(credentialID, environment)
+	c, exists := b.circuits[key]
+	if !exists {
+		c = &circuit{
+			credentialID: credentialID,
+			environment:  environment,
+			state:        CircuitClosed,
+			updatedAt:    time.Now(),
+		}
+		b.circuits[key] = c
+	}
+	return c
+}
+
+func (b *CircuitBreaker) transition(c *circuit, state CircuitState) {
+	c.state = state
+	c.halfOpenInFlight = 0
+	c.updatedAt = time.Now()
+	if state == CircuitOpen {
+		c.openedAt = c.updatedAt
+	}
+}
+
+func (b *CircuitBreaker) snapshot(c *circuit) CircuitSnapshot {
+	s := CircuitSnapshot{
+		CredentialID:        c.credentialID,
+		Environment:         c.environment,
+		State:               c.state,
+		ConsecutiveFailures: c.failures,
+		UpdatedAt:           c.updatedAt,
+	}
+	if c.state != CircuitClosed {
+		openedAt := c.openedAt
+		s.OpenedAt = &openedAt
+	}
+	return s
+}
+
+func circuitKey(credentialID uuid.UUID, environment string) string {
+	return fmt.Sprintf("%s:%s", credentialID, environment)
+}
@@ -0,0 +1,220 @@
+package apns
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+var testCredentialID = uuid.MustParse("3c9d2e1f-4a5b-4c6d-8e7f-9a0b1c2d3e4f")
+
+const testEnvironment = "production"
+
+// expireOpenTimeout backdates an open circuit so that the next Allow probes it
+func expireOpenTimeout(b *CircuitBreaker, credentialID uuid.UUID, environment string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.get(credentialID, environment).openedAt = time.Now().Add(-b.cfg.OpenTimeout)
+}
+
+func state(b *CircuitBreaker, credentialID uuid.UUID, environment string) CircuitState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.get(credentialID, environment).state
+}
+
+func TestCircuitBreakerTransitions(t *testing.T) {
+	b := NewCircuitBreaker(BreakerConfig{FailureThreshold: 3, OpenTimeout: time.Minute, HalfOpenMaxRequests: 2})
+
+	var changes []CircuitState
+	b.OnStateChange(func(s CircuitSnapshot) {
+		if s.CredentialID != testCredentialID || s.Environment != testEnvironment {
+			t.Errorf("change reported for %s/%s", s.CredentialID, s.Environment)
+		}
+		if (s.State == CircuitClosed) != (s.OpenedAt == nil) {
+			t.Errorf("%s snapshot has opened_at %v", s.State, s.OpenedAt)
+		}
+		changes = append(changes, s.State)
+	})
+
+	allow := func() error { return b.Allow(testCredentialID, testEnvironment) }
+	fail := func() { b.RecordFailure(testCredentialID, testEnvironment) }
+	succeed := func() { b.RecordSuccess(testCredentialID, testEnvironment) }
+
+	steps := []struct {
+		name    string
+		do      func()
+		allow   bool
+		want    CircuitState
+		changes int
+	}{
+		{name: "new circuit", do: func() {}, allow: true, want: CircuitClosed},
+		{name: "below threshold", do: func() { fail(); fail() }, allow: true, want: CircuitClosed},
+		{name: "success resets failures", do: func() { succeed(); fail(); fail() }, allow: true, want: CircuitClosed},
+		{name: "threshold reached", do: fail, allow: false, want: CircuitOpen, changes: 1},
+		{name: "failures while open", do: fail, allow: false, want: CircuitOpen, changes: 1},
+		{name: "open timeout elapsed", do: func() { expireOpenTimeout(b, testCredentialID, testEnvironment) }, allow: true, want: CircuitHalfOpen, changes: 2},
+		{name: "second half-open probe", do: func() {}, allow: true, want: CircuitHalfOpen, changes: 2},
+		{name: "half-open probes exhausted", do: func() {}, allow: false, want: CircuitHalfOpen, changes: 2},
+		{name: "released probe", do: func() { b.Release(testCredentialID, testEnvironment) }, allow: true, want: CircuitHalfOpen, changes: 2},
+		{name: "failed probe reopens", do: fail, allow: false, want: CircuitOpen, changes: 3},
+		{name: "reopened timeout elapsed", do: func() { expireOpenTimeout(b, testCredentialID, testEnvironment) }, allow: true, want: CircuitHalfOpen, changes: 4},
+		{name: "successful probe closes", do: succeed, allow: true, want: CircuitClosed, changes: 5},
+		{name: "closed again needs the full threshold", do: func() { fail(); fail() }, allow: true, want: CircuitClosed, changes: 5},
+	}
+
+	for _, step := range steps {
+		step.do()
+		err := allow()
+		if step.allow && err != nil {
+			t.Errorf("%s: Allow returned %v", step.name, err)
+		}
+		if !step.allow && !errors.Is(err, ErrCircuitOpen) {
+			t.Errorf("%s: Allow returned %v, want ErrCircuitOpen", step.name, err)
+		}
+		if got := state(b, testCredentialID, testEnvironment); got != step.want {
+			t.Errorf("%s: state = %s, want %s", step.name, got, step.want)
+		}
+		if len(changes) != step.changes {
+			t.Errorf("%s: %d state changes reported, want %d", step.name, len(changes), step.changes)
+		}
+	}
+
+	want := []CircuitState{CircuitOpen, CircuitHalfOpen, CircuitOpen, CircuitHalfOpen, CircuitClosed}
+	for i := range want {
+		if i < len(changes) && changes[i] != want[i] {
+			t.Errorf("change %d = %s, want %s", i, changes[i], want[i])
+		}
+	}
+}
+
+func TestCircuitBreakerOpenTimeout(t *testing.T) {
+	b := NewCircuitBreaker(BreakerConfig{FailureThreshold: 1, OpenTimeout: 20 * time.Millisecond})
+
+	b.RecordFailure(testCredentialID, testEnvironment)
+	if err := b.Allow(testCredentialID, testEnvironment); !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("Allow right after opening returned %v, want ErrCircuitOpen", err)
+	}
+
+	time.Sleep(30 * time.Millisecond)
+	if err := b.Allow(testCredentialID, testEnvironment); err != nil {
+		t.Fatalf("Allow after the open timeout returned %v", err)
+	}
+	// HalfOpenMaxRequests defaults to a single probe
+	if err := b.Allow(testCredentialID, testEnvironment); !errors.Is(err, ErrCircuitOpen) {
+		t.Errorf("second Allow while probing returned %v, want ErrCircuitOpen", err)
+	}
+}
+
+func TestCircuitBreakerIsolation(t *testing.T) {
+	b := NewCircuitBreaker(BreakerConfig{FailureThreshold: 1, OpenTimeout: time.Minute})
+	other := uuid.MustParse("5e6f7a8b-9c0d-4e1f-8a2b-3c4d5e6f7a8b")
+
+	b.RecordFailure(testCredentialID, testEnvironment)
+
+	tests := []struct {
+		credentialID uuid.UUID
+		environment  string
+		open         bool
+	}{
+		{testCredentialID, testEnvironment, true},
+		{testCredentialID, "sandbox", false},
+		{other, testEnvironment, false},
+	}
+
+	for _, tt := range tests {
+		err := b.Allow(tt.credentialID, tt.environment)
+		if got := errors.Is(err, ErrCircuitOpen); got != tt.open {
+			t.Errorf("Allow(%s, %s) = %v, want open %v", tt.credentialID, tt.environment, err, tt.open)
+		}
+	}
+}
+
+func TestCircuitBreakerRelease(t *testing.T) {
+	b := NewCircuitBreaker(BreakerConfig{FailureThreshold: 1, OpenTimeout: time.Minute})
+
+	// Release outside half-open is a no-op
+	b.Release(testCredentialID, testEnvironment)
+	if got := state(b, testCredentialID, testEnvironment); got != CircuitClosed {
+		t.Fatalf("state after Release = %s, want closed", got)
+	}
+
+	b.RecordFailure(testCredentialID, testEnvironment)
+	b.Release(testCredentialID, testEnvironment)
+	if err := b.Allow(testCredentialID, testEnvironment); !errors.Is(err, ErrCircuitOpen) {
+		t.Errorf("Release opened the way through an open circuit: %v", err)
+	}
+
+	expireOpenTimeout(b, testCredentialID, testEnvironment)
+	if err := b.Allow(testCredentialID, testEnvironment); err != nil {
+		t.Fatalf("Allow after the open timeout returned %v", err)
+	}
+	b.Release(testCredentialID, testEnvironment)
+	b.Release(testCredentialID, testEnvironment)
+	if err := b.Allow(testCredentialID, testEnvironment); err != nil {
+		t.Errorf("Allow after Release returned %v", err)
+	}
+	if err := b.Allow(testCredentialID, testEnvironment); !errors.Is(err, ErrCircuitOpen) {
+		t.Errorf("repeated Release freed more than one probe: %v", err)
+	}
+}
+
+func TestCircuitBreakerRestore(t *testing.T) {
+	now := time.Now()
+	openedAt := now.Add(-10 * time.Second)
+	longAgo := now.Add(-time.Hour)
+
+	credentials := []uuid.UUID{uuid.New(), uuid.New(), uuid.New(), uuid.New(), uuid.New()}
+	snapshots := []CircuitSnapshot{
+		{CredentialID: credentials[0], Environment: testEnvironment, State: CircuitOpen, ConsecutiveFailures: 5, OpenedAt: &openedAt, UpdatedAt: now},
+		{CredentialID: credentials[1], Environment: testEnvironment, State: CircuitOpen, ConsecutiveFailures: 5, OpenedAt: &longAgo, UpdatedAt: longAgo},
+		// Probes ended with the previous process
+		{CredentialID: credentials[2], Environment: testEnvironment, State: CircuitHalfOpen, OpenedAt: &openedAt, UpdatedAt: now},
+		{CredentialID: credentials[3], Environment: testEnvironment, State: CircuitClosed, ConsecutiveFailures: 2, UpdatedAt: now},
+		// Without opened_at the last update stands in
+		{CredentialID: credentials[4], Environment: testEnvironment, State: CircuitOpen, UpdatedAt: now},
+	}
+
+	tests := []struct {
+		name  string
+		state CircuitState
+		allow bool
+	}{
+		{"open within timeout", CircuitOpen, false},
+		{"open past timeout", CircuitHalfOpen, true},
+		{"half-open", CircuitOpen, false},
+		{"closed", CircuitClosed, true},
+		{"open without opened_at", CircuitOpen, false},
+	}
+
+	b := NewCircuitBreaker(BreakerConfig{FailureThreshold: 5, OpenTimeout: time.Minute})
+	var changes int
+	b.OnStateChange(func(CircuitSnapshot) { changes++ })
+	b.Restore(snapshots)
+	if changes != 0 {
+		t.Errorf("Restore reported %d state changes", changes)
+	}
+	if got := len(b.Snapshot()); got != 4 {
+		t.Errorf("%d circuits after Restore, want 4", got)
+	}
+
+	for i, tt := range tests {
+		err := b.Allow(credentials[i], testEnvironment)
+		if got := err == nil; got != tt.allow {
+			t.Errorf("%s: Allow returned %v, want allowed %v", tt.name, err, tt.allow)
+		}
+		if got := state(b, credentials[i], testEnvironment); got != tt.state {
+			t.Errorf("%s: state = %s, want %s", tt.name, got, tt.state)
+		}
+	}
+
+	// A restored circuit remembers its failures and closes on success
+	b.RecordSuccess(credentials[0], testEnvironment)
+	for _, s := range b.Snapshot() {
+		if s.CredentialID == credentials[0] && (s.State != CircuitClosed || s.ConsecutiveFailures != 0) {
+			t.Errorf("after success: %s with %d failures, want closed with 0", s.State, s.ConsecutiveFailures)
+		}
+	}
+}
@@ -0,0 +1,66 @@
+package apns
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/pem"
+	"fmt"
+	"time"
+
+	"github.com/sideshow/apns2/certificate"
+)
+
+// oidUserID is the subject UID attribute; Apple sets it to the bundle ID
+var oidUserID = asn1.ObjectIdentifier{0, 9, 2342, 19200300, 100, 1, 1}
+
+// ParseCertificate decodes a PKCS#12 APNs certificate and re-encodes the
+// certificate and private key as unencrypted PEM, so the passphrase does not
+// need to be stored. It rejects expired certificates and certificates issued
+// for a different bundle ID.
+func ParseCertificate(p12 []byte, passphrase, bundleID string) ([]byte, time.Time, error) {
+	cert, err := certificate.FromP12Bytes(p12, passphrase)
+	if err != nil {
+		return nil, time.Time{}, fmt.Errorf("failed to decode PKCS#12 certificate: %w", err)
+	}
+
+	leaf := cert.Leaf
+	if time.Now().After(leaf.NotAfter) {
+		return nil, time.Time{}, fmt.Errorf("certificate expired on %s", leaf.NotAfter.Format(time.RFC3339))
+	}
+
+	for _, name := range leaf.Subject.Names {
+		if name.Type.Equal(oidUserID) {
+			if uid, ok := name.Value.(string); ok && uid != bundleID {
+				return nil, time.Time{}, fmt.Errorf("certificate is for bundle ID %s, not %s", uid, bundleID)
+			}
+		}
+	}
+
+	pemData, err := certificateToPEM(cert)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+
+	return pemData, leaf.NotAfter, nil
+}
+
+func certificateToPEM(cert tls.Certificate) ([]byte, error) {
+	var buf bytes.Buffer
+	for _, der := range cert.Certificate {
+		if err := pem.Encode(&buf, &pem.Block{Type: "CERTIFICATE", Bytes: der}); err != nil {
+			return nil, err
+		}
+	}
+
+	key, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode private key: %w", err)
+	}
+	if err := pem.Encode(&buf, &pem.Block{Type: "PRIVATE KEY", Bytes: key}); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
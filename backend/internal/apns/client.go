@@ -1,36 +1,52 @@
 package apns
 
 import (
+	"context"
 	"crypto/ecdsa"
-	"crypto/x509"
-	"encoding/pem"
+	"crypto/tls"
 	"fmt"
+	"log"
 	"os"
 	"sync"
+	"time"
 
+	"github.com/google/uuid"
+	"github.com/pushlab/backend/internal/keystore"
+	"github.com/pushlab/backend/internal/models"
 	"github.com/sideshow/apns2"
+	"github.com/sideshow/apns2/certificate"
 	"github.com/sideshow/apns2/token"
 )
 
+type cachedClient struct {
+	client       *apns2.Client
+	credentialID uuid.UUID
+	keyPath      string
+	lastUsed     time.Time
+}
+
 type Client struct {
-	clients map[string]*apns2.Client
-	mu      sync.RWMutex
+	clients  map[string]*cachedClient
+	keystore *keystore.Keystore
+	mu       sync.RWMutex
 }
 
-func NewClient() *Client {
+func NewClient(ks *keystore.Keystore) *Client {
 	return &Client{
-		clients: make(map[string]*apns2.Client),
+		clients:  make(map[string]*cachedClient),
+		keystore: ks,
 	}
 }
 
 // GetClient returns or creates an APNs client for the given credentials
-func (c *Client) GetClient(keyPath, keyID, teamID, environment string) (*apns2.Client, error) {
-	cacheKey := fmt.Sprintf("%s:%s:%s:%s", teamID, keyID, environment, keyPath)
+func (c *Client) GetClient(cred *models.APNsCredential) (*apns2.Client, error) {
+	cacheKey := fmt.Sprintf("%s:%s:%s:%s:%s", cred.ID, cred.TeamID, cred.KeyID, cred.Environment, cred.PrivateKeyPath)
 
 	c.mu.RLock()
-	if client, exists := c.clients[cacheKey]; exists {
+	if cached, exists := c.clients[cacheKey]; exists {
 		c.mu.RUnlock()
-		return client, nil
+		c.touch(cached)
+		return cached.client, nil
 	}
 	c.mu.RUnlock()
 
@@ -39,56 +55,171 @@ func (c *Client) GetClient(keyPath, keyID, teamID, environment string) (*apns2.C
 	defer c.mu.Unlock()
 
 	// Double-check after acquiring write lock
-	if client, exists := c.clients[cacheKey]; exists {
-		return client, nil
+	if cached, exists := c.clients[cacheKey]; exists {
+		cached.lastUsed = time.Now()
+		return cached.client, nil
 	}
 
-	authKey, err := loadAuthKey(keyPath)
+	client, err := c.NewUncached(cred)
 	if err != nil {
-		return nil, fmt.Errorf("failed to load auth key: %w", err)
+		return nil, err
 	}
 
-	jwtToken := &token.Token{
-		AuthKey: authKey,
-		KeyID:   keyID,
-		TeamID:  teamID,
+	c.clients[cacheKey] = &cachedClient{
+		client:       client,
+		credentialID: cred.ID,
+		keyPath:      cred.PrivateKeyPath,
+		lastUsed:     time.Now(),
 	}
+	return client, nil
+}
+
+// NewUncached builds an APNs client for the credential without caching it,
+// e.g. for one-off verification pushes
+func (c *Client) NewUncached(cred *models.APNsCredential) (*apns2.Client, error) {
+	var client *apns2.Client
 
-	client := apns2.NewTokenClient(jwtToken)
+	if cred.AuthType == models.APNsAuthCertificate {
+		cert, err := loadCertificate(c.keystore, cred)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load certificate: %w", err)
+		}
+		client = apns2.NewClient(cert)
+	} else {
+		authKey, err := loadAuthKey(c.keystore, cred)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load auth key: %w", err)
+		}
+
+		jwtToken := &token.Token{
+			AuthKey: authKey,
+			KeyID:   cred.KeyID,
+			TeamID:  cred.TeamID,
+		}
+		client = apns2.NewTokenClient(jwtToken)
+	}
 
-	if environment == "production" {
+	if cred.Environment == "production" {
 		client = client.Production()
 	} else {
 		client = client.Development()
 	}
 
-	c.clients[cacheKey] = client
 	return client, nil
 }
 
-// loadAuthKey loads the ECDSA private key from a .p8 file
-func loadAuthKey(path string) (*ecdsa.PrivateKey, error) {
-	keyData, err := os.ReadFile(path)
-	if err != nil {
-		return nil, fmt.Errorf("failed to read key file: %w", err)
+func (c *Client) touch(cached *cachedClient) {
+	c.mu.Lock()
+	cached.lastUsed = time.Now()
+	c.mu.Unlock()
+}
+
+// Evict closes and removes every cached client built from the credential or
+// from the key file at keyPath
+func (c *Client) Evict(credentialID uuid.UUID, keyPath string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	evicted := 0
+	for key, cached := range c.clients {
+		if cached.credentialID == credentialID || (keyPath != "" && cached.keyPath == keyPath) {
+			closeClient(cached.client)
+			delete(c.clients, key)
+			evicted++
+		}
+	}
+	return evicted
+}
+
+// EvictIdle closes and removes clients that have not been used within ttl
+func (c *Client) EvictIdle(ttl time.Duration) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	evicted := 0
+	for key, cached := range c.clients {
+		if time.Since(cached.lastUsed) > ttl {
+			closeClient(cached.client)
+			delete(c.clients, key)
+			evicted++
+		}
 	}
+	return evicted
+}
 
-	block, _ := pem.Decode(keyData)
-	if block == nil {
-		return nil, fmt.Errorf("failed to decode PEM block")
+// StartIdleEviction periodically evicts clients idle for longer than ttl
+// until ctx is cancelled
+func (c *Client) StartIdleEviction(ctx context.Context, ttl time.Duration) {
+	interval := ttl / 2
+	if interval < time.Minute {
+		interval = time.Minute
+	}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if n := c.EvictIdle(ttl); n > 0 {
+					log.Printf("Evicted %d idle APNs clients", n)
+				}
+			}
+		}
+	}()
+}
+
+// loadAuthKey loads the credential's ECDSA private key. Encrypted keys are
+// decrypted in memory only; credentials created before encryption at rest
+// fall back to the .p8 file on disk.
+func loadAuthKey(ks *keystore.Keystore, cred *models.APNsCredential) (*ecdsa.PrivateKey, error) {
+	var keyData []byte
+	var err error
+
+	if cred.PrivateKeyCiphertext != nil {
+		keyData, err = ks.Open(SealedKey(cred))
+		if err != nil {
+			return nil, fmt.Errorf("failed to decrypt key: %w", err)
+		}
+	} else {
+		keyData, err = os.ReadFile(cred.PrivateKeyPath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read key file: %w", err)
+		}
 	}
 
-	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	return ParseAuthKey(keyData)
+}
+
+// loadCertificate decrypts the credential's certificate and key in memory
+func loadCertificate(ks *keystore.Keystore, cred *models.APNsCredential) (tls.Certificate, error) {
+	pemData, err := ks.Open(SealedKey(cred))
 	if err != nil {
-		return nil, fmt.Errorf("failed to parse private key: %w", err)
+		return tls.Certificate{}, fmt.Errorf("failed to decrypt certificate: %w", err)
 	}
+	return certificate.FromPemBytes(pemData, "")
+}
 
-	ecdsaKey, ok := key.(*ecdsa.PrivateKey)
-	if !ok {
-		return nil, fmt.Errorf("key is not ECDSA")
+// SealedKey returns the credential's encrypted key material
+func SealedKey(cred *models.APNsCredential) *keystore.Sealed {
+	sealed := &keystore.Sealed{
+		Ciphertext: cred.PrivateKeyCiphertext,
+		WrappedDEK: cred.PrivateKeyDEK,
+	}
+	if cred.KEKID != nil {
+		sealed.KEKID = *cred.KEKID
 	}
+	return sealed
+}
 
-	return ecdsaKey, nil
+// SetSealedKey stores encrypted key material on the credential
+func SetSealedKey(cred *models.APNsCredential, sealed *keystore.Sealed) {
+	cred.PrivateKeyCiphertext = sealed.Ciphertext
+	cred.PrivateKeyDEK = sealed.WrappedDEK
+	cred.KEKID = &sealed.KEKID
 }
 
 // Close closes all APNs clients
@@ -96,11 +227,15 @@ func (c *Client) Close() {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
-	for _, client := range c.clients {
-		if client.HTTPClient != nil && client.HTTPClient.CloseIdleConnections != nil {
-			client.HTTPClient.CloseIdleConnections()
-		}
+	for _, cached := range c.clients {
+		closeClient(cached.client)
 	}
 
-	c.clients = make(map[string]*apns2.Client)
+	c.clients = make(map[string]*cachedClient)
+}
+
+func closeClient(client *apns2.Client) {
+	if client.HTTPClient != nil {
+		client.HTTPClient.CloseIdleConnections()
+	}
 }
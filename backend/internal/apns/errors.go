@@ -0,0 +1,45 @@
+package apns
+
+import "github.com/sideshow/apns2"
+
+// RejectsDeviceToken reports whether APNs rejected the device token itself,
+// meaning it should not be used again. 410 responses are excluded because
+// they must be checked against the token's registration time.
+func RejectsDeviceToken(statusCode int, reason string) bool {
+	if statusCode != 400 {
+		return false
+	}
+	return reason == apns2.ReasonBadDeviceToken || reason == apns2.ReasonDeviceTokenNotForTopic
+}
+
+// BlamesDeviceToken reports whether a failure points at the device token
+// without proving it dead, so repeated failures should retire it. Payload and
+// request errors such as PayloadTooLarge or BadPriority say nothing about the
+// token and are not counted.
+func BlamesDeviceToken(reason string) bool {
+	switch reason {
+	case apns2.ReasonMissingDeviceToken,
+		apns2.ReasonExpiredToken:
+		return true
+	default:
+		return false
+	}
+}
+
+// IsProviderError reports whether a failure was caused by the credential used
+// to sign the request rather than by the device token or payload.
+func IsProviderError(reason string) bool {
+	switch reason {
+	case apns2.ReasonInvalidProviderToken,
+		apns2.ReasonExpiredProviderToken,
+		apns2.ReasonMissingProviderToken,
+		apns2.ReasonTooManyProviderTokenUpdates,
+		apns2.ReasonBadCertificate,
+		apns2.ReasonBadCertificateEnvironment,
+		apns2.ReasonTopicDisallowed,
+		apns2.ReasonForbidden:
+		return true
+	default:
+		return false
+	}
+}
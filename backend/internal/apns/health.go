@@ -0,0 +1,56 @@
+package apns
+
+import (
+	"math"
+	"time"
+
+	"github.com/pushlab/backend/internal/models"
+)
+
+// HealthPolicy decides when a credential counts as degraded, failing or
+// close to expiry
+type HealthPolicy struct {
+	// ErrorThreshold is the number of consecutive errors after which a
+	// credential is failing rather than degraded
+	ErrorThreshold int
+	// ExpiryWarning is how long before certificate expiry to start warning
+	ExpiryWarning time.Duration
+}
+
+// Evaluate summarises the credential's tracked health
+func (p HealthPolicy) Evaluate(cred *models.APNsCredential, now time.Time) *models.APNsCredentialHealth {
+	health := &models.APNsCredentialHealth{
+		LastSuccessAt:     cred.LastSuccessAt,
+		LastErrorAt:       cred.LastErrorAt,
+		LastError:         cred.LastError,
+		ConsecutiveErrors: cred.ErrorCount,
+		ProviderError:     cred.ProviderError,
+		ProviderErrorAt:   cred.ProviderErrorAt,
+	}
+
+	var untilExpiry time.Duration
+	if cred.CertificateExpiresAt != nil {
+		untilExpiry = cred.CertificateExpiresAt.Sub(now)
+		days := int(math.Floor(untilExpiry.Hours() / 24))
+		health.ExpiresInDays = &days
+	}
+
+	switch {
+	case cred.CertificateExpiresAt != nil && untilExpiry <= 0:
+		health.Status = models.CredentialHealthExpired
+	case cred.ProviderError != nil:
+		health.Status = models.CredentialHealthFailing
+	case p.ErrorThreshold > 0 && cred.ErrorCount >= p.ErrorThreshold:
+		health.Status = models.CredentialHealthFailing
+	case cred.CertificateExpiresAt != nil && untilExpiry < p.ExpiryWarning:
+		health.Status = models.CredentialHealthExpiring
+	case cred.ErrorCount > 0:
+		health.Status = models.CredentialHealthDegraded
+	case cred.LastSuccessAt == nil:
+		health.Status = models.CredentialHealthUnknown
+	default:
+		health.Status = models.CredentialHealthHealthy
+	}
+
+	return health
+}
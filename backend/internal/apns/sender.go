@@ -2,11 +2,13 @@ package apns
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
 	"time"
 
 	"github.com/google/uuid"
+	"github.com/pushlab/backend/internal/models"
 	"github.com/sideshow/apns2"
 )
 
@@ -16,29 +18,51 @@ type SendResult struct {
 	StatusCode    int
 	Reason        string
 	Timestamp     time.Time
+	// UnregisteredAt is the time APNs last confirmed the token was no longer
+	// valid for the topic; only set on 410 responses
+	UnregisteredAt *time.Time
 }
 
 type Sender struct {
-	client *Client
+	client  *Client
+	breaker *CircuitBreaker
 }
 
-func NewSender(client *Client) *Sender {
-	return &Sender{client: client}
+func NewSender(client *Client, breaker *CircuitBreaker) *Sender {
+	return &Sender{
+		client:  client,
+		breaker: breaker,
+	}
 }
 
-func (s *Sender) Send(ctx context.Context, deviceToken, bundleID, environment, keyPath, keyID, teamID string, notif *apns2.Notification) (*SendResult, error) {
-	apnsClient, err := s.client.GetClient(keyPath, keyID, teamID, environment)
+func (s *Sender) Send(ctx context.Context, cred *models.APNsCredential, deviceToken string, notif *apns2.Notification) (*SendResult, error) {
+	if err := s.breaker.Allow(cred.ID, cred.Environment); err != nil {
+		return nil, err
+	}
+
+	apnsClient, err := s.client.GetClient(cred)
 	if err != nil {
+		// Nothing reached APNs, so this says nothing about its health
+		s.breaker.Release(cred.ID, cred.Environment)
 		return nil, fmt.Errorf("failed to get APNs client: %w", err)
 	}
 
-	notif.Topic = bundleID
+	notif.Topic = cred.BundleID
 
 	res, err := apnsClient.PushWithContext(ctx, notif)
 	if err != nil {
+		s.breaker.RecordFailure(cred.ID, cred.Environment)
 		return nil, fmt.Errorf("failed to send push notification: %w", err)
 	}
 
+	// Only server-side errors count against the circuit; 4xx responses mean
+	// APNs is up and rejected this particular request.
+	if res.StatusCode >= 500 {
+		s.breaker.RecordFailure(cred.ID, cred.Environment)
+	} else {
+		s.breaker.RecordSuccess(cred.ID, cred.Environment)
+	}
+
 	result := &SendResult{
 		StatusCode: res.StatusCode,
 		Timestamp:  time.Now(),
@@ -50,6 +74,10 @@ func (s *Sender) Send(ctx context.Context, deviceToken, bundleID, environment, k
 	} else {
 		result.Success = false
 		result.Reason = res.Reason
+		if res.StatusCode == 410 && !res.Timestamp.IsZero() {
+			unregisteredAt := res.Timestamp.Time
+			result.UnregisteredAt = &unregisteredAt
+		}
 		log.Printf("Failed to send notification: status=%d, reason=%s, apns_id=%s",
 			res.StatusCode, res.Reason, res.ApnsID)
 	}
@@ -57,7 +85,7 @@ func (s *Sender) Send(ctx context.Context, deviceToken, bundleID, environment, k
 	return result, nil
 }
 
-func (s *Sender) SendWithRetry(ctx context.Context, deviceToken, bundleID, environment, keyPath, keyID, teamID string, notif *apns2.Notification, maxRetries int) (*SendResult, error) {
+func (s *Sender) SendWithRetry(ctx context.Context, cred *models.APNsCredential, deviceToken string, notif *apns2.Notification, maxRetries int) (*SendResult, error) {
 	var lastErr error
 	var result *SendResult
 
@@ -73,7 +101,10 @@ func (s *Sender) SendWithRetry(ctx context.Context, deviceToken, bundleID, envir
 			}
 		}
 
-		result, lastErr = s.Send(ctx, deviceToken, bundleID, environment, keyPath, keyID, teamID, notif)
+		result, lastErr = s.Send(ctx, cred, deviceToken, notif)
+		if errors.Is(lastErr, ErrCircuitOpen) {
+			return nil, lastErr
+		}
 		if lastErr == nil {
 			if result.Success {
 				return result, nil
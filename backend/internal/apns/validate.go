@@ -0,0 +1,48 @@
+package apns
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"regexp"
+)
+
+// Team IDs and key IDs issued by Apple are 10 uppercase alphanumerics
+var appleIDPattern = regexp.MustCompile(`^[A-Z0-9]{10}$`)
+
+// ValidTeamID reports whether id looks like an Apple Developer Team ID
+func ValidTeamID(id string) bool {
+	return appleIDPattern.MatchString(id)
+}
+
+// ValidKeyID reports whether id looks like an APNs auth key ID
+func ValidKeyID(id string) bool {
+	return appleIDPattern.MatchString(id)
+}
+
+// ParseAuthKey parses a .p8 APNs auth key: a PEM-encoded PKCS#8 ECDSA key on
+// the P-256 curve
+func ParseAuthKey(keyData []byte) (*ecdsa.PrivateKey, error) {
+	block, _ := pem.Decode(keyData)
+	if block == nil {
+		return nil, fmt.Errorf("failed to decode PEM block")
+	}
+
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse private key: %w", err)
+	}
+
+	ecdsaKey, ok := key.(*ecdsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("key is not ECDSA")
+	}
+
+	if ecdsaKey.Curve != elliptic.P256() {
+		return nil, fmt.Errorf("key is not on the P-256 curve")
+	}
+
+	return ecdsaKey, nil
+}
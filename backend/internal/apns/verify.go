@@ -0,0 +1,68 @@
+package apns
+
+import (
+	"context"
+
+	"github.com/pushlab/backend/internal/models"
+	"github.com/sideshow/apns2"
+	"github.com/sideshow/apns2/payload"
+)
+
+// Verify checks that a credential can sign a provider token and, when a device
+// token is given, sends it a silent probe push and reports Apple's verdict
+func (c *Client) Verify(ctx context.Context, cred *models.APNsCredential, deviceToken string) *models.VerifyAPNsCredentialResponse {
+	result := &models.VerifyAPNsCredentialResponse{}
+
+	client, err := c.NewUncached(cred)
+	if err != nil {
+		result.Verdict = "Private key could not be loaded: " + err.Error()
+		return result
+	}
+	defer closeClient(client)
+	result.KeyValid = true
+
+	if client.Token != nil {
+		if _, err := client.Token.Generate(); err != nil {
+			result.Verdict = "Failed to sign provider token: " + err.Error()
+			return result
+		}
+		result.TokenSigned = true
+	}
+
+	if deviceToken == "" {
+		result.Verdict = "Credential loaded successfully; supply a device_token to test delivery"
+		return result
+	}
+
+	probe := &apns2.Notification{
+		DeviceToken: deviceToken,
+		Topic:       cred.BundleID,
+		PushType:    apns2.PushTypeBackground,
+		Priority:    apns2.PriorityLow,
+		Payload:     payload.NewPayload().ContentAvailable(),
+	}
+
+	res, err := client.PushWithContext(ctx, probe)
+	if err != nil {
+		result.Verdict = "Failed to reach APNs: " + err.Error()
+		return result
+	}
+
+	result.ProbeSent = true
+	result.StatusCode = res.StatusCode
+	result.Reason = res.Reason
+	result.APNsID = res.ApnsID
+
+	switch {
+	case res.Sent():
+		result.Verdict = "Accepted by APNs"
+	case IsProviderError(res.Reason):
+		result.Verdict = "APNs rejected the credential (" + res.Reason + ")"
+	case RejectsDeviceToken(res.StatusCode, res.Reason) || res.StatusCode == 410:
+		result.Verdict = "Credential accepted, but APNs rejected the device token (" + res.Reason + ")"
+	default:
+		result.Verdict = "APNs returned " + res.Reason
+	}
+
+	return result
+}
@@ -0,0 +1,77 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"strings"
+)
+
+const (
+	apiKeyScheme    = "pl_"
+	apiKeyPrefixLen = 12
+)
+
+// GenerateAPIKey generates a random API key of the form pl_<prefix>_<secret>.
+// The prefix identifies the key and may be shown; only the hash is stored.
+func GenerateAPIKey() (key, prefix string, hash []byte, err error) {
+	prefixBytes := make([]byte, apiKeyPrefixLen/2)
+	if _, err := rand.Read(prefixBytes); err != nil {
+		return "", "", nil, err
+	}
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", "", nil, err
+	}
+
+	prefix = hex.EncodeToString(prefixBytes)
+	key = apiKeyScheme + prefix + "_" + hex.EncodeToString(secret)
+	return key, prefix, HashAPIKey(key), nil
+}
+
+// APIKeyPrefix extracts the lookup prefix from a presented API key. Keys
+// issued before the pl_ format use their first 12 characters.
+func APIKeyPrefix(key string) (string, bool) {
+	if rest, ok := strings.CutPrefix(key, apiKeyScheme); ok {
+		prefix, _, found := strings.Cut(rest, "_")
+		if !found || len(prefix) != apiKeyPrefixLen {
+			return "", false
+		}
+		return prefix, true
+	}
+	if len(key) < apiKeyPrefixLen {
+		return "", false
+	}
+	return key[:apiKeyPrefixLen], true
+}
+
+// HashAPIKey returns the SHA-256 hash stored for an API key. Keys carry 256
+// bits of randomness, so a slow password hash is not needed.
+func HashAPIKey(key string) []byte {
+	return HashToken(key)
+}
+
+// CompareAPIKey reports whether key matches the stored hash in constant time
+func CompareAPIKey(key string, hash []byte) bool {
+	return subtle.ConstantTimeCompare(HashAPIKey(key), hash) == 1
+}
+
+// heartbeatTokenScheme marks device heartbeat tokens
+const heartbeatTokenScheme = "plhb_"
+
+// GenerateHeartbeatToken generates a random token that lets a single device
+// check in. Only the hash is stored.
+func GenerateHeartbeatToken() (token string, hash []byte, err error) {
+	secret, err := GenerateSecret()
+	if err != nil {
+		return "", nil, err
+	}
+	token = heartbeatTokenScheme + secret
+	return token, HashToken(token), nil
+}
+
+// CompareHeartbeatToken reports whether token matches the stored hash in
+// constant time
+func CompareHeartbeatToken(token string, hash []byte) bool {
+	return len(hash) > 0 && subtle.ConstantTimeCompare(HashToken(token), hash) == 1
+}
@@ -0,0 +1,128 @@
+package auth
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestGenerateAPIKey(t *testing.T) {
+	key, prefix, hash, err := GenerateAPIKey()
+	if err != nil {
+		t.Fatalf("GenerateAPIKey returned error: %v", err)
+	}
+
+	format := regexp.MustCompile(`^pl_[0-9a-f]{12}_[0-9a-f]{64}$`)
+	if !format.MatchString(key) {
+		t.Errorf("key %q is not of the form pl_<12 hex>_<64 hex>", key)
+	}
+	if got, ok := APIKeyPrefix(key); !ok || got != prefix {
+		t.Errorf("APIKeyPrefix(key) = %q, %v, want %q, true", got, ok, prefix)
+	}
+	sum := sha256.Sum256([]byte(key))
+	if !bytes.Equal(hash, sum[:]) {
+		t.Error("hash is not the SHA-256 of the key")
+	}
+	if !CompareAPIKey(key, hash) {
+		t.Error("CompareAPIKey rejected the generated key")
+	}
+
+	other, otherPrefix, _, err := GenerateAPIKey()
+	if err != nil {
+		t.Fatalf("GenerateAPIKey returned error: %v", err)
+	}
+	if other == key || otherPrefix == prefix {
+		t.Error("GenerateAPIKey returned the same key or prefix twice")
+	}
+}
+
+func TestAPIKeyPrefix(t *testing.T) {
+	secret := strings.Repeat("ab", 32)
+
+	tests := []struct {
+		name string
+		key  string
+		want string
+		ok   bool
+	}{
+		{"valid", "pl_0123456789ab_" + secret, "0123456789ab", true},
+		{"empty secret", "pl_0123456789ab_", "0123456789ab", true},
+		{"short prefix", "pl_0123456789a_" + secret, "", false},
+		{"long prefix", "pl_0123456789abc_" + secret, "", false},
+		{"no separator", "pl_0123456789ab" + secret, "", false},
+		{"scheme only", "pl_", "", false},
+		{"legacy", "legacykey0123456789", "legacykey012", true},
+		{"legacy of exactly 12 characters", "abcdefghijkl", "abcdefghijkl", true},
+		{"short legacy", "abcdefghijk", "", false},
+		{"empty", "", "", false},
+		{"other scheme", "PL_0123456789ab_" + secret, "PL_012345678", true},
+	}
+
+	for _, tt := range tests {
+		got, ok := APIKeyPrefix(tt.key)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("%s: APIKeyPrefix(%q) = %q, %v, want %q, %v", tt.name, tt.key, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestCompareAPIKey(t *testing.T) {
+	key := "pl_0123456789ab_" + strings.Repeat("ab", 32)
+	hash := HashAPIKey(key)
+
+	if !bytes.Equal(hash, HashAPIKey(key)) {
+		t.Fatal("HashAPIKey is not deterministic")
+	}
+
+	tests := []struct {
+		name string
+		key  string
+		hash []byte
+		ok   bool
+	}{
+		{"match", key, hash, true},
+		{"other key", key + "0", hash, false},
+		{"uppercase key", strings.ToUpper(key), hash, false},
+		{"truncated hash", key, hash[:16], false},
+		{"empty hash", key, nil, false},
+		{"empty key", "", hash, false},
+	}
+
+	for _, tt := range tests {
+		if got := CompareAPIKey(tt.key, tt.hash); got != tt.ok {
+			t.Errorf("%s: CompareAPIKey = %v, want %v", tt.name, got, tt.ok)
+		}
+	}
+}
+
+func TestHeartbeatToken(t *testing.T) {
+	token, hash, err := GenerateHeartbeatToken()
+	if err != nil {
+		t.Fatalf("GenerateHeartbeatToken returned error: %v", err)
+	}
+	if !regexp.MustCompile(`^plhb_[0-9a-f]{64}$`).MatchString(token) {
+		t.Errorf("token %q is not of the form plhb_<64 hex>", token)
+	}
+
+	tests := []struct {
+		name  string
+		token string
+		hash  []byte
+		ok    bool
+	}{
+		{"match", token, hash, true},
+		{"other token", token[:len(token)-1], hash, false},
+		{"empty hash", token, nil, false},
+		// Devices registered before heartbeat tokens have no hash; an empty
+		// token must not match it
+		{"empty token and hash", "", []byte{}, false},
+	}
+
+	for _, tt := range tests {
+		if got := CompareHeartbeatToken(tt.token, tt.hash); got != tt.ok {
+			t.Errorf("%s: CompareHeartbeatToken = %v, want %v", tt.name, got, tt.ok)
+		}
+	}
+}
@@ -2,6 +2,8 @@ package auth
 
 import (
 	"fmt"
+	"sort"
+	"sync"
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
@@ -11,6 +13,11 @@ import (
 type Claims struct {
 	UserID   uuid.UUID `json:"user_id"`
 	Username string    `json:"username"`
+	// SessionID identifies the refresh token family the token was issued for
+	SessionID uuid.UUID `json:"sid,omitempty"`
+	// ImpersonatorID is the admin acting as the user; such tokens are
+	// read-only
+	ImpersonatorID *uuid.UUID `json:"imp,omitempty"`
 	jwt.RegisteredClaims
 }
 
@@ -18,41 +25,149 @@ type JWTService struct {
 	secret       []byte
 	expiryHours  int
 	issuer       string
+	refreshTTL   time.Duration
+
+	// Asymmetric signing keys, newest first. When any are set,
+	// tokens are signed with the newest active key; HS256 tokens are still
+	// accepted while a secret is configured.
+	mu   sync.RWMutex
+	keys []*SigningKey
 }
 
-func NewJWTService(secret string, expiryHours int, issuer string) *JWTService {
+func NewJWTService(secret string, expiryHours int, issuer string, refreshTTL time.Duration) *JWTService {
 	return &JWTService{
 		secret:      []byte(secret),
 		expiryHours: expiryHours,
 		issuer:      issuer,
+		refreshTTL:  refreshTTL,
 	}
 }
 
-// GenerateToken creates a new JWT token for a user
-func (s *JWTService) GenerateToken(userID uuid.UUID, username string) (string, error) {
-	claims := Claims{
-		UserID:   userID,
-		Username: username,
-		RegisteredClaims: jwt.RegisteredClaims{
-			ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Duration(s.expiryHours) * time.Hour)),
-			IssuedAt:  jwt.NewNumericDate(time.Now()),
-			Issuer:    s.issuer,
-			Subject:   userID.String(),
-		},
+// RefreshTokenTTL is how long a refresh token issued alongside an access
+// token stays valid
+func (s *JWTService) RefreshTokenTTL() time.Duration {
+	return s.refreshTTL
+}
+
+// TokenLifetime is how long issued access tokens are valid
+func (s *JWTService) TokenLifetime() time.Duration {
+	return time.Duration(s.expiryHours) * time.Hour
+}
+
+// SetSigningKeys replaces the asymmetric keys used to sign and verify tokens.
+// Keys that are not active yet are only used for verification.
+func (s *JWTService) SetSigningKeys(keys []*SigningKey) {
+	sorted := append([]*SigningKey(nil), keys...)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].ActivatesAt.After(sorted[j].ActivatesAt)
+	})
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.keys = sorted
+}
+
+// JWKS returns the public keys that verify tokens issued by this service
+func (s *JWTService) JWKS() JWKS {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	jwks := JWKS{Keys: []JWK{}}
+	for _, key := range s.keys {
+		jwks.Keys = append(jwks.Keys, key.JWK())
 	}
+	return jwks
+}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	return token.SignedString(s.secret)
+// signingKey returns the newest active asymmetric key, or nil to sign with
+// the HMAC secret
+func (s *JWTService) signingKey() *SigningKey {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	now := time.Now()
+	for _, key := range s.keys {
+		if !key.ActivatesAt.After(now) {
+			return key
+		}
+	}
+	return nil
+}
+
+// verificationKey looks up an asymmetric key by ID
+func (s *JWTService) verificationKey(kid string) *SigningKey {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, key := range s.keys {
+		if key.KID == kid {
+			return key
+		}
+	}
+	return nil
+}
+
+// GenerateToken creates a new JWT token for a user within a session. Each
+// token gets a unique ID (jti) so it can be revoked individually.
+func (s *JWTService) GenerateToken(userID uuid.UUID, username string, sessionID uuid.UUID) (string, error) {
+	return s.sign(Claims{
+		UserID:    userID,
+		Username:  username,
+		SessionID: sessionID,
+	}, time.Duration(s.expiryHours)*time.Hour)
+}
+
+// GenerateImpersonationToken creates a token that lets an admin act as the
+// user for ttl
+func (s *JWTService) GenerateImpersonationToken(userID uuid.UUID, username string, sessionID, impersonatorID uuid.UUID, ttl time.Duration) (string, error) {
+	return s.sign(Claims{
+		UserID:         userID,
+		Username:       username,
+		SessionID:      sessionID,
+		ImpersonatorID: &impersonatorID,
+	}, ttl)
+}
+
+func (s *JWTService) sign(claims Claims, ttl time.Duration) (string, error) {
+	claims.RegisteredClaims = jwt.RegisteredClaims{
+		ID:        uuid.New().String(),
+		ExpiresAt: jwt.NewNumericDate(time.Now().Add(ttl)),
+		IssuedAt:  jwt.NewNumericDate(time.Now()),
+		Issuer:    s.issuer,
+		Subject:   claims.UserID.String(),
+	}
+
+	key := s.signingKey()
+	if key == nil {
+		token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+		return token.SignedString(s.secret)
+	}
+
+	token := jwt.NewWithClaims(jwt.GetSigningMethod(key.Algorithm), claims)
+	token.Header["kid"] = key.KID
+	return token.SignedString(key.Private)
 }
 
 // ValidateToken validates and parses a JWT token
 func (s *JWTService) ValidateToken(tokenString string) (*Claims, error) {
 	token, err := jwt.ParseWithClaims(tokenString, &Claims{}, func(token *jwt.Token) (interface{}, error) {
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+		if token.Method.Alg() == AlgHS256 {
+			if len(s.secret) == 0 {
+				return nil, fmt.Errorf("HS256 tokens are not accepted")
+			}
+			return s.secret, nil
+		}
+
+		kid, _ := token.Header["kid"].(string)
+		key := s.verificationKey(kid)
+		if key == nil {
+			return nil, fmt.Errorf("unknown signing key: %q", kid)
+		}
+		if token.Method.Alg() != key.Algorithm {
 			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
 		}
-		return s.secret, nil
-	})
+		return key.Public, nil
+	}, jwt.WithValidMethods([]string{AlgHS256, AlgRS256, AlgES256}))
 
 	if err != nil {
 		return nil, err
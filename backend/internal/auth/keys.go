@@ -0,0 +1,157 @@
+package auth
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/pushlab/backend/internal/keystore"
+	"github.com/pushlab/backend/internal/models"
+	"github.com/pushlab/backend/internal/repository"
+)
+
+// KeyManager keeps the JWT service's asymmetric signing keys in sync with the
+// database and rotates them on schedule. Every API instance runs one; the
+// database serializes rotations.
+type KeyManager struct {
+	repo             *repository.SigningKeyRepository
+	ks               *keystore.Keystore
+	jwtService       *JWTService
+	algorithm        string
+	rotationInterval time.Duration
+	refreshInterval  time.Duration
+}
+
+func NewKeyManager(
+	repo *repository.SigningKeyRepository,
+	ks *keystore.Keystore,
+	jwtService *JWTService,
+	algorithm string,
+	rotationInterval time.Duration,
+) *KeyManager {
+	return &KeyManager{
+		repo:             repo,
+		ks:               ks,
+		jwtService:       jwtService,
+		algorithm:        algorithm,
+		rotationInterval: rotationInterval,
+		refreshInterval:  time.Minute,
+	}
+}
+
+// retention is how long a retired key keeps verifying tokens: until the last
+// token signed with it, possibly by an instance that has not reloaded yet,
+// has expired
+func (m *KeyManager) retention() time.Duration {
+	return m.jwtService.TokenLifetime() + m.refreshInterval
+}
+
+// Load rotates the signing key if it is due, or right away when the
+// configured algorithm changed, and loads the current keys into the JWT
+// service
+func (m *KeyManager) Load(ctx context.Context) error {
+	stored, err := m.repo.GetUsable(ctx, m.retention())
+	if err != nil {
+		return err
+	}
+
+	// Keys are ordered newest first; the repository re-checks under a lock
+	if len(stored) == 0 || time.Since(stored[0].CreatedAt) >= m.rotationInterval ||
+		stored[0].Algorithm != m.algorithm {
+		if _, err := m.Rotate(ctx, false); err != nil {
+			return err
+		}
+		if stored, err = m.repo.GetUsable(ctx, m.retention()); err != nil {
+			return err
+		}
+	}
+
+	keys := make([]*SigningKey, 0, len(stored))
+	for i := range stored {
+		key, err := m.open(&stored[i])
+		if err != nil {
+			return err
+		}
+		keys = append(keys, key)
+	}
+
+	m.jwtService.SetSigningKeys(keys)
+	return nil
+}
+
+// Rotate creates a new signing key if the newest one is older than the
+// rotation interval or uses another algorithm, or unconditionally when force
+// is set. New keys are
+// published one refresh interval before they are used to sign.
+func (m *KeyManager) Rotate(ctx context.Context, force bool) (bool, error) {
+	key, err := GenerateSigningKey(m.algorithm)
+	if err != nil {
+		return false, err
+	}
+
+	private, public, err := MarshalSigningKey(key)
+	if err != nil {
+		return false, err
+	}
+
+	sealed, err := m.ks.Seal(private)
+	if err != nil {
+		return false, err
+	}
+
+	stored := &models.JWTSigningKey{
+		KID:                  key.KID,
+		Algorithm:            key.Algorithm,
+		PublicKey:            public,
+		PrivateKeyCiphertext: sealed.Ciphertext,
+		PrivateKeyDEK:        sealed.WrappedDEK,
+		KEKID:                sealed.KEKID,
+	}
+
+	interval := m.rotationInterval
+	if force {
+		interval = 0
+	}
+
+	rotated, err := m.repo.Rotate(ctx, stored, interval, 2*m.refreshInterval, m.retention())
+	if err != nil {
+		return false, err
+	}
+	if rotated {
+		log.Printf("Created JWT signing key %s (%s), active from %v", stored.KID, stored.Algorithm, stored.ActivatesAt)
+	}
+	return rotated, nil
+}
+
+// Start reloads keys and rotates them in the background until ctx is
+// cancelled
+func (m *KeyManager) Start(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(m.refreshInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if err := m.Load(ctx); err != nil {
+					log.Printf("Failed to refresh JWT signing keys: %v", err)
+				}
+			}
+		}
+	}()
+}
+
+func (m *KeyManager) open(stored *models.JWTSigningKey) (*SigningKey, error) {
+	private, err := m.ks.Open(&keystore.Sealed{
+		Ciphertext: stored.PrivateKeyCiphertext,
+		WrappedDEK: stored.PrivateKeyDEK,
+		KEKID:      stored.KEKID,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt signing key %s: %w", stored.KID, err)
+	}
+	return ParseSigningKey(stored.KID, stored.Algorithm, private, stored.ActivatesAt)
+}
@@ -0,0 +1,161 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"math/big"
+	"time"
+)
+
+// Supported JWT signing algorithms
+const (
+	AlgHS256 = "HS256"
+	AlgRS256 = "RS256"
+	AlgES256 = "ES256"
+)
+
+// IsAsymmetric reports whether tokens signed with alg can be verified with a
+// published public key
+func IsAsymmetric(alg string) bool {
+	return alg == AlgRS256 || alg == AlgES256
+}
+
+// SigningKey is an asymmetric key used to sign and verify access tokens
+type SigningKey struct {
+	KID         string
+	Algorithm   string
+	Private     crypto.PrivateKey
+	Public      crypto.PublicKey
+	ActivatesAt time.Time
+}
+
+// GenerateSigningKey creates a new RS256 (RSA 2048) or ES256 (P-256) key with
+// a random key ID
+func GenerateSigningKey(alg string) (*SigningKey, error) {
+	var private crypto.Signer
+	var err error
+	switch alg {
+	case AlgRS256:
+		private, err = rsa.GenerateKey(rand.Reader, 2048)
+	case AlgES256:
+		private, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	default:
+		return nil, fmt.Errorf("unsupported signing algorithm: %s", alg)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate signing key: %w", err)
+	}
+
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+
+	return &SigningKey{
+		KID:       hex.EncodeToString(id),
+		Algorithm: alg,
+		Private:   private,
+		Public:    private.Public(),
+	}, nil
+}
+
+// MarshalSigningKey encodes the key pair as PKCS#8 (private) and PKIX
+// (public) DER
+func MarshalSigningKey(key *SigningKey) (private, public []byte, err error) {
+	private, err = x509.MarshalPKCS8PrivateKey(key.Private)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to encode private key: %w", err)
+	}
+	public, err = x509.MarshalPKIXPublicKey(key.Public)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to encode public key: %w", err)
+	}
+	return private, public, nil
+}
+
+// ParseSigningKey decodes a PKCS#8 private key and checks it matches alg
+func ParseSigningKey(kid, alg string, private []byte, activatesAt time.Time) (*SigningKey, error) {
+	parsed, err := x509.ParsePKCS8PrivateKey(private)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse signing key %s: %w", kid, err)
+	}
+
+	signer, ok := parsed.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("signing key %s is not a signing key", kid)
+	}
+
+	switch signer.(type) {
+	case *rsa.PrivateKey:
+		ok = alg == AlgRS256
+	case *ecdsa.PrivateKey:
+		ok = alg == AlgES256
+	default:
+		ok = false
+	}
+	if !ok {
+		return nil, fmt.Errorf("signing key %s does not match algorithm %s", kid, alg)
+	}
+
+	return &SigningKey{
+		KID:         kid,
+		Algorithm:   alg,
+		Private:     signer,
+		Public:      signer.Public(),
+		ActivatesAt: activatesAt,
+	}, nil
+}
+
+// JWK is a public key in JSON Web Key format (RFC 7517)
+type JWK struct {
+	KeyType   string `json:"kty"`
+	Use       string `json:"use"`
+	Algorithm string `json:"alg"`
+	KeyID     string `json:"kid"`
+	// RSA
+	N string `json:"n,omitempty"`
+	E string `json:"e,omitempty"`
+	// EC
+	Curve string `json:"crv,omitempty"`
+	X     string `json:"x,omitempty"`
+	Y     string `json:"y,omitempty"`
+}
+
+// JWKS is a JSON Web Key Set, as served at /.well-known/jwks.json
+type JWKS struct {
+	Keys []JWK `json:"keys"`
+}
+
+// JWK returns the public half of the key
+func (k *SigningKey) JWK() JWK {
+	jwk := JWK{
+		Use:       "sig",
+		Algorithm: k.Algorithm,
+		KeyID:     k.KID,
+	}
+
+	switch pub := k.Public.(type) {
+	case *rsa.PublicKey:
+		jwk.KeyType = "RSA"
+		jwk.N = encodeBase64URL(pub.N.Bytes())
+		jwk.E = encodeBase64URL(big.NewInt(int64(pub.E)).Bytes())
+	case *ecdsa.PublicKey:
+		size := (pub.Curve.Params().BitSize + 7) / 8
+		jwk.KeyType = "EC"
+		jwk.Curve = pub.Curve.Params().Name
+		jwk.X = encodeBase64URL(pub.X.FillBytes(make([]byte, size)))
+		jwk.Y = encodeBase64URL(pub.Y.FillBytes(make([]byte, size)))
+	}
+	return jwk
+}
+
+func encodeBase64URL(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
@@ -0,0 +1,184 @@
+package auth
+
+import (
+	"bytes"
+	"encoding/base32"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+// rfc6238Secret is the SHA-1 seed of the RFC 6238 test vectors,
+// "12345678901234567890", base32 encoded
+const rfc6238Secret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+func TestTOTPCodeRFC6238(t *testing.T) {
+	key := []byte("12345678901234567890")
+
+	// RFC 6238 appendix B, SHA-1, truncated to the six digits we use
+	tests := []struct {
+		unix int64
+		want string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	}
+
+	for _, tt := range tests {
+		step := tt.unix / int64(totpPeriod.Seconds())
+		if got := totpCode(key, step); got != tt.want {
+			t.Errorf("totpCode at %d = %s, want %s", tt.unix, got, tt.want)
+		}
+
+		gotStep, ok := ValidateTOTP(rfc6238Secret, tt.want, time.Unix(tt.unix, 0))
+		if !ok || gotStep != step {
+			t.Errorf("ValidateTOTP(%s) at %d = %d, %v, want %d, true", tt.want, tt.unix, gotStep, ok, step)
+		}
+	}
+}
+
+func TestValidateTOTPSkew(t *testing.T) {
+	// The code for T = 1111111109 belongs to step 37037036, which spans
+	// 1111111080-1111111109. With a skew of one step it is accepted from the
+	// start of the previous step to the end of the next one.
+	const code = "081804"
+	const step = 37037036
+
+	tests := []struct {
+		unix int64
+		ok   bool
+	}{
+		{1111111049, false}, // two steps early
+		{1111111050, true},  // first second of the previous step
+		{1111111079, true},
+		{1111111080, true}, // the code's own step
+		{1111111109, true},
+		{1111111110, true}, // next step
+		{1111111139, true}, // last second of the next step
+		{1111111140, false},
+		{1111111170, false},
+	}
+
+	for _, tt := range tests {
+		gotStep, ok := ValidateTOTP(rfc6238Secret, code, time.Unix(tt.unix, 0))
+		if ok != tt.ok {
+			t.Errorf("ValidateTOTP at %d = %v, want %v", tt.unix, ok, tt.ok)
+			continue
+		}
+		if ok && gotStep != step {
+			t.Errorf("ValidateTOTP at %d returned step %d, want %d", tt.unix, gotStep, step)
+		}
+	}
+}
+
+func TestValidateTOTPInput(t *testing.T) {
+	now := time.Unix(1111111109, 0)
+
+	tests := []struct {
+		name   string
+		secret string
+		code   string
+		ok     bool
+	}{
+		{"valid", rfc6238Secret, "081804", true},
+		{"spaces", rfc6238Secret, "081 804", true},
+		{"lowercase secret", strings.ToLower(rfc6238Secret), "081804", true},
+		{"wrong code", rfc6238Secret, "081805", false},
+		{"too short", rfc6238Secret, "81804", false},
+		{"too long", rfc6238Secret, "0081804", false},
+		{"eight digit code", rfc6238Secret, "07081804", false},
+		{"empty", rfc6238Secret, "", false},
+		{"letters", rfc6238Secret, "o81804", false},
+		{"invalid secret", "not base32!", "081804", false},
+		{"padded secret", rfc6238Secret + "====", "081804", false},
+		{"other secret", "JBSWY3DPEHPK3PXP", "081804", false},
+	}
+
+	for _, tt := range tests {
+		if _, ok := ValidateTOTP(tt.secret, tt.code, now); ok != tt.ok {
+			t.Errorf("%s: ValidateTOTP(%q, %q) = %v, want %v", tt.name, tt.secret, tt.code, ok, tt.ok)
+		}
+	}
+}
+
+func TestGenerateTOTPSecret(t *testing.T) {
+	secret, err := GenerateTOTPSecret()
+	if err != nil {
+		t.Fatalf("GenerateTOTPSecret returned error: %v", err)
+	}
+	key, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(secret)
+	if err != nil {
+		t.Fatalf("secret %q is not unpadded base32: %v", secret, err)
+	}
+	if len(key) != 20 {
+		t.Errorf("secret has %d bytes, want 20", len(key))
+	}
+
+	now := time.Now()
+	code := totpCode(key, now.Unix()/int64(totpPeriod.Seconds()))
+	if _, ok := ValidateTOTP(secret, code, now); !ok {
+		t.Error("the current code of a generated secret does not validate")
+	}
+}
+
+func TestTOTPProvisioningURI(t *testing.T) {
+	uri := TOTPProvisioningURI(rfc6238Secret, "PushLab", "alice@example.com")
+
+	parsed, err := url.Parse(uri)
+	if err != nil {
+		t.Fatalf("invalid URI %q: %v", uri, err)
+	}
+	if parsed.Scheme != "otpauth" || parsed.Host != "totp" || parsed.Path != "/PushLab:alice@example.com" {
+		t.Errorf("URI %q does not name the TOTP account", uri)
+	}
+
+	query := parsed.Query()
+	want := map[string]string{
+		"secret": rfc6238Secret, "issuer": "PushLab", "algorithm": "SHA1", "digits": "6", "period": "30",
+	}
+	for param, value := range want {
+		if got := query.Get(param); got != value {
+			t.Errorf("%s = %q, want %q", param, got, value)
+		}
+	}
+}
+
+func TestRecoveryCodes(t *testing.T) {
+	codes, err := GenerateRecoveryCodes(10)
+	if err != nil {
+		t.Fatalf("GenerateRecoveryCodes returned error: %v", err)
+	}
+	if len(codes) != 10 {
+		t.Fatalf("got %d codes, want 10", len(codes))
+	}
+
+	format := regexp.MustCompile(`^[a-z2-7]{5}-[a-z2-7]{5}$`)
+	seen := make(map[string]bool)
+	for _, code := range codes {
+		if !format.MatchString(code) {
+			t.Errorf("code %q is not of the form xxxxx-xxxxx", code)
+		}
+		if seen[code] {
+			t.Errorf("code %q generated twice", code)
+		}
+		seen[code] = true
+	}
+
+	hash := HashRecoveryCode("abcde-fghij")
+	for _, typed := range []string{"abcde-fghij", "ABCDE-FGHIJ", "abcdefghij", "abcde fghij", " abc-de fgh-ij "} {
+		if !bytes.Equal(HashRecoveryCode(typed), hash) {
+			t.Errorf("HashRecoveryCode(%q) differs from the hash of abcde-fghij", typed)
+		}
+	}
+	for _, typed := range []string{"abcde-fghik", "abcdefghi", ""} {
+		if bytes.Equal(HashRecoveryCode(typed), hash) {
+			t.Errorf("HashRecoveryCode(%q) matches the hash of abcde-fghij", typed)
+		}
+	}
+}
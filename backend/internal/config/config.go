@@ -10,13 +10,20 @@ import (
 )
 
 type Config struct {
-	Server   ServerConfig   `yaml:"server"`
-	Database DatabaseConfig `yaml:"database"`
-	RabbitMQ RabbitMQConfig `yaml:"rabbitmq"`
-	Redis    RedisConfig    `yaml:"redis"`
-	JWT      JWTConfig      `yaml:"jwt"`
-	APNs     APNsConfig     `yaml:"apns"`
-	Logging  LoggingConfig  `yaml:"logging"`
+	Server     ServerConfig     `yaml:"server"`
+	Database   DatabaseConfig   `yaml:"database"`
+	RabbitMQ   RabbitMQConfig   `yaml:"rabbitmq"`
+	Redis      RedisConfig      `yaml:"redis"`
+	RateLimit  RateLimitConfig  `yaml:"rate_limit"`
+	Quotas     QuotaConfig      `yaml:"quotas"`
+	JWT        JWTConfig        `yaml:"jwt"`
+	OIDC       OIDCConfig       `yaml:"oidc"`
+	Accounts   AccountsConfig   `yaml:"accounts"`
+	Mail       MailConfig       `yaml:"mail"`
+	APNs       APNsConfig       `yaml:"apns"`
+	Devices    DevicesConfig    `yaml:"devices"`
+	Encryption EncryptionConfig `yaml:"encryption"`
+	Logging    LoggingConfig    `yaml:"logging"`
 }
 
 type ServerConfig struct {
@@ -54,16 +61,160 @@ type RedisConfig struct {
 	Enabled  bool   `yaml:"enabled"`
 }
 
+// RateLimitConfig limits requests per API key, or per user for sessions,
+// with a token bucket per route. Buckets live in Redis when it is enabled.
+type RateLimitConfig struct {
+	Default RateLimit `yaml:"default"`
+	// Routes overrides the default by method and route pattern, e.g.
+	// "POST /api/v1/notify"
+	Routes map[string]RateLimit `yaml:"routes"`
+}
+
+type RateLimit struct {
+	RequestsPerMinute int `yaml:"requests_per_minute"`
+	Burst             int `yaml:"burst"`
+}
+
+// QuotaConfig caps the pushes each user sends per UTC day and month; 0
+// means unlimited. Admins can override them per user.
+type QuotaConfig struct {
+	Daily   int64 `yaml:"daily"`
+	Monthly int64 `yaml:"monthly"`
+}
+
+func (r RedisConfig) Addr() string {
+	return fmt.Sprintf("%s:%d", r.Host, r.Port)
+}
+
 type JWTConfig struct {
-	Secret       string `yaml:"secret"`
-	ExpiryHours  int    `yaml:"expiry_hours"`
-	Issuer       string `yaml:"issuer"`
+	Secret      string `yaml:"secret"`
+	ExpiryHours int    `yaml:"expiry_hours"`
+	Issuer      string `yaml:"issuer"`
+	// RefreshTokenTTL is how long a refresh token can be used; each refresh
+	// issues a new one
+	RefreshTokenTTL time.Duration `yaml:"refresh_token_ttl"`
+	// Algorithm signs access tokens: HS256 with the shared secret, or RS256 /
+	// ES256 with rotating keys published at /.well-known/jwks.json
+	Algorithm string `yaml:"algorithm"`
+	// RotationInterval is how often a new RS256/ES256 signing key is created
+	RotationInterval time.Duration `yaml:"rotation_interval"`
+}
+
+// OIDCConfig enables single sign-on through an OpenID Connect provider
+type OIDCConfig struct {
+	Enabled      bool   `yaml:"enabled"`
+	IssuerURL    string `yaml:"issuer_url"`
+	ClientID     string `yaml:"client_id"`
+	ClientSecret string `yaml:"client_secret"`
+	// RedirectURL is PushLab's callback, e.g.
+	// https://push.example.com/api/v1/auth/oidc/callback
+	RedirectURL string   `yaml:"redirect_url"`
+	Scopes      []string `yaml:"scopes"`
+	// AllowedRedirectURIs lists where clients may ask to receive tokens after
+	// login, e.g. the iOS app's pushlab://auth URL
+	AllowedRedirectURIs []string `yaml:"allowed_redirect_uris"`
+	// AutoProvision creates PushLab users for identities without an account
+	AutoProvision bool `yaml:"auto_provision"`
+}
+
+// AccountsConfig controls password reset, email verification and login
+// lockout
+type AccountsConfig struct {
+	PasswordResetTTL     time.Duration `yaml:"password_reset_ttl"`
+	EmailVerificationTTL time.Duration `yaml:"email_verification_ttl"`
+	Lockout              LockoutConfig `yaml:"lockout"`
+}
+
+// LockoutConfig rejects logins for a username or client IP after too many
+// failures within Window
+type LockoutConfig struct {
+	MaxAccountFailures int           `yaml:"max_account_failures"`
+	MaxIPFailures      int           `yaml:"max_ip_failures"`
+	Window             time.Duration `yaml:"window"`
+}
+
+// MailConfig selects how account emails are delivered: "smtp", or "log" to
+// print them during development
+type MailConfig struct {
+	Driver string `yaml:"driver"`
+	From   string `yaml:"from"`
+	// PublicURL is where users reach the API, used for links in emails
+	PublicURL string     `yaml:"public_url"`
+	SMTP      SMTPConfig `yaml:"smtp"`
+}
+
+type SMTPConfig struct {
+	Host     string `yaml:"host"`
+	Port     int    `yaml:"port"`
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
 }
 
 type APNsConfig struct {
-	DefaultEnvironment  string `yaml:"default_environment"`
-	ConnectionPoolSize  int    `yaml:"connection_pool_size"`
-	MaxConcurrentPushes int    `yaml:"max_concurrent_pushes"`
+	DefaultEnvironment  string               `yaml:"default_environment"`
+	ConnectionPoolSize  int                  `yaml:"connection_pool_size"`
+	MaxConcurrentPushes int                  `yaml:"max_concurrent_pushes"`
+	CircuitBreaker      CircuitBreakerConfig `yaml:"circuit_breaker"`
+	// TokenFailureThreshold is the number of consecutive failed deliveries
+	// after which a device token is marked invalid
+	TokenFailureThreshold int `yaml:"token_failure_threshold"`
+	// ClientIdleTTL is how long an unused APNs client stays cached
+	ClientIdleTTL    time.Duration          `yaml:"client_idle_ttl"`
+	CredentialHealth CredentialHealthConfig `yaml:"credential_health"`
+}
+
+type CredentialHealthConfig struct {
+	// ErrorThreshold is the number of consecutive errors after which a
+	// credential is reported as failing and its owner is alerted
+	ErrorThreshold int `yaml:"error_threshold"`
+	// ExpiryWarning is how long before a certificate expires to alert
+	ExpiryWarning time.Duration `yaml:"expiry_warning"`
+	// CheckInterval is how often the worker looks for expiring certificates
+	CheckInterval time.Duration `yaml:"check_interval"`
+}
+
+type CircuitBreakerConfig struct {
+	FailureThreshold    int           `yaml:"failure_threshold"`
+	OpenTimeout         time.Duration `yaml:"open_timeout"`
+	HalfOpenMaxRequests int           `yaml:"half_open_max_requests"`
+	DeferDelay          time.Duration `yaml:"defer_delay"`
+	MaxDeferrals        int           `yaml:"max_deferrals"`
+	StateTTL            time.Duration `yaml:"state_ttl"`
+}
+
+type DevicesConfig struct {
+	Lifecycle DeviceLifecycleConfig  `yaml:"lifecycle"`
+	Heartbeat HeartbeatMonitorConfig `yaml:"heartbeat"`
+}
+
+// HeartbeatMonitorConfig enables the worker's alerts about devices that miss
+// their heartbeat window
+type HeartbeatMonitorConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// CheckInterval is how often the worker looks for missed heartbeats
+	CheckInterval time.Duration `yaml:"check_interval"`
+}
+
+// DeviceLifecycleConfig sets when the worker's janitor marks devices stale
+// that stopped checking in, and deletes devices whose tokens have all been
+// invalid for a while. The API reports what the policy would prune even while
+// the janitor is disabled.
+type DeviceLifecycleConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// StaleAfterDays is how long a device may go without checking in
+	StaleAfterDays int `yaml:"stale_after_days"`
+	// DeleteInvalidAfterDays is how long a device is kept without a valid
+	// token
+	DeleteInvalidAfterDays int `yaml:"delete_invalid_after_days"`
+	// CheckInterval is how often the janitor runs
+	CheckInterval time.Duration `yaml:"check_interval"`
+}
+
+// EncryptionConfig holds the master key used to encrypt secrets at rest. The
+// key is 32 random bytes, base64 encoded, given inline or in a file.
+type EncryptionConfig struct {
+	MasterKey     string `yaml:"master_key"`
+	MasterKeyFile string `yaml:"master_key_file"`
 }
 
 type LoggingConfig struct {
@@ -104,15 +255,115 @@ func Load(path string) (*Config, error) {
 	if cfg.RabbitMQ.PrefetchCount == 0 {
 		cfg.RabbitMQ.PrefetchCount = 10
 	}
+	if cfg.Redis.Port == 0 {
+		cfg.Redis.Port = 6379
+	}
+	if cfg.RateLimit.Default.RequestsPerMinute == 0 {
+		cfg.RateLimit.Default.RequestsPerMinute = 600
+	}
+	if cfg.RateLimit.Default.Burst == 0 {
+		cfg.RateLimit.Default.Burst = 100
+	}
+	if cfg.RateLimit.Routes == nil {
+		cfg.RateLimit.Routes = map[string]RateLimit{
+			"POST /api/v1/notify":                    {RequestsPerMinute: 60, Burst: 20},
+			"POST /api/v1/notify/device/{device_id}": {RequestsPerMinute: 120, Burst: 30},
+			"POST /api/v1/topics/{name}":             {RequestsPerMinute: 60, Burst: 20},
+		}
+	}
 	if cfg.JWT.ExpiryHours == 0 {
 		cfg.JWT.ExpiryHours = 24
 	}
+	if cfg.JWT.RefreshTokenTTL == 0 {
+		cfg.JWT.RefreshTokenTTL = 30 * 24 * time.Hour
+	}
+	if cfg.JWT.Algorithm == "" {
+		cfg.JWT.Algorithm = "HS256"
+	}
+	if cfg.JWT.RotationInterval == 0 {
+		cfg.JWT.RotationInterval = 30 * 24 * time.Hour
+	}
+	if len(cfg.OIDC.Scopes) == 0 {
+		cfg.OIDC.Scopes = []string{"openid", "profile", "email"}
+	}
+	if cfg.Accounts.PasswordResetTTL == 0 {
+		cfg.Accounts.PasswordResetTTL = time.Hour
+	}
+	if cfg.Accounts.EmailVerificationTTL == 0 {
+		cfg.Accounts.EmailVerificationTTL = 48 * time.Hour
+	}
+	if cfg.Accounts.Lockout.MaxAccountFailures == 0 {
+		cfg.Accounts.Lockout.MaxAccountFailures = 5
+	}
+	if cfg.Accounts.Lockout.MaxIPFailures == 0 {
+		cfg.Accounts.Lockout.MaxIPFailures = 20
+	}
+	if cfg.Accounts.Lockout.Window == 0 {
+		cfg.Accounts.Lockout.Window = 15 * time.Minute
+	}
+	if cfg.Mail.Driver == "" {
+		cfg.Mail.Driver = "log"
+	}
+	if cfg.Mail.From == "" {
+		cfg.Mail.From = "PushLab <noreply@localhost>"
+	}
+	if cfg.Mail.PublicURL == "" {
+		cfg.Mail.PublicURL = fmt.Sprintf("http://localhost:%d", cfg.Server.APIPort)
+	}
+	if cfg.Mail.SMTP.Port == 0 {
+		cfg.Mail.SMTP.Port = 587
+	}
 	if cfg.APNs.ConnectionPoolSize == 0 {
 		cfg.APNs.ConnectionPoolSize = 5
 	}
 	if cfg.APNs.MaxConcurrentPushes == 0 {
 		cfg.APNs.MaxConcurrentPushes = 100
 	}
+	if cfg.APNs.ClientIdleTTL == 0 {
+		cfg.APNs.ClientIdleTTL = time.Hour
+	}
+	if cfg.APNs.TokenFailureThreshold == 0 {
+		cfg.APNs.TokenFailureThreshold = 5
+	}
+	if cfg.APNs.CredentialHealth.ErrorThreshold == 0 {
+		cfg.APNs.CredentialHealth.ErrorThreshold = 10
+	}
+	if cfg.APNs.CredentialHealth.ExpiryWarning == 0 {
+		cfg.APNs.CredentialHealth.ExpiryWarning = 30 * 24 * time.Hour
+	}
+	if cfg.APNs.CredentialHealth.CheckInterval == 0 {
+		cfg.APNs.CredentialHealth.CheckInterval = time.Hour
+	}
+	if cfg.APNs.CircuitBreaker.FailureThreshold == 0 {
+		cfg.APNs.CircuitBreaker.FailureThreshold = 5
+	}
+	if cfg.APNs.CircuitBreaker.OpenTimeout == 0 {
+		cfg.APNs.CircuitBreaker.OpenTimeout = 30 * time.Second
+	}
+	if cfg.APNs.CircuitBreaker.HalfOpenMaxRequests == 0 {
+		cfg.APNs.CircuitBreaker.HalfOpenMaxRequests = 1
+	}
+	if cfg.APNs.CircuitBreaker.DeferDelay == 0 {
+		cfg.APNs.CircuitBreaker.DeferDelay = 30 * time.Second
+	}
+	if cfg.APNs.CircuitBreaker.MaxDeferrals == 0 {
+		cfg.APNs.CircuitBreaker.MaxDeferrals = 20
+	}
+	if cfg.APNs.CircuitBreaker.StateTTL == 0 {
+		cfg.APNs.CircuitBreaker.StateTTL = 10 * time.Minute
+	}
+	if cfg.Devices.Lifecycle.StaleAfterDays == 0 {
+		cfg.Devices.Lifecycle.StaleAfterDays = 90
+	}
+	if cfg.Devices.Lifecycle.DeleteInvalidAfterDays == 0 {
+		cfg.Devices.Lifecycle.DeleteInvalidAfterDays = 180
+	}
+	if cfg.Devices.Lifecycle.CheckInterval == 0 {
+		cfg.Devices.Lifecycle.CheckInterval = 6 * time.Hour
+	}
+	if cfg.Devices.Heartbeat.CheckInterval == 0 {
+		cfg.Devices.Heartbeat.CheckInterval = time.Minute
+	}
 
 	return &cfg, nil
 }
@@ -138,12 +389,52 @@ func (c *Config) Validate() error {
 	if c.RabbitMQ.URL == "" {
 		return fmt.Errorf("rabbitmq url is required")
 	}
-	if c.JWT.Secret == "" || c.JWT.Secret == "${JWT_SECRET}" {
-		return fmt.Errorf("jwt secret is required (set JWT_SECRET environment variable)")
+	switch c.JWT.Algorithm {
+	case "HS256":
+		if c.JWT.Secret == "" || c.JWT.Secret == "${JWT_SECRET}" {
+			return fmt.Errorf("jwt secret is required (set JWT_SECRET environment variable)")
+		}
+	case "RS256", "ES256":
+		// The secret is optional and only verifies tokens issued before
+		// switching to asymmetric signing
+	default:
+		return fmt.Errorf("jwt algorithm must be HS256, RS256 or ES256")
 	}
-	if !strings.HasPrefix(c.JWT.Secret, "${") && len(c.JWT.Secret) < 32 {
+	if c.JWT.Secret != "" && !strings.HasPrefix(c.JWT.Secret, "${") && len(c.JWT.Secret) < 32 {
 		return fmt.Errorf("jwt secret must be at least 32 characters")
 	}
+	if c.Redis.Enabled && c.Redis.Host == "" {
+		return fmt.Errorf("redis host is required when redis is enabled")
+	}
+	if c.RateLimit.Default.RequestsPerMinute < 0 || c.RateLimit.Default.Burst < 0 {
+		return fmt.Errorf("rate_limit default requests_per_minute and burst must be positive")
+	}
+	for route, limit := range c.RateLimit.Routes {
+		if limit.RequestsPerMinute <= 0 || limit.Burst <= 0 {
+			return fmt.Errorf("rate_limit route %q needs positive requests_per_minute and burst", route)
+		}
+	}
+	if c.Quotas.Daily < 0 || c.Quotas.Monthly < 0 {
+		return fmt.Errorf("quotas cannot be negative")
+	}
+	if c.Devices.Lifecycle.StaleAfterDays < 0 || c.Devices.Lifecycle.DeleteInvalidAfterDays < 0 {
+		return fmt.Errorf("devices lifecycle days must be positive")
+	}
+	if c.OIDC.Enabled && (c.OIDC.IssuerURL == "" || c.OIDC.ClientID == "" || c.OIDC.RedirectURL == "") {
+		return fmt.Errorf("oidc issuer_url, client_id and redirect_url are required when oidc is enabled")
+	}
+	switch c.Mail.Driver {
+	case "log":
+	case "smtp":
+		if c.Mail.SMTP.Host == "" {
+			return fmt.Errorf("mail smtp host is required when the smtp driver is used")
+		}
+	default:
+		return fmt.Errorf("mail driver must be smtp or log")
+	}
+	if c.Encryption.MasterKey == "" && c.Encryption.MasterKeyFile == "" {
+		return fmt.Errorf("encryption master key is required (set PUSHLAB_MASTER_KEY or encryption.master_key_file)")
+	}
 
 	return nil
 }
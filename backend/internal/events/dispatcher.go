@@ -0,0 +1,126 @@
+package events
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/pushlab/backend/internal/repository"
+)
+
+// Event types delivered to webhooks
+const (
+	DeviceTokenInvalidated = "device.token_invalidated"
+)
+
+// Types lists every event type a webhook may subscribe to
+var Types = []string{
+	DeviceTokenInvalidated,
+}
+
+type Event struct {
+	ID        uuid.UUID   `json:"id"`
+	Type      string      `json:"type"`
+	OrgID     uuid.UUID   `json:"org_id"`
+	CreatedAt time.Time   `json:"created_at"`
+	Data      interface{} `json:"data"`
+}
+
+// Dispatcher delivers events to the webhooks an organization has registered
+// for them
+type Dispatcher struct {
+	webhookRepo *repository.WebhookRepository
+	httpClient  *http.Client
+}
+
+func NewDispatcher(webhookRepo *repository.WebhookRepository) *Dispatcher {
+	return &Dispatcher{
+		webhookRepo: webhookRepo,
+		httpClient:  &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// Dispatch sends the event to every matching webhook in the background.
+// Delivery is best effort; failures are logged.
+func (d *Dispatcher) Dispatch(orgID uuid.UUID, eventType string, data interface{}) {
+	event := Event{
+		ID:        uuid.New(),
+		Type:      eventType,
+		OrgID:     orgID,
+		CreatedAt: time.Now().UTC(),
+		Data:      data,
+	}
+
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+
+		webhooks, err := d.webhookRepo.GetByOrgAndEvent(ctx, orgID, eventType)
+		if err != nil {
+			log.Printf("Failed to load webhooks for event %s: %v", eventType, err)
+			return
+		}
+		if len(webhooks) == 0 {
+			return
+		}
+
+		body, err := json.Marshal(event)
+		if err != nil {
+			log.Printf("Failed to marshal event %s: %v", event.ID, err)
+			return
+		}
+
+		for _, webhook := range webhooks {
+			if err := d.post(ctx, webhook.URL, webhook.Secret, eventType, body); err != nil {
+				log.Printf("Failed to deliver event %s to webhook %s: %v", event.ID, webhook.ID, err)
+			}
+		}
+	}()
+}
+
+func (d *Dispatcher) post(ctx context.Context, url, secret, eventType string, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-PushLab-Event", eventType)
+	req.Header.Set("X-PushLab-Signature", "sha256="+Sign(secret, body))
+
+	resp, err := d.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// Sign returns the hex-encoded HMAC-SHA256 of body using the webhook secret
+func Sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// IsValidType reports whether eventType is a known event type
+func IsValidType(eventType string) bool {
+	for _, t := range Types {
+		if t == eventType {
+			return true
+		}
+	}
+	return false
+}
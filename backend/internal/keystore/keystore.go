@@ -0,0 +1,185 @@
+package keystore
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Keystore implements envelope encryption: every secret is encrypted with its
+// own random data encryption key (DEK), and the DEK is wrapped with the master
+// key encryption key (KEK). Rotating the master key only re-wraps DEKs.
+type Keystore struct {
+	kek   []byte
+	kekID string
+}
+
+// Sealed is an encrypted secret together with its wrapped DEK
+type Sealed struct {
+	Ciphertext []byte
+	WrappedDEK []byte
+	KEKID      string
+}
+
+// New creates a keystore from a 32-byte master key
+func New(masterKey []byte) (*Keystore, error) {
+	if len(masterKey) != 32 {
+		return nil, fmt.Errorf("master key must be 32 bytes, got %d", len(masterKey))
+	}
+
+	sum := sha256.Sum256(masterKey)
+	return &Keystore{
+		kek:   masterKey,
+		kekID: hex.EncodeToString(sum[:8]),
+	}, nil
+}
+
+// Load creates a keystore from a base64-encoded master key, or from a file
+// containing one when masterKey is empty
+func Load(masterKey, masterKeyFile string) (*Keystore, error) {
+	encoded := strings.TrimSpace(masterKey)
+	if encoded == "" && masterKeyFile != "" {
+		data, err := os.ReadFile(masterKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read master key file: %w", err)
+		}
+		encoded = strings.TrimSpace(string(data))
+	}
+	if encoded == "" {
+		return nil, fmt.Errorf("no master key configured")
+	}
+
+	key, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("master key is not valid base64: %w", err)
+	}
+
+	return New(key)
+}
+
+// GenerateMasterKey returns a new random base64-encoded master key
+func GenerateMasterKey() (string, error) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(key), nil
+}
+
+// KEKID identifies the master key without revealing it
+func (k *Keystore) KEKID() string {
+	return k.kekID
+}
+
+// Seal encrypts plaintext under a fresh DEK
+func (k *Keystore) Seal(plaintext []byte) (*Sealed, error) {
+	dek := make([]byte, 32)
+	if _, err := rand.Read(dek); err != nil {
+		return nil, fmt.Errorf("failed to generate data key: %w", err)
+	}
+
+	ciphertext, err := encrypt(dek, plaintext)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encrypt secret: %w", err)
+	}
+
+	wrapped, err := encrypt(k.kek, dek)
+	if err != nil {
+		return nil, fmt.Errorf("failed to wrap data key: %w", err)
+	}
+
+	return &Sealed{
+		Ciphertext: ciphertext,
+		WrappedDEK: wrapped,
+		KEKID:      k.kekID,
+	}, nil
+}
+
+// Open decrypts a sealed secret
+func (k *Keystore) Open(sealed *Sealed) ([]byte, error) {
+	dek, err := k.unwrap(sealed)
+	if err != nil {
+		return nil, err
+	}
+
+	plaintext, err := decrypt(dek, sealed.Ciphertext)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt secret: %w", err)
+	}
+	return plaintext, nil
+}
+
+// Rewrap re-encrypts the sealed secret's DEK under the master key of next.
+// The secret itself is not re-encrypted.
+func (k *Keystore) Rewrap(sealed *Sealed, next *Keystore) (*Sealed, error) {
+	dek, err := k.unwrap(sealed)
+	if err != nil {
+		return nil, err
+	}
+
+	wrapped, err := encrypt(next.kek, dek)
+	if err != nil {
+		return nil, fmt.Errorf("failed to wrap data key: %w", err)
+	}
+
+	return &Sealed{
+		Ciphertext: sealed.Ciphertext,
+		WrappedDEK: wrapped,
+		KEKID:      next.kekID,
+	}, nil
+}
+
+func (k *Keystore) unwrap(sealed *Sealed) ([]byte, error) {
+	if sealed.KEKID != k.kekID {
+		return nil, fmt.Errorf("secret was sealed with master key %s, have %s", sealed.KEKID, k.kekID)
+	}
+
+	dek, err := decrypt(k.kek, sealed.WrappedDEK)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unwrap data key: %w", err)
+	}
+	return dek, nil
+}
+
+// encrypt seals plaintext with AES-256-GCM, prefixing the random nonce
+func encrypt(key, plaintext []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	return gcm.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+func decrypt(key, data []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(data) < gcm.NonceSize() {
+		return nil, fmt.Errorf("ciphertext too short")
+	}
+
+	nonce, ciphertext := data[:gcm.NonceSize()], data[gcm.NonceSize():]
+	return gcm.Open(nil, nonce, ciphertext, nil)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
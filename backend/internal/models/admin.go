@@ -0,0 +1,43 @@
+package models
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// UserFilter selects users in the admin listing, oldest first
+type UserFilter struct {
+	// Query matches part of the username or email, ignoring case
+	Query  string
+	Active *bool
+	Limit  int
+	Offset int
+}
+
+// UserUsage summarizes what a user owns and how much they send
+type UserUsage struct {
+	UserID                  uuid.UUID  `json:"user_id"`
+	Organizations           int        `json:"organizations"`
+	Devices                 int        `json:"devices"`
+	ActiveAPIKeys           int        `json:"active_api_keys"`
+	ActiveSessions          int        `json:"active_sessions"`
+	NotificationsSent       int        `json:"notifications_sent"`
+	NotificationsLast30Days int        `json:"notifications_last_30_days"`
+	LastNotificationAt      *time.Time `json:"last_notification_at,omitempty"`
+	LastAPIKeyUseAt         *time.Time `json:"last_api_key_use_at,omitempty"`
+	LastLoginAt             *time.Time `json:"last_login_at,omitempty"`
+}
+
+// ResetAPIKeysResponse reports how many keys were revoked
+type ResetAPIKeysResponse struct {
+	Revoked int `json:"revoked"`
+}
+
+// ImpersonationResponse carries a short-lived, read-only access token acting
+// as the user. There is no refresh token.
+type ImpersonationResponse struct {
+	Token     string    `json:"token"`
+	ExpiresAt time.Time `json:"expires_at"`
+	User      User      `json:"user"`
+}
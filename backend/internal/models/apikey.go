@@ -0,0 +1,200 @@
+package models
+
+import (
+	"net"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// API key scopes. A new scope needs a migration granting it to existing
+// full-access keys, as in 028_backfill_api_key_scopes.sql.
+const (
+	ScopeNotifySend       = "notify:send"
+	ScopeNotifyRead       = "notify:read"
+	ScopeDevicesRead      = "devices:read"
+	ScopeDevicesWrite     = "devices:write"
+	ScopeCredentialsAdmin = "credentials:admin"
+	ScopeWebhooksAdmin    = "webhooks:admin"
+	ScopeTopicsAdmin      = "topics:admin"
+	ScopeKeysAdmin        = "keys:admin"
+	ScopeAuditRead        = "audit:read"
+)
+
+// AllScopes lists every scope; keys created at registration get all of them
+var AllScopes = []string{
+	ScopeNotifySend, ScopeNotifyRead, ScopeDevicesRead, ScopeDevicesWrite,
+	ScopeCredentialsAdmin, ScopeWebhooksAdmin, ScopeTopicsAdmin, ScopeKeysAdmin, ScopeAuditRead,
+}
+
+// ReadScopes lists the scopes that only read; impersonation sessions are
+// limited to them
+var ReadScopes = []string{ScopeNotifyRead, ScopeDevicesRead, ScopeAuditRead}
+
+// IsReadScope reports whether the scope only reads
+func IsReadScope(scope string) bool {
+	for _, s := range ReadScopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+func IsValidScope(scope string) bool {
+	for _, s := range AllScopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+type APIKey struct {
+	ID         uuid.UUID  `json:"id" db:"id"`
+	OrgID      uuid.UUID  `json:"org_id" db:"org_id"`
+	UserID     uuid.UUID  `json:"user_id" db:"user_id"`
+	Name       string     `json:"name" db:"name"`
+	Prefix     string     `json:"prefix" db:"prefix"`
+	KeyHash    []byte     `json:"-" db:"key_hash"`
+	CreatedAt  time.Time  `json:"created_at" db:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty" db:"last_used_at"`
+	ExpiresAt  *time.Time `json:"expires_at,omitempty" db:"expires_at"`
+	RevokedAt  *time.Time `json:"revoked_at,omitempty" db:"revoked_at"`
+
+	Scopes      []string `json:"scopes" db:"scopes"`
+	AllowedTags []string `json:"allowed_tags,omitempty" db:"allowed_tags"`
+	AllowedIPs  []string `json:"allowed_ips,omitempty" db:"allowed_ips"`
+}
+
+// Usable reports whether the key is neither revoked nor expired
+func (k *APIKey) Usable(now time.Time) bool {
+	if k.RevokedAt != nil {
+		return false
+	}
+	return k.ExpiresAt == nil || now.Before(*k.ExpiresAt)
+}
+
+// HasScope reports whether the key grants the scope
+func (k *APIKey) HasScope(scope string) bool {
+	for _, s := range k.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// AllowsIP reports whether requests from ip may use the key
+func (k *APIKey) AllowsIP(ip net.IP) bool {
+	if len(k.AllowedIPs) == 0 {
+		return true
+	}
+	if ip == nil {
+		return false
+	}
+	for _, cidr := range k.AllowedIPs {
+		if _, network, err := net.ParseCIDR(cidr); err == nil && network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// AllowsNetworks reports whether every one of the CIDRs lies within the key's
+// allowed IPs. An IP-restricted key does not allow unrestricted (i.e. all)
+// addresses.
+func (k *APIKey) AllowsNetworks(cidrs []string) bool {
+	if len(k.AllowedIPs) == 0 {
+		return true
+	}
+	if len(cidrs) == 0 {
+		return false
+	}
+	for _, cidr := range cidrs {
+		_, inner, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return false
+		}
+		innerOnes, innerBits := inner.Mask.Size()
+		contained := false
+		for _, allowed := range k.AllowedIPs {
+			_, outer, err := net.ParseCIDR(allowed)
+			if err != nil {
+				continue
+			}
+			outerOnes, outerBits := outer.Mask.Size()
+			if outerBits == innerBits && outerOnes <= innerOnes && outer.Contains(inner.IP) {
+				contained = true
+				break
+			}
+		}
+		if !contained {
+			return false
+		}
+	}
+	return true
+}
+
+// AllowsTags reports whether the key may target devices with all of the given
+// tags. A tag-restricted key cannot target untagged (i.e. all) devices.
+func (k *APIKey) AllowsTags(tags []string) bool {
+	if len(k.AllowedTags) == 0 {
+		return true
+	}
+	if len(tags) == 0 {
+		return false
+	}
+	for _, tag := range tags {
+		allowed := false
+		for _, a := range k.AllowedTags {
+			if a == tag {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return false
+		}
+	}
+	return true
+}
+
+// AllowsDevice reports whether the key may target a device with the given
+// tags, i.e. one that would be reached by notifying one of the allowed tags
+func (k *APIKey) AllowsDevice(deviceTags []string) bool {
+	if len(k.AllowedTags) == 0 {
+		return true
+	}
+	for _, tag := range deviceTags {
+		for _, a := range k.AllowedTags {
+			if a == tag {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+type CreateAPIKeyRequest struct {
+	Name        string     `json:"name"`
+	ExpiresAt   *time.Time `json:"expires_at,omitempty"`
+	Scopes      []string   `json:"scopes"`
+	AllowedTags []string   `json:"allowed_tags,omitempty"`
+	AllowedIPs  []string   `json:"allowed_ips,omitempty"`
+}
+
+// UpdateAPIKeyRequest changes only the fields that are present
+type UpdateAPIKeyRequest struct {
+	Name        *string   `json:"name,omitempty"`
+	Scopes      *[]string `json:"scopes,omitempty"`
+	AllowedTags *[]string `json:"allowed_tags,omitempty"`
+	AllowedIPs  *[]string `json:"allowed_ips,omitempty"`
+}
+
+// CreateAPIKeyResponse includes the plaintext key, which is only ever
+// returned once
+type CreateAPIKeyResponse struct {
+	APIKey
+	Key string `json:"key"`
+}
@@ -0,0 +1,138 @@
+package models
+
+import (
+	"net"
+	"testing"
+)
+
+func TestAPIKeyAllowsTags(t *testing.T) {
+	tests := []struct {
+		name    string
+		allowed []string
+		tags    []string
+		want    bool
+	}{
+		{"unrestricted key, no tags", nil, nil, true},
+		{"unrestricted key, tags", nil, []string{"a"}, true},
+		{"empty allow list is unrestricted", []string{}, []string{"a"}, true},
+		{"allowed tag", []string{"a", "b"}, []string{"a"}, true},
+		{"all tags allowed", []string{"a", "b"}, []string{"b", "a"}, true},
+		{"one tag not allowed", []string{"a", "b"}, []string{"a", "c"}, false},
+		{"no allowed tag", []string{"a"}, []string{"c"}, false},
+		// Targeting no tags means every device
+		{"restricted key, no tags", []string{"a"}, nil, false},
+		{"restricted key, empty tags", []string{"a"}, []string{}, false},
+		{"case sensitive", []string{"a"}, []string{"A"}, false},
+	}
+
+	for _, tt := range tests {
+		key := &APIKey{AllowedTags: tt.allowed}
+		if got := key.AllowsTags(tt.tags); got != tt.want {
+			t.Errorf("%s: AllowsTags(%q) with %q = %v, want %v", tt.name, tt.tags, tt.allowed, got, tt.want)
+		}
+	}
+}
+
+func TestAPIKeyAllowsDevice(t *testing.T) {
+	tests := []struct {
+		name       string
+		allowed    []string
+		deviceTags []string
+		want       bool
+	}{
+		{"unrestricted key, untagged device", nil, nil, true},
+		{"unrestricted key, tagged device", nil, []string{"a"}, true},
+		{"allowed tag", []string{"a"}, []string{"a"}, true},
+		// A device reached by notifying tag a, even if it has other tags
+		{"one allowed tag among others", []string{"a"}, []string{"b", "a"}, true},
+		{"no allowed tag", []string{"a"}, []string{"b", "c"}, false},
+		{"restricted key, untagged device", []string{"a"}, nil, false},
+		{"restricted key, empty tags", []string{"a"}, []string{}, false},
+	}
+
+	for _, tt := range tests {
+		key := &APIKey{AllowedTags: tt.allowed}
+		if got := key.AllowsDevice(tt.deviceTags); got != tt.want {
+			t.Errorf("%s: AllowsDevice(%q) with %q = %v, want %v", tt.name, tt.deviceTags, tt.allowed, got, tt.want)
+		}
+	}
+}
+
+func TestAPIKeyAllowsIP(t *testing.T) {
+	tests := []struct {
+		name    string
+		allowed []string
+		ip      string
+		want    bool
+	}{
+		{"unrestricted key", nil, "203.0.113.7", true},
+		{"unrestricted key, unknown address", nil, "", true},
+		{"empty allow list is unrestricted", []string{}, "203.0.113.7", true},
+		{"inside network", []string{"10.0.0.0/8"}, "10.1.2.3", true},
+		{"outside network", []string{"10.0.0.0/8"}, "11.0.0.1", false},
+		{"single address", []string{"203.0.113.7/32"}, "203.0.113.7", true},
+		{"next to single address", []string{"203.0.113.7/32"}, "203.0.113.8", false},
+		{"second network", []string{"10.0.0.0/8", "192.168.0.0/16"}, "192.168.1.1", true},
+		{"restricted key, unknown address", []string{"10.0.0.0/8"}, "", false},
+		// Dual-stack listeners report IPv4 clients in their mapped form
+		{"IPv4-mapped IPv6 inside network", []string{"10.0.0.0/8"}, "::ffff:10.1.2.3", true},
+		{"IPv4-mapped IPv6 outside network", []string{"10.0.0.0/8"}, "::ffff:11.0.0.1", false},
+		{"IPv6 inside network", []string{"2001:db8::/32"}, "2001:db8::1", true},
+		{"IPv6 outside network", []string{"2001:db8::/32"}, "2001:db9::1", false},
+		{"IPv4 /0", []string{"0.0.0.0/0"}, "203.0.113.7", true},
+		{"IPv4 /0, IPv4-mapped IPv6", []string{"0.0.0.0/0"}, "::ffff:203.0.113.7", true},
+		// A /0 covers only its own address family
+		{"IPv4 /0, IPv6 address", []string{"0.0.0.0/0"}, "2001:db8::1", false},
+		{"IPv6 /0", []string{"::/0"}, "2001:db8::1", true},
+		{"IPv6 /0, IPv4 address", []string{"::/0"}, "203.0.113.7", false},
+		{"malformed entry is skipped", []string{"nope", "10.0.0.0/8"}, "10.1.2.3", true},
+		{"only malformed entries", []string{"nope"}, "10.1.2.3", false},
+	}
+
+	for _, tt := range tests {
+		key := &APIKey{AllowedIPs: tt.allowed}
+		if got := key.AllowsIP(net.ParseIP(tt.ip)); got != tt.want {
+			t.Errorf("%s: AllowsIP(%s) with %q = %v, want %v", tt.name, tt.ip, tt.allowed, got, tt.want)
+		}
+	}
+}
+
+func TestAPIKeyAllowsNetworks(t *testing.T) {
+	tests := []struct {
+		name    string
+		allowed []string
+		cidrs   []string
+		want    bool
+	}{
+		{"unrestricted key, no networks", nil, nil, true},
+		{"unrestricted key, any network", nil, []string{"0.0.0.0/0"}, true},
+		// No networks means every address
+		{"restricted key, no networks", []string{"10.0.0.0/8"}, nil, false},
+		{"restricted key, empty networks", []string{"10.0.0.0/8"}, []string{}, false},
+		{"same network", []string{"10.0.0.0/8"}, []string{"10.0.0.0/8"}, true},
+		{"narrower network", []string{"10.0.0.0/8"}, []string{"10.1.0.0/16"}, true},
+		{"single address", []string{"10.0.0.0/8"}, []string{"10.1.2.3/32"}, true},
+		{"wider network", []string{"10.0.0.0/8"}, []string{"10.0.0.0/7"}, false},
+		{"overlapping wider network", []string{"10.1.0.0/16"}, []string{"10.0.0.0/8"}, false},
+		{"disjoint network", []string{"10.0.0.0/8"}, []string{"192.168.0.0/16"}, false},
+		{"each network in some allowed one", []string{"10.0.0.0/8", "192.168.0.0/16"}, []string{"192.168.1.0/24", "10.1.0.0/16"}, true},
+		{"one network outside", []string{"10.0.0.0/8"}, []string{"10.1.0.0/16", "192.168.1.0/24"}, false},
+		{"malformed network", []string{"10.0.0.0/8"}, []string{"10.1.2.3"}, false},
+		{"IPv4 /0 within IPv4 /0", []string{"0.0.0.0/0"}, []string{"0.0.0.0/0"}, true},
+		{"anything IPv4 within IPv4 /0", []string{"0.0.0.0/0"}, []string{"203.0.113.0/24"}, true},
+		{"IPv4 /0 outside a narrower key", []string{"10.0.0.0/8"}, []string{"0.0.0.0/0"}, false},
+		{"IPv6 /0 outside IPv4 /0", []string{"0.0.0.0/0"}, []string{"::/0"}, false},
+		{"IPv4 outside IPv6 /0", []string{"::/0"}, []string{"10.0.0.0/8"}, false},
+		{"IPv6 within IPv6", []string{"2001:db8::/32"}, []string{"2001:db8:1::/48"}, true},
+		// An IPv4-mapped IPv6 network is an IPv6 network to the parser and is
+		// not matched against IPv4 allow lists
+		{"IPv4-mapped IPv6 network", []string{"10.0.0.0/8"}, []string{"::ffff:10.1.0.0/112"}, false},
+	}
+
+	for _, tt := range tests {
+		key := &APIKey{AllowedIPs: tt.allowed}
+		if got := key.AllowsNetworks(tt.cidrs); got != tt.want {
+			t.Errorf("%s: AllowsNetworks(%q) with %q = %v, want %v", tt.name, tt.cidrs, tt.allowed, got, tt.want)
+		}
+	}
+}
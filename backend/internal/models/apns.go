@@ -6,22 +6,99 @@ import (
 	"github.com/google/uuid"
 )
 
+// APNs authentication types
+const (
+	APNsAuthToken       = "token"
+	APNsAuthCertificate = "certificate"
+)
+
 type APNsCredential struct {
 	ID             uuid.UUID `json:"id" db:"id"`
+	OrgID          uuid.UUID `json:"org_id" db:"org_id"`
 	UserID         uuid.UUID `json:"user_id" db:"user_id"`
-	TeamID         string    `json:"team_id" db:"team_id"`
-	KeyID          string    `json:"key_id" db:"key_id"`
+	AuthType       string    `json:"auth_type" db:"auth_type"`
+	TeamID         string    `json:"team_id,omitempty" db:"team_id"`
+	KeyID          string    `json:"key_id,omitempty" db:"key_id"`
 	BundleID       string    `json:"bundle_id" db:"bundle_id"`
 	Environment    string    `json:"environment" db:"environment"`
 	PrivateKeyPath string    `json:"-" db:"private_key_path"`
 	CreatedAt      time.Time `json:"created_at" db:"created_at"`
 	IsActive       bool      `json:"is_active" db:"is_active"`
+
+	CertificateExpiresAt *time.Time `json:"certificate_expires_at,omitempty" db:"certificate_expires_at"`
+
+	// Health tracking, updated by the worker
+	LastSuccessAt   *time.Time `json:"-" db:"last_success_at"`
+	LastErrorAt     *time.Time `json:"-" db:"last_error_at"`
+	LastError       *string    `json:"-" db:"last_error"`
+	ErrorCount      int        `json:"-" db:"error_count"`
+	ProviderError   *string    `json:"-" db:"provider_error"`
+	ProviderErrorAt *time.Time `json:"-" db:"provider_error_at"`
+	ExpiryAlertedAt *time.Time `json:"-" db:"expiry_alerted_at"`
+
+	Health *APNsCredentialHealth `json:"health,omitempty" db:"-"`
+
+	// Encrypted .p8 key, or certificate and key PEM; see keystore.Sealed
+	PrivateKeyCiphertext []byte  `json:"-" db:"private_key_ciphertext"`
+	PrivateKeyDEK        []byte  `json:"-" db:"private_key_dek"`
+	KEKID                *string `json:"-" db:"kek_id"`
+}
+
+// Credential health statuses
+const (
+	CredentialHealthUnknown  = "unknown"
+	CredentialHealthHealthy  = "healthy"
+	CredentialHealthDegraded = "degraded"
+	CredentialHealthExpiring = "expiring"
+	CredentialHealthFailing  = "failing"
+	CredentialHealthExpired  = "expired"
+)
+
+type APNsCredentialHealth struct {
+	Status            string     `json:"status"`
+	LastSuccessAt     *time.Time `json:"last_success_at,omitempty"`
+	LastErrorAt       *time.Time `json:"last_error_at,omitempty"`
+	LastError         *string    `json:"last_error,omitempty"`
+	ConsecutiveErrors int        `json:"consecutive_errors"`
+	ProviderError     *string    `json:"provider_error,omitempty"`
+	ProviderErrorAt   *time.Time `json:"provider_error_at,omitempty"`
+	ExpiresInDays     *int       `json:"certificate_expires_in_days,omitempty"`
 }
 
 type CreateAPNsCredentialRequest struct {
+	AuthType    string `json:"auth_type,omitempty"`
 	TeamID      string `json:"team_id"`
 	KeyID       string `json:"key_id"`
 	BundleID    string `json:"bundle_id"`
 	Environment string `json:"environment"`
 	PrivateKey  string `json:"private_key"`
+	// Certificate is a base64-encoded PKCS#12 (.p12) file, used when AuthType
+	// is "certificate"
+	Certificate string `json:"certificate,omitempty"`
+	Passphrase  string `json:"passphrase,omitempty"`
+}
+
+type APNsCircuitState struct {
+	CredentialID        uuid.UUID  `json:"credential_id" db:"credential_id"`
+	BundleID            string     `json:"bundle_id" db:"bundle_id"`
+	Environment         string     `json:"environment" db:"environment"`
+	State               string     `json:"state" db:"state"`
+	ConsecutiveFailures int        `json:"consecutive_failures" db:"consecutive_failures"`
+	OpenedAt            *time.Time `json:"opened_at,omitempty" db:"opened_at"`
+	UpdatedAt           time.Time  `json:"updated_at" db:"updated_at"`
+	ExpiresAt           *time.Time `json:"expires_at,omitempty" db:"expires_at"`
+}
+
+type VerifyAPNsCredentialRequest struct {
+	DeviceToken string `json:"device_token,omitempty"`
+}
+
+type VerifyAPNsCredentialResponse struct {
+	KeyValid    bool   `json:"key_valid"`
+	TokenSigned bool   `json:"token_signed"`
+	ProbeSent   bool   `json:"probe_sent"`
+	StatusCode  int    `json:"status_code,omitempty"`
+	Reason      string `json:"reason,omitempty"`
+	APNsID      string `json:"apns_id,omitempty"`
+	Verdict     string `json:"verdict"`
 }
@@ -0,0 +1,116 @@
+package models
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Audit actions
+const (
+	AuditLogin                    = "auth.login"
+	AuditLoginFailed              = "auth.login_failed"
+	AuditLogout                   = "auth.logout"
+	AuditLogoutAll                = "auth.logout_all"
+	AuditRefreshTokenReused       = "auth.refresh_token_reused"
+	AuditPasswordReset            = "auth.password_reset"
+	AuditMFAEnabled               = "auth.mfa_enabled"
+	AuditMFADisabled              = "auth.mfa_disabled"
+	AuditRecoveryCodesRegenerated = "auth.recovery_codes_regenerated"
+
+	AuditAPIKeyCreated = "apikey.created"
+	AuditAPIKeyUpdated = "apikey.updated"
+	AuditAPIKeyRevoked = "apikey.revoked"
+
+	AuditCredentialCreated  = "credential.created"
+	AuditCredentialDeleted  = "credential.deleted"
+	AuditCredentialVerified = "credential.verified"
+
+	AuditDeviceRegistered            = "device.registered"
+	AuditDeviceUpdated               = "device.updated"
+	AuditDeviceDeleted               = "device.deleted"
+	AuditDevicePruned                = "device.pruned"
+	AuditDeviceTokenUpdated          = "device.token_updated"
+	AuditDeviceTokenRemoved          = "device.token_removed"
+	AuditDeviceTokenTransferred      = "device.token_transferred"
+	AuditDeviceHeartbeatTokenIssued  = "device.heartbeat_token_issued"
+	AuditDeviceHeartbeatTokenRevoked = "device.heartbeat_token_revoked"
+	AuditDeviceSubscribed            = "device.subscribed"
+	AuditDeviceUnsubscribed          = "device.unsubscribed"
+
+	AuditNotifySent = "notify.sent"
+
+	AuditSegmentCreated = "segment.created"
+	AuditSegmentUpdated = "segment.updated"
+	AuditSegmentDeleted = "segment.deleted"
+
+	AuditTopicUpdated       = "topic.updated"
+	AuditTopicDeleted       = "topic.deleted"
+	AuditTopicAccessUpdated = "topic.access_updated"
+
+	AuditWebhookCreated = "webhook.created"
+	AuditWebhookDeleted = "webhook.deleted"
+
+	AuditMemberUpdated      = "org.member_updated"
+	AuditMemberRemoved      = "org.member_removed"
+	AuditInvitationCreated  = "org.invitation_created"
+	AuditInvitationDeleted  = "org.invitation_deleted"
+	AuditInvitationAccepted = "org.invitation_accepted"
+
+	AuditUserDeactivated      = "admin.user_deactivated"
+	AuditUserReactivated      = "admin.user_reactivated"
+	AuditUserAPIKeysReset     = "admin.api_keys_reset"
+	AuditUserLimitsUpdated    = "admin.limits_updated"
+	AuditImpersonationStarted = "admin.impersonation_started"
+)
+
+// Audit target types
+const (
+	AuditTargetUser       = "user"
+	AuditTargetAPIKey     = "api_key"
+	AuditTargetCredential = "apns_credential"
+	AuditTargetDevice     = "device"
+	AuditTargetNotify     = "notification"
+	AuditTargetSegment    = "segment"
+	AuditTargetTopic      = "topic"
+	AuditTargetWebhook    = "webhook"
+	AuditTargetMember     = "org_member"
+	AuditTargetInvitation = "org_invitation"
+)
+
+// AuditEvent records who did what to which resource. Before and After hold
+// the fields that changed.
+type AuditEvent struct {
+	ID            int64           `json:"id" db:"id"`
+	OrgID         *uuid.UUID      `json:"org_id,omitempty" db:"org_id"`
+	ActorUserID   *uuid.UUID      `json:"actor_user_id,omitempty" db:"actor_user_id"`
+	ActorUsername *string         `json:"actor_username,omitempty" db:"actor_username"`
+	ActorAPIKeyID *uuid.UUID      `json:"actor_api_key_id,omitempty" db:"actor_api_key_id"`
+	Action        string          `json:"action" db:"action"`
+	TargetType    string          `json:"target_type" db:"target_type"`
+	TargetID      *string         `json:"target_id,omitempty" db:"target_id"`
+	IP            *string         `json:"ip,omitempty" db:"ip"`
+	UserAgent     *string         `json:"user_agent,omitempty" db:"user_agent"`
+	Before        json.RawMessage `json:"before,omitempty" db:"before"`
+	After         json.RawMessage `json:"after,omitempty" db:"after"`
+	CreatedAt     time.Time       `json:"created_at" db:"created_at"`
+}
+
+// AuditFilter selects audit events, newest first. Exactly one of OrgID and
+// AccountUserID is set: an organization's events, or a user's own account
+// events.
+type AuditFilter struct {
+	OrgID         *uuid.UUID
+	AccountUserID *uuid.UUID
+	// Action matches exactly, or a whole category such as "apikey"
+	Action      string
+	ActorUserID *uuid.UUID
+	TargetType  string
+	TargetID    string
+	Since       *time.Time
+	Until       *time.Time
+	// BeforeID continues a listing after the last event of the previous page
+	BeforeID int64
+	Limit    int
+}
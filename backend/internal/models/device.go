@@ -1,6 +1,7 @@
 package models
 
 import (
+	"fmt"
 	"time"
 
 	"github.com/google/uuid"
@@ -8,6 +9,7 @@ import (
 
 type Device struct {
 	ID               uuid.UUID  `json:"id" db:"id"`
+	OrgID            uuid.UUID  `json:"org_id" db:"org_id"`
 	UserID           uuid.UUID  `json:"user_id" db:"user_id"`
 	DeviceName       string     `json:"device_name" db:"device_name"`
 	DeviceIdentifier string     `json:"device_identifier" db:"device_identifier"`
@@ -15,20 +17,178 @@ type Device struct {
 	CreatedAt        time.Time  `json:"created_at" db:"created_at"`
 	UpdatedAt        time.Time  `json:"updated_at" db:"updated_at"`
 	LastSeenAt       *time.Time `json:"last_seen_at,omitempty" db:"last_seen_at"`
+	StaleAt          *time.Time `json:"stale_at,omitempty" db:"stale_at"`
+	// HeartbeatWindowMinutes is how long the device may go without checking
+	// in before its owner is alerted; nil leaves it unmonitored
+	HeartbeatWindowMinutes *int       `json:"heartbeat_window_minutes,omitempty" db:"heartbeat_window_minutes"`
+	OfflineAlertedAt       *time.Time `json:"offline_alerted_at,omitempty" db:"offline_alerted_at"`
+	DeviceMetadata
 }
 
 type DeviceToken struct {
-	ID          uuid.UUID  `json:"id" db:"id"`
-	DeviceID    uuid.UUID  `json:"device_id" db:"device_id"`
-	Token       string     `json:"token" db:"token"`
-	Environment string     `json:"environment" db:"environment"`
-	BundleID    string     `json:"bundle_id" db:"bundle_id"`
-	IssuedAt    time.Time  `json:"issued_at" db:"issued_at"`
-	IsValid     bool       `json:"is_valid" db:"is_valid"`
-	LastUsedAt  *time.Time `json:"last_used_at,omitempty" db:"last_used_at"`
-	ErrorCount  int        `json:"error_count" db:"error_count"`
-	LastError   *string    `json:"last_error,omitempty" db:"last_error"`
-	UpdatedAt   time.Time  `json:"updated_at" db:"updated_at"`
+	ID                uuid.UUID  `json:"id" db:"id"`
+	DeviceID          uuid.UUID  `json:"device_id" db:"device_id"`
+	Token             string     `json:"token" db:"token"`
+	Environment       string     `json:"environment" db:"environment"`
+	BundleID          string     `json:"bundle_id" db:"bundle_id"`
+	IssuedAt          time.Time  `json:"issued_at" db:"issued_at"`
+	IsValid           bool       `json:"is_valid" db:"is_valid"`
+	LastUsedAt        *time.Time `json:"last_used_at,omitempty" db:"last_used_at"`
+	ErrorCount        int        `json:"error_count" db:"error_count"`
+	LastError         *string    `json:"last_error,omitempty" db:"last_error"`
+	UpdatedAt         time.Time  `json:"updated_at" db:"updated_at"`
+	InvalidatedAt     *time.Time `json:"invalidated_at,omitempty" db:"invalidated_at"`
+	InvalidatedReason *string    `json:"invalidated_reason,omitempty" db:"invalidated_reason"`
+}
+
+// Reasons a device token stopped being active
+const (
+	TokenReplaced    = "replaced"
+	TokenMoved       = "moved"
+	TokenTransferred = "transferred"
+	TokenRejected    = "rejected"
+	TokenRemoved     = "removed"
+)
+
+// TokenHolder identifies the device a token was active on before it was
+// assigned to another device
+type TokenHolder struct {
+	TokenID  uuid.UUID
+	DeviceID uuid.UUID
+	UserID   uuid.UUID
+	OrgID    uuid.UUID
+}
+
+// LifecyclePolicy decides when devices that stopped checking in are marked
+// stale, and when devices without a valid token are deleted
+type LifecyclePolicy struct {
+	StaleAfterDays         int `json:"stale_after_days"`
+	DeleteInvalidAfterDays int `json:"delete_invalid_after_days"`
+}
+
+// LifecycleDevice is a device the worker marks stale, deletes or flags as
+// offline
+type LifecycleDevice struct {
+	ID         uuid.UUID  `json:"id"`
+	OrgID      uuid.UUID  `json:"org_id"`
+	UserID     uuid.UUID  `json:"user_id"`
+	DeviceName string     `json:"device_name"`
+	LastSeenAt *time.Time `json:"last_seen_at,omitempty"`
+	StaleAt    *time.Time `json:"stale_at,omitempty"`
+	// InvalidSince is when the device's last valid token was retired, for
+	// devices without one
+	InvalidSince *time.Time `json:"invalid_since,omitempty"`
+}
+
+// PruneReport lists the organization's devices the lifecycle policy marks
+// stale and deletes. The lists hold at most a sample of the counted devices.
+type PruneReport struct {
+	Policy      LifecyclePolicy   `json:"policy"`
+	StaleCount  int               `json:"stale_count"`
+	Stale       []LifecycleDevice `json:"stale"`
+	DeleteCount int               `json:"delete_count"`
+	Delete      []LifecycleDevice `json:"delete"`
+}
+
+// Device platforms
+const (
+	PlatformIOS      = "ios"
+	PlatformIPadOS   = "ipados"
+	PlatformMacOS    = "macos"
+	PlatformWatchOS  = "watchos"
+	PlatformTvOS     = "tvos"
+	PlatformVisionOS = "visionos"
+)
+
+// Notification authorization states reported by the app, mirroring
+// UNAuthorizationStatus
+const (
+	PushAuthorized    = "authorized"
+	PushDenied        = "denied"
+	PushProvisional   = "provisional"
+	PushEphemeral     = "ephemeral"
+	PushNotDetermined = "not_determined"
+)
+
+var validPlatforms = map[string]bool{
+	PlatformIOS: true, PlatformIPadOS: true, PlatformMacOS: true,
+	PlatformWatchOS: true, PlatformTvOS: true, PlatformVisionOS: true,
+}
+
+var validPushAuthorizations = map[string]bool{
+	PushAuthorized: true, PushDenied: true, PushProvisional: true,
+	PushEphemeral: true, PushNotDetermined: true,
+}
+
+func IsValidPlatform(platform string) bool {
+	return validPlatforms[platform]
+}
+
+func IsValidPushAuthorization(status string) bool {
+	return validPushAuthorizations[status]
+}
+
+// maxMetadataLength bounds the free-form metadata fields
+const maxMetadataLength = 64
+
+// DeviceMetadata describes the device and app as last reported at
+// registration. Empty fields are unknown.
+type DeviceMetadata struct {
+	Platform          string `json:"platform,omitempty" db:"platform"`
+	OSVersion         string `json:"os_version,omitempty" db:"os_version"`
+	AppVersion        string `json:"app_version,omitempty" db:"app_version"`
+	AppBuild          string `json:"app_build,omitempty" db:"app_build"`
+	Model             string `json:"model,omitempty" db:"model"`
+	Timezone          string `json:"timezone,omitempty" db:"timezone"`
+	Locale            string `json:"locale,omitempty" db:"locale"`
+	PushAuthorization string `json:"push_authorization,omitempty" db:"push_authorization"`
+}
+
+// Validate checks the reported values; empty fields are allowed
+func (m DeviceMetadata) Validate() error {
+	if m.Platform != "" && !IsValidPlatform(m.Platform) {
+		return fmt.Errorf("invalid platform: %s", m.Platform)
+	}
+	if m.PushAuthorization != "" && !IsValidPushAuthorization(m.PushAuthorization) {
+		return fmt.Errorf("invalid push authorization: %s", m.PushAuthorization)
+	}
+	if m.Timezone != "" {
+		if _, err := time.LoadLocation(m.Timezone); err != nil {
+			return fmt.Errorf("invalid timezone: %s", m.Timezone)
+		}
+	}
+	fields := map[string]string{
+		"os_version":  m.OSVersion,
+		"app_version": m.AppVersion,
+		"app_build":   m.AppBuild,
+		"model":       m.Model,
+		"timezone":    m.Timezone,
+		"locale":      m.Locale,
+	}
+	for name, value := range fields {
+		if len(value) > maxMetadataLength {
+			return fmt.Errorf("%s must be at most %d characters", name, maxMetadataLength)
+		}
+	}
+	return nil
+}
+
+// Merge overwrites the fields reported in update, keeping the known values
+// of fields it leaves empty
+func (m *DeviceMetadata) Merge(update DeviceMetadata) {
+	merge := func(dst *string, src string) {
+		if src != "" {
+			*dst = src
+		}
+	}
+	merge(&m.Platform, update.Platform)
+	merge(&m.OSVersion, update.OSVersion)
+	merge(&m.AppVersion, update.AppVersion)
+	merge(&m.AppBuild, update.AppBuild)
+	merge(&m.Model, update.Model)
+	merge(&m.Timezone, update.Timezone)
+	merge(&m.Locale, update.Locale)
+	merge(&m.PushAuthorization, update.PushAuthorization)
 }
 
 type RegisterDeviceRequest struct {
@@ -38,17 +198,34 @@ type RegisterDeviceRequest struct {
 	BundleID         string   `json:"bundle_id"`
 	Environment      string   `json:"environment"`
 	Tags             []string `json:"tags"`
+	// TransferToken takes the token over from another user's device
+	TransferToken bool `json:"transfer_token,omitempty"`
+	DeviceMetadata
 }
 
 type UpdateDeviceRequest struct {
 	DeviceName string   `json:"device_name,omitempty"`
 	Tags       []string `json:"tags,omitempty"`
+	// HeartbeatWindowMinutes starts monitoring the device's heartbeats; 0
+	// stops it
+	HeartbeatWindowMinutes *int `json:"heartbeat_window_minutes,omitempty"`
+}
+
+// MaxHeartbeatWindowMinutes bounds a device's heartbeat window to a week
+const MaxHeartbeatWindowMinutes = 7 * 24 * 60
+
+// HeartbeatTokenResponse returns a new heartbeat token, which is only shown
+// once
+type HeartbeatTokenResponse struct {
+	DeviceID       uuid.UUID `json:"device_id"`
+	HeartbeatToken string    `json:"heartbeat_token"`
 }
 
 type UpdateTokenRequest struct {
-	DeviceToken string `json:"device_token"`
-	Environment string `json:"environment"`
-	BundleID    string `json:"bundle_id"`
+	DeviceToken   string `json:"device_token"`
+	Environment   string `json:"environment"`
+	BundleID      string `json:"bundle_id"`
+	TransferToken bool   `json:"transfer_token,omitempty"`
 }
 
 type DeviceWithToken struct {
@@ -0,0 +1,29 @@
+package models
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// UserIdentity links a PushLab user to an account at an OpenID Connect
+// provider
+type UserIdentity struct {
+	ID          uuid.UUID `json:"id" db:"id"`
+	UserID      uuid.UUID `json:"user_id" db:"user_id"`
+	Issuer      string    `json:"issuer" db:"issuer"`
+	Subject     string    `json:"subject" db:"subject"`
+	Email       *string   `json:"email,omitempty" db:"email"`
+	CreatedAt   time.Time `json:"created_at" db:"created_at"`
+	LastLoginAt time.Time `json:"last_login_at" db:"last_login_at"`
+}
+
+// OIDCLoginState is an authorization request waiting for the provider's
+// callback
+type OIDCLoginState struct {
+	StateHash    []byte    `db:"state_hash"`
+	CodeVerifier string    `db:"code_verifier"`
+	Nonce        string    `db:"nonce"`
+	RedirectURI  *string   `db:"redirect_uri"`
+	ExpiresAt    time.Time `db:"expires_at"`
+}
@@ -0,0 +1,62 @@
+package models
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Send quota periods
+const (
+	QuotaDay   = "day"
+	QuotaMonth = "month"
+)
+
+// UserLimits overrides the configured rate limit and send quotas for a user.
+// Nil fields keep the configured default; a quota of 0 means unlimited.
+type UserLimits struct {
+	UserID            uuid.UUID  `json:"user_id" db:"user_id"`
+	RequestsPerMinute *int       `json:"requests_per_minute" db:"requests_per_minute"`
+	Burst             *int       `json:"burst" db:"burst"`
+	DailyQuota        *int64     `json:"daily_quota" db:"daily_quota"`
+	MonthlyQuota      *int64     `json:"monthly_quota" db:"monthly_quota"`
+	UpdatedAt         *time.Time `json:"updated_at,omitempty" db:"updated_at"`
+}
+
+// Quotas caps the pushes a user sends per UTC day and month; 0 means
+// unlimited
+type Quotas struct {
+	Daily   int64
+	Monthly int64
+}
+
+// UserLimitsResponse shows an admin the user's overrides, the quotas in
+// effect and how much of them is used
+type UserLimitsResponse struct {
+	Overrides     UserLimits `json:"overrides"`
+	DailyQuota    int64      `json:"daily_quota"`
+	MonthlyQuota  int64      `json:"monthly_quota"`
+	SentToday     int64      `json:"sent_today"`
+	SentThisMonth int64      `json:"sent_this_month"`
+}
+
+// UpdateUserLimitsRequest replaces the user's overrides; omitted or null
+// fields fall back to the configured defaults
+type UpdateUserLimitsRequest struct {
+	RequestsPerMinute *int   `json:"requests_per_minute"`
+	Burst             *int   `json:"burst"`
+	DailyQuota        *int64 `json:"daily_quota"`
+	MonthlyQuota      *int64 `json:"monthly_quota"`
+}
+
+// Quotas applies the user's overrides to the configured defaults
+func (l *UserLimits) Quotas(defaults Quotas) Quotas {
+	quotas := defaults
+	if l.DailyQuota != nil {
+		quotas.Daily = *l.DailyQuota
+	}
+	if l.MonthlyQuota != nil {
+		quotas.Monthly = *l.MonthlyQuota
+	}
+	return quotas
+}
@@ -0,0 +1,57 @@
+package models
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// UserTOTP is a user's TOTP enrollment. The secret is encrypted at rest.
+type UserTOTP struct {
+	UserID           uuid.UUID  `db:"user_id"`
+	SecretCiphertext []byte     `db:"secret_ciphertext"`
+	SecretDEK        []byte     `db:"secret_dek"`
+	KEKID            string     `db:"kek_id"`
+	CreatedAt        time.Time  `db:"created_at"`
+	EnabledAt        *time.Time `db:"enabled_at"`
+	LastUsedStep     *int64     `db:"last_used_step"`
+}
+
+// MFAChallenge is a password login waiting for the second factor
+type MFAChallenge struct {
+	TokenHash []byte    `db:"token_hash"`
+	UserID    uuid.UUID `db:"user_id"`
+	Attempts  int       `db:"attempts"`
+	ExpiresAt time.Time `db:"expires_at"`
+}
+
+// TOTPEnrollResponse carries the new secret. Authenticator apps import the
+// provisioning URI, usually shown as a QR code.
+type TOTPEnrollResponse struct {
+	Secret          string `json:"secret"`
+	ProvisioningURI string `json:"provisioning_uri"`
+}
+
+type TOTPCodeRequest struct {
+	Code string `json:"code"`
+}
+
+// RecoveryCodesResponse lists recovery codes; they are only shown once
+type RecoveryCodesResponse struct {
+	RecoveryCodes []string `json:"recovery_codes"`
+}
+
+// MFAChallengeResponse is returned by login instead of tokens when the user
+// has two-factor authentication enabled
+type MFAChallengeResponse struct {
+	MFARequired bool      `json:"mfa_required"`
+	MFAToken    string    `json:"mfa_token"`
+	ExpiresAt   time.Time `json:"expires_at"`
+}
+
+// MFAVerifyRequest completes a login with a TOTP code or a recovery code
+type MFAVerifyRequest struct {
+	MFAToken     string `json:"mfa_token"`
+	Code         string `json:"code,omitempty"`
+	RecoveryCode string `json:"recovery_code,omitempty"`
+}
@@ -9,6 +9,7 @@ import (
 
 type Notification struct {
 	ID        uuid.UUID       `json:"id" db:"id"`
+	OrgID     uuid.UUID       `json:"org_id" db:"org_id"`
 	UserID    uuid.UUID       `json:"user_id" db:"user_id"`
 	Title     *string         `json:"title,omitempty" db:"title"`
 	Body      string          `json:"body" db:"body"`
@@ -18,6 +19,9 @@ type Notification struct {
 	Category  *string         `json:"category,omitempty" db:"category"`
 	Priority  string          `json:"priority" db:"priority"`
 	Tags      []string        `json:"tags,omitempty" db:"tags"`
+	Target    *string         `json:"target,omitempty" db:"target"`
+	Segment   *string         `json:"segment,omitempty" db:"segment"`
+	TopicID   *uuid.UUID      `json:"topic_id,omitempty" db:"topic_id"`
 	CreatedAt time.Time       `json:"created_at" db:"created_at"`
 	Status    string          `json:"status" db:"status"`
 }
@@ -39,6 +43,7 @@ type SendNotificationRequest struct {
 	Title    *string                `json:"title,omitempty"`
 	Body     string                 `json:"body"`
 	Tags     []string               `json:"tags,omitempty"`
+	Target   *Target                `json:"target,omitempty"`
 	Badge    *int                   `json:"badge,omitempty"`
 	Sound    string                 `json:"sound,omitempty"`
 	Category *string                `json:"category,omitempty"`
@@ -46,6 +51,13 @@ type SendNotificationRequest struct {
 	Data     map[string]interface{} `json:"data,omitempty"`
 }
 
+// Target selects the devices to notify with either a filter expression, as
+// parsed by the targeting package, or the name of a saved segment
+type Target struct {
+	Expression string `json:"expression,omitempty"`
+	Segment    string `json:"segment,omitempty"`
+}
+
 type SendNotificationResponse struct {
 	NotificationID uuid.UUID `json:"notification_id"`
 	TargetDevices  int       `json:"target_devices"`
@@ -59,9 +71,11 @@ type NotificationDetail struct {
 
 type NotificationJob struct {
 	NotificationID uuid.UUID              `json:"notification_id"`
+	OrgID          uuid.UUID              `json:"org_id"`
 	UserID         uuid.UUID              `json:"user_id"`
 	DeviceTokenIDs []uuid.UUID            `json:"device_token_ids"`
 	Payload        NotificationPayload    `json:"payload"`
+	Deferrals      int                    `json:"deferrals,omitempty"`
 }
 
 type NotificationPayload struct {
@@ -0,0 +1,120 @@
+package models
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Organization roles, from most to least privileged
+const (
+	RoleOwner  = "owner"
+	RoleAdmin  = "admin"
+	RoleSender = "sender"
+	RoleViewer = "viewer"
+)
+
+// roleScopes lists what each role may do within its organization. API keys
+// are additionally limited to their own scopes.
+var roleScopes = map[string][]string{
+	RoleViewer: {ScopeNotifyRead, ScopeDevicesRead, ScopeKeysAdmin},
+	RoleSender: {ScopeNotifyRead, ScopeDevicesRead, ScopeKeysAdmin, ScopeNotifySend, ScopeDevicesWrite},
+	RoleAdmin:  AllScopes,
+	RoleOwner:  AllScopes,
+}
+
+var roleRank = map[string]int{
+	RoleViewer: 1,
+	RoleSender: 2,
+	RoleAdmin:  3,
+	RoleOwner:  4,
+}
+
+func IsValidRole(role string) bool {
+	_, ok := roleRank[role]
+	return ok
+}
+
+// RoleHasScope reports whether members with the role may use the scope
+func RoleHasScope(role, scope string) bool {
+	for _, s := range roleScopes[role] {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// RoleScopes returns the scopes granted to the role
+func RoleScopes(role string) []string {
+	return append([]string(nil), roleScopes[role]...)
+}
+
+// RoleAtLeast reports whether role is at least as privileged as min
+func RoleAtLeast(role, min string) bool {
+	return roleRank[role] >= roleRank[min]
+}
+
+type Organization struct {
+	ID        uuid.UUID `json:"id" db:"id"`
+	Name      string    `json:"name" db:"name"`
+	Personal  bool      `json:"personal" db:"personal"`
+	CreatedAt time.Time `json:"created_at" db:"created_at"`
+	UpdatedAt time.Time `json:"updated_at" db:"updated_at"`
+}
+
+// OrgMembership is a user's role in an organization
+type OrgMembership struct {
+	OrgID     uuid.UUID `json:"org_id" db:"org_id"`
+	OrgName   string    `json:"org_name" db:"org_name"`
+	Personal  bool      `json:"personal" db:"personal"`
+	UserID    uuid.UUID `json:"user_id" db:"user_id"`
+	Role      string    `json:"role" db:"role"`
+	CreatedAt time.Time `json:"created_at" db:"created_at"`
+}
+
+// OrgMember is a member as listed to the rest of the organization
+type OrgMember struct {
+	UserID    uuid.UUID `json:"user_id" db:"user_id"`
+	Username  string    `json:"username" db:"username"`
+	Email     string    `json:"email" db:"email"`
+	Role      string    `json:"role" db:"role"`
+	CreatedAt time.Time `json:"created_at" db:"created_at"`
+}
+
+type OrgInvitation struct {
+	ID         uuid.UUID  `json:"id" db:"id"`
+	OrgID      uuid.UUID  `json:"org_id" db:"org_id"`
+	Email      string     `json:"email" db:"email"`
+	Role       string     `json:"role" db:"role"`
+	TokenHash  []byte     `json:"-" db:"token_hash"`
+	InvitedBy  *uuid.UUID `json:"invited_by,omitempty" db:"invited_by"`
+	CreatedAt  time.Time  `json:"created_at" db:"created_at"`
+	ExpiresAt  time.Time  `json:"expires_at" db:"expires_at"`
+	AcceptedAt *time.Time `json:"accepted_at,omitempty" db:"accepted_at"`
+	AcceptedBy *uuid.UUID `json:"accepted_by,omitempty" db:"accepted_by"`
+}
+
+type CreateOrgRequest struct {
+	Name string `json:"name"`
+}
+
+type UpdateMemberRequest struct {
+	Role string `json:"role"`
+}
+
+type InviteMemberRequest struct {
+	Email string `json:"email"`
+	Role  string `json:"role"`
+}
+
+// InvitationResponse includes the invitation token, which is only returned
+// once and must be passed to the invitee
+type InvitationResponse struct {
+	OrgInvitation
+	Token string `json:"token"`
+}
+
+type AcceptInvitationRequest struct {
+	Token string `json:"token"`
+}
@@ -0,0 +1,53 @@
+package models
+
+import (
+	"regexp"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Segment is a named target expression. Its members are the devices matching
+// the expression when a notification is sent.
+type Segment struct {
+	ID          uuid.UUID  `json:"id" db:"id"`
+	OrgID       uuid.UUID  `json:"org_id" db:"org_id"`
+	UserID      *uuid.UUID `json:"user_id,omitempty" db:"user_id"`
+	Name        string     `json:"name" db:"name"`
+	Description string     `json:"description" db:"description"`
+	Expression  string     `json:"expression" db:"expression"`
+	CreatedAt   time.Time  `json:"created_at" db:"created_at"`
+	UpdatedAt   time.Time  `json:"updated_at" db:"updated_at"`
+}
+
+var segmentNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9._-]{0,99}$`)
+
+// IsValidSegmentName reports whether name is lowercase letters, digits, dots,
+// dashes and underscores, starting with a letter or digit
+func IsValidSegmentName(name string) bool {
+	return segmentNamePattern.MatchString(name)
+}
+
+type CreateSegmentRequest struct {
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+	Expression  string `json:"expression"`
+}
+
+// UpdateSegmentRequest changes only the fields that are present
+type UpdateSegmentRequest struct {
+	Name        *string `json:"name,omitempty"`
+	Description *string `json:"description,omitempty"`
+	Expression  *string `json:"expression,omitempty"`
+}
+
+type PreviewSegmentRequest struct {
+	Expression string `json:"expression"`
+}
+
+// SegmentPreview counts the devices a notification to the segment would
+// currently reach, with a sample of them
+type SegmentPreview struct {
+	MatchingDevices int      `json:"matching_devices"`
+	Sample          []Device `json:"sample"`
+}
@@ -0,0 +1,19 @@
+package models
+
+import (
+	"time"
+)
+
+// JWTSigningKey is an asymmetric key pair used to sign access tokens. The
+// private key is encrypted at rest; the public key is published in the JWKS.
+type JWTSigningKey struct {
+	KID                  string     `json:"kid" db:"kid"`
+	Algorithm            string     `json:"algorithm" db:"algorithm"`
+	PublicKey            []byte     `json:"-" db:"public_key"`
+	PrivateKeyCiphertext []byte     `json:"-" db:"private_key_ciphertext"`
+	PrivateKeyDEK        []byte     `json:"-" db:"private_key_dek"`
+	KEKID                string     `json:"-" db:"kek_id"`
+	CreatedAt            time.Time  `json:"created_at" db:"created_at"`
+	ActivatesAt          time.Time  `json:"activates_at" db:"activates_at"`
+	RetiredAt            *time.Time `json:"retired_at,omitempty" db:"retired_at"`
+}
@@ -0,0 +1,87 @@
+package models
+
+import (
+	"regexp"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Topic access levels. Read covers subscribing devices and reading the
+// history; write covers publishing.
+const (
+	TopicAccessReadWrite = "read-write"
+	TopicAccessReadOnly  = "read-only"
+	TopicAccessWriteOnly = "write-only"
+	TopicAccessDeny      = "deny"
+)
+
+// Topic is a named channel devices subscribe to. Topics are created when
+// first subscribed or published to.
+type Topic struct {
+	ID                    uuid.UUID `json:"id" db:"id"`
+	OrgID                 uuid.UUID `json:"org_id" db:"org_id"`
+	Name                  string    `json:"name" db:"name"`
+	Description           string    `json:"description" db:"description"`
+	DefaultAccess         string    `json:"default_access" db:"default_access"`
+	MessageRetentionHours int       `json:"message_retention_hours" db:"message_retention_hours"`
+	Subscribers           int       `json:"subscribers"`
+	CreatedAt             time.Time `json:"created_at" db:"created_at"`
+	UpdatedAt             time.Time `json:"updated_at" db:"updated_at"`
+}
+
+var topicNamePattern = regexp.MustCompile(`^[-_A-Za-z0-9]{1,64}$`)
+
+// IsValidTopicName reports whether name is 1-64 letters, digits, dashes and
+// underscores
+func IsValidTopicName(name string) bool {
+	return topicNamePattern.MatchString(name)
+}
+
+func IsValidTopicAccess(access string) bool {
+	switch access {
+	case TopicAccessReadWrite, TopicAccessReadOnly, TopicAccessWriteOnly, TopicAccessDeny:
+		return true
+	}
+	return false
+}
+
+// TopicAccessAllows reports whether the access level permits writing
+// (publishing) or, if write is false, reading
+func TopicAccessAllows(access string, write bool) bool {
+	if write {
+		return access == TopicAccessReadWrite || access == TopicAccessWriteOnly
+	}
+	return access == TopicAccessReadWrite || access == TopicAccessReadOnly
+}
+
+// TopicACLEntry overrides a topic's default access for one member
+type TopicACLEntry struct {
+	TopicID   uuid.UUID `json:"topic_id" db:"topic_id"`
+	UserID    uuid.UUID `json:"user_id" db:"user_id"`
+	Username  string    `json:"username" db:"username"`
+	Access    string    `json:"access" db:"access"`
+	CreatedAt time.Time `json:"created_at" db:"created_at"`
+}
+
+// UpdateTopicRequest changes only the fields that are present
+type UpdateTopicRequest struct {
+	Description           *string `json:"description,omitempty"`
+	DefaultAccess         *string `json:"default_access,omitempty"`
+	MessageRetentionHours *int    `json:"message_retention_hours,omitempty"`
+}
+
+type SetTopicAccessRequest struct {
+	Access string `json:"access"`
+}
+
+type SubscribeRequest struct {
+	Topic string `json:"topic"`
+}
+
+type TopicSubscription struct {
+	TopicID   uuid.UUID `json:"topic_id" db:"topic_id"`
+	Topic     string    `json:"topic" db:"topic"`
+	DeviceID  uuid.UUID `json:"device_id" db:"device_id"`
+	CreatedAt time.Time `json:"created_at" db:"created_at"`
+}
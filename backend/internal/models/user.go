@@ -7,14 +7,20 @@ import (
 )
 
 type User struct {
-	ID           uuid.UUID `json:"id" db:"id"`
-	Username     string    `json:"username" db:"username"`
-	Email        string    `json:"email" db:"email"`
-	PasswordHash string    `json:"-" db:"password_hash"`
-	APIKey       string    `json:"api_key,omitempty" db:"api_key"`
-	CreatedAt    time.Time `json:"created_at" db:"created_at"`
-	UpdatedAt    time.Time `json:"updated_at" db:"updated_at"`
-	IsActive     bool      `json:"is_active" db:"is_active"`
+	ID           uuid.UUID  `json:"id" db:"id"`
+	Username     string     `json:"username" db:"username"`
+	Email        string     `json:"email" db:"email"`
+	PasswordHash string     `json:"-" db:"password_hash"`
+	CreatedAt    time.Time  `json:"created_at" db:"created_at"`
+	UpdatedAt    time.Time  `json:"updated_at" db:"updated_at"`
+	IsActive     bool       `json:"is_active" db:"is_active"`
+	IsAdmin      bool       `json:"is_admin" db:"is_admin"`
+	DefaultOrgID *uuid.UUID `json:"default_org_id,omitempty" db:"default_org_id"`
+	// EmailVerifiedAt is nil until the user confirms the address
+	EmailVerifiedAt *time.Time `json:"email_verified_at" db:"email_verified_at"`
+
+	// APIKey is only set in the registration response; keys are stored hashed
+	APIKey string `json:"api_key,omitempty" db:"-"`
 }
 
 type RegisterRequest struct {
@@ -29,8 +35,33 @@ type LoginRequest struct {
 }
 
 type LoginResponse struct {
+	Token        string `json:"token"`
+	RefreshToken string `json:"refresh_token"`
+	User         User   `json:"user"`
+}
+
+type RefreshRequest struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
+// RefreshResponse carries a new access token and the refresh token that
+// replaces the one presented
+type RefreshResponse struct {
+	Token        string `json:"token"`
+	RefreshToken string `json:"refresh_token"`
+}
+
+type ForgotPasswordRequest struct {
+	Email string `json:"email"`
+}
+
+type ResetPasswordRequest struct {
+	Token    string `json:"token"`
+	Password string `json:"password"`
+}
+
+type VerifyEmailRequest struct {
 	Token string `json:"token"`
-	User  User   `json:"user"`
 }
 
 type APIKeyResponse struct {
@@ -4,6 +4,7 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"time"
 
 	"github.com/pushlab/backend/internal/models"
 )
@@ -28,3 +29,18 @@ func (p *Publisher) PublishNotification(ctx context.Context, job *models.Notific
 
 	return nil
 }
+
+// PublishNotificationDelayed queues a job that becomes visible to consumers
+// after the given delay
+func (p *Publisher) PublishNotificationDelayed(ctx context.Context, job *models.NotificationJob, delay time.Duration) error {
+	body, err := json.Marshal(job)
+	if err != nil {
+		return fmt.Errorf("failed to marshal notification job: %w", err)
+	}
+
+	if err := p.rmq.PublishDelayed(ctx, body, delay); err != nil {
+		return fmt.Errorf("failed to publish delayed notification: %w", err)
+	}
+
+	return nil
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 	"log"
+	"strconv"
 	"time"
 
 	amqp "github.com/rabbitmq/amqp091-go"
@@ -76,6 +77,25 @@ func (r *RabbitMQ) connect() error {
 		return fmt.Errorf("failed to declare DLQ: %w", err)
 	}
 
+	// Declare delay queue; expired messages are dead-lettered back onto the
+	// main queue
+	_, err = ch.QueueDeclare(
+		r.DelayQueueName(),
+		true,
+		false,
+		false,
+		false,
+		amqp.Table{
+			"x-dead-letter-exchange":    "",
+			"x-dead-letter-routing-key": r.queueName,
+		},
+	)
+	if err != nil {
+		ch.Close()
+		conn.Close()
+		return fmt.Errorf("failed to declare delay queue: %w", err)
+	}
+
 	r.conn = conn
 	r.channel = ch
 
@@ -115,6 +135,10 @@ func (r *RabbitMQ) QueueName() string {
 	return r.queueName
 }
 
+func (r *RabbitMQ) DelayQueueName() string {
+	return r.queueName + ".delay"
+}
+
 func (r *RabbitMQ) Close() error {
 	if r.channel != nil {
 		if err := r.channel.Close(); err != nil {
@@ -142,3 +166,22 @@ func (r *RabbitMQ) Publish(ctx context.Context, body []byte) error {
 		},
 	)
 }
+
+// PublishDelayed publishes a message that is delivered to the main queue once
+// the delay has elapsed
+func (r *RabbitMQ) PublishDelayed(ctx context.Context, body []byte, delay time.Duration) error {
+	return r.channel.PublishWithContext(
+		ctx,
+		"",                 // exchange
+		r.DelayQueueName(), // routing key
+		false,              // mandatory
+		false,              // immediate
+		amqp.Publishing{
+			DeliveryMode: amqp.Persistent,
+			ContentType:  "application/json",
+			Body:         body,
+			Timestamp:    time.Now(),
+			Expiration:   strconv.FormatInt(delay.Milliseconds(), 10),
+		},
+	)
+}
@@ -0,0 +1,80 @@
+// Package ratelimit implements token bucket rate limits, shared between API
+// instances through Redis or kept in memory
+package ratelimit
+
+import (
+	"context"
+	"log"
+	"math"
+	"sync/atomic"
+	"time"
+)
+
+// Limit allows PerMinute requests a minute on average, and bursts of up to
+// Burst requests
+type Limit struct {
+	PerMinute int
+	Burst     int
+}
+
+func (l Limit) perSecond() float64 {
+	return float64(l.PerMinute) / 60
+}
+
+// Result describes the bucket after a request
+type Result struct {
+	Allowed   bool
+	Limit     int
+	Remaining int
+	// RetryAfter is how long until the next request is allowed
+	RetryAfter time.Duration
+	// ResetAfter is how long until the bucket is full again
+	ResetAfter time.Duration
+}
+
+type Limiter interface {
+	// Allow takes a token from the bucket named key, if one is left
+	Allow(ctx context.Context, key string, limit Limit) (Result, error)
+}
+
+// result builds the Result for a bucket holding tokens after the request
+func result(allowed bool, tokens float64, limit Limit) Result {
+	rate := limit.perSecond()
+	res := Result{
+		Allowed:    allowed,
+		Limit:      limit.Burst,
+		Remaining:  int(math.Floor(tokens)),
+		ResetAfter: time.Duration((float64(limit.Burst) - tokens) / rate * float64(time.Second)),
+	}
+	if tokens < 1 {
+		res.RetryAfter = time.Duration((1 - tokens) / rate * float64(time.Second))
+	}
+	return res
+}
+
+// Fallback uses primary, and fallback while primary fails, e.g. when Redis
+// is unreachable
+func Fallback(primary, fallback Limiter) Limiter {
+	return &fallbackLimiter{primary: primary, fallback: fallback}
+}
+
+type fallbackLimiter struct {
+	primary  Limiter
+	fallback Limiter
+	failing  atomic.Bool
+}
+
+func (l *fallbackLimiter) Allow(ctx context.Context, key string, limit Limit) (Result, error) {
+	res, err := l.primary.Allow(ctx, key, limit)
+	if err == nil {
+		if l.failing.Swap(false) {
+			log.Printf("Rate limiter recovered")
+		}
+		return res, nil
+	}
+
+	if !l.failing.Swap(true) {
+		log.Printf("Rate limiter failed, limiting in memory: %v", err)
+	}
+	return l.fallback.Allow(ctx, key, limit)
+}
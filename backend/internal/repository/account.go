@@ -0,0 +1,157 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// ErrTokenUnavailable is returned when a password reset or verification
+// token is unknown, expired or already used
+var ErrTokenUnavailable = errors.New("token not found or no longer valid")
+
+// AccountRepository stores email verification and password reset tokens and
+// counts failed logins
+type AccountRepository struct {
+	db *pgxpool.Pool
+}
+
+func NewAccountRepository(db *pgxpool.Pool) *AccountRepository {
+	return &AccountRepository{db: db}
+}
+
+// CreateEmailVerification stores a token confirming that the user controls
+// email. Expired tokens are pruned on the way.
+func (r *AccountRepository) CreateEmailVerification(ctx context.Context, userID uuid.UUID, email string, tokenHash []byte, ttl time.Duration) error {
+	if _, err := r.db.Exec(ctx, `DELETE FROM email_verification_tokens WHERE expires_at < CURRENT_TIMESTAMP`); err != nil {
+		return fmt.Errorf("failed to prune verification tokens: %w", err)
+	}
+
+	query := `
+		INSERT INTO email_verification_tokens (token_hash, user_id, email, expires_at)
+		VALUES ($1, $2, $3, CURRENT_TIMESTAMP + make_interval(secs => $4))
+	`
+	if _, err := r.db.Exec(ctx, query, tokenHash, userID, email, ttl.Seconds()); err != nil {
+		return fmt.Errorf("failed to create verification token: %w", err)
+	}
+	return nil
+}
+
+// ConsumeEmailVerification deletes the token and returns the user and the
+// address it was sent to
+func (r *AccountRepository) ConsumeEmailVerification(ctx context.Context, tokenHash []byte) (uuid.UUID, string, error) {
+	query := `
+		DELETE FROM email_verification_tokens
+		WHERE token_hash = $1 AND expires_at > CURRENT_TIMESTAMP
+		RETURNING user_id, email
+	`
+	var userID uuid.UUID
+	var email string
+	err := r.db.QueryRow(ctx, query, tokenHash).Scan(&userID, &email)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return uuid.Nil, "", ErrTokenUnavailable
+	}
+	if err != nil {
+		return uuid.Nil, "", fmt.Errorf("failed to consume verification token: %w", err)
+	}
+	return userID, email, nil
+}
+
+// CreatePasswordReset stores a password reset token. Expired tokens are
+// pruned on the way.
+func (r *AccountRepository) CreatePasswordReset(ctx context.Context, userID uuid.UUID, tokenHash []byte, ttl time.Duration) error {
+	if _, err := r.db.Exec(ctx, `DELETE FROM password_reset_tokens WHERE expires_at < CURRENT_TIMESTAMP`); err != nil {
+		return fmt.Errorf("failed to prune password reset tokens: %w", err)
+	}
+
+	query := `
+		INSERT INTO password_reset_tokens (token_hash, user_id, expires_at)
+		VALUES ($1, $2, CURRENT_TIMESTAMP + make_interval(secs => $3))
+	`
+	if _, err := r.db.Exec(ctx, query, tokenHash, userID, ttl.Seconds()); err != nil {
+		return fmt.Errorf("failed to create password reset token: %w", err)
+	}
+	return nil
+}
+
+// ResetPassword consumes the token and sets the new password hash. All other
+// reset tokens of the user are invalidated as well.
+func (r *AccountRepository) ResetPassword(ctx context.Context, tokenHash []byte, passwordHash string) (uuid.UUID, error) {
+	tx, err := r.db.Begin(ctx)
+	if err != nil {
+		return uuid.Nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	query := `
+		DELETE FROM password_reset_tokens
+		WHERE token_hash = $1 AND expires_at > CURRENT_TIMESTAMP
+		RETURNING user_id
+	`
+	var userID uuid.UUID
+	err = tx.QueryRow(ctx, query, tokenHash).Scan(&userID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return uuid.Nil, ErrTokenUnavailable
+	}
+	if err != nil {
+		return uuid.Nil, fmt.Errorf("failed to consume password reset token: %w", err)
+	}
+
+	if _, err := tx.Exec(ctx, `DELETE FROM password_reset_tokens WHERE user_id = $1`, userID); err != nil {
+		return uuid.Nil, fmt.Errorf("failed to delete password reset tokens: %w", err)
+	}
+
+	query = `UPDATE users SET password_hash = $2, updated_at = CURRENT_TIMESTAMP WHERE id = $1`
+	if _, err := tx.Exec(ctx, query, userID, passwordHash); err != nil {
+		return uuid.Nil, fmt.Errorf("failed to update password: %w", err)
+	}
+
+	return userID, tx.Commit(ctx)
+}
+
+// RecordLoginFailure counts a failed login for the username and client IP.
+// Failures older than a day are pruned on the way.
+func (r *AccountRepository) RecordLoginFailure(ctx context.Context, username, ip string) error {
+	if _, err := r.db.Exec(ctx, `DELETE FROM login_failures WHERE created_at < CURRENT_TIMESTAMP - INTERVAL '1 day'`); err != nil {
+		return fmt.Errorf("failed to prune login failures: %w", err)
+	}
+
+	query := `INSERT INTO login_failures (username, ip) VALUES ($1, $2)`
+	if _, err := r.db.Exec(ctx, query, username, ip); err != nil {
+		return fmt.Errorf("failed to record login failure: %w", err)
+	}
+	return nil
+}
+
+// CountLoginFailures returns the failures for the username and for the
+// client IP within window
+func (r *AccountRepository) CountLoginFailures(ctx context.Context, username, ip string, window time.Duration) (int, int, error) {
+	query := `
+		SELECT
+			COUNT(*) FILTER (WHERE username = $1),
+			COUNT(*) FILTER (WHERE ip = $2)
+		FROM login_failures
+		WHERE (username = $1 OR ip = $2)
+		  AND created_at > CURRENT_TIMESTAMP - make_interval(secs => $3)
+	`
+	var accountFailures, ipFailures int
+	err := r.db.QueryRow(ctx, query, username, ip, window.Seconds()).Scan(&accountFailures, &ipFailures)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to count login failures: %w", err)
+	}
+	return accountFailures, ipFailures, nil
+}
+
+// ClearLoginFailures forgets the failures of a username after it signed in
+// or reset its password
+func (r *AccountRepository) ClearLoginFailures(ctx context.Context, username string) error {
+	if _, err := r.db.Exec(ctx, `DELETE FROM login_failures WHERE username = $1`, username); err != nil {
+		return fmt.Errorf("failed to clear login failures: %w", err)
+	}
+	return nil
+}
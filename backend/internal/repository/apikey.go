@@ -0,0 +1,135 @@
+package repository
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/pushlab/backend/internal/models"
+)
+
+const apiKeyColumns = `id, org_id, user_id, name, prefix, key_hash, created_at, last_used_at, expires_at, revoked_at,
+	scopes, allowed_tags, allowed_ips`
+
+type APIKeyRepository struct {
+	db *pgxpool.Pool
+}
+
+func NewAPIKeyRepository(db *pgxpool.Pool) *APIKeyRepository {
+	return &APIKeyRepository{db: db}
+}
+
+func (r *APIKeyRepository) Create(ctx context.Context, key *models.APIKey) error {
+	query := `
+		INSERT INTO api_keys (org_id, user_id, name, prefix, key_hash, expires_at, scopes, allowed_tags, allowed_ips)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+		RETURNING id, created_at
+	`
+	return r.db.QueryRow(ctx, query,
+		key.OrgID, key.UserID, key.Name, key.Prefix, key.KeyHash, key.ExpiresAt,
+		nonNil(key.Scopes), nonNil(key.AllowedTags), nonNil(key.AllowedIPs),
+	).Scan(&key.ID, &key.CreatedAt)
+}
+
+func (r *APIKeyRepository) GetByPrefix(ctx context.Context, prefix string) (*models.APIKey, error) {
+	var key models.APIKey
+	query := `SELECT ` + apiKeyColumns + ` FROM api_keys WHERE prefix = $1`
+	err := r.db.QueryRow(ctx, query, prefix).Scan(apiKeyFields(&key)...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get API key: %w", err)
+	}
+	return &key, nil
+}
+
+func (r *APIKeyRepository) GetByID(ctx context.Context, id uuid.UUID) (*models.APIKey, error) {
+	var key models.APIKey
+	query := `SELECT ` + apiKeyColumns + ` FROM api_keys WHERE id = $1`
+	err := r.db.QueryRow(ctx, query, id).Scan(apiKeyFields(&key)...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get API key: %w", err)
+	}
+	return &key, nil
+}
+
+// GetByUserAndOrg lists the user's keys for an organization
+func (r *APIKeyRepository) GetByUserAndOrg(ctx context.Context, userID, orgID uuid.UUID) ([]models.APIKey, error) {
+	query := `
+		SELECT ` + apiKeyColumns + `
+		FROM api_keys
+		WHERE user_id = $1 AND org_id = $2
+		ORDER BY created_at DESC
+	`
+	rows, err := r.db.Query(ctx, query, userID, orgID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query API keys: %w", err)
+	}
+	defer rows.Close()
+
+	var keys []models.APIKey
+	for rows.Next() {
+		var key models.APIKey
+		if err := rows.Scan(apiKeyFields(&key)...); err != nil {
+			return nil, fmt.Errorf("failed to scan API key: %w", err)
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// Update saves the key's name, scopes and restrictions
+func (r *APIKeyRepository) Update(ctx context.Context, key *models.APIKey) error {
+	query := `
+		UPDATE api_keys
+		SET name = $2, scopes = $3, allowed_tags = $4, allowed_ips = $5
+		WHERE id = $1
+	`
+	_, err := r.db.Exec(ctx, query,
+		key.ID, key.Name, nonNil(key.Scopes), nonNil(key.AllowedTags), nonNil(key.AllowedIPs),
+	)
+	return err
+}
+
+// Revoke permanently disables a key; revoked keys stay listed for reference
+func (r *APIKeyRepository) Revoke(ctx context.Context, id uuid.UUID) error {
+	query := `UPDATE api_keys SET revoked_at = CURRENT_TIMESTAMP WHERE id = $1 AND revoked_at IS NULL`
+	_, err := r.db.Exec(ctx, query, id)
+	return err
+}
+
+// UpdateLastUsed records key usage, at most once a minute per key
+func (r *APIKeyRepository) UpdateLastUsed(ctx context.Context, id uuid.UUID) error {
+	query := `
+		UPDATE api_keys SET last_used_at = CURRENT_TIMESTAMP
+		WHERE id = $1 AND (last_used_at IS NULL OR last_used_at < CURRENT_TIMESTAMP - INTERVAL '1 minute')
+	`
+	_, err := r.db.Exec(ctx, query, id)
+	return err
+}
+
+func apiKeyFields(key *models.APIKey) []interface{} {
+	return []interface{}{
+		&key.ID, &key.OrgID, &key.UserID, &key.Name, &key.Prefix, &key.KeyHash,
+		&key.CreatedAt, &key.LastUsedAt, &key.ExpiresAt, &key.RevokedAt,
+		&key.Scopes, &key.AllowedTags, &key.AllowedIPs,
+	}
+}
+
+// nonNil stores empty lists as '{}' rather than NULL
+func nonNil(values []string) []string {
+	if values == nil {
+		return []string{}
+	}
+	return values
+}
+
+// RevokeAllForUser revokes every key of the user in all organizations and
+// returns how many were revoked
+func (r *APIKeyRepository) RevokeAllForUser(ctx context.Context, userID uuid.UUID) (int64, error) {
+	query := `UPDATE api_keys SET revoked_at = CURRENT_TIMESTAMP WHERE user_id = $1 AND revoked_at IS NULL`
+	tag, err := r.db.Exec(ctx, query, userID)
+	if err != nil {
+		return 0, fmt.Errorf("failed to revoke API keys: %w", err)
+	}
+	return tag.RowsAffected(), nil
+}
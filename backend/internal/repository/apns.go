@@ -3,12 +3,31 @@ package repository
 import (
 	"context"
 	"fmt"
+	"time"
 
 	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgxpool"
 	"github.com/pushlab/backend/internal/models"
 )
 
+const apnsCredentialColumns = `id, org_id, user_id, team_id, key_id, bundle_id, environment, private_key_path,
+		       created_at, is_active, private_key_ciphertext, private_key_dek, kek_id,
+		       auth_type, certificate_expires_at, last_success_at, last_error_at, last_error,
+		       error_count, provider_error, provider_error_at, expiry_alerted_at`
+
+// credentialFields returns scan destinations matching apnsCredentialColumns
+func credentialFields(cred *models.APNsCredential) []interface{} {
+	return []interface{}{
+		&cred.ID, &cred.OrgID, &cred.UserID, &cred.TeamID, &cred.KeyID, &cred.BundleID,
+		&cred.Environment, &cred.PrivateKeyPath, &cred.CreatedAt, &cred.IsActive,
+		&cred.PrivateKeyCiphertext, &cred.PrivateKeyDEK, &cred.KEKID,
+		&cred.AuthType, &cred.CertificateExpiresAt, &cred.LastSuccessAt, &cred.LastErrorAt,
+		&cred.LastError, &cred.ErrorCount, &cred.ProviderError, &cred.ProviderErrorAt,
+		&cred.ExpiryAlertedAt,
+	}
+}
+
 type APNsRepository struct {
 	db *pgxpool.Pool
 }
@@ -17,64 +36,239 @@ func NewAPNsRepository(db *pgxpool.Pool) *APNsRepository {
 	return &APNsRepository{db: db}
 }
 
+// Create stores a credential. Uploading again for the same bundle and
+// environment replaces (rotates) the existing credential in place and resets
+// its health.
 func (r *APNsRepository) Create(ctx context.Context, cred *models.APNsCredential) error {
 	query := `
-		INSERT INTO apns_credentials (user_id, team_id, key_id, bundle_id, environment, private_key_path)
-		VALUES ($1, $2, $3, $4, $5, $6)
+		INSERT INTO apns_credentials (org_id, user_id, team_id, key_id, bundle_id, environment, private_key_path,
+		                              private_key_ciphertext, private_key_dek, kek_id,
+		                              auth_type, certificate_expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)
+		ON CONFLICT (org_id, bundle_id, environment) DO UPDATE
+		SET user_id = EXCLUDED.user_id,
+		    auth_type = EXCLUDED.auth_type,
+		    certificate_expires_at = EXCLUDED.certificate_expires_at,
+		    team_id = EXCLUDED.team_id,
+		    key_id = EXCLUDED.key_id,
+		    private_key_path = EXCLUDED.private_key_path,
+		    private_key_ciphertext = EXCLUDED.private_key_ciphertext,
+		    private_key_dek = EXCLUDED.private_key_dek,
+		    kek_id = EXCLUDED.kek_id,
+		    created_at = CURRENT_TIMESTAMP,
+		    is_active = true,
+		    last_success_at = NULL,
+		    last_error_at = NULL,
+		    last_error = NULL,
+		    error_count = 0,
+		    provider_error = NULL,
+		    provider_error_at = NULL,
+		    expiry_alerted_at = NULL
 		RETURNING id, created_at, is_active
 	`
 	return r.db.QueryRow(ctx, query,
-		cred.UserID, cred.TeamID, cred.KeyID, cred.BundleID, cred.Environment, cred.PrivateKeyPath,
+		cred.OrgID, cred.UserID, cred.TeamID, cred.KeyID, cred.BundleID, cred.Environment, cred.PrivateKeyPath,
+		cred.PrivateKeyCiphertext, cred.PrivateKeyDEK, cred.KEKID,
+		cred.AuthType, cred.CertificateExpiresAt,
 	).Scan(&cred.ID, &cred.CreatedAt, &cred.IsActive)
 }
 
-func (r *APNsRepository) GetByUserAndBundle(ctx context.Context, userID uuid.UUID, bundleID, environment string) (*models.APNsCredential, error) {
+func (r *APNsRepository) GetByID(ctx context.Context, id uuid.UUID) (*models.APNsCredential, error) {
 	var cred models.APNsCredential
 	query := `
-		SELECT id, user_id, team_id, key_id, bundle_id, environment, private_key_path, created_at, is_active
+		SELECT ` + apnsCredentialColumns + `
 		FROM apns_credentials
-		WHERE user_id = $1 AND bundle_id = $2 AND environment = $3 AND is_active = true
+		WHERE id = $1 AND is_active = true
 	`
-	err := r.db.QueryRow(ctx, query, userID, bundleID, environment).Scan(
-		&cred.ID, &cred.UserID, &cred.TeamID, &cred.KeyID, &cred.BundleID,
-		&cred.Environment, &cred.PrivateKeyPath, &cred.CreatedAt, &cred.IsActive,
-	)
+	err := r.db.QueryRow(ctx, query, id).Scan(credentialFields(&cred)...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get APNs credential: %w", err)
+	}
+	return &cred, nil
+}
+
+func (r *APNsRepository) GetByOrgAndBundle(ctx context.Context, orgID uuid.UUID, bundleID, environment string) (*models.APNsCredential, error) {
+	var cred models.APNsCredential
+	query := `
+		SELECT ` + apnsCredentialColumns + `
+		FROM apns_credentials
+		WHERE org_id = $1 AND bundle_id = $2 AND environment = $3 AND is_active = true
+	`
+	err := r.db.QueryRow(ctx, query, orgID, bundleID, environment).Scan(credentialFields(&cred)...)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get APNs credential: %w", err)
 	}
 	return &cred, nil
 }
 
-func (r *APNsRepository) GetByUserID(ctx context.Context, userID uuid.UUID) ([]models.APNsCredential, error) {
+func (r *APNsRepository) GetByOrgID(ctx context.Context, orgID uuid.UUID) ([]models.APNsCredential, error) {
 	query := `
-		SELECT id, user_id, team_id, key_id, bundle_id, environment, private_key_path, created_at, is_active
+		SELECT ` + apnsCredentialColumns + `
 		FROM apns_credentials
-		WHERE user_id = $1 AND is_active = true
+		WHERE org_id = $1 AND is_active = true
 		ORDER BY created_at DESC
 	`
-	rows, err := r.db.Query(ctx, query, userID)
+	rows, err := r.db.Query(ctx, query, orgID)
 	if err != nil {
 		return nil, fmt.Errorf("failed to query APNs credentials: %w", err)
 	}
 	defer rows.Close()
 
+	return r.scanCredentials(rows)
+}
+
+// Delete deactivates a credential and discards its encrypted key
+func (r *APNsRepository) Delete(ctx context.Context, id uuid.UUID) error {
+	query := `
+		UPDATE apns_credentials
+		SET is_active = false, private_key_ciphertext = NULL, private_key_dek = NULL, kek_id = NULL
+		WHERE id = $1
+	`
+	_, err := r.db.Exec(ctx, query, id)
+	return err
+}
+
+// Credential health. These columns are left out of the credential change
+// trigger (migration 026), so recording health never evicts cached clients;
+// keep it that way when adding health fields.
+
+// RecordSuccess marks the credential as having authenticated with APNs and
+// clears its errors. Writes are skipped while nothing changes except the
+// timestamp, to avoid an update per push.
+func (r *APNsRepository) RecordSuccess(ctx context.Context, id uuid.UUID) error {
+	query := `
+		UPDATE apns_credentials
+		SET last_success_at = CURRENT_TIMESTAMP, error_count = 0,
+		    provider_error = NULL, provider_error_at = NULL
+		WHERE id = $1
+		  AND (last_success_at IS NULL OR last_success_at < CURRENT_TIMESTAMP - INTERVAL '1 minute'
+		       OR error_count > 0 OR provider_error IS NOT NULL)
+	`
+	_, err := r.db.Exec(ctx, query, id)
+	return err
+}
+
+// RecordError counts a failed attempt to reach APNs with the credential and
+// returns the number of consecutive errors
+func (r *APNsRepository) RecordError(ctx context.Context, id uuid.UUID, reason string) (int, error) {
+	var errorCount int
+	query := `
+		UPDATE apns_credentials
+		SET error_count = error_count + 1, last_error = $2, last_error_at = CURRENT_TIMESTAMP
+		WHERE id = $1
+		RETURNING error_count
+	`
+	if err := r.db.QueryRow(ctx, query, id, reason).Scan(&errorCount); err != nil {
+		return 0, fmt.Errorf("failed to record credential error: %w", err)
+	}
+	return errorCount, nil
+}
+
+// RecordProviderError stores an authentication error returned by Apple, such
+// as InvalidProviderToken. It reports whether the credential was previously
+// free of provider errors, i.e. whether it has just gone bad.
+func (r *APNsRepository) RecordProviderError(ctx context.Context, id uuid.UUID, reason string) (bool, error) {
+	var first bool
+	query := `
+		UPDATE apns_credentials c
+		SET provider_error = $2, provider_error_at = CURRENT_TIMESTAMP,
+		    error_count = c.error_count + 1, last_error = $2, last_error_at = CURRENT_TIMESTAMP
+		FROM (SELECT id, provider_error FROM apns_credentials WHERE id = $1 FOR UPDATE) prev
+		WHERE c.id = prev.id
+		RETURNING prev.provider_error IS NULL
+	`
+	if err := r.db.QueryRow(ctx, query, id, reason).Scan(&first); err != nil {
+		return false, fmt.Errorf("failed to record provider error: %w", err)
+	}
+	return first, nil
+}
+
+// GetCertificatesToAlert returns active certificate credentials that expire
+// within the warning window and whose owner has not been alerted yet, or that
+// have expired since the last alert
+func (r *APNsRepository) GetCertificatesToAlert(ctx context.Context, warning time.Duration) ([]models.APNsCredential, error) {
+	query := `
+		SELECT ` + apnsCredentialColumns + `
+		FROM apns_credentials
+		WHERE auth_type = 'certificate' AND is_active = true
+		  AND certificate_expires_at < CURRENT_TIMESTAMP + make_interval(secs => $1)
+		  AND (expiry_alerted_at IS NULL
+		       OR (certificate_expires_at <= CURRENT_TIMESTAMP AND expiry_alerted_at < certificate_expires_at))
+	`
+	rows, err := r.db.Query(ctx, query, warning.Seconds())
+	if err != nil {
+		return nil, fmt.Errorf("failed to query expiring certificates: %w", err)
+	}
+	defer rows.Close()
+
+	return r.scanCredentials(rows)
+}
+
+// MarkExpiryAlerted records that the owner was told about certificate expiry
+func (r *APNsRepository) MarkExpiryAlerted(ctx context.Context, id uuid.UUID) error {
+	query := `UPDATE apns_credentials SET expiry_alerted_at = CURRENT_TIMESTAMP WHERE id = $1`
+	_, err := r.db.Exec(ctx, query, id)
+	return err
+}
+
+// UpdateKeyMaterial replaces the stored key material of a credential, e.g.
+// after importing a legacy key file or re-wrapping under a new master key
+func (r *APNsRepository) UpdateKeyMaterial(ctx context.Context, cred *models.APNsCredential) error {
+	query := `
+		UPDATE apns_credentials
+		SET private_key_path = $2, private_key_ciphertext = $3, private_key_dek = $4, kek_id = $5
+		WHERE id = $1
+	`
+	_, err := r.db.Exec(ctx, query,
+		cred.ID, cred.PrivateKeyPath, cred.PrivateKeyCiphertext, cred.PrivateKeyDEK, cred.KEKID,
+	)
+	return err
+}
+
+// UpdateKeyMaterialBatch updates the key material of several credentials in
+// the caller's transaction
+func (r *APNsRepository) UpdateKeyMaterialBatch(ctx context.Context, tx pgx.Tx, creds []models.APNsCredential) error {
+	query := `
+		UPDATE apns_credentials
+		SET private_key_path = $2, private_key_ciphertext = $3, private_key_dek = $4, kek_id = $5
+		WHERE id = $1
+	`
+	for _, cred := range creds {
+		if _, err := tx.Exec(ctx, query,
+			cred.ID, cred.PrivateKeyPath, cred.PrivateKeyCiphertext, cred.PrivateKeyDEK, cred.KEKID,
+		); err != nil {
+			return fmt.Errorf("failed to update credential %s: %w", cred.ID, err)
+		}
+	}
+
+	return nil
+}
+
+// GetAll returns every credential, including inactive ones, for maintenance
+// commands
+func (r *APNsRepository) GetAll(ctx context.Context) ([]models.APNsCredential, error) {
+	query := `
+		SELECT ` + apnsCredentialColumns + `
+		FROM apns_credentials
+		ORDER BY created_at
+	`
+	rows, err := r.db.Query(ctx, query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query APNs credentials: %w", err)
+	}
+	defer rows.Close()
+
+	return r.scanCredentials(rows)
+}
+
+func (r *APNsRepository) scanCredentials(rows pgx.Rows) ([]models.APNsCredential, error) {
 	var credentials []models.APNsCredential
 	for rows.Next() {
 		var cred models.APNsCredential
-		if err := rows.Scan(
-			&cred.ID, &cred.UserID, &cred.TeamID, &cred.KeyID, &cred.BundleID,
-			&cred.Environment, &cred.PrivateKeyPath, &cred.CreatedAt, &cred.IsActive,
-		); err != nil {
+		if err := rows.Scan(credentialFields(&cred)...); err != nil {
 			return nil, fmt.Errorf("failed to scan APNs credential: %w", err)
 		}
 		credentials = append(credentials, cred)
 	}
-
 	return credentials, nil
 }
-
-func (r *APNsRepository) Delete(ctx context.Context, id uuid.UUID) error {
-	query := `UPDATE apns_credentials SET is_active = false WHERE id = $1`
-	_, err := r.db.Exec(ctx, query, id)
-	return err
-}
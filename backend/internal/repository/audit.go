@@ -0,0 +1,115 @@
+package repository
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/pushlab/backend/internal/models"
+)
+
+type AuditRepository struct {
+	db *pgxpool.Pool
+}
+
+func NewAuditRepository(db *pgxpool.Pool) *AuditRepository {
+	return &AuditRepository{db: db}
+}
+
+func (r *AuditRepository) Create(ctx context.Context, event *models.AuditEvent) error {
+	query := `
+		INSERT INTO audit_events (
+			org_id, actor_user_id, actor_username, actor_api_key_id, action,
+			target_type, target_id, ip, user_agent, before, after
+		)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)
+		RETURNING id, created_at
+	`
+	return r.db.QueryRow(ctx, query,
+		event.OrgID, event.ActorUserID, event.ActorUsername, event.ActorAPIKeyID, event.Action,
+		event.TargetType, event.TargetID, event.IP, event.UserAgent, nullJSON(event.Before), nullJSON(event.After),
+	).Scan(&event.ID, &event.CreatedAt)
+}
+
+// List returns the events matching filter, newest first
+func (r *AuditRepository) List(ctx context.Context, filter models.AuditFilter) ([]models.AuditEvent, error) {
+	var conditions []string
+	var args []any
+	arg := func(value any) string {
+		args = append(args, value)
+		return fmt.Sprintf("$%d", len(args))
+	}
+
+	if filter.OrgID != nil {
+		conditions = append(conditions, "org_id = "+arg(*filter.OrgID))
+	}
+	if filter.AccountUserID != nil {
+		conditions = append(conditions, "org_id IS NULL",
+			"target_type = "+arg(models.AuditTargetUser),
+			"target_id = "+arg(filter.AccountUserID.String()))
+	}
+	if filter.Action != "" {
+		if strings.Contains(filter.Action, ".") {
+			conditions = append(conditions, "action = "+arg(filter.Action))
+		} else {
+			conditions = append(conditions, "action LIKE "+arg(filter.Action+".%"))
+		}
+	}
+	if filter.ActorUserID != nil {
+		conditions = append(conditions, "actor_user_id = "+arg(*filter.ActorUserID))
+	}
+	if filter.TargetType != "" {
+		conditions = append(conditions, "target_type = "+arg(filter.TargetType))
+	}
+	if filter.TargetID != "" {
+		conditions = append(conditions, "target_id = "+arg(filter.TargetID))
+	}
+	if filter.Since != nil {
+		conditions = append(conditions, "created_at >= "+arg(*filter.Since))
+	}
+	if filter.Until != nil {
+		conditions = append(conditions, "created_at < "+arg(*filter.Until))
+	}
+	if filter.BeforeID > 0 {
+		conditions = append(conditions, "id < "+arg(filter.BeforeID))
+	}
+	if len(conditions) == 0 {
+		return nil, fmt.Errorf("audit filter must select an organization or account")
+	}
+
+	query := `
+		SELECT id, org_id, actor_user_id, actor_username, actor_api_key_id, action,
+		       target_type, target_id, ip, user_agent, before, after, created_at
+		FROM audit_events
+		WHERE ` + strings.Join(conditions, " AND ") + `
+		ORDER BY id DESC
+		LIMIT ` + arg(filter.Limit)
+
+	rows, err := r.db.Query(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query audit events: %w", err)
+	}
+	defer rows.Close()
+
+	events := []models.AuditEvent{}
+	for rows.Next() {
+		var event models.AuditEvent
+		if err := rows.Scan(
+			&event.ID, &event.OrgID, &event.ActorUserID, &event.ActorUsername, &event.ActorAPIKeyID, &event.Action,
+			&event.TargetType, &event.TargetID, &event.IP, &event.UserAgent, &event.Before, &event.After, &event.CreatedAt,
+		); err != nil {
+			return nil, fmt.Errorf("failed to scan audit event: %w", err)
+		}
+		events = append(events, event)
+	}
+	return events, rows.Err()
+}
+
+// nullJSON stores an empty document as NULL
+func nullJSON(doc []byte) any {
+	if len(doc) == 0 {
+		return nil
+	}
+	return string(doc)
+}
@@ -0,0 +1,119 @@
+package repository
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/pushlab/backend/internal/models"
+)
+
+type CircuitRepository struct {
+	db *pgxpool.Pool
+}
+
+func NewCircuitRepository(db *pgxpool.Pool) *CircuitRepository {
+	return &CircuitRepository{db: db}
+}
+
+func (r *CircuitRepository) Upsert(ctx context.Context, state *models.APNsCircuitState) error {
+	query := `
+		INSERT INTO apns_circuit_states (credential_id, environment, state, consecutive_failures, opened_at, updated_at, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		ON CONFLICT (credential_id, environment) DO UPDATE
+		SET state = EXCLUDED.state,
+		    consecutive_failures = EXCLUDED.consecutive_failures,
+		    opened_at = EXCLUDED.opened_at,
+		    updated_at = EXCLUDED.updated_at,
+		    expires_at = EXCLUDED.expires_at
+	`
+	_, err := r.db.Exec(ctx, query,
+		state.CredentialID, state.Environment, state.State,
+		state.ConsecutiveFailures, state.OpenedAt, state.UpdatedAt, state.ExpiresAt,
+	)
+	return err
+}
+
+// GetActive returns the open and half-open circuits that have not expired,
+// for workers to restore at startup
+func (r *CircuitRepository) GetActive(ctx context.Context) ([]models.APNsCircuitState, error) {
+	query := `
+		SELECT cs.credential_id, c.bundle_id, cs.environment, cs.state,
+		       cs.consecutive_failures, cs.opened_at, cs.updated_at, cs.expires_at
+		FROM apns_circuit_states cs
+		JOIN apns_credentials c ON cs.credential_id = c.id
+		WHERE cs.state <> 'closed' AND cs.expires_at > NOW()
+	`
+	rows, err := r.db.Query(ctx, query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query circuit states: %w", err)
+	}
+	defer rows.Close()
+	return scanCircuitStates(rows)
+}
+
+// GetByOrgID returns the organization's circuits. Expired states are reported
+// as closed.
+func (r *CircuitRepository) GetByOrgID(ctx context.Context, orgID uuid.UUID) ([]models.APNsCircuitState, error) {
+	query := `
+		SELECT cs.credential_id, c.bundle_id, cs.environment,
+		       CASE WHEN cs.expires_at <= NOW() THEN 'closed' ELSE cs.state END,
+		       cs.consecutive_failures, cs.opened_at, cs.updated_at, cs.expires_at
+		FROM apns_circuit_states cs
+		JOIN apns_credentials c ON cs.credential_id = c.id
+		WHERE c.org_id = $1
+		ORDER BY cs.updated_at DESC
+	`
+	rows, err := r.db.Query(ctx, query, orgID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query circuit states: %w", err)
+	}
+	defer rows.Close()
+	return scanCircuitStates(rows)
+}
+
+func scanCircuitStates(rows pgx.Rows) ([]models.APNsCircuitState, error) {
+	var states []models.APNsCircuitState
+	for rows.Next() {
+		var state models.APNsCircuitState
+		if err := rows.Scan(
+			&state.CredentialID, &state.BundleID, &state.Environment, &state.State,
+			&state.ConsecutiveFailures, &state.OpenedAt, &state.UpdatedAt, &state.ExpiresAt,
+		); err != nil {
+			return nil, fmt.Errorf("failed to scan circuit state: %w", err)
+		}
+		states = append(states, state)
+	}
+
+	return states, nil
+}
+
+// CountByState returns the number of unexpired circuits in each non-closed
+// state
+func (r *CircuitRepository) CountByState(ctx context.Context) (map[string]int, error) {
+	query := `
+		SELECT state, COUNT(*)
+		FROM apns_circuit_states
+		WHERE state <> 'closed' AND expires_at > NOW()
+		GROUP BY state
+	`
+	rows, err := r.db.Query(ctx, query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to count circuit states: %w", err)
+	}
+	defer rows.Close()
+
+	counts := make(map[string]int)
+	for rows.Next() {
+		var state string
+		var count int
+		if err := rows.Scan(&state, &count); err != nil {
+			return nil, fmt.Errorf("failed to scan circuit count: %w", err)
+		}
+		counts[state] = count
+	}
+
+	return counts, nil
+}
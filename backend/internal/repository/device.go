@@ -2,15 +2,22 @@ package repository
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"strconv"
 	"time"
 
 	"github.com/google/uuid"
 	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgxpool"
 	"github.com/pushlab/backend/internal/models"
+	"github.com/pushlab/backend/internal/targeting"
 )
 
+// ErrTokenInUse means the token is active on a device of another user or
+// organization
+var ErrTokenInUse = errors.New("device token is registered to another user's device")
+
 type DeviceRepository struct {
 	db *pgxpool.Pool
 }
@@ -21,23 +28,31 @@ func NewDeviceRepository(db *pgxpool.Pool) *DeviceRepository {
 
 func (r *DeviceRepository) Create(ctx context.Context, device *models.Device) error {
 	query := `
-		INSERT INTO devices (user_id, device_name, device_identifier, tags)
-		VALUES ($1, $2, $3, $4)
+		INSERT INTO devices (org_id, user_id, device_name, device_identifier, tags,
+		                     platform, os_version, app_version, app_build, model, timezone, locale, push_authorization)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13)
 		RETURNING id, created_at, updated_at
 	`
-	return r.db.QueryRow(ctx, query, device.UserID, device.DeviceName, device.DeviceIdentifier, device.Tags).
+	m := device.DeviceMetadata
+	return r.db.QueryRow(ctx, query, device.OrgID, device.UserID, device.DeviceName, device.DeviceIdentifier, device.Tags,
+		m.Platform, m.OSVersion, m.AppVersion, m.AppBuild, m.Model, m.Timezone, m.Locale, m.PushAuthorization).
 		Scan(&device.ID, &device.CreatedAt, &device.UpdatedAt)
 }
 
 func (r *DeviceRepository) GetByID(ctx context.Context, id uuid.UUID) (*models.Device, error) {
 	var device models.Device
 	query := `
-		SELECT id, user_id, device_name, device_identifier, tags, created_at, updated_at, last_seen_at
+		SELECT id, org_id, user_id, device_name, device_identifier, tags,
+		       platform, os_version, app_version, app_build, model, timezone, locale, push_authorization,
+		       created_at, updated_at, last_seen_at, stale_at, heartbeat_window_minutes, offline_alerted_at
 		FROM devices WHERE id = $1
 	`
 	err := r.db.QueryRow(ctx, query, id).Scan(
-		&device.ID, &device.UserID, &device.DeviceName, &device.DeviceIdentifier,
-		&device.Tags, &device.CreatedAt, &device.UpdatedAt, &device.LastSeenAt,
+		&device.ID, &device.OrgID, &device.UserID, &device.DeviceName, &device.DeviceIdentifier,
+		&device.Tags, &device.Platform, &device.OSVersion, &device.AppVersion, &device.AppBuild,
+		&device.Model, &device.Timezone, &device.Locale, &device.PushAuthorization,
+		&device.CreatedAt, &device.UpdatedAt, &device.LastSeenAt, &device.StaleAt,
+		&device.HeartbeatWindowMinutes, &device.OfflineAlertedAt,
 	)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get device: %w", err)
@@ -45,12 +60,14 @@ func (r *DeviceRepository) GetByID(ctx context.Context, id uuid.UUID) (*models.D
 	return &device, nil
 }
 
-func (r *DeviceRepository) GetByUserID(ctx context.Context, userID uuid.UUID) ([]models.Device, error) {
+func (r *DeviceRepository) GetByOrgID(ctx context.Context, orgID uuid.UUID) ([]models.Device, error) {
 	query := `
-		SELECT id, user_id, device_name, device_identifier, tags, created_at, updated_at, last_seen_at
-		FROM devices WHERE user_id = $1 ORDER BY created_at DESC
+		SELECT id, org_id, user_id, device_name, device_identifier, tags,
+		       platform, os_version, app_version, app_build, model, timezone, locale, push_authorization,
+		       created_at, updated_at, last_seen_at, stale_at, heartbeat_window_minutes, offline_alerted_at
+		FROM devices WHERE org_id = $1 ORDER BY created_at DESC
 	`
-	rows, err := r.db.Query(ctx, query, userID)
+	rows, err := r.db.Query(ctx, query, orgID)
 	if err != nil {
 		return nil, fmt.Errorf("failed to query devices: %w", err)
 	}
@@ -60,8 +77,11 @@ func (r *DeviceRepository) GetByUserID(ctx context.Context, userID uuid.UUID) ([
 	for rows.Next() {
 		var device models.Device
 		if err := rows.Scan(
-			&device.ID, &device.UserID, &device.DeviceName, &device.DeviceIdentifier,
-			&device.Tags, &device.CreatedAt, &device.UpdatedAt, &device.LastSeenAt,
+			&device.ID, &device.OrgID, &device.UserID, &device.DeviceName, &device.DeviceIdentifier,
+			&device.Tags, &device.Platform, &device.OSVersion, &device.AppVersion, &device.AppBuild,
+			&device.Model, &device.Timezone, &device.Locale, &device.PushAuthorization,
+			&device.CreatedAt, &device.UpdatedAt, &device.LastSeenAt, &device.StaleAt,
+			&device.HeartbeatWindowMinutes, &device.OfflineAlertedAt,
 		); err != nil {
 			return nil, fmt.Errorf("failed to scan device: %w", err)
 		}
@@ -71,15 +91,20 @@ func (r *DeviceRepository) GetByUserID(ctx context.Context, userID uuid.UUID) ([
 	return devices, nil
 }
 
-func (r *DeviceRepository) GetByUserAndIdentifier(ctx context.Context, userID uuid.UUID, identifier string) (*models.Device, error) {
+func (r *DeviceRepository) GetByOrgAndIdentifier(ctx context.Context, orgID uuid.UUID, identifier string) (*models.Device, error) {
 	var device models.Device
 	query := `
-		SELECT id, user_id, device_name, device_identifier, tags, created_at, updated_at, last_seen_at
-		FROM devices WHERE user_id = $1 AND device_identifier = $2
+		SELECT id, org_id, user_id, device_name, device_identifier, tags,
+		       platform, os_version, app_version, app_build, model, timezone, locale, push_authorization,
+		       created_at, updated_at, last_seen_at, stale_at, heartbeat_window_minutes, offline_alerted_at
+		FROM devices WHERE org_id = $1 AND device_identifier = $2
 	`
-	err := r.db.QueryRow(ctx, query, userID, identifier).Scan(
-		&device.ID, &device.UserID, &device.DeviceName, &device.DeviceIdentifier,
-		&device.Tags, &device.CreatedAt, &device.UpdatedAt, &device.LastSeenAt,
+	err := r.db.QueryRow(ctx, query, orgID, identifier).Scan(
+		&device.ID, &device.OrgID, &device.UserID, &device.DeviceName, &device.DeviceIdentifier,
+		&device.Tags, &device.Platform, &device.OSVersion, &device.AppVersion, &device.AppBuild,
+		&device.Model, &device.Timezone, &device.Locale, &device.PushAuthorization,
+		&device.CreatedAt, &device.UpdatedAt, &device.LastSeenAt, &device.StaleAt,
+		&device.HeartbeatWindowMinutes, &device.OfflineAlertedAt,
 	)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get device: %w", err)
@@ -90,19 +115,68 @@ func (r *DeviceRepository) GetByUserAndIdentifier(ctx context.Context, userID uu
 func (r *DeviceRepository) Update(ctx context.Context, device *models.Device) error {
 	query := `
 		UPDATE devices
-		SET device_name = $2, tags = $3
+		SET device_name = $2, tags = $3,
+		    platform = $4, os_version = $5, app_version = $6, app_build = $7,
+		    model = $8, timezone = $9, locale = $10, push_authorization = $11,
+		    heartbeat_window_minutes = $12,
+		    offline_alerted_at = CASE WHEN $12::int IS NULL THEN NULL ELSE offline_alerted_at END
 		WHERE id = $1
-		RETURNING updated_at
+		RETURNING updated_at, offline_alerted_at
 	`
-	return r.db.QueryRow(ctx, query, device.ID, device.DeviceName, device.Tags).Scan(&device.UpdatedAt)
+	m := device.DeviceMetadata
+	return r.db.QueryRow(ctx, query, device.ID, device.DeviceName, device.Tags,
+		m.Platform, m.OSVersion, m.AppVersion, m.AppBuild, m.Model, m.Timezone, m.Locale, m.PushAuthorization,
+		device.HeartbeatWindowMinutes).
+		Scan(&device.UpdatedAt, &device.OfflineAlertedAt)
 }
 
+// UpdateLastSeen records that the device checked in, which also makes a stale
+// device current again
 func (r *DeviceRepository) UpdateLastSeen(ctx context.Context, id uuid.UUID) error {
-	query := `UPDATE devices SET last_seen_at = $2 WHERE id = $1`
+	query := `UPDATE devices SET last_seen_at = $2, stale_at = NULL WHERE id = $1`
 	_, err := r.db.Exec(ctx, query, id, time.Now())
 	return err
 }
 
+// Heartbeat records a check-in of the device with the metadata it reports,
+// keeping the known values of fields it leaves empty
+func (r *DeviceRepository) Heartbeat(ctx context.Context, id uuid.UUID, m models.DeviceMetadata) error {
+	query := `
+		UPDATE devices
+		SET last_seen_at = $2, stale_at = NULL,
+		    platform = COALESCE(NULLIF($3, ''), platform),
+		    os_version = COALESCE(NULLIF($4, ''), os_version),
+		    app_version = COALESCE(NULLIF($5, ''), app_version),
+		    app_build = COALESCE(NULLIF($6, ''), app_build),
+		    model = COALESCE(NULLIF($7, ''), model),
+		    timezone = COALESCE(NULLIF($8, ''), timezone),
+		    locale = COALESCE(NULLIF($9, ''), locale),
+		    push_authorization = COALESCE(NULLIF($10, ''), push_authorization)
+		WHERE id = $1
+	`
+	_, err := r.db.Exec(ctx, query, id, time.Now(),
+		m.Platform, m.OSVersion, m.AppVersion, m.AppBuild, m.Model, m.Timezone, m.Locale, m.PushAuthorization)
+	return err
+}
+
+// SetHeartbeatToken stores the hash of the device's heartbeat token,
+// replacing the previous one; a nil hash revokes it
+func (r *DeviceRepository) SetHeartbeatToken(ctx context.Context, id uuid.UUID, hash []byte) error {
+	_, err := r.db.Exec(ctx, `UPDATE devices SET heartbeat_token_hash = $2 WHERE id = $1`, id, hash)
+	return err
+}
+
+// GetHeartbeatTokenHash returns the hash of the device's heartbeat token, or
+// nil if it has none
+func (r *DeviceRepository) GetHeartbeatTokenHash(ctx context.Context, id uuid.UUID) ([]byte, error) {
+	var hash []byte
+	err := r.db.QueryRow(ctx, `SELECT heartbeat_token_hash FROM devices WHERE id = $1`, id).Scan(&hash)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get heartbeat token: %w", err)
+	}
+	return hash, nil
+}
+
 func (r *DeviceRepository) Delete(ctx context.Context, id uuid.UUID) error {
 	query := `DELETE FROM devices WHERE id = $1`
 	_, err := r.db.Exec(ctx, query, id)
@@ -111,46 +185,124 @@ func (r *DeviceRepository) Delete(ctx context.Context, id uuid.UUID) error {
 
 // Device Token operations
 
-func (r *DeviceRepository) CreateToken(ctx context.Context, token *models.DeviceToken) error {
+// GetTokensByDeviceID returns the device's active tokens
+func (r *DeviceRepository) GetTokensByDeviceID(ctx context.Context, deviceID uuid.UUID) ([]models.DeviceToken, error) {
 	query := `
-		INSERT INTO device_tokens (device_id, token, environment, bundle_id)
-		VALUES ($1, $2, $3, $4)
-		RETURNING id, issued_at, is_valid, error_count, updated_at
+		SELECT dt.id, dt.device_id, dt.token, dt.environment, dt.bundle_id,
+		       dt.issued_at, dt.is_valid, dt.last_used_at, dt.error_count,
+		       dt.last_error, dt.updated_at, dt.invalidated_at, dt.invalidated_reason
+		FROM device_tokens dt
+		WHERE dt.device_id = $1 AND dt.is_valid = true
+		ORDER BY dt.issued_at DESC
 	`
-	return r.db.QueryRow(ctx, query, token.DeviceID, token.Token, token.Environment, token.BundleID).
-		Scan(&token.ID, &token.IssuedAt, &token.IsValid, &token.ErrorCount, &token.UpdatedAt)
+	rows, err := r.db.Query(ctx, query, deviceID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query device tokens: %w", err)
+	}
+	defer rows.Close()
+
+	return r.scanTokens(rows)
 }
 
-func (r *DeviceRepository) GetTokenByDeviceID(ctx context.Context, deviceID uuid.UUID) (*models.DeviceToken, error) {
-	var token models.DeviceToken
+// GetTokenHistory returns all tokens the device had, active and retired,
+// newest first
+func (r *DeviceRepository) GetTokenHistory(ctx context.Context, deviceID uuid.UUID) ([]models.DeviceToken, error) {
 	query := `
-		SELECT id, device_id, token, environment, bundle_id, issued_at, is_valid,
-		       last_used_at, error_count, last_error, updated_at
-		FROM device_tokens WHERE device_id = $1 AND is_valid = true
-		ORDER BY issued_at DESC LIMIT 1
+		SELECT dt.id, dt.device_id, dt.token, dt.environment, dt.bundle_id,
+		       dt.issued_at, dt.is_valid, dt.last_used_at, dt.error_count,
+		       dt.last_error, dt.updated_at, dt.invalidated_at, dt.invalidated_reason
+		FROM device_tokens dt
+		WHERE dt.device_id = $1
+		ORDER BY dt.issued_at DESC
 	`
-	err := r.db.QueryRow(ctx, query, deviceID).Scan(
-		&token.ID, &token.DeviceID, &token.Token, &token.Environment, &token.BundleID,
-		&token.IssuedAt, &token.IsValid, &token.LastUsedAt, &token.ErrorCount,
-		&token.LastError, &token.UpdatedAt,
-	)
+	rows, err := r.db.Query(ctx, query, deviceID)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get device token: %w", err)
+		return nil, fmt.Errorf("failed to query device tokens: %w", err)
+	}
+	defer rows.Close()
+
+	tokens, err := r.scanTokens(rows)
+	if tokens == nil && err == nil {
+		tokens = []models.DeviceToken{}
 	}
-	return &token, nil
+	return tokens, err
 }
 
-func (r *DeviceRepository) GetTokensByUserAndTags(ctx context.Context, userID uuid.UUID, tags []string) ([]models.DeviceToken, error) {
+func (r *DeviceRepository) GetTokensByOrgAndTags(ctx context.Context, orgID uuid.UUID, tags []string) ([]models.DeviceToken, error) {
 	query := `
 		SELECT dt.id, dt.device_id, dt.token, dt.environment, dt.bundle_id,
 		       dt.issued_at, dt.is_valid, dt.last_used_at, dt.error_count,
-		       dt.last_error, dt.updated_at
+		       dt.last_error, dt.updated_at, dt.invalidated_at, dt.invalidated_reason
 		FROM device_tokens dt
 		JOIN devices d ON dt.device_id = d.id
-		WHERE d.user_id = $1 AND dt.is_valid = true
+		WHERE d.org_id = $1 AND dt.is_valid = true
 		  AND d.tags && $2::text[]
 	`
-	rows, err := r.db.Query(ctx, query, userID, tags)
+	rows, err := r.db.Query(ctx, query, orgID, tags)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query device tokens: %w", err)
+	}
+	defer rows.Close()
+
+	return r.scanTokens(rows)
+}
+
+func (r *DeviceRepository) GetTokensByOrgID(ctx context.Context, orgID uuid.UUID) ([]models.DeviceToken, error) {
+	query := `
+		SELECT dt.id, dt.device_id, dt.token, dt.environment, dt.bundle_id,
+		       dt.issued_at, dt.is_valid, dt.last_used_at, dt.error_count,
+		       dt.last_error, dt.updated_at, dt.invalidated_at, dt.invalidated_reason
+		FROM device_tokens dt
+		JOIN devices d ON dt.device_id = d.id
+		WHERE d.org_id = $1 AND dt.is_valid = true
+	`
+	rows, err := r.db.Query(ctx, query, orgID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query device tokens: %w", err)
+	}
+	defer rows.Close()
+
+	return r.scanTokens(rows)
+}
+
+// GetTokensByOrgAndTarget returns the valid tokens of the organization's
+// devices matching the target expression. Non-empty allowedTags further limit
+// them to devices with one of those tags.
+func (r *DeviceRepository) GetTokensByOrgAndTarget(ctx context.Context, orgID uuid.UUID, target targeting.Expr, allowedTags []string) ([]models.DeviceToken, error) {
+	q := &targetQuery{now: time.Now()}
+	condition, err := q.where(orgID, target, allowedTags)
+	if err != nil {
+		return nil, err
+	}
+
+	query := `
+		SELECT dt.id, dt.device_id, dt.token, dt.environment, dt.bundle_id,
+		       dt.issued_at, dt.is_valid, dt.last_used_at, dt.error_count,
+		       dt.last_error, dt.updated_at, dt.invalidated_at, dt.invalidated_reason
+		FROM device_tokens dt
+		JOIN devices d ON dt.device_id = d.id
+		WHERE dt.is_valid = true AND ` + condition
+	rows, err := r.db.Query(ctx, query, q.args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query device tokens: %w", err)
+	}
+	defer rows.Close()
+
+	return r.scanTokens(rows)
+}
+
+// GetTokensByTopic returns the valid tokens of the devices subscribed to the
+// topic
+func (r *DeviceRepository) GetTokensByTopic(ctx context.Context, topicID uuid.UUID) ([]models.DeviceToken, error) {
+	query := `
+		SELECT dt.id, dt.device_id, dt.token, dt.environment, dt.bundle_id,
+		       dt.issued_at, dt.is_valid, dt.last_used_at, dt.error_count,
+		       dt.last_error, dt.updated_at, dt.invalidated_at, dt.invalidated_reason
+		FROM device_tokens dt
+		JOIN topic_subscriptions s ON s.device_id = dt.device_id
+		WHERE s.topic_id = $1 AND dt.is_valid = true
+	`
+	rows, err := r.db.Query(ctx, query, topicID)
 	if err != nil {
 		return nil, fmt.Errorf("failed to query device tokens: %w", err)
 	}
@@ -159,16 +311,90 @@ func (r *DeviceRepository) GetTokensByUserAndTags(ctx context.Context, userID uu
 	return r.scanTokens(rows)
 }
 
-func (r *DeviceRepository) GetTokensByUserID(ctx context.Context, userID uuid.UUID) ([]models.DeviceToken, error) {
+// PreviewTarget counts the organization's devices with a valid token that
+// match the target expression, and returns up to sampleSize of them, most
+// recently seen first
+func (r *DeviceRepository) PreviewTarget(ctx context.Context, orgID uuid.UUID, target targeting.Expr, allowedTags []string, sampleSize int) (int, []models.Device, error) {
+	q := &targetQuery{now: time.Now()}
+	condition, err := q.where(orgID, target, allowedTags)
+	if err != nil {
+		return 0, nil, err
+	}
+	condition = `EXISTS (SELECT 1 FROM device_tokens dt WHERE dt.device_id = d.id AND dt.is_valid = true)
+		  AND ` + condition
+
+	var count int
+	if err := r.db.QueryRow(ctx, `SELECT COUNT(*) FROM devices d WHERE `+condition, q.args...).Scan(&count); err != nil {
+		return 0, nil, fmt.Errorf("failed to count devices: %w", err)
+	}
+
+	query := `
+		SELECT d.id, d.org_id, d.user_id, d.device_name, d.device_identifier, d.tags,
+		       d.platform, d.os_version, d.app_version, d.app_build, d.model, d.timezone, d.locale, d.push_authorization,
+		       d.created_at, d.updated_at, d.last_seen_at, d.stale_at,
+		       d.heartbeat_window_minutes, d.offline_alerted_at
+		FROM devices d
+		WHERE ` + condition + `
+		ORDER BY d.last_seen_at DESC NULLS LAST, d.created_at DESC
+		LIMIT ` + q.param(sampleSize)
+	rows, err := r.db.Query(ctx, query, q.args...)
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed to query devices: %w", err)
+	}
+	defer rows.Close()
+
+	devices := []models.Device{}
+	for rows.Next() {
+		var device models.Device
+		if err := rows.Scan(
+			&device.ID, &device.OrgID, &device.UserID, &device.DeviceName, &device.DeviceIdentifier,
+			&device.Tags, &device.Platform, &device.OSVersion, &device.AppVersion, &device.AppBuild,
+			&device.Model, &device.Timezone, &device.Locale, &device.PushAuthorization,
+			&device.CreatedAt, &device.UpdatedAt, &device.LastSeenAt, &device.StaleAt,
+			&device.HeartbeatWindowMinutes, &device.OfflineAlertedAt,
+		); err != nil {
+			return 0, nil, fmt.Errorf("failed to scan device: %w", err)
+		}
+		devices = append(devices, device)
+	}
+
+	return count, devices, nil
+}
+
+// GetTokensForOrgAdmins returns the valid tokens of devices registered in the
+// organization by its owners and admins, e.g. for operational alerts
+func (r *DeviceRepository) GetTokensForOrgAdmins(ctx context.Context, orgID uuid.UUID) ([]models.DeviceToken, error) {
 	query := `
 		SELECT dt.id, dt.device_id, dt.token, dt.environment, dt.bundle_id,
 		       dt.issued_at, dt.is_valid, dt.last_used_at, dt.error_count,
-		       dt.last_error, dt.updated_at
+		       dt.last_error, dt.updated_at, dt.invalidated_at, dt.invalidated_reason
 		FROM device_tokens dt
 		JOIN devices d ON dt.device_id = d.id
-		WHERE d.user_id = $1 AND dt.is_valid = true
+		JOIN org_memberships m ON m.org_id = d.org_id AND m.user_id = d.user_id
+		WHERE d.org_id = $1 AND dt.is_valid = true AND m.role IN ('owner', 'admin')
 	`
-	rows, err := r.db.Query(ctx, query, userID)
+	rows, err := r.db.Query(ctx, query, orgID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query device tokens: %w", err)
+	}
+	defer rows.Close()
+
+	return r.scanTokens(rows)
+}
+
+// GetTokensByOrgAndUser returns the valid tokens of the user's devices in
+// the organization that are not stale, e.g. for alerts about their other
+// devices
+func (r *DeviceRepository) GetTokensByOrgAndUser(ctx context.Context, orgID, userID uuid.UUID) ([]models.DeviceToken, error) {
+	query := `
+		SELECT dt.id, dt.device_id, dt.token, dt.environment, dt.bundle_id,
+		       dt.issued_at, dt.is_valid, dt.last_used_at, dt.error_count,
+		       dt.last_error, dt.updated_at, dt.invalidated_at, dt.invalidated_reason
+		FROM device_tokens dt
+		JOIN devices d ON dt.device_id = d.id
+		WHERE d.org_id = $1 AND d.user_id = $2 AND dt.is_valid = true AND d.stale_at IS NULL
+	`
+	rows, err := r.db.Query(ctx, query, orgID, userID)
 	if err != nil {
 		return nil, fmt.Errorf("failed to query device tokens: %w", err)
 	}
@@ -184,7 +410,7 @@ func (r *DeviceRepository) scanTokens(rows pgx.Rows) ([]models.DeviceToken, erro
 		if err := rows.Scan(
 			&token.ID, &token.DeviceID, &token.Token, &token.Environment, &token.BundleID,
 			&token.IssuedAt, &token.IsValid, &token.LastUsedAt, &token.ErrorCount,
-			&token.LastError, &token.UpdatedAt,
+			&token.LastError, &token.UpdatedAt, &token.InvalidatedAt, &token.InvalidatedReason,
 		); err != nil {
 			return nil, fmt.Errorf("failed to scan device token: %w", err)
 		}
@@ -193,35 +419,321 @@ func (r *DeviceRepository) scanTokens(rows pgx.Rows) ([]models.DeviceToken, erro
 	return tokens, nil
 }
 
-func (r *DeviceRepository) UpdateToken(ctx context.Context, deviceID uuid.UUID, tokenStr, environment, bundleID string) error {
-	// First, invalidate old tokens for this device
-	invalidateQuery := `UPDATE device_tokens SET is_valid = false WHERE device_id = $1`
-	if _, err := r.db.Exec(ctx, invalidateQuery, deviceID); err != nil {
-		return fmt.Errorf("failed to invalidate old tokens: %w", err)
+// AssignToken makes the token the device's active token for its bundle ID
+// and environment, retiring the token it replaces. A token that is active on
+// another device of the same user and organization moves to this device. On
+// anyone else's device it is only taken over if transfer is set; otherwise
+// ErrTokenInUse is returned. The device the token was taken from, if any, is
+// returned as well.
+func (r *DeviceRepository) AssignToken(ctx context.Context, device *models.Device, tokenStr, environment, bundleID string, transfer bool) (*models.DeviceToken, *models.TokenHolder, error) {
+	tx, err := r.db.Begin(ctx)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	var holder models.TokenHolder
+	var holderEnvironment, holderBundleID string
+	err = tx.QueryRow(ctx, `
+		SELECT dt.id, dt.device_id, d.user_id, d.org_id, dt.environment, dt.bundle_id
+		FROM device_tokens dt
+		JOIN devices d ON d.id = dt.device_id
+		WHERE dt.token = $1 AND dt.is_valid = true
+		FOR UPDATE OF dt
+	`, tokenStr).Scan(&holder.TokenID, &holder.DeviceID, &holder.UserID, &holder.OrgID, &holderEnvironment, &holderBundleID)
+	found := err == nil
+	if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+		return nil, nil, fmt.Errorf("failed to look up device token: %w", err)
+	}
+
+	if found && holder.DeviceID == device.ID && holderEnvironment == environment && holderBundleID == bundleID {
+		// Already active in this slot
+		token, err := r.getToken(ctx, tx, holder.TokenID)
+		if err != nil {
+			return nil, nil, err
+		}
+		if err := tx.Commit(ctx); err != nil {
+			return nil, nil, fmt.Errorf("failed to commit device token: %w", err)
+		}
+		return token, nil, nil
+	}
+
+	var previous *models.TokenHolder
+	if found {
+		reason := models.TokenReplaced
+		if holder.DeviceID != device.ID {
+			switch {
+			case holder.UserID == device.UserID && holder.OrgID == device.OrgID:
+				reason = models.TokenMoved
+			case transfer:
+				reason = models.TokenTransferred
+			default:
+				return nil, nil, ErrTokenInUse
+			}
+			previous = &holder
+		}
+		if err := retireToken(ctx, tx, `id = $1`, reason, holder.TokenID); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	if err := retireToken(ctx, tx, `device_id = $1 AND bundle_id = $2 AND environment = $3`,
+		models.TokenReplaced, device.ID, bundleID, environment); err != nil {
+		return nil, nil, err
 	}
 
-	// Create new token
 	token := &models.DeviceToken{
-		DeviceID:    deviceID,
+		DeviceID:    device.ID,
 		Token:       tokenStr,
 		Environment: environment,
 		BundleID:    bundleID,
 	}
-	return r.CreateToken(ctx, token)
+	err = tx.QueryRow(ctx, `
+		INSERT INTO device_tokens (device_id, token, environment, bundle_id)
+		VALUES ($1, $2, $3, $4)
+		RETURNING id, issued_at, is_valid, error_count, updated_at
+	`, token.DeviceID, token.Token, token.Environment, token.BundleID).
+		Scan(&token.ID, &token.IssuedAt, &token.IsValid, &token.ErrorCount, &token.UpdatedAt)
+	if isUniqueViolation(err) {
+		// Registered concurrently to another device
+		return nil, nil, ErrTokenInUse
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create device token: %w", err)
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return nil, nil, fmt.Errorf("failed to commit device token: %w", err)
+	}
+	return token, previous, nil
 }
 
+func (r *DeviceRepository) getToken(ctx context.Context, tx pgx.Tx, id uuid.UUID) (*models.DeviceToken, error) {
+	rows, err := tx.Query(ctx, `
+		SELECT dt.id, dt.device_id, dt.token, dt.environment, dt.bundle_id,
+		       dt.issued_at, dt.is_valid, dt.last_used_at, dt.error_count,
+		       dt.last_error, dt.updated_at, dt.invalidated_at, dt.invalidated_reason
+		FROM device_tokens dt WHERE dt.id = $1
+	`, id)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get device token: %w", err)
+	}
+	defer rows.Close()
+
+	tokens, err := r.scanTokens(rows)
+	if err != nil {
+		return nil, err
+	}
+	if len(tokens) == 0 {
+		return nil, fmt.Errorf("failed to get device token: %w", pgx.ErrNoRows)
+	}
+	return &tokens[0], nil
+}
+
+// retireToken deactivates the active tokens matching the condition, keeping
+// them as history
+func retireToken(ctx context.Context, tx pgx.Tx, condition, reason string, args ...any) error {
+	query := `
+		UPDATE device_tokens
+		SET is_valid = false, invalidated_at = CURRENT_TIMESTAMP, invalidated_reason = $` + strconv.Itoa(len(args)+1) + `
+		WHERE is_valid = true AND ` + condition
+	if _, err := tx.Exec(ctx, query, append(args, reason)...); err != nil {
+		return fmt.Errorf("failed to retire device token: %w", err)
+	}
+	return nil
+}
+
+// RemoveToken retires one of the device's active tokens, e.g. when an app
+// extension is no longer installed
+func (r *DeviceRepository) RemoveToken(ctx context.Context, deviceID, tokenID uuid.UUID) (bool, error) {
+	query := `
+		UPDATE device_tokens
+		SET is_valid = false, invalidated_at = CURRENT_TIMESTAMP, invalidated_reason = $3
+		WHERE id = $1 AND device_id = $2 AND is_valid = true
+	`
+	tag, err := r.db.Exec(ctx, query, tokenID, deviceID, models.TokenRemoved)
+	if err != nil {
+		return false, err
+	}
+	return tag.RowsAffected() > 0, nil
+}
+
+// MarkTokenInvalid retires a token APNs rejected
 func (r *DeviceRepository) MarkTokenInvalid(ctx context.Context, tokenID uuid.UUID, errorReason string) error {
 	query := `
 		UPDATE device_tokens
-		SET is_valid = false, error_count = error_count + 1, last_error = $2
+		SET is_valid = false, error_count = error_count + 1, last_error = $2,
+		    invalidated_at = CURRENT_TIMESTAMP, invalidated_reason = $3
 		WHERE id = $1
 	`
-	_, err := r.db.Exec(ctx, query, tokenID, errorReason)
+	_, err := r.db.Exec(ctx, query, tokenID, errorReason, models.TokenRejected)
 	return err
 }
 
+// RecordTokenError increments the token's consecutive failure count and
+// returns the new value
+func (r *DeviceRepository) RecordTokenError(ctx context.Context, tokenID uuid.UUID, errorReason string) (int, error) {
+	query := `
+		UPDATE device_tokens
+		SET error_count = error_count + 1, last_error = $2
+		WHERE id = $1
+		RETURNING error_count
+	`
+	var errorCount int
+	err := r.db.QueryRow(ctx, query, tokenID, errorReason).Scan(&errorCount)
+	return errorCount, err
+}
+
+// UpdateTokenLastUsed records a successful delivery and resets the token's
+// consecutive failure count
 func (r *DeviceRepository) UpdateTokenLastUsed(ctx context.Context, tokenID uuid.UUID) error {
-	query := `UPDATE device_tokens SET last_used_at = $2 WHERE id = $1`
+	query := `UPDATE device_tokens SET last_used_at = $2, error_count = 0 WHERE id = $1`
 	_, err := r.db.Exec(ctx, query, tokenID, time.Now())
 	return err
 }
+
+// Lifecycle operations
+
+// unseenCondition matches devices not seen since $1. Devices that never
+// checked in count from their registration.
+const unseenCondition = `COALESCE(d.last_seen_at, d.created_at) < $1`
+
+// invalidSince is when the device's last token was retired
+const invalidSince = `COALESCE((SELECT MAX(dt.invalidated_at) FROM device_tokens dt WHERE dt.device_id = d.id), d.created_at)`
+
+// invalidCondition matches devices that have had no valid token since $1
+const invalidCondition = `NOT EXISTS (SELECT 1 FROM device_tokens dt WHERE dt.device_id = d.id AND dt.is_valid = true)
+	AND ` + invalidSince + ` < $1`
+
+// GetUnseen counts the organization's devices not seen since the cutoff, and
+// returns up to limit of them, least recently seen first
+func (r *DeviceRepository) GetUnseen(ctx context.Context, orgID uuid.UUID, cutoff time.Time, limit int) (int, []models.LifecycleDevice, error) {
+	return r.getLifecycleDevices(ctx, unseenCondition, `COALESCE(d.last_seen_at, d.created_at)`, orgID, cutoff, limit)
+}
+
+// GetInvalid counts the organization's devices that have had no valid token
+// since the cutoff, and returns up to limit of them, longest invalid first
+func (r *DeviceRepository) GetInvalid(ctx context.Context, orgID uuid.UUID, cutoff time.Time, limit int) (int, []models.LifecycleDevice, error) {
+	return r.getLifecycleDevices(ctx, invalidCondition, invalidSince, orgID, cutoff, limit)
+}
+
+func (r *DeviceRepository) getLifecycleDevices(ctx context.Context, condition, order string, orgID uuid.UUID, cutoff time.Time, limit int) (int, []models.LifecycleDevice, error) {
+	var count int
+	countQuery := `SELECT COUNT(*) FROM devices d WHERE ` + condition + ` AND d.org_id = $2`
+	if err := r.db.QueryRow(ctx, countQuery, cutoff, orgID).Scan(&count); err != nil {
+		return 0, nil, fmt.Errorf("failed to count devices: %w", err)
+	}
+
+	query := `
+		SELECT d.id, d.org_id, d.user_id, d.device_name, d.last_seen_at, d.stale_at,
+		       CASE WHEN EXISTS (SELECT 1 FROM device_tokens dt WHERE dt.device_id = d.id AND dt.is_valid = true)
+		            THEN NULL ELSE ` + invalidSince + ` END
+		FROM devices d
+		WHERE ` + condition + ` AND d.org_id = $2
+		ORDER BY ` + order + `
+		LIMIT $3
+	`
+	rows, err := r.db.Query(ctx, query, cutoff, orgID, limit)
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed to query devices: %w", err)
+	}
+	defer rows.Close()
+
+	devices, err := scanLifecycleDevices(rows)
+	return count, devices, err
+}
+
+// MarkStale marks up to limit devices stale that were not seen since the
+// cutoff and are not stale yet, and returns them
+func (r *DeviceRepository) MarkStale(ctx context.Context, cutoff time.Time, limit int) ([]models.LifecycleDevice, error) {
+	query := `
+		UPDATE devices SET stale_at = $3
+		WHERE id IN (
+			SELECT d.id FROM devices d
+			WHERE d.stale_at IS NULL AND ` + unseenCondition + `
+			LIMIT $2
+		)
+		RETURNING id, org_id, user_id, device_name, last_seen_at, stale_at, NULL::timestamp
+	`
+	rows, err := r.db.Query(ctx, query, cutoff, limit, time.Now())
+	if err != nil {
+		return nil, fmt.Errorf("failed to mark devices stale: %w", err)
+	}
+	defer rows.Close()
+
+	return scanLifecycleDevices(rows)
+}
+
+// DeleteInvalid deletes up to limit devices that have had no valid token
+// since the cutoff, with their token history and deliveries, and returns them
+func (r *DeviceRepository) DeleteInvalid(ctx context.Context, cutoff time.Time, limit int) ([]models.LifecycleDevice, error) {
+	query := `
+		WITH doomed AS (
+			SELECT d.id, ` + invalidSince + ` AS invalid_since
+			FROM devices d
+			WHERE ` + invalidCondition + `
+			LIMIT $2
+		)
+		DELETE FROM devices d USING doomed
+		WHERE d.id = doomed.id
+		  AND NOT EXISTS (SELECT 1 FROM device_tokens dt WHERE dt.device_id = d.id AND dt.is_valid = true)
+		RETURNING d.id, d.org_id, d.user_id, d.device_name, d.last_seen_at, d.stale_at, doomed.invalid_since
+	`
+	rows, err := r.db.Query(ctx, query, cutoff, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to delete invalid devices: %w", err)
+	}
+	defer rows.Close()
+
+	return scanLifecycleDevices(rows)
+}
+
+func scanLifecycleDevices(rows pgx.Rows) ([]models.LifecycleDevice, error) {
+	devices := []models.LifecycleDevice{}
+	for rows.Next() {
+		var device models.LifecycleDevice
+		if err := rows.Scan(
+			&device.ID, &device.OrgID, &device.UserID, &device.DeviceName,
+			&device.LastSeenAt, &device.StaleAt, &device.InvalidSince,
+		); err != nil {
+			return nil, fmt.Errorf("failed to scan device: %w", err)
+		}
+		devices = append(devices, device)
+	}
+	return devices, rows.Err()
+}
+
+// MarkOffline flags the monitored devices that missed their heartbeat window
+// and were not flagged yet, and returns them
+func (r *DeviceRepository) MarkOffline(ctx context.Context) ([]models.LifecycleDevice, error) {
+	query := `
+		UPDATE devices d SET offline_alerted_at = $1
+		WHERE d.heartbeat_window_minutes IS NOT NULL AND d.offline_alerted_at IS NULL
+		  AND COALESCE(d.last_seen_at, d.created_at) + make_interval(mins => d.heartbeat_window_minutes) < $1
+		RETURNING d.id, d.org_id, d.user_id, d.device_name, d.last_seen_at, d.stale_at, NULL::timestamp
+	`
+	rows, err := r.db.Query(ctx, query, time.Now())
+	if err != nil {
+		return nil, fmt.Errorf("failed to mark devices offline: %w", err)
+	}
+	defer rows.Close()
+
+	return scanLifecycleDevices(rows)
+}
+
+// MarkBackOnline clears the flag of devices that checked in again after
+// they were flagged offline, and returns them
+func (r *DeviceRepository) MarkBackOnline(ctx context.Context) ([]models.LifecycleDevice, error) {
+	query := `
+		UPDATE devices d SET offline_alerted_at = NULL
+		WHERE d.offline_alerted_at IS NOT NULL AND d.last_seen_at > d.offline_alerted_at
+		RETURNING d.id, d.org_id, d.user_id, d.device_name, d.last_seen_at, d.stale_at, NULL::timestamp
+	`
+	rows, err := r.db.Query(ctx, query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to mark devices online: %w", err)
+	}
+	defer rows.Close()
+
+	return scanLifecycleDevices(rows)
+}
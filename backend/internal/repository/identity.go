@@ -0,0 +1,89 @@
+package repository
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/pushlab/backend/internal/models"
+)
+
+// IdentityRepository stores external identities and in-flight OIDC logins
+type IdentityRepository struct {
+	db *pgxpool.Pool
+}
+
+func NewIdentityRepository(db *pgxpool.Pool) *IdentityRepository {
+	return &IdentityRepository{db: db}
+}
+
+func (r *IdentityRepository) GetByIssuerAndSubject(ctx context.Context, issuer, subject string) (*models.UserIdentity, error) {
+	var identity models.UserIdentity
+	query := `
+		SELECT id, user_id, issuer, subject, email, created_at, last_login_at
+		FROM user_identities
+		WHERE issuer = $1 AND subject = $2
+	`
+	err := r.db.QueryRow(ctx, query, issuer, subject).Scan(
+		&identity.ID, &identity.UserID, &identity.Issuer, &identity.Subject,
+		&identity.Email, &identity.CreatedAt, &identity.LastLoginAt,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get identity: %w", err)
+	}
+	return &identity, nil
+}
+
+func (r *IdentityRepository) Create(ctx context.Context, identity *models.UserIdentity) error {
+	query := `
+		INSERT INTO user_identities (user_id, issuer, subject, email)
+		VALUES ($1, $2, $3, $4)
+		RETURNING id, created_at, last_login_at
+	`
+	return r.db.QueryRow(ctx, query, identity.UserID, identity.Issuer, identity.Subject, identity.Email).
+		Scan(&identity.ID, &identity.CreatedAt, &identity.LastLoginAt)
+}
+
+// RecordLogin updates the identity's last login and the email the provider
+// reported
+func (r *IdentityRepository) RecordLogin(ctx context.Context, id uuid.UUID, email *string) error {
+	query := `UPDATE user_identities SET last_login_at = CURRENT_TIMESTAMP, email = $2 WHERE id = $1`
+	_, err := r.db.Exec(ctx, query, id, email)
+	return err
+}
+
+// CreateLoginState stores an authorization request until the callback.
+// Expired requests are pruned on the way.
+func (r *IdentityRepository) CreateLoginState(ctx context.Context, state *models.OIDCLoginState, ttl time.Duration) error {
+	if _, err := r.db.Exec(ctx, `DELETE FROM oidc_login_states WHERE expires_at < CURRENT_TIMESTAMP`); err != nil {
+		return fmt.Errorf("failed to prune login states: %w", err)
+	}
+
+	query := `
+		INSERT INTO oidc_login_states (state_hash, code_verifier, nonce, redirect_uri, expires_at)
+		VALUES ($1, $2, $3, $4, CURRENT_TIMESTAMP + make_interval(secs => $5))
+		RETURNING expires_at
+	`
+	return r.db.QueryRow(ctx, query, state.StateHash, state.CodeVerifier, state.Nonce, state.RedirectURI, ttl.Seconds()).
+		Scan(&state.ExpiresAt)
+}
+
+// ConsumeLoginState removes and returns an unexpired authorization request,
+// so each state can complete only one login
+func (r *IdentityRepository) ConsumeLoginState(ctx context.Context, stateHash []byte) (*models.OIDCLoginState, error) {
+	var state models.OIDCLoginState
+	query := `
+		DELETE FROM oidc_login_states
+		WHERE state_hash = $1 AND expires_at > CURRENT_TIMESTAMP
+		RETURNING state_hash, code_verifier, nonce, redirect_uri, expires_at
+	`
+	err := r.db.QueryRow(ctx, query, stateHash).Scan(
+		&state.StateHash, &state.CodeVerifier, &state.Nonce, &state.RedirectURI, &state.ExpiresAt,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get login state: %w", err)
+	}
+	return &state, nil
+}
@@ -0,0 +1,145 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/pushlab/backend/internal/models"
+)
+
+// LimitsRepository stores per-user limit overrides and counts pushes against
+// send quotas
+type LimitsRepository struct {
+	db *pgxpool.Pool
+}
+
+func NewLimitsRepository(db *pgxpool.Pool) *LimitsRepository {
+	return &LimitsRepository{db: db}
+}
+
+// GetUserLimits returns the user's overrides; users without any get empty
+// limits
+func (r *LimitsRepository) GetUserLimits(ctx context.Context, userID uuid.UUID) (*models.UserLimits, error) {
+	limits := models.UserLimits{UserID: userID}
+	query := `
+		SELECT requests_per_minute, burst, daily_quota, monthly_quota, updated_at
+		FROM user_limits WHERE user_id = $1
+	`
+	err := r.db.QueryRow(ctx, query, userID).Scan(
+		&limits.RequestsPerMinute, &limits.Burst, &limits.DailyQuota, &limits.MonthlyQuota, &limits.UpdatedAt,
+	)
+	if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+		return nil, fmt.Errorf("failed to get user limits: %w", err)
+	}
+	return &limits, nil
+}
+
+// SetUserLimits replaces the user's overrides. Clearing every field removes
+// them.
+func (r *LimitsRepository) SetUserLimits(ctx context.Context, limits *models.UserLimits) error {
+	if limits.RequestsPerMinute == nil && limits.Burst == nil && limits.DailyQuota == nil && limits.MonthlyQuota == nil {
+		if _, err := r.db.Exec(ctx, `DELETE FROM user_limits WHERE user_id = $1`, limits.UserID); err != nil {
+			return fmt.Errorf("failed to clear user limits: %w", err)
+		}
+		limits.UpdatedAt = nil
+		return nil
+	}
+
+	query := `
+		INSERT INTO user_limits (user_id, requests_per_minute, burst, daily_quota, monthly_quota)
+		VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (user_id) DO UPDATE
+		SET requests_per_minute = EXCLUDED.requests_per_minute, burst = EXCLUDED.burst,
+		    daily_quota = EXCLUDED.daily_quota, monthly_quota = EXCLUDED.monthly_quota,
+		    updated_at = CURRENT_TIMESTAMP
+		RETURNING updated_at
+	`
+	err := r.db.QueryRow(ctx, query,
+		limits.UserID, limits.RequestsPerMinute, limits.Burst, limits.DailyQuota, limits.MonthlyQuota,
+	).Scan(&limits.UpdatedAt)
+	if err != nil {
+		return fmt.Errorf("failed to set user limits: %w", err)
+	}
+	return nil
+}
+
+// ConsumeSends counts n pushes against the user's day and month. When that
+// would exceed a quota nothing is counted and the exceeded period is
+// returned.
+func (r *LimitsRepository) ConsumeSends(ctx context.Context, userID uuid.UUID, n int, quotas models.Quotas, now time.Time) (string, error) {
+	tx, err := r.db.Begin(ctx)
+	if err != nil {
+		return "", fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	day, month := quotaPeriods(now)
+	query := `
+		INSERT INTO send_counters (user_id, period, period_start, sent)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (user_id, period, period_start) DO UPDATE
+		SET sent = send_counters.sent + EXCLUDED.sent
+		RETURNING sent
+	`
+	for _, period := range []struct {
+		name  string
+		start time.Time
+		quota int64
+	}{
+		{models.QuotaDay, day, quotas.Daily},
+		{models.QuotaMonth, month, quotas.Monthly},
+	} {
+		var sent int64
+		if err := tx.QueryRow(ctx, query, userID, period.name, period.start, n).Scan(&sent); err != nil {
+			return "", fmt.Errorf("failed to count sends: %w", err)
+		}
+		if period.quota > 0 && sent > period.quota {
+			return period.name, nil
+		}
+	}
+
+	return "", tx.Commit(ctx)
+}
+
+// RefundSends gives back pushes that were counted but not sent
+func (r *LimitsRepository) RefundSends(ctx context.Context, userID uuid.UUID, n int, now time.Time) error {
+	day, month := quotaPeriods(now)
+	query := `
+		UPDATE send_counters SET sent = GREATEST(sent - $4, 0)
+		WHERE user_id = $1 AND ((period = 'day' AND period_start = $2) OR (period = 'month' AND period_start = $3))
+	`
+	if _, err := r.db.Exec(ctx, query, userID, day, month, n); err != nil {
+		return fmt.Errorf("failed to refund sends: %w", err)
+	}
+	return nil
+}
+
+// GetSendUsage returns the pushes the user sent today and this month
+func (r *LimitsRepository) GetSendUsage(ctx context.Context, userID uuid.UUID, now time.Time) (int64, int64, error) {
+	day, month := quotaPeriods(now)
+	query := `
+		SELECT
+			COALESCE(SUM(sent) FILTER (WHERE period = 'day' AND period_start = $2), 0),
+			COALESCE(SUM(sent) FILTER (WHERE period = 'month' AND period_start = $3), 0)
+		FROM send_counters
+		WHERE user_id = $1
+	`
+	var today, thisMonth int64
+	if err := r.db.QueryRow(ctx, query, userID, day, month).Scan(&today, &thisMonth); err != nil {
+		return 0, 0, fmt.Errorf("failed to get send usage: %w", err)
+	}
+	return today, thisMonth, nil
+}
+
+// quotaPeriods returns the start of the UTC day and month containing now
+func quotaPeriods(now time.Time) (time.Time, time.Time) {
+	now = now.UTC()
+	day := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	month := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+	return day, month
+}
@@ -0,0 +1,282 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/pushlab/backend/internal/models"
+)
+
+var ErrChallengeUnavailable = errors.New("MFA challenge not found or already used")
+
+// MFARepository stores TOTP enrollments, recovery codes and pending MFA
+// login challenges
+type MFARepository struct {
+	db *pgxpool.Pool
+}
+
+func NewMFARepository(db *pgxpool.Pool) *MFARepository {
+	return &MFARepository{db: db}
+}
+
+// SaveTOTP stores a new, not yet enabled, TOTP secret for the user,
+// replacing any earlier unconfirmed enrollment
+func (r *MFARepository) SaveTOTP(ctx context.Context, totp *models.UserTOTP) error {
+	query := `
+		INSERT INTO user_totp (user_id, secret_ciphertext, secret_dek, kek_id)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (user_id) DO UPDATE
+		SET secret_ciphertext = EXCLUDED.secret_ciphertext,
+		    secret_dek = EXCLUDED.secret_dek,
+		    kek_id = EXCLUDED.kek_id,
+		    created_at = CURRENT_TIMESTAMP,
+		    enabled_at = NULL,
+		    last_used_step = NULL
+		WHERE user_totp.enabled_at IS NULL
+		RETURNING created_at
+	`
+	return r.db.QueryRow(ctx, query, totp.UserID, totp.SecretCiphertext, totp.SecretDEK, totp.KEKID).
+		Scan(&totp.CreatedAt)
+}
+
+func (r *MFARepository) GetTOTP(ctx context.Context, userID uuid.UUID) (*models.UserTOTP, error) {
+	var totp models.UserTOTP
+	query := `
+		SELECT user_id, secret_ciphertext, secret_dek, kek_id, created_at, enabled_at, last_used_step
+		FROM user_totp
+		WHERE user_id = $1
+	`
+	err := r.db.QueryRow(ctx, query, userID).Scan(
+		&totp.UserID, &totp.SecretCiphertext, &totp.SecretDEK, &totp.KEKID,
+		&totp.CreatedAt, &totp.EnabledAt, &totp.LastUsedStep,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get TOTP enrollment: %w", err)
+	}
+	return &totp, nil
+}
+
+// IsTOTPEnabled reports whether the user has confirmed a TOTP enrollment
+func (r *MFARepository) IsTOTPEnabled(ctx context.Context, userID uuid.UUID) (bool, error) {
+	query := `SELECT EXISTS (SELECT 1 FROM user_totp WHERE user_id = $1 AND enabled_at IS NOT NULL)`
+	var enabled bool
+	if err := r.db.QueryRow(ctx, query, userID).Scan(&enabled); err != nil {
+		return false, fmt.Errorf("failed to check TOTP enrollment: %w", err)
+	}
+	return enabled, nil
+}
+
+// GetAllTOTP returns every enrollment, for maintenance commands
+func (r *MFARepository) GetAllTOTP(ctx context.Context) ([]models.UserTOTP, error) {
+	query := `
+		SELECT user_id, secret_ciphertext, secret_dek, kek_id, created_at, enabled_at, last_used_step
+		FROM user_totp
+	`
+	rows, err := r.db.Query(ctx, query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query TOTP enrollments: %w", err)
+	}
+	defer rows.Close()
+
+	var enrollments []models.UserTOTP
+	for rows.Next() {
+		var totp models.UserTOTP
+		if err := rows.Scan(
+			&totp.UserID, &totp.SecretCiphertext, &totp.SecretDEK, &totp.KEKID,
+			&totp.CreatedAt, &totp.EnabledAt, &totp.LastUsedStep,
+		); err != nil {
+			return nil, fmt.Errorf("failed to scan TOTP enrollment: %w", err)
+		}
+		enrollments = append(enrollments, totp)
+	}
+	return enrollments, nil
+}
+
+// UpdateTOTPKeyMaterialBatch stores re-wrapped secrets in the caller's
+// transaction, e.g. after rotating the master key
+func (r *MFARepository) UpdateTOTPKeyMaterialBatch(ctx context.Context, tx pgx.Tx, enrollments []models.UserTOTP) error {
+	query := `UPDATE user_totp SET secret_dek = $2, kek_id = $3 WHERE user_id = $1`
+	for _, totp := range enrollments {
+		if _, err := tx.Exec(ctx, query, totp.UserID, totp.SecretDEK, totp.KEKID); err != nil {
+			return fmt.Errorf("failed to update TOTP secret of user %s: %w", totp.UserID, err)
+		}
+	}
+
+	return nil
+}
+
+// UseTOTPStep records that the code for a time step was accepted. It
+// reports false if that or a later code was already used.
+func (r *MFARepository) UseTOTPStep(ctx context.Context, userID uuid.UUID, step int64) (bool, error) {
+	query := `
+		UPDATE user_totp SET last_used_step = $2
+		WHERE user_id = $1 AND (last_used_step IS NULL OR last_used_step < $2)
+	`
+	tag, err := r.db.Exec(ctx, query, userID, step)
+	if err != nil {
+		return false, err
+	}
+	return tag.RowsAffected() > 0, nil
+}
+
+// EnableTOTP confirms the enrollment and replaces the user's recovery codes
+func (r *MFARepository) EnableTOTP(ctx context.Context, userID uuid.UUID, recoveryCodeHashes [][]byte) error {
+	tx, err := r.db.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	if _, err := tx.Exec(ctx, `UPDATE user_totp SET enabled_at = CURRENT_TIMESTAMP WHERE user_id = $1`, userID); err != nil {
+		return fmt.Errorf("failed to enable TOTP: %w", err)
+	}
+
+	if err := replaceRecoveryCodes(ctx, tx, userID, recoveryCodeHashes); err != nil {
+		return err
+	}
+
+	return tx.Commit(ctx)
+}
+
+// ReplaceRecoveryCodes invalidates the user's recovery codes and stores new ones
+func (r *MFARepository) ReplaceRecoveryCodes(ctx context.Context, userID uuid.UUID, hashes [][]byte) error {
+	tx, err := r.db.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	if err := replaceRecoveryCodes(ctx, tx, userID, hashes); err != nil {
+		return err
+	}
+
+	return tx.Commit(ctx)
+}
+
+func replaceRecoveryCodes(ctx context.Context, tx pgx.Tx, userID uuid.UUID, hashes [][]byte) error {
+	if _, err := tx.Exec(ctx, `DELETE FROM mfa_recovery_codes WHERE user_id = $1`, userID); err != nil {
+		return fmt.Errorf("failed to delete recovery codes: %w", err)
+	}
+	for _, hash := range hashes {
+		if _, err := tx.Exec(ctx, `INSERT INTO mfa_recovery_codes (user_id, code_hash) VALUES ($1, $2)`, userID, hash); err != nil {
+			return fmt.Errorf("failed to store recovery code: %w", err)
+		}
+	}
+	return nil
+}
+
+// UseRecoveryCode consumes the MFA challenge together with a recovery code,
+// so that neither is used up without the other. It reports false if the code
+// is unknown or was already used, leaving the challenge in place, and
+// ErrChallengeUnavailable if the challenge was already consumed, e.g. by a
+// concurrent verification.
+func (r *MFARepository) UseRecoveryCode(ctx context.Context, tokenHash []byte, userID uuid.UUID, hash []byte) (bool, error) {
+	tx, err := r.db.Begin(ctx)
+	if err != nil {
+		return false, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	tag, err := tx.Exec(ctx, `DELETE FROM mfa_challenges WHERE token_hash = $1`, tokenHash)
+	if err != nil {
+		return false, fmt.Errorf("failed to consume MFA challenge: %w", err)
+	}
+	if tag.RowsAffected() == 0 {
+		return false, ErrChallengeUnavailable
+	}
+
+	query := `
+		UPDATE mfa_recovery_codes SET used_at = CURRENT_TIMESTAMP
+		WHERE user_id = $1 AND code_hash = $2 AND used_at IS NULL
+	`
+	tag, err = tx.Exec(ctx, query, userID, hash)
+	if err != nil {
+		return false, fmt.Errorf("failed to use recovery code: %w", err)
+	}
+	if tag.RowsAffected() == 0 {
+		return false, nil
+	}
+
+	return true, tx.Commit(ctx)
+}
+
+// DisableTOTP removes the enrollment and the recovery codes
+func (r *MFARepository) DisableTOTP(ctx context.Context, userID uuid.UUID) error {
+	tx, err := r.db.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	if _, err := tx.Exec(ctx, `DELETE FROM user_totp WHERE user_id = $1`, userID); err != nil {
+		return fmt.Errorf("failed to delete TOTP enrollment: %w", err)
+	}
+	if err := replaceRecoveryCodes(ctx, tx, userID, nil); err != nil {
+		return err
+	}
+
+	return tx.Commit(ctx)
+}
+
+// CreateChallenge stores a pending MFA login. Expired challenges are pruned
+// on the way.
+func (r *MFARepository) CreateChallenge(ctx context.Context, challenge *models.MFAChallenge, ttl time.Duration) error {
+	if _, err := r.db.Exec(ctx, `DELETE FROM mfa_challenges WHERE expires_at < CURRENT_TIMESTAMP`); err != nil {
+		return fmt.Errorf("failed to prune MFA challenges: %w", err)
+	}
+
+	query := `
+		INSERT INTO mfa_challenges (token_hash, user_id, expires_at)
+		VALUES ($1, $2, CURRENT_TIMESTAMP + make_interval(secs => $3))
+		RETURNING expires_at
+	`
+	return r.db.QueryRow(ctx, query, challenge.TokenHash, challenge.UserID, ttl.Seconds()).
+		Scan(&challenge.ExpiresAt)
+}
+
+// GetChallenge returns an unexpired challenge
+func (r *MFARepository) GetChallenge(ctx context.Context, tokenHash []byte) (*models.MFAChallenge, error) {
+	var challenge models.MFAChallenge
+	query := `
+		SELECT token_hash, user_id, attempts, expires_at
+		FROM mfa_challenges
+		WHERE token_hash = $1 AND expires_at > CURRENT_TIMESTAMP
+	`
+	err := r.db.QueryRow(ctx, query, tokenHash).Scan(
+		&challenge.TokenHash, &challenge.UserID, &challenge.Attempts, &challenge.ExpiresAt,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get MFA challenge: %w", err)
+	}
+	return &challenge, nil
+}
+
+// RecordFailedAttempt counts a wrong code and deletes the challenge once
+// maxAttempts is reached
+func (r *MFARepository) RecordFailedAttempt(ctx context.Context, tokenHash []byte, maxAttempts int) error {
+	query := `UPDATE mfa_challenges SET attempts = attempts + 1 WHERE token_hash = $1 RETURNING attempts`
+	var attempts int
+	if err := r.db.QueryRow(ctx, query, tokenHash).Scan(&attempts); err != nil {
+		return fmt.Errorf("failed to record MFA attempt: %w", err)
+	}
+	if attempts >= maxAttempts {
+		_, err := r.DeleteChallenge(ctx, tokenHash)
+		return err
+	}
+	return nil
+}
+
+// DeleteChallenge consumes the challenge. It reports false if it was
+// already used, e.g. by a concurrent verification.
+func (r *MFARepository) DeleteChallenge(ctx context.Context, tokenHash []byte) (bool, error) {
+	tag, err := r.db.Exec(ctx, `DELETE FROM mfa_challenges WHERE token_hash = $1`, tokenHash)
+	if err != nil {
+		return false, err
+	}
+	return tag.RowsAffected() > 0, nil
+}
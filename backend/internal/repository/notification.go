@@ -2,9 +2,12 @@ package repository
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"time"
 
 	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgxpool"
 	"github.com/pushlab/backend/internal/models"
 )
@@ -19,27 +22,27 @@ func NewNotificationRepository(db *pgxpool.Pool) *NotificationRepository {
 
 func (r *NotificationRepository) Create(ctx context.Context, notification *models.Notification) error {
 	query := `
-		INSERT INTO notifications (user_id, title, body, data, badge, sound, category, priority, tags, status)
-		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+		INSERT INTO notifications (org_id, user_id, title, body, data, badge, sound, category, priority, tags, target, segment, topic_id, status)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14)
 		RETURNING id, created_at
 	`
 	return r.db.QueryRow(ctx, query,
-		notification.UserID, notification.Title, notification.Body, notification.Data,
+		notification.OrgID, notification.UserID, notification.Title, notification.Body, notification.Data,
 		notification.Badge, notification.Sound, notification.Category, notification.Priority,
-		notification.Tags, notification.Status,
+		notification.Tags, notification.Target, notification.Segment, notification.TopicID, notification.Status,
 	).Scan(&notification.ID, &notification.CreatedAt)
 }
 
 func (r *NotificationRepository) GetByID(ctx context.Context, id uuid.UUID) (*models.Notification, error) {
 	var notif models.Notification
 	query := `
-		SELECT id, user_id, title, body, data, badge, sound, category, priority, tags, created_at, status
+		SELECT id, org_id, user_id, title, body, data, badge, sound, category, priority, tags, target, segment, topic_id, created_at, status
 		FROM notifications WHERE id = $1
 	`
 	err := r.db.QueryRow(ctx, query, id).Scan(
-		&notif.ID, &notif.UserID, &notif.Title, &notif.Body, &notif.Data,
+		&notif.ID, &notif.OrgID, &notif.UserID, &notif.Title, &notif.Body, &notif.Data,
 		&notif.Badge, &notif.Sound, &notif.Category, &notif.Priority,
-		&notif.Tags, &notif.CreatedAt, &notif.Status,
+		&notif.Tags, &notif.Target, &notif.Segment, &notif.TopicID, &notif.CreatedAt, &notif.Status,
 	)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get notification: %w", err)
@@ -47,15 +50,15 @@ func (r *NotificationRepository) GetByID(ctx context.Context, id uuid.UUID) (*mo
 	return &notif, nil
 }
 
-func (r *NotificationRepository) GetByUserID(ctx context.Context, userID uuid.UUID, limit, offset int) ([]models.Notification, error) {
+func (r *NotificationRepository) GetByOrgID(ctx context.Context, orgID uuid.UUID, limit, offset int) ([]models.Notification, error) {
 	query := `
-		SELECT id, user_id, title, body, data, badge, sound, category, priority, tags, created_at, status
+		SELECT id, org_id, user_id, title, body, data, badge, sound, category, priority, tags, target, segment, topic_id, created_at, status
 		FROM notifications
-		WHERE user_id = $1
+		WHERE org_id = $1
 		ORDER BY created_at DESC
 		LIMIT $2 OFFSET $3
 	`
-	rows, err := r.db.Query(ctx, query, userID, limit, offset)
+	rows, err := r.db.Query(ctx, query, orgID, limit, offset)
 	if err != nil {
 		return nil, fmt.Errorf("failed to query notifications: %w", err)
 	}
@@ -65,9 +68,41 @@ func (r *NotificationRepository) GetByUserID(ctx context.Context, userID uuid.UU
 	for rows.Next() {
 		var notif models.Notification
 		if err := rows.Scan(
-			&notif.ID, &notif.UserID, &notif.Title, &notif.Body, &notif.Data,
+			&notif.ID, &notif.OrgID, &notif.UserID, &notif.Title, &notif.Body, &notif.Data,
 			&notif.Badge, &notif.Sound, &notif.Category, &notif.Priority,
-			&notif.Tags, &notif.CreatedAt, &notif.Status,
+			&notif.Tags, &notif.Target, &notif.Segment, &notif.TopicID, &notif.CreatedAt, &notif.Status,
+		); err != nil {
+			return nil, fmt.Errorf("failed to scan notification: %w", err)
+		}
+		notifications = append(notifications, notif)
+	}
+
+	return notifications, nil
+}
+
+// GetByTopic returns the messages published to the topic since the given
+// time, newest first
+func (r *NotificationRepository) GetByTopic(ctx context.Context, topicID uuid.UUID, since time.Time, limit int) ([]models.Notification, error) {
+	query := `
+		SELECT id, org_id, user_id, title, body, data, badge, sound, category, priority, tags, target, segment, topic_id, created_at, status
+		FROM notifications
+		WHERE topic_id = $1 AND created_at >= $2
+		ORDER BY created_at DESC
+		LIMIT $3
+	`
+	rows, err := r.db.Query(ctx, query, topicID, since, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query notifications: %w", err)
+	}
+	defer rows.Close()
+
+	notifications := []models.Notification{}
+	for rows.Next() {
+		var notif models.Notification
+		if err := rows.Scan(
+			&notif.ID, &notif.OrgID, &notif.UserID, &notif.Title, &notif.Body, &notif.Data,
+			&notif.Badge, &notif.Sound, &notif.Category, &notif.Priority,
+			&notif.Tags, &notif.Target, &notif.Segment, &notif.TopicID, &notif.CreatedAt, &notif.Status,
 		); err != nil {
 			return nil, fmt.Errorf("failed to scan notification: %w", err)
 		}
@@ -95,6 +130,31 @@ func (r *NotificationRepository) CreateDelivery(ctx context.Context, delivery *m
 		Scan(&delivery.ID, &delivery.CreatedAt, &delivery.UpdatedAt)
 }
 
+// GetOrCreateDelivery loads the notification's delivery to the device token,
+// creating it if this is the first attempt, so deferred deliveries keep a
+// single row across passes
+func (r *NotificationRepository) GetOrCreateDelivery(ctx context.Context, delivery *models.NotificationDelivery) error {
+	query := `
+		SELECT id, delivery_status, attempt_count, apns_response_code, apns_error_reason,
+		       delivered_at, created_at, updated_at
+		FROM notification_deliveries
+		WHERE notification_id = $1 AND device_token_id = $2
+		ORDER BY created_at
+		LIMIT 1
+	`
+	err := r.db.QueryRow(ctx, query, delivery.NotificationID, delivery.DeviceTokenID).Scan(
+		&delivery.ID, &delivery.DeliveryStatus, &delivery.AttemptCount, &delivery.APNsResponseCode,
+		&delivery.APNsErrorReason, &delivery.DeliveredAt, &delivery.CreatedAt, &delivery.UpdatedAt,
+	)
+	if err == nil {
+		return nil
+	}
+	if !errors.Is(err, pgx.ErrNoRows) {
+		return fmt.Errorf("failed to get delivery: %w", err)
+	}
+	return r.CreateDelivery(ctx, delivery)
+}
+
 func (r *NotificationRepository) GetDeliveriesByNotificationID(ctx context.Context, notificationID uuid.UUID) ([]models.NotificationDelivery, error) {
 	query := `
 		SELECT id, notification_id, device_token_id, delivery_status, attempt_count,
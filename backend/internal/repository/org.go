@@ -0,0 +1,265 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/pushlab/backend/internal/models"
+)
+
+// ErrInvitationUnavailable is returned when an invitation was already
+// accepted, has expired or does not exist
+var ErrInvitationUnavailable = errors.New("invitation not found or no longer valid")
+
+type OrgRepository struct {
+	db *pgxpool.Pool
+}
+
+func NewOrgRepository(db *pgxpool.Pool) *OrgRepository {
+	return &OrgRepository{db: db}
+}
+
+// Create stores an organization and makes ownerID its owner
+func (r *OrgRepository) Create(ctx context.Context, org *models.Organization, ownerID uuid.UUID) error {
+	tx, err := r.db.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	if err := createOrg(ctx, tx, org, ownerID); err != nil {
+		return err
+	}
+
+	return tx.Commit(ctx)
+}
+
+// CreatePersonal creates the personal organization of a new user and makes
+// it their default
+func (r *OrgRepository) CreatePersonal(ctx context.Context, user *models.User) (*models.Organization, error) {
+	tx, err := r.db.Begin(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	org := &models.Organization{Name: user.Username, Personal: true}
+	if err := createOrg(ctx, tx, org, user.ID); err != nil {
+		return nil, err
+	}
+
+	if _, err := tx.Exec(ctx, `UPDATE users SET default_org_id = $2 WHERE id = $1`, user.ID, org.ID); err != nil {
+		return nil, fmt.Errorf("failed to set default organization: %w", err)
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return nil, err
+	}
+	user.DefaultOrgID = &org.ID
+	return org, nil
+}
+
+func createOrg(ctx context.Context, tx pgx.Tx, org *models.Organization, ownerID uuid.UUID) error {
+	query := `
+		INSERT INTO organizations (name, personal)
+		VALUES ($1, $2)
+		RETURNING id, created_at, updated_at
+	`
+	if err := tx.QueryRow(ctx, query, org.Name, org.Personal).Scan(&org.ID, &org.CreatedAt, &org.UpdatedAt); err != nil {
+		return fmt.Errorf("failed to create organization: %w", err)
+	}
+
+	memberQuery := `INSERT INTO org_memberships (org_id, user_id, role) VALUES ($1, $2, $3)`
+	if _, err := tx.Exec(ctx, memberQuery, org.ID, ownerID, models.RoleOwner); err != nil {
+		return fmt.Errorf("failed to add organization owner: %w", err)
+	}
+	return nil
+}
+
+// GetMembership returns the user's role in the organization
+func (r *OrgRepository) GetMembership(ctx context.Context, orgID, userID uuid.UUID) (*models.OrgMembership, error) {
+	var m models.OrgMembership
+	query := `
+		SELECT m.org_id, o.name, o.personal, m.user_id, m.role, m.created_at
+		FROM org_memberships m
+		JOIN organizations o ON m.org_id = o.id
+		WHERE m.org_id = $1 AND m.user_id = $2
+	`
+	err := r.db.QueryRow(ctx, query, orgID, userID).Scan(
+		&m.OrgID, &m.OrgName, &m.Personal, &m.UserID, &m.Role, &m.CreatedAt,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get membership: %w", err)
+	}
+	return &m, nil
+}
+
+// GetByUserID lists the organizations the user belongs to
+func (r *OrgRepository) GetByUserID(ctx context.Context, userID uuid.UUID) ([]models.OrgMembership, error) {
+	query := `
+		SELECT m.org_id, o.name, o.personal, m.user_id, m.role, m.created_at
+		FROM org_memberships m
+		JOIN organizations o ON m.org_id = o.id
+		WHERE m.user_id = $1
+		ORDER BY o.personal DESC, o.name
+	`
+	rows, err := r.db.Query(ctx, query, userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query memberships: %w", err)
+	}
+	defer rows.Close()
+
+	var memberships []models.OrgMembership
+	for rows.Next() {
+		var m models.OrgMembership
+		if err := rows.Scan(&m.OrgID, &m.OrgName, &m.Personal, &m.UserID, &m.Role, &m.CreatedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan membership: %w", err)
+		}
+		memberships = append(memberships, m)
+	}
+	return memberships, nil
+}
+
+func (r *OrgRepository) GetMembers(ctx context.Context, orgID uuid.UUID) ([]models.OrgMember, error) {
+	query := `
+		SELECT m.user_id, u.username, u.email, m.role, m.created_at
+		FROM org_memberships m
+		JOIN users u ON m.user_id = u.id
+		WHERE m.org_id = $1
+		ORDER BY m.created_at
+	`
+	rows, err := r.db.Query(ctx, query, orgID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query members: %w", err)
+	}
+	defer rows.Close()
+
+	var members []models.OrgMember
+	for rows.Next() {
+		var m models.OrgMember
+		if err := rows.Scan(&m.UserID, &m.Username, &m.Email, &m.Role, &m.CreatedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan member: %w", err)
+		}
+		members = append(members, m)
+	}
+	return members, nil
+}
+
+func (r *OrgRepository) UpdateRole(ctx context.Context, orgID, userID uuid.UUID, role string) error {
+	query := `UPDATE org_memberships SET role = $3 WHERE org_id = $1 AND user_id = $2`
+	_, err := r.db.Exec(ctx, query, orgID, userID, role)
+	return err
+}
+
+func (r *OrgRepository) RemoveMember(ctx context.Context, orgID, userID uuid.UUID) error {
+	query := `DELETE FROM org_memberships WHERE org_id = $1 AND user_id = $2`
+	_, err := r.db.Exec(ctx, query, orgID, userID)
+	return err
+}
+
+func (r *OrgRepository) CountOwners(ctx context.Context, orgID uuid.UUID) (int, error) {
+	var count int
+	query := `SELECT COUNT(*) FROM org_memberships WHERE org_id = $1 AND role = 'owner'`
+	err := r.db.QueryRow(ctx, query, orgID).Scan(&count)
+	return count, err
+}
+
+// Invitations
+
+const invitationColumns = `id, org_id, email, role, token_hash, invited_by, created_at, expires_at, accepted_at, accepted_by`
+
+func (r *OrgRepository) CreateInvitation(ctx context.Context, inv *models.OrgInvitation) error {
+	query := `
+		INSERT INTO org_invitations (org_id, email, role, token_hash, invited_by, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		RETURNING id, created_at
+	`
+	return r.db.QueryRow(ctx, query, inv.OrgID, inv.Email, inv.Role, inv.TokenHash, inv.InvitedBy, inv.ExpiresAt).
+		Scan(&inv.ID, &inv.CreatedAt)
+}
+
+// GetPendingInvitations lists invitations that were not accepted yet
+func (r *OrgRepository) GetPendingInvitations(ctx context.Context, orgID uuid.UUID) ([]models.OrgInvitation, error) {
+	query := `
+		SELECT ` + invitationColumns + `
+		FROM org_invitations
+		WHERE org_id = $1 AND accepted_at IS NULL
+		ORDER BY created_at DESC
+	`
+	rows, err := r.db.Query(ctx, query, orgID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query invitations: %w", err)
+	}
+	defer rows.Close()
+
+	var invitations []models.OrgInvitation
+	for rows.Next() {
+		var inv models.OrgInvitation
+		if err := rows.Scan(invitationFields(&inv)...); err != nil {
+			return nil, fmt.Errorf("failed to scan invitation: %w", err)
+		}
+		invitations = append(invitations, inv)
+	}
+	return invitations, nil
+}
+
+func (r *OrgRepository) GetInvitationByTokenHash(ctx context.Context, tokenHash []byte) (*models.OrgInvitation, error) {
+	var inv models.OrgInvitation
+	query := `SELECT ` + invitationColumns + ` FROM org_invitations WHERE token_hash = $1`
+	if err := r.db.QueryRow(ctx, query, tokenHash).Scan(invitationFields(&inv)...); err != nil {
+		return nil, fmt.Errorf("failed to get invitation: %w", err)
+	}
+	return &inv, nil
+}
+
+// AcceptInvitation marks the invitation accepted and adds the user to the
+// organization. Existing members keep their current role.
+func (r *OrgRepository) AcceptInvitation(ctx context.Context, inv *models.OrgInvitation, userID uuid.UUID) error {
+	tx, err := r.db.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	tag, err := tx.Exec(ctx, `
+		UPDATE org_invitations
+		SET accepted_at = CURRENT_TIMESTAMP, accepted_by = $2
+		WHERE id = $1 AND accepted_at IS NULL AND expires_at > CURRENT_TIMESTAMP
+	`, inv.ID, userID)
+	if err != nil {
+		return fmt.Errorf("failed to accept invitation: %w", err)
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrInvitationUnavailable
+	}
+
+	if _, err := tx.Exec(ctx, `
+		INSERT INTO org_memberships (org_id, user_id, role)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (org_id, user_id) DO NOTHING
+	`, inv.OrgID, userID, inv.Role); err != nil {
+		return fmt.Errorf("failed to add member: %w", err)
+	}
+
+	return tx.Commit(ctx)
+}
+
+func (r *OrgRepository) DeleteInvitation(ctx context.Context, id, orgID uuid.UUID) (bool, error) {
+	query := `DELETE FROM org_invitations WHERE id = $1 AND org_id = $2 AND accepted_at IS NULL`
+	tag, err := r.db.Exec(ctx, query, id, orgID)
+	if err != nil {
+		return false, err
+	}
+	return tag.RowsAffected() > 0, nil
+}
+
+func invitationFields(inv *models.OrgInvitation) []interface{} {
+	return []interface{}{
+		&inv.ID, &inv.OrgID, &inv.Email, &inv.Role, &inv.TokenHash, &inv.InvitedBy,
+		&inv.CreatedAt, &inv.ExpiresAt, &inv.AcceptedAt, &inv.AcceptedBy,
+	}
+}
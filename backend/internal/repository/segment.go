@@ -0,0 +1,119 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/pushlab/backend/internal/models"
+)
+
+var ErrSegmentNameTaken = errors.New("a segment with this name already exists")
+
+type SegmentRepository struct {
+	db *pgxpool.Pool
+}
+
+func NewSegmentRepository(db *pgxpool.Pool) *SegmentRepository {
+	return &SegmentRepository{db: db}
+}
+
+func (r *SegmentRepository) Create(ctx context.Context, segment *models.Segment) error {
+	query := `
+		INSERT INTO segments (org_id, user_id, name, description, expression)
+		VALUES ($1, $2, $3, $4, $5)
+		RETURNING id, created_at, updated_at
+	`
+	err := r.db.QueryRow(ctx, query, segment.OrgID, segment.UserID, segment.Name, segment.Description, segment.Expression).
+		Scan(&segment.ID, &segment.CreatedAt, &segment.UpdatedAt)
+	if isUniqueViolation(err) {
+		return ErrSegmentNameTaken
+	}
+	return err
+}
+
+func (r *SegmentRepository) GetByID(ctx context.Context, id, orgID uuid.UUID) (*models.Segment, error) {
+	query := `
+		SELECT id, org_id, user_id, name, description, expression, created_at, updated_at
+		FROM segments WHERE id = $1 AND org_id = $2
+	`
+	return r.scanSegment(r.db.QueryRow(ctx, query, id, orgID))
+}
+
+func (r *SegmentRepository) GetByName(ctx context.Context, orgID uuid.UUID, name string) (*models.Segment, error) {
+	query := `
+		SELECT id, org_id, user_id, name, description, expression, created_at, updated_at
+		FROM segments WHERE org_id = $1 AND name = $2
+	`
+	return r.scanSegment(r.db.QueryRow(ctx, query, orgID, name))
+}
+
+func (r *SegmentRepository) scanSegment(row pgx.Row) (*models.Segment, error) {
+	var segment models.Segment
+	err := row.Scan(
+		&segment.ID, &segment.OrgID, &segment.UserID, &segment.Name, &segment.Description,
+		&segment.Expression, &segment.CreatedAt, &segment.UpdatedAt,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get segment: %w", err)
+	}
+	return &segment, nil
+}
+
+func (r *SegmentRepository) GetByOrgID(ctx context.Context, orgID uuid.UUID) ([]models.Segment, error) {
+	query := `
+		SELECT id, org_id, user_id, name, description, expression, created_at, updated_at
+		FROM segments WHERE org_id = $1 ORDER BY name
+	`
+	rows, err := r.db.Query(ctx, query, orgID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query segments: %w", err)
+	}
+	defer rows.Close()
+
+	segments := []models.Segment{}
+	for rows.Next() {
+		var segment models.Segment
+		if err := rows.Scan(
+			&segment.ID, &segment.OrgID, &segment.UserID, &segment.Name, &segment.Description,
+			&segment.Expression, &segment.CreatedAt, &segment.UpdatedAt,
+		); err != nil {
+			return nil, fmt.Errorf("failed to scan segment: %w", err)
+		}
+		segments = append(segments, segment)
+	}
+	return segments, nil
+}
+
+func (r *SegmentRepository) Update(ctx context.Context, segment *models.Segment) error {
+	query := `
+		UPDATE segments
+		SET name = $2, description = $3, expression = $4
+		WHERE id = $1
+		RETURNING updated_at
+	`
+	err := r.db.QueryRow(ctx, query, segment.ID, segment.Name, segment.Description, segment.Expression).
+		Scan(&segment.UpdatedAt)
+	if isUniqueViolation(err) {
+		return ErrSegmentNameTaken
+	}
+	return err
+}
+
+func (r *SegmentRepository) Delete(ctx context.Context, id, orgID uuid.UUID) (bool, error) {
+	query := `DELETE FROM segments WHERE id = $1 AND org_id = $2`
+	tag, err := r.db.Exec(ctx, query, id, orgID)
+	if err != nil {
+		return false, err
+	}
+	return tag.RowsAffected() > 0, nil
+}
+
+func isUniqueViolation(err error) bool {
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && pgErr.Code == "23505"
+}
@@ -0,0 +1,114 @@
+package repository
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/pushlab/backend/internal/models"
+)
+
+// SessionRepository stores refresh tokens and the denylist of revoked access
+// tokens
+type SessionRepository struct {
+	db *pgxpool.Pool
+}
+
+func NewSessionRepository(db *pgxpool.Pool) *SessionRepository {
+	return &SessionRepository{db: db}
+}
+
+func (r *SessionRepository) CreateRefreshToken(ctx context.Context, token *models.RefreshToken, ttl time.Duration) error {
+	query := `
+		INSERT INTO refresh_tokens (user_id, family_id, token_hash, expires_at)
+		VALUES ($1, $2, $3, CURRENT_TIMESTAMP + make_interval(secs => $4))
+		RETURNING id, created_at, expires_at
+	`
+	return r.db.QueryRow(ctx, query, token.UserID, token.FamilyID, token.TokenHash, ttl.Seconds()).
+		Scan(&token.ID, &token.CreatedAt, &token.ExpiresAt)
+}
+
+func (r *SessionRepository) GetRefreshToken(ctx context.Context, tokenHash []byte) (*models.RefreshToken, error) {
+	var token models.RefreshToken
+	query := `
+		SELECT id, user_id, family_id, token_hash, created_at, expires_at, used_at, revoked_at,
+		       expires_at <= CURRENT_TIMESTAMP
+		FROM refresh_tokens
+		WHERE token_hash = $1
+	`
+	err := r.db.QueryRow(ctx, query, tokenHash).Scan(
+		&token.ID, &token.UserID, &token.FamilyID, &token.TokenHash, &token.CreatedAt,
+		&token.ExpiresAt, &token.UsedAt, &token.RevokedAt, &token.Expired,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get refresh token: %w", err)
+	}
+	return &token, nil
+}
+
+// MarkRefreshTokenUsed consumes a refresh token. It reports false if the
+// token was already used or revoked, e.g. by a concurrent refresh.
+func (r *SessionRepository) MarkRefreshTokenUsed(ctx context.Context, id uuid.UUID) (bool, error) {
+	query := `
+		UPDATE refresh_tokens
+		SET used_at = CURRENT_TIMESTAMP
+		WHERE id = $1 AND used_at IS NULL AND revoked_at IS NULL
+	`
+	tag, err := r.db.Exec(ctx, query, id)
+	if err != nil {
+		return false, err
+	}
+	return tag.RowsAffected() > 0, nil
+}
+
+// RevokeFamily revokes every refresh token of a session
+func (r *SessionRepository) RevokeFamily(ctx context.Context, familyID uuid.UUID) error {
+	query := `
+		UPDATE refresh_tokens
+		SET revoked_at = CURRENT_TIMESTAMP
+		WHERE family_id = $1 AND revoked_at IS NULL
+	`
+	_, err := r.db.Exec(ctx, query, familyID)
+	return err
+}
+
+// RevokeAllForUser revokes every refresh token of the user
+func (r *SessionRepository) RevokeAllForUser(ctx context.Context, userID uuid.UUID) error {
+	query := `
+		UPDATE refresh_tokens
+		SET revoked_at = CURRENT_TIMESTAMP
+		WHERE user_id = $1 AND revoked_at IS NULL
+	`
+	_, err := r.db.Exec(ctx, query, userID)
+	return err
+}
+
+// RevokeAccessToken adds an access token to the denylist until it expires.
+// Entries for tokens that have expired anyway are pruned on the way.
+func (r *SessionRepository) RevokeAccessToken(ctx context.Context, jti uuid.UUID, expiresAt time.Time) error {
+	if _, err := r.db.Exec(ctx, `DELETE FROM revoked_access_tokens WHERE expires_at < CURRENT_TIMESTAMP`); err != nil {
+		return fmt.Errorf("failed to prune revoked access tokens: %w", err)
+	}
+
+	query := `
+		INSERT INTO revoked_access_tokens (jti, expires_at)
+		VALUES ($1, $2)
+		ON CONFLICT (jti) DO NOTHING
+	`
+	_, err := r.db.Exec(ctx, query, jti, expiresAt.UTC())
+	return err
+}
+
+// IsAccessTokenRevoked reports whether the access token is on the denylist
+// or belongs to a revoked session
+func (r *SessionRepository) IsAccessTokenRevoked(ctx context.Context, jti, sessionID uuid.UUID) (bool, error) {
+	var revoked bool
+	query := `
+		SELECT EXISTS (SELECT 1 FROM revoked_access_tokens WHERE jti = $1)
+		    OR EXISTS (SELECT 1 FROM refresh_tokens WHERE family_id = $2 AND revoked_at IS NOT NULL)
+	`
+	err := r.db.QueryRow(ctx, query, jti, sessionID).Scan(&revoked)
+	return revoked, err
+}
@@ -0,0 +1,158 @@
+package repository
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/pushlab/backend/internal/models"
+)
+
+// signingKeyRotationLock is the advisory lock held while rotating JWT signing
+// keys, so that concurrent API instances create only one new key
+const signingKeyRotationLock = 0x6a7774
+
+const signingKeyColumns = `kid, algorithm, public_key, private_key_ciphertext, private_key_dek, kek_id,
+		       created_at, activates_at, retired_at`
+
+type SigningKeyRepository struct {
+	db *pgxpool.Pool
+}
+
+func NewSigningKeyRepository(db *pgxpool.Pool) *SigningKeyRepository {
+	return &SigningKeyRepository{db: db}
+}
+
+// GetUsable returns the keys that may still verify tokens: keys that are not
+// retired, and retired keys whose tokens may not have expired yet
+func (r *SigningKeyRepository) GetUsable(ctx context.Context, retention time.Duration) ([]models.JWTSigningKey, error) {
+	query := `
+		SELECT ` + signingKeyColumns + `
+		FROM jwt_signing_keys
+		WHERE retired_at IS NULL OR retired_at > CURRENT_TIMESTAMP - make_interval(secs => $1)
+		ORDER BY activates_at DESC
+	`
+	rows, err := r.db.Query(ctx, query, retention.Seconds())
+	if err != nil {
+		return nil, fmt.Errorf("failed to query signing keys: %w", err)
+	}
+	defer rows.Close()
+
+	return scanSigningKeys(rows)
+}
+
+// GetAll returns every stored key, for maintenance commands
+func (r *SigningKeyRepository) GetAll(ctx context.Context) ([]models.JWTSigningKey, error) {
+	query := `SELECT ` + signingKeyColumns + ` FROM jwt_signing_keys ORDER BY created_at`
+	rows, err := r.db.Query(ctx, query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query signing keys: %w", err)
+	}
+	defer rows.Close()
+
+	return scanSigningKeys(rows)
+}
+
+// Rotate stores key as the next signing key if the newest key is older than
+// interval (always, when interval is zero) or uses another algorithm than
+// key. The new key activates after
+// publishDelay, except for the very first key, and the keys it replaces are
+// retired at that moment. Keys retired for longer than retention are deleted.
+// It reports whether the key was stored.
+func (r *SigningKeyRepository) Rotate(
+	ctx context.Context,
+	key *models.JWTSigningKey,
+	interval, publishDelay, retention time.Duration,
+) (bool, error) {
+	tx, err := r.db.Begin(ctx)
+	if err != nil {
+		return false, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	if _, err := tx.Exec(ctx, `SELECT pg_advisory_xact_lock($1)`, signingKeyRotationLock); err != nil {
+		return false, fmt.Errorf("failed to lock signing keys: %w", err)
+	}
+
+	var due, first bool
+	err = tx.QueryRow(ctx, `
+		SELECT COALESCE(MAX(created_at) <= CURRENT_TIMESTAMP - make_interval(secs => $1), true)
+		       OR COALESCE(bool_or(algorithm <> $2), false),
+		       COUNT(*) = 0
+		FROM jwt_signing_keys
+		WHERE retired_at IS NULL
+	`, interval.Seconds(), key.Algorithm).Scan(&due, &first)
+	if err != nil {
+		return false, fmt.Errorf("failed to check signing keys: %w", err)
+	}
+	if !due {
+		return false, nil
+	}
+	if first {
+		publishDelay = 0
+	}
+
+	err = tx.QueryRow(ctx, `
+		INSERT INTO jwt_signing_keys (kid, algorithm, public_key, private_key_ciphertext, private_key_dek, kek_id, activates_at)
+		VALUES ($1, $2, $3, $4, $5, $6, CURRENT_TIMESTAMP + make_interval(secs => $7))
+		RETURNING created_at, activates_at
+	`, key.KID, key.Algorithm, key.PublicKey, key.PrivateKeyCiphertext, key.PrivateKeyDEK, key.KEKID,
+		publishDelay.Seconds(),
+	).Scan(&key.CreatedAt, &key.ActivatesAt)
+	if err != nil {
+		return false, fmt.Errorf("failed to store signing key: %w", err)
+	}
+
+	if _, err := tx.Exec(ctx, `
+		UPDATE jwt_signing_keys SET retired_at = $2
+		WHERE kid <> $1 AND retired_at IS NULL
+	`, key.KID, key.ActivatesAt); err != nil {
+		return false, fmt.Errorf("failed to retire signing keys: %w", err)
+	}
+
+	if _, err := tx.Exec(ctx, `
+		DELETE FROM jwt_signing_keys
+		WHERE retired_at < CURRENT_TIMESTAMP - make_interval(secs => $1)
+	`, retention.Seconds()); err != nil {
+		return false, fmt.Errorf("failed to delete expired signing keys: %w", err)
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// UpdateKeyMaterialBatch stores re-wrapped private keys in the caller's
+// transaction, e.g. after rotating the master key
+func (r *SigningKeyRepository) UpdateKeyMaterialBatch(ctx context.Context, tx pgx.Tx, keys []models.JWTSigningKey) error {
+	query := `
+		UPDATE jwt_signing_keys
+		SET private_key_ciphertext = $2, private_key_dek = $3, kek_id = $4
+		WHERE kid = $1
+	`
+	for _, key := range keys {
+		if _, err := tx.Exec(ctx, query, key.KID, key.PrivateKeyCiphertext, key.PrivateKeyDEK, key.KEKID); err != nil {
+			return fmt.Errorf("failed to update signing key %s: %w", key.KID, err)
+		}
+	}
+
+	return nil
+}
+
+func scanSigningKeys(rows pgx.Rows) ([]models.JWTSigningKey, error) {
+	var keys []models.JWTSigningKey
+	for rows.Next() {
+		var key models.JWTSigningKey
+		if err := rows.Scan(
+			&key.KID, &key.Algorithm, &key.PublicKey, &key.PrivateKeyCiphertext, &key.PrivateKeyDEK,
+			&key.KEKID, &key.CreatedAt, &key.ActivatesAt, &key.RetiredAt,
+		); err != nil {
+			return nil, fmt.Errorf("failed to scan signing key: %w", err)
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
@@ -0,0 +1,109 @@
+package repository
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/pushlab/backend/internal/targeting"
+)
+
+// targetColumns maps the comparable fields of target expressions to columns
+// of the devices table, aliased d
+var targetColumns = map[string]string{
+	"platform":           "d.platform",
+	"os_version":         "d.os_version",
+	"app_version":        "d.app_version",
+	"app_build":          "d.app_build",
+	"model":              "d.model",
+	"timezone":           "d.timezone",
+	"locale":             "d.locale",
+	"push_authorization": "d.push_authorization",
+}
+
+var targetOperators = map[string]string{
+	targeting.OpEq: "=",
+	targeting.OpNe: "<>",
+	targeting.OpLt: "<",
+	targeting.OpLe: "<=",
+	targeting.OpGt: ">",
+	targeting.OpGe: ">=",
+}
+
+// targetQuery compiles target expressions to SQL conditions on devices,
+// aliased d, collecting their parameters. Every condition yields TRUE or
+// FALSE, never NULL, so that NOT matches exactly the devices its term does
+// not match.
+type targetQuery struct {
+	args []any
+	now  time.Time
+}
+
+func (q *targetQuery) param(v any) string {
+	q.args = append(q.args, v)
+	return "$" + strconv.Itoa(len(q.args))
+}
+
+// where builds the condition selecting the organization's devices that match
+// target and, if allowedTags is not empty, have one of those tags
+func (q *targetQuery) where(orgID uuid.UUID, target targeting.Expr, allowedTags []string) (string, error) {
+	org := q.param(orgID)
+	condition, err := q.compile(target)
+	if err != nil {
+		return "", fmt.Errorf("failed to compile target: %w", err)
+	}
+	condition = "d.org_id = " + org + " AND " + condition
+	if len(allowedTags) > 0 {
+		condition += " AND d.tags && " + q.param(allowedTags) + "::text[]"
+	}
+	return condition, nil
+}
+
+func (q *targetQuery) compile(expr targeting.Expr) (string, error) {
+	switch e := expr.(type) {
+	case targeting.And:
+		return q.compileAll(e.Terms, " AND ")
+	case targeting.Or:
+		return q.compileAll(e.Terms, " OR ")
+	case targeting.Not:
+		term, err := q.compile(e.Term)
+		if err != nil {
+			return "", err
+		}
+		return "NOT " + term, nil
+	case targeting.Tag:
+		return fmt.Sprintf("COALESCE(%s = ANY(d.tags), false)", q.param(e.Name)), nil
+	case targeting.Device:
+		return "d.id = " + q.param(e.ID), nil
+	case targeting.SeenWithin:
+		return fmt.Sprintf("COALESCE(d.last_seen_at >= %s, false)", q.param(q.now.Add(-e.Duration))), nil
+	case targeting.Compare:
+		column, ok := targetColumns[e.Field]
+		op, opOK := targetOperators[e.Op]
+		if !ok || !opOK {
+			return "", fmt.Errorf("unsupported comparison: %s %s", e.Field, e.Op)
+		}
+		if targeting.IsVersionField(e.Field) {
+			return fmt.Sprintf("COALESCE(version_key(%s) %s %s::int[], false)", column, op, q.param(e.Version)), nil
+		}
+		// The other metadata columns are NOT NULL DEFAULT '' (migration 019),
+		// so this cannot be NULL and needs no COALESCE
+		return fmt.Sprintf("%s %s %s", column, op, q.param(e.Value)), nil
+	default:
+		return "", fmt.Errorf("unsupported target expression: %T", expr)
+	}
+}
+
+func (q *targetQuery) compileAll(terms []targeting.Expr, sep string) (string, error) {
+	parts := make([]string, len(terms))
+	for i, term := range terms {
+		part, err := q.compile(term)
+		if err != nil {
+			return "", err
+		}
+		parts[i] = part
+	}
+	return "(" + strings.Join(parts, sep) + ")", nil
+}
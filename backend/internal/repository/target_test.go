@@ -0,0 +1,106 @@
+package repository
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/pushlab/backend/internal/targeting"
+)
+
+func TestTargetQueryWhere(t *testing.T) {
+	orgID := uuid.MustParse("0b7e4c1a-2f3d-4a5b-8c6d-7e8f9a0b1c2d")
+	deviceID := uuid.MustParse("6f1c2b4e-8d3a-4e5f-9a7b-0c1d2e3f4a5b")
+	now := time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		target      string
+		allowedTags []string
+		want        string
+		args        []any
+	}{
+		{
+			target: `tag:oncall`,
+			want:   `d.org_id = $1 AND COALESCE($2 = ANY(d.tags), false)`,
+			args:   []any{orgID, "oncall"},
+		},
+		{
+			target: `device:` + deviceID.String(),
+			want:   `d.org_id = $1 AND d.id = $2`,
+			args:   []any{orgID, deviceID},
+		},
+		{
+			target: `platform != ios`,
+			want:   `d.org_id = $1 AND d.platform <> $2`,
+			args:   []any{orgID, "ios"},
+		},
+		{
+			target: `model = ""`,
+			want:   `d.org_id = $1 AND d.model = $2`,
+			args:   []any{orgID, ""},
+		},
+		{
+			target: `app_version >= 2.3.0`,
+			want:   `d.org_id = $1 AND COALESCE(version_key(d.app_version) >= $2::int[], false)`,
+			args:   []any{orgID, []int32{2, 3}},
+		},
+		{
+			target:      `seen_within:7d`,
+			allowedTags: []string{"team-a", "team-b"},
+			want:        `d.org_id = $1 AND COALESCE(d.last_seen_at >= $2, false) AND d.tags && $3::text[]`,
+			args:        []any{orgID, now.Add(-7 * 24 * time.Hour), []string{"team-a", "team-b"}},
+		},
+		{
+			target: `tag:a OR NOT tag:b AND os_version < 17`,
+			want: `d.org_id = $1 AND (COALESCE($2 = ANY(d.tags), false) OR ` +
+				`(NOT COALESCE($3 = ANY(d.tags), false) AND COALESCE(version_key(d.os_version) < $4::int[], false)))`,
+			args: []any{orgID, "a", "b", []int32{17}},
+		},
+		{
+			target: `NOT (tag:a OR tag:b)`,
+			want:   `d.org_id = $1 AND NOT (COALESCE($2 = ANY(d.tags), false) OR COALESCE($3 = ANY(d.tags), false))`,
+			args:   []any{orgID, "a", "b"},
+		},
+	}
+
+	for _, tt := range tests {
+		expr, err := targeting.Parse(tt.target)
+		if err != nil {
+			t.Fatalf("Parse(%q) returned error: %v", tt.target, err)
+		}
+
+		q := &targetQuery{now: now}
+		got, err := q.where(orgID, expr, tt.allowedTags)
+		if err != nil {
+			t.Errorf("where(%q) returned error: %v", tt.target, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("where(%q) =\n  %s\nwant\n  %s", tt.target, got, tt.want)
+		}
+		if !reflect.DeepEqual(q.args, tt.args) {
+			t.Errorf("where(%q) args = %#v, want %#v", tt.target, q.args, tt.args)
+		}
+	}
+}
+
+func TestTargetQueryCompileErrors(t *testing.T) {
+	tests := []struct {
+		expr targeting.Expr
+		want string
+	}{
+		{targeting.Compare{Field: "carrier", Op: targeting.OpEq, Value: "x"}, "unsupported comparison: carrier ="},
+		{targeting.Compare{Field: "model", Op: "~", Value: "x"}, "unsupported comparison: model ~"},
+		{targeting.And{Terms: []targeting.Expr{targeting.Tag{Name: "a"}, nil}}, "unsupported target expression: <nil>"},
+	}
+
+	for _, tt := range tests {
+		q := &targetQuery{}
+		_, err := q.compile(tt.expr)
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("compile(%#v) error = %v, want %q", tt.expr, err, tt.want)
+		}
+	}
+}
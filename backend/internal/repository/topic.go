@@ -0,0 +1,204 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/pushlab/backend/internal/models"
+)
+
+var ErrTopicNotFound = errors.New("topic not found")
+
+type TopicRepository struct {
+	db *pgxpool.Pool
+}
+
+func NewTopicRepository(db *pgxpool.Pool) *TopicRepository {
+	return &TopicRepository{db: db}
+}
+
+// GetOrCreate returns the organization's topic, creating it with the default
+// settings if it does not exist yet
+func (r *TopicRepository) GetOrCreate(ctx context.Context, orgID uuid.UUID, name string) (*models.Topic, error) {
+	insert := `INSERT INTO topics (org_id, name) VALUES ($1, $2) ON CONFLICT (org_id, name) DO NOTHING`
+	if _, err := r.db.Exec(ctx, insert, orgID, name); err != nil {
+		return nil, fmt.Errorf("failed to create topic: %w", err)
+	}
+	return r.GetByName(ctx, orgID, name)
+}
+
+func (r *TopicRepository) GetByName(ctx context.Context, orgID uuid.UUID, name string) (*models.Topic, error) {
+	var topic models.Topic
+	query := `
+		SELECT t.id, t.org_id, t.name, t.description, t.default_access, t.message_retention_hours,
+		       (SELECT COUNT(*) FROM topic_subscriptions s WHERE s.topic_id = t.id),
+		       t.created_at, t.updated_at
+		FROM topics t WHERE t.org_id = $1 AND t.name = $2
+	`
+	err := r.db.QueryRow(ctx, query, orgID, name).Scan(
+		&topic.ID, &topic.OrgID, &topic.Name, &topic.Description, &topic.DefaultAccess,
+		&topic.MessageRetentionHours, &topic.Subscribers, &topic.CreatedAt, &topic.UpdatedAt,
+	)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, ErrTopicNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get topic: %w", err)
+	}
+	return &topic, nil
+}
+
+func (r *TopicRepository) GetByOrgID(ctx context.Context, orgID uuid.UUID) ([]models.Topic, error) {
+	query := `
+		SELECT t.id, t.org_id, t.name, t.description, t.default_access, t.message_retention_hours,
+		       (SELECT COUNT(*) FROM topic_subscriptions s WHERE s.topic_id = t.id),
+		       t.created_at, t.updated_at
+		FROM topics t WHERE t.org_id = $1 ORDER BY t.name
+	`
+	rows, err := r.db.Query(ctx, query, orgID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query topics: %w", err)
+	}
+	defer rows.Close()
+
+	topics := []models.Topic{}
+	for rows.Next() {
+		var topic models.Topic
+		if err := rows.Scan(
+			&topic.ID, &topic.OrgID, &topic.Name, &topic.Description, &topic.DefaultAccess,
+			&topic.MessageRetentionHours, &topic.Subscribers, &topic.CreatedAt, &topic.UpdatedAt,
+		); err != nil {
+			return nil, fmt.Errorf("failed to scan topic: %w", err)
+		}
+		topics = append(topics, topic)
+	}
+	return topics, nil
+}
+
+func (r *TopicRepository) Update(ctx context.Context, topic *models.Topic) error {
+	query := `
+		UPDATE topics
+		SET description = $2, default_access = $3, message_retention_hours = $4
+		WHERE id = $1
+		RETURNING updated_at
+	`
+	return r.db.QueryRow(ctx, query, topic.ID, topic.Description, topic.DefaultAccess, topic.MessageRetentionHours).
+		Scan(&topic.UpdatedAt)
+}
+
+// Delete removes the topic with its subscriptions and ACL. Its messages stay
+// in the notification history.
+func (r *TopicRepository) Delete(ctx context.Context, id uuid.UUID) error {
+	_, err := r.db.Exec(ctx, `DELETE FROM topics WHERE id = $1`, id)
+	return err
+}
+
+// GetAccess returns the member's ACL entry for the topic, if there is one
+func (r *TopicRepository) GetAccess(ctx context.Context, topicID, userID uuid.UUID) (string, bool, error) {
+	var access string
+	query := `SELECT access FROM topic_acl WHERE topic_id = $1 AND user_id = $2`
+	err := r.db.QueryRow(ctx, query, topicID, userID).Scan(&access)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, fmt.Errorf("failed to get topic access: %w", err)
+	}
+	return access, true, nil
+}
+
+func (r *TopicRepository) GetACL(ctx context.Context, topicID uuid.UUID) ([]models.TopicACLEntry, error) {
+	query := `
+		SELECT a.topic_id, a.user_id, u.username, a.access, a.created_at
+		FROM topic_acl a
+		JOIN users u ON u.id = a.user_id
+		WHERE a.topic_id = $1
+		ORDER BY u.username
+	`
+	rows, err := r.db.Query(ctx, query, topicID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query topic ACL: %w", err)
+	}
+	defer rows.Close()
+
+	entries := []models.TopicACLEntry{}
+	for rows.Next() {
+		var entry models.TopicACLEntry
+		if err := rows.Scan(&entry.TopicID, &entry.UserID, &entry.Username, &entry.Access, &entry.CreatedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan topic ACL entry: %w", err)
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+func (r *TopicRepository) SetAccess(ctx context.Context, topicID, userID uuid.UUID, access string) error {
+	query := `
+		INSERT INTO topic_acl (topic_id, user_id, access)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (topic_id, user_id) DO UPDATE SET access = EXCLUDED.access
+	`
+	_, err := r.db.Exec(ctx, query, topicID, userID, access)
+	return err
+}
+
+func (r *TopicRepository) RemoveAccess(ctx context.Context, topicID, userID uuid.UUID) (bool, error) {
+	tag, err := r.db.Exec(ctx, `DELETE FROM topic_acl WHERE topic_id = $1 AND user_id = $2`, topicID, userID)
+	if err != nil {
+		return false, err
+	}
+	return tag.RowsAffected() > 0, nil
+}
+
+// Subscribe subscribes the device to the topic, returning false if it
+// already was
+func (r *TopicRepository) Subscribe(ctx context.Context, topicID, deviceID uuid.UUID) (bool, error) {
+	query := `
+		INSERT INTO topic_subscriptions (topic_id, device_id)
+		VALUES ($1, $2)
+		ON CONFLICT (topic_id, device_id) DO NOTHING
+	`
+	tag, err := r.db.Exec(ctx, query, topicID, deviceID)
+	if err != nil {
+		return false, err
+	}
+	return tag.RowsAffected() > 0, nil
+}
+
+func (r *TopicRepository) Unsubscribe(ctx context.Context, topicID, deviceID uuid.UUID) (bool, error) {
+	query := `DELETE FROM topic_subscriptions WHERE topic_id = $1 AND device_id = $2`
+	tag, err := r.db.Exec(ctx, query, topicID, deviceID)
+	if err != nil {
+		return false, err
+	}
+	return tag.RowsAffected() > 0, nil
+}
+
+func (r *TopicRepository) GetSubscriptions(ctx context.Context, deviceID uuid.UUID) ([]models.TopicSubscription, error) {
+	query := `
+		SELECT s.topic_id, t.name, s.device_id, s.created_at
+		FROM topic_subscriptions s
+		JOIN topics t ON t.id = s.topic_id
+		WHERE s.device_id = $1
+		ORDER BY t.name
+	`
+	rows, err := r.db.Query(ctx, query, deviceID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query subscriptions: %w", err)
+	}
+	defer rows.Close()
+
+	subscriptions := []models.TopicSubscription{}
+	for rows.Next() {
+		var sub models.TopicSubscription
+		if err := rows.Scan(&sub.TopicID, &sub.Topic, &sub.DeviceID, &sub.CreatedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan subscription: %w", err)
+		}
+		subscriptions = append(subscriptions, sub)
+	}
+	return subscriptions, nil
+}
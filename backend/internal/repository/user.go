@@ -3,6 +3,7 @@ package repository
 import (
 	"context"
 	"fmt"
+	"strings"
 
 	"github.com/google/uuid"
 	"github.com/jackc/pgx/v5/pgxpool"
@@ -19,23 +20,23 @@ func NewUserRepository(db *pgxpool.Pool) *UserRepository {
 
 func (r *UserRepository) Create(ctx context.Context, user *models.User) error {
 	query := `
-		INSERT INTO users (username, email, password_hash, api_key)
-		VALUES ($1, $2, $3, $4)
+		INSERT INTO users (username, email, password_hash)
+		VALUES ($1, $2, NULLIF($3, ''))
 		RETURNING id, created_at, updated_at, is_active
 	`
-	return r.db.QueryRow(ctx, query, user.Username, user.Email, user.PasswordHash, user.APIKey).
+	return r.db.QueryRow(ctx, query, user.Username, user.Email, user.PasswordHash).
 		Scan(&user.ID, &user.CreatedAt, &user.UpdatedAt, &user.IsActive)
 }
 
 func (r *UserRepository) GetByID(ctx context.Context, id uuid.UUID) (*models.User, error) {
 	var user models.User
 	query := `
-		SELECT id, username, email, password_hash, api_key, created_at, updated_at, is_active
+		SELECT id, username, email, COALESCE(password_hash, ''), created_at, updated_at, is_active, is_admin, default_org_id, email_verified_at
 		FROM users WHERE id = $1
 	`
 	err := r.db.QueryRow(ctx, query, id).Scan(
 		&user.ID, &user.Username, &user.Email, &user.PasswordHash,
-		&user.APIKey, &user.CreatedAt, &user.UpdatedAt, &user.IsActive,
+		&user.CreatedAt, &user.UpdatedAt, &user.IsActive, &user.IsAdmin, &user.DefaultOrgID, &user.EmailVerifiedAt,
 	)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get user: %w", err)
@@ -46,12 +47,12 @@ func (r *UserRepository) GetByID(ctx context.Context, id uuid.UUID) (*models.Use
 func (r *UserRepository) GetByUsername(ctx context.Context, username string) (*models.User, error) {
 	var user models.User
 	query := `
-		SELECT id, username, email, password_hash, api_key, created_at, updated_at, is_active
+		SELECT id, username, email, COALESCE(password_hash, ''), created_at, updated_at, is_active, is_admin, default_org_id, email_verified_at
 		FROM users WHERE username = $1
 	`
 	err := r.db.QueryRow(ctx, query, username).Scan(
 		&user.ID, &user.Username, &user.Email, &user.PasswordHash,
-		&user.APIKey, &user.CreatedAt, &user.UpdatedAt, &user.IsActive,
+		&user.CreatedAt, &user.UpdatedAt, &user.IsActive, &user.IsAdmin, &user.DefaultOrgID, &user.EmailVerifiedAt,
 	)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get user: %w", err)
@@ -59,15 +60,16 @@ func (r *UserRepository) GetByUsername(ctx context.Context, username string) (*m
 	return &user, nil
 }
 
-func (r *UserRepository) GetByAPIKey(ctx context.Context, apiKey string) (*models.User, error) {
+// GetByEmail looks a user up by email address, ignoring case
+func (r *UserRepository) GetByEmail(ctx context.Context, email string) (*models.User, error) {
 	var user models.User
 	query := `
-		SELECT id, username, email, password_hash, api_key, created_at, updated_at, is_active
-		FROM users WHERE api_key = $1 AND is_active = true
+		SELECT id, username, email, COALESCE(password_hash, ''), created_at, updated_at, is_active, is_admin, default_org_id, email_verified_at
+		FROM users WHERE LOWER(email) = LOWER($1)
 	`
-	err := r.db.QueryRow(ctx, query, apiKey).Scan(
+	err := r.db.QueryRow(ctx, query, email).Scan(
 		&user.ID, &user.Username, &user.Email, &user.PasswordHash,
-		&user.APIKey, &user.CreatedAt, &user.UpdatedAt, &user.IsActive,
+		&user.CreatedAt, &user.UpdatedAt, &user.IsActive, &user.IsAdmin, &user.DefaultOrgID, &user.EmailVerifiedAt,
 	)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get user: %w", err)
@@ -75,18 +77,123 @@ func (r *UserRepository) GetByAPIKey(ctx context.Context, apiKey string) (*model
 	return &user, nil
 }
 
+// UsernameExists reports whether the username is taken
+func (r *UserRepository) UsernameExists(ctx context.Context, username string) (bool, error) {
+	var exists bool
+	query := `SELECT EXISTS (SELECT 1 FROM users WHERE username = $1)`
+	err := r.db.QueryRow(ctx, query, username).Scan(&exists)
+	return exists, err
+}
+
 func (r *UserRepository) Update(ctx context.Context, user *models.User) error {
 	query := `
 		UPDATE users
-		SET email = $2, is_active = $3
+		SET email = $2, is_active = $3,
+		    email_verified_at = CASE WHEN email = $2 THEN email_verified_at END
 		WHERE id = $1
 		RETURNING updated_at
 	`
 	return r.db.QueryRow(ctx, query, user.ID, user.Email, user.IsActive).Scan(&user.UpdatedAt)
 }
 
-func (r *UserRepository) UpdateAPIKey(ctx context.Context, userID uuid.UUID, apiKey string) error {
-	query := `UPDATE users SET api_key = $2 WHERE id = $1`
-	_, err := r.db.Exec(ctx, query, userID, apiKey)
-	return err
+// MarkEmailVerified records that the user controls email, unless the address
+// was changed in the meantime
+func (r *UserRepository) MarkEmailVerified(ctx context.Context, id uuid.UUID, email string) (bool, error) {
+	query := `
+		UPDATE users SET email_verified_at = CURRENT_TIMESTAMP
+		WHERE id = $1 AND email = $2
+	`
+	tag, err := r.db.Exec(ctx, query, id, email)
+	if err != nil {
+		return false, fmt.Errorf("failed to verify email: %w", err)
+	}
+	return tag.RowsAffected() > 0, nil
+}
+
+// List returns the users matching filter, oldest first
+func (r *UserRepository) List(ctx context.Context, filter models.UserFilter) ([]models.User, error) {
+	query := `
+		SELECT id, username, email, COALESCE(password_hash, ''), created_at, updated_at, is_active, is_admin, default_org_id, email_verified_at
+		FROM users
+		WHERE ($1 = '' OR username ILIKE '%' || $1 || '%' OR email ILIKE '%' || $1 || '%')
+		  AND ($2::BOOLEAN IS NULL OR is_active = $2)
+		ORDER BY created_at, id
+		LIMIT $3 OFFSET $4
+	`
+	rows, err := r.db.Query(ctx, query, escapeLike(filter.Query), filter.Active, filter.Limit, filter.Offset)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list users: %w", err)
+	}
+	defer rows.Close()
+
+	users := []models.User{}
+	for rows.Next() {
+		var user models.User
+		if err := rows.Scan(
+			&user.ID, &user.Username, &user.Email, &user.PasswordHash,
+			&user.CreatedAt, &user.UpdatedAt, &user.IsActive, &user.IsAdmin, &user.DefaultOrgID, &user.EmailVerifiedAt,
+		); err != nil {
+			return nil, fmt.Errorf("failed to scan user: %w", err)
+		}
+		users = append(users, user)
+	}
+	return users, rows.Err()
+}
+
+// SetActive deactivates or reactivates the user. It reports false when the
+// user was already in that state.
+func (r *UserRepository) SetActive(ctx context.Context, id uuid.UUID, active bool) (bool, error) {
+	query := `
+		UPDATE users SET is_active = $2, updated_at = CURRENT_TIMESTAMP
+		WHERE id = $1 AND is_active <> $2
+	`
+	tag, err := r.db.Exec(ctx, query, id, active)
+	if err != nil {
+		return false, fmt.Errorf("failed to update user: %w", err)
+	}
+	return tag.RowsAffected() > 0, nil
+}
+
+// SetAdmin grants or revokes instance administration
+func (r *UserRepository) SetAdmin(ctx context.Context, username string, admin bool) (bool, error) {
+	query := `UPDATE users SET is_admin = $2, updated_at = CURRENT_TIMESTAMP WHERE username = $1`
+	tag, err := r.db.Exec(ctx, query, username, admin)
+	if err != nil {
+		return false, fmt.Errorf("failed to update user: %w", err)
+	}
+	return tag.RowsAffected() > 0, nil
+}
+
+// GetUsage counts what the user owns and sends
+func (r *UserRepository) GetUsage(ctx context.Context, id uuid.UUID) (*models.UserUsage, error) {
+	usage := models.UserUsage{UserID: id}
+	query := `
+		SELECT
+			(SELECT COUNT(*) FROM org_memberships WHERE user_id = $1),
+			(SELECT COUNT(*) FROM devices WHERE user_id = $1),
+			(SELECT COUNT(*) FROM api_keys
+			 WHERE user_id = $1 AND revoked_at IS NULL AND (expires_at IS NULL OR expires_at > CURRENT_TIMESTAMP)),
+			(SELECT COUNT(DISTINCT family_id) FROM refresh_tokens
+			 WHERE user_id = $1 AND used_at IS NULL AND revoked_at IS NULL AND expires_at > CURRENT_TIMESTAMP),
+			(SELECT COUNT(*) FROM notifications WHERE user_id = $1),
+			(SELECT COUNT(*) FROM notifications WHERE user_id = $1 AND created_at > CURRENT_TIMESTAMP - INTERVAL '30 days'),
+			(SELECT MAX(created_at) FROM notifications WHERE user_id = $1),
+			(SELECT MAX(last_used_at) FROM api_keys WHERE user_id = $1),
+			(SELECT MAX(created_at) FROM audit_events
+			 WHERE action = 'auth.login' AND target_type = 'user' AND target_id = $1::TEXT)
+	`
+	err := r.db.QueryRow(ctx, query, id).Scan(
+		&usage.Organizations, &usage.Devices, &usage.ActiveAPIKeys, &usage.ActiveSessions,
+		&usage.NotificationsSent, &usage.NotificationsLast30Days,
+		&usage.LastNotificationAt, &usage.LastAPIKeyUseAt, &usage.LastLoginAt,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get user usage: %w", err)
+	}
+	return &usage, nil
+}
+
+// escapeLike quotes the wildcards of a LIKE pattern
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
 }
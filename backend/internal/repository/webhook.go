@@ -0,0 +1,85 @@
+package repository
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/pushlab/backend/internal/models"
+)
+
+type WebhookRepository struct {
+	db *pgxpool.Pool
+}
+
+func NewWebhookRepository(db *pgxpool.Pool) *WebhookRepository {
+	return &WebhookRepository{db: db}
+}
+
+func (r *WebhookRepository) Create(ctx context.Context, webhook *models.Webhook) error {
+	query := `
+		INSERT INTO webhooks (org_id, user_id, url, secret, events)
+		VALUES ($1, $2, $3, $4, $5)
+		RETURNING id, created_at, is_active
+	`
+	return r.db.QueryRow(ctx, query, webhook.OrgID, webhook.UserID, webhook.URL, webhook.Secret, webhook.Events).
+		Scan(&webhook.ID, &webhook.CreatedAt, &webhook.IsActive)
+}
+
+func (r *WebhookRepository) GetByOrgID(ctx context.Context, orgID uuid.UUID) ([]models.Webhook, error) {
+	query := `
+		SELECT id, org_id, user_id, url, secret, events, created_at, is_active
+		FROM webhooks
+		WHERE org_id = $1 AND is_active = true
+		ORDER BY created_at DESC
+	`
+	rows, err := r.db.Query(ctx, query, orgID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query webhooks: %w", err)
+	}
+	defer rows.Close()
+
+	return r.scanWebhooks(rows)
+}
+
+// GetByOrgAndEvent returns the active webhooks subscribed to an event type
+func (r *WebhookRepository) GetByOrgAndEvent(ctx context.Context, orgID uuid.UUID, eventType string) ([]models.Webhook, error) {
+	query := `
+		SELECT id, org_id, user_id, url, secret, events, created_at, is_active
+		FROM webhooks
+		WHERE org_id = $1 AND is_active = true AND $2 = ANY(events)
+	`
+	rows, err := r.db.Query(ctx, query, orgID, eventType)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query webhooks: %w", err)
+	}
+	defer rows.Close()
+
+	return r.scanWebhooks(rows)
+}
+
+func (r *WebhookRepository) scanWebhooks(rows pgx.Rows) ([]models.Webhook, error) {
+	var webhooks []models.Webhook
+	for rows.Next() {
+		var webhook models.Webhook
+		if err := rows.Scan(
+			&webhook.ID, &webhook.OrgID, &webhook.UserID, &webhook.URL, &webhook.Secret,
+			&webhook.Events, &webhook.CreatedAt, &webhook.IsActive,
+		); err != nil {
+			return nil, fmt.Errorf("failed to scan webhook: %w", err)
+		}
+		webhooks = append(webhooks, webhook)
+	}
+	return webhooks, nil
+}
+
+func (r *WebhookRepository) Delete(ctx context.Context, id, orgID uuid.UUID) (bool, error) {
+	query := `UPDATE webhooks SET is_active = false WHERE id = $1 AND org_id = $2 AND is_active = true`
+	tag, err := r.db.Exec(ctx, query, id, orgID)
+	if err != nil {
+		return false, err
+	}
+	return tag.RowsAffected() > 0, nil
+}
@@ -0,0 +1,116 @@
+package targeting
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokWord
+	tokString
+	tokOp
+	tokLParen
+	tokRParen
+)
+
+type token struct {
+	kind tokenKind
+	text string
+	pos  int
+}
+
+func isWordChar(r rune) bool {
+	return !unicode.IsSpace(r) && !strings.ContainsRune(`()"=!<>`, r)
+}
+
+// lex splits the input into tokens. Positions are 1-based byte offsets.
+// A quoted string directly after a prefix, as in tag:"on call", becomes part
+// of the prefixed word.
+func lex(input string) ([]token, error) {
+	var tokens []token
+	runes := []rune(input)
+	offsets := make([]int, len(runes)+1)
+	for i, off := 0, 0; i < len(runes); i++ {
+		offsets[i] = off
+		off += len(string(runes[i]))
+		offsets[i+1] = off
+	}
+
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		pos := offsets[i] + 1
+		switch {
+		case unicode.IsSpace(r):
+			i++
+		case r == '(':
+			tokens = append(tokens, token{kind: tokLParen, text: "(", pos: pos})
+			i++
+		case r == ')':
+			tokens = append(tokens, token{kind: tokRParen, text: ")", pos: pos})
+			i++
+		case r == '"':
+			s, next, err := lexString(runes, i, pos)
+			if err != nil {
+				return nil, err
+			}
+			tokens = append(tokens, token{kind: tokString, text: s, pos: pos})
+			i = next
+		case strings.ContainsRune("=!<>", r):
+			op := string(r)
+			i++
+			if i < len(runes) && runes[i] == '=' {
+				op += "="
+				i++
+			}
+			switch op {
+			case "==":
+				op = OpEq
+			case "!":
+				return nil, fmt.Errorf("unexpected ! at position %d: use NOT or !=", pos)
+			}
+			tokens = append(tokens, token{kind: tokOp, text: op, pos: pos})
+		default:
+			start := i
+			for i < len(runes) && isWordChar(runes[i]) {
+				i++
+			}
+			word := string(runes[start:i])
+			if strings.HasSuffix(word, ":") && i < len(runes) && runes[i] == '"' {
+				s, next, err := lexString(runes, i, offsets[i]+1)
+				if err != nil {
+					return nil, err
+				}
+				word += s
+				i = next
+			}
+			tokens = append(tokens, token{kind: tokWord, text: word, pos: pos})
+		}
+	}
+
+	tokens = append(tokens, token{kind: tokEOF, text: "end of expression", pos: len(input) + 1})
+	return tokens, nil
+}
+
+// lexString reads the quoted string starting at runes[i], in which \" and \\
+// are escapes, and returns it with the index after the closing quote
+func lexString(runes []rune, i, pos int) (string, int, error) {
+	var b strings.Builder
+	for i++; i < len(runes); i++ {
+		switch runes[i] {
+		case '\\':
+			if i+1 < len(runes) && (runes[i+1] == '"' || runes[i+1] == '\\') {
+				i++
+			}
+			b.WriteRune(runes[i])
+		case '"':
+			return b.String(), i + 1, nil
+		default:
+			b.WriteRune(runes[i])
+		}
+	}
+	return "", 0, fmt.Errorf("unterminated string at position %d", pos)
+}
@@ -0,0 +1,346 @@
+// Package targeting parses audience filter expressions such as
+//
+//	tag:oncall AND NOT tag:muted AND app_version >= 2.3
+//
+// into a tree that the device repository compiles to SQL
+package targeting
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/pushlab/backend/internal/models"
+)
+
+const (
+	// MaxLength bounds the length of an expression
+	MaxLength = 2000
+	// maxTerms bounds the number of conditions in an expression
+	maxTerms = 100
+	// maxDepth bounds the nesting of parentheses and NOTs
+	maxDepth = 32
+)
+
+// Expr is a node of a parsed expression
+type Expr interface {
+	expr()
+}
+
+// And matches devices matching all of its terms
+type And struct {
+	Terms []Expr
+}
+
+// Or matches devices matching any of its terms
+type Or struct {
+	Terms []Expr
+}
+
+// Not matches devices not matching Term
+type Not struct {
+	Term Expr
+}
+
+// Tag matches devices tagged Name
+type Tag struct {
+	Name string
+}
+
+// Device matches a single device
+type Device struct {
+	ID uuid.UUID
+}
+
+// SeenWithin matches devices seen in the last Duration. Devices that were
+// never seen do not match.
+type SeenWithin struct {
+	Duration time.Duration
+}
+
+// Compare matches devices whose metadata Field compares to Value with Op.
+// Version fields compare numerically by component, with Version holding the
+// parsed Value.
+type Compare struct {
+	Field   string
+	Op      string
+	Value   string
+	Version []int32
+}
+
+func (And) expr()        {}
+func (Or) expr()         {}
+func (Not) expr()        {}
+func (Tag) expr()        {}
+func (Device) expr()     {}
+func (SeenWithin) expr() {}
+func (Compare) expr()    {}
+
+// Comparison operators
+const (
+	OpEq = "="
+	OpNe = "!="
+	OpLt = "<"
+	OpLe = "<="
+	OpGt = ">"
+	OpGe = ">="
+)
+
+// fields lists the device metadata that can be compared, and whether it is
+// a version compared by component
+var fields = map[string]bool{
+	"platform":           false,
+	"os_version":         true,
+	"app_version":        true,
+	"app_build":          true,
+	"model":              false,
+	"timezone":           false,
+	"locale":             false,
+	"push_authorization": false,
+}
+
+// IsVersionField reports whether the field holds dotted version numbers
+func IsVersionField(field string) bool {
+	return fields[field]
+}
+
+// Parse parses an expression
+func Parse(input string) (Expr, error) {
+	if strings.TrimSpace(input) == "" {
+		return nil, fmt.Errorf("expression is empty")
+	}
+	if len(input) > MaxLength {
+		return nil, fmt.Errorf("expression must be at most %d characters", MaxLength)
+	}
+
+	tokens, err := lex(input)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &parser{tokens: tokens}
+	expr, err := p.parseOr(0)
+	if err != nil {
+		return nil, err
+	}
+	if tok := p.peek(); tok.kind != tokEOF {
+		return nil, fmt.Errorf("unexpected %q at position %d", tok.text, tok.pos)
+	}
+	return expr, nil
+}
+
+type parser struct {
+	tokens []token
+	next   int
+	terms  int
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.next]
+}
+
+func (p *parser) advance() token {
+	tok := p.tokens[p.next]
+	if tok.kind != tokEOF {
+		p.next++
+	}
+	return tok
+}
+
+func (p *parser) keyword(word string) bool {
+	tok := p.peek()
+	if tok.kind == tokWord && strings.EqualFold(tok.text, word) {
+		p.advance()
+		return true
+	}
+	return false
+}
+
+func (p *parser) parseOr(depth int) (Expr, error) {
+	term, err := p.parseAnd(depth)
+	if err != nil {
+		return nil, err
+	}
+	terms := []Expr{term}
+	for p.keyword("OR") {
+		term, err := p.parseAnd(depth)
+		if err != nil {
+			return nil, err
+		}
+		terms = append(terms, term)
+	}
+	if len(terms) == 1 {
+		return terms[0], nil
+	}
+	return Or{Terms: terms}, nil
+}
+
+func (p *parser) parseAnd(depth int) (Expr, error) {
+	term, err := p.parseUnary(depth)
+	if err != nil {
+		return nil, err
+	}
+	terms := []Expr{term}
+	for p.keyword("AND") {
+		term, err := p.parseUnary(depth)
+		if err != nil {
+			return nil, err
+		}
+		terms = append(terms, term)
+	}
+	if len(terms) == 1 {
+		return terms[0], nil
+	}
+	return And{Terms: terms}, nil
+}
+
+func (p *parser) parseUnary(depth int) (Expr, error) {
+	if depth > maxDepth {
+		return nil, fmt.Errorf("expression is nested too deeply")
+	}
+	if p.keyword("NOT") {
+		term, err := p.parseUnary(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		return Not{Term: term}, nil
+	}
+
+	tok := p.advance()
+	switch tok.kind {
+	case tokLParen:
+		expr, err := p.parseOr(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		if closing := p.advance(); closing.kind != tokRParen {
+			return nil, fmt.Errorf("expected ) at position %d", closing.pos)
+		}
+		return expr, nil
+	case tokWord:
+		p.terms++
+		if p.terms > maxTerms {
+			return nil, fmt.Errorf("expression may have at most %d conditions", maxTerms)
+		}
+		if prefix, value, ok := strings.Cut(tok.text, ":"); ok {
+			return parsePrefixed(strings.ToLower(prefix), value, tok.pos)
+		}
+		return p.parseCompare(tok)
+	case tokEOF:
+		return nil, fmt.Errorf("unexpected end of expression")
+	default:
+		return nil, fmt.Errorf("unexpected %q at position %d", tok.text, tok.pos)
+	}
+}
+
+func parsePrefixed(prefix, value string, pos int) (Expr, error) {
+	if value == "" {
+		return nil, fmt.Errorf("missing value for %s: at position %d", prefix, pos)
+	}
+	switch prefix {
+	case "tag":
+		return Tag{Name: value}, nil
+	case "device":
+		id, err := uuid.Parse(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid device ID %q at position %d", value, pos)
+		}
+		return Device{ID: id}, nil
+	case "seen_within":
+		d, err := parseDuration(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid duration %q at position %d: use e.g. 30m, 12h, 7d or 4w", value, pos)
+		}
+		return SeenWithin{Duration: d}, nil
+	default:
+		return nil, fmt.Errorf("unknown condition %s: at position %d", prefix, pos)
+	}
+}
+
+func (p *parser) parseCompare(field token) (Expr, error) {
+	name := strings.ToLower(field.text)
+	version, ok := fields[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown field %q at position %d", field.text, field.pos)
+	}
+
+	op := p.advance()
+	if op.kind != tokOp {
+		return nil, fmt.Errorf("expected a comparison after %s at position %d", name, op.pos)
+	}
+	if !version && op.text != OpEq && op.text != OpNe {
+		return nil, fmt.Errorf("%s only supports = and != at position %d", name, op.pos)
+	}
+
+	value := p.advance()
+	if value.kind != tokWord && value.kind != tokString {
+		return nil, fmt.Errorf("expected a value after %s %s at position %d", name, op.text, value.pos)
+	}
+
+	cmp := Compare{Field: name, Op: op.text, Value: value.text}
+	switch {
+	case version:
+		parts, err := ParseVersion(value.text)
+		if err != nil {
+			return nil, fmt.Errorf("invalid version %q at position %d", value.text, value.pos)
+		}
+		cmp.Version = parts
+	case name == "platform" && !models.IsValidPlatform(value.text):
+		return nil, fmt.Errorf("invalid platform %q at position %d", value.text, value.pos)
+	case name == "push_authorization" && !models.IsValidPushAuthorization(value.text):
+		return nil, fmt.Errorf("invalid push authorization %q at position %d", value.text, value.pos)
+	}
+	return cmp, nil
+}
+
+// ParseVersion splits a dotted version into its numeric components, without
+// trailing zero components so that 2.3 and 2.3.0 compare equal. This matches
+// the version_key SQL function.
+func ParseVersion(v string) ([]int32, error) {
+	var parts []int32
+	for _, s := range strings.Split(v, ".") {
+		if s == "" || len(s) > 9 {
+			return nil, fmt.Errorf("invalid version: %s", v)
+		}
+		n, err := strconv.ParseInt(s, 10, 32)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid version: %s", v)
+		}
+		parts = append(parts, int32(n))
+	}
+	for len(parts) > 1 && parts[len(parts)-1] == 0 {
+		parts = parts[:len(parts)-1]
+	}
+	return parts, nil
+}
+
+// parseDuration accepts Go durations as well as days (d) and weeks (w)
+func parseDuration(s string) (time.Duration, error) {
+	unit := time.Duration(0)
+	switch {
+	case strings.HasSuffix(s, "d"):
+		unit = 24 * time.Hour
+	case strings.HasSuffix(s, "w"):
+		unit = 7 * 24 * time.Hour
+	}
+
+	var d time.Duration
+	if unit != 0 {
+		n, err := strconv.Atoi(strings.TrimSuffix(strings.TrimSuffix(s, "d"), "w"))
+		if err != nil || n > 3650 {
+			return 0, fmt.Errorf("invalid duration: %s", s)
+		}
+		d = time.Duration(n) * unit
+	} else {
+		var err error
+		if d, err = time.ParseDuration(s); err != nil {
+			return 0, err
+		}
+	}
+	if d <= 0 {
+		return 0, fmt.Errorf("duration must be positive: %s", s)
+	}
+	return d, nil
+}
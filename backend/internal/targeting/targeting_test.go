@@ -0,0 +1,244 @@
+package targeting
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestLex(t *testing.T) {
+	tests := []struct {
+		input string
+		want  []token
+	}{
+		{
+			input: `tag:oncall AND app_version>=2.3`,
+			want: []token{
+				{tokWord, "tag:oncall", 1},
+				{tokWord, "AND", 12},
+				{tokWord, "app_version", 16},
+				{tokOp, ">=", 27},
+				{tokWord, "2.3", 29},
+				{tokEOF, "end of expression", 32},
+			},
+		},
+		{
+			input: `tag:"on call"`,
+			want: []token{
+				{tokWord, "tag:on call", 1},
+				{tokEOF, "end of expression", 14},
+			},
+		},
+		{
+			input: `model == "a \"b\" \\"`,
+			want: []token{
+				{tokWord, "model", 1},
+				{tokOp, OpEq, 7},
+				{tokString, `a "b" \`, 10},
+				{tokEOF, "end of expression", 22},
+			},
+		},
+		{
+			input: `(NOT tag:a)`,
+			want: []token{
+				{tokLParen, "(", 1},
+				{tokWord, "NOT", 2},
+				{tokWord, "tag:a", 6},
+				{tokRParen, ")", 11},
+				{tokEOF, "end of expression", 12},
+			},
+		},
+		{
+			input: `model != "é" OR x<y`,
+			want: []token{
+				{tokWord, "model", 1},
+				{tokOp, OpNe, 7},
+				{tokString, "é", 10},
+				{tokWord, "OR", 15},
+				{tokWord, "x", 18},
+				{tokOp, OpLt, 19},
+				{tokWord, "y", 20},
+				{tokEOF, "end of expression", 21},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		got, err := lex(tt.input)
+		if err != nil {
+			t.Errorf("lex(%q) returned error: %v", tt.input, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("lex(%q) = %v, want %v", tt.input, got, tt.want)
+		}
+	}
+}
+
+func TestLexErrors(t *testing.T) {
+	tests := []struct {
+		input string
+		want  string
+	}{
+		{`model = "open`, "unterminated string at position 9"},
+		{`tag:"open`, "unterminated string at position 5"},
+		{`!tag:a`, "unexpected ! at position 1"},
+	}
+
+	for _, tt := range tests {
+		_, err := lex(tt.input)
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("lex(%q) error = %v, want %q", tt.input, err, tt.want)
+		}
+	}
+}
+
+func TestParse(t *testing.T) {
+	deviceID := uuid.MustParse("6f1c2b4e-8d3a-4e5f-9a7b-0c1d2e3f4a5b")
+
+	tests := []struct {
+		input string
+		want  Expr
+	}{
+		{`tag:a`, Tag{Name: "a"}},
+		{`TAG:"on call"`, Tag{Name: "on call"}},
+		{`device:` + deviceID.String(), Device{ID: deviceID}},
+		{`seen_within:7d`, SeenWithin{Duration: 7 * 24 * time.Hour}},
+		{`seen_within:2w`, SeenWithin{Duration: 14 * 24 * time.Hour}},
+		{`seen_within:90m`, SeenWithin{Duration: 90 * time.Minute}},
+
+		// AND binds tighter than OR
+		{`tag:a OR tag:b AND tag:c`, Or{Terms: []Expr{
+			Tag{Name: "a"},
+			And{Terms: []Expr{Tag{Name: "b"}, Tag{Name: "c"}}},
+		}}},
+		{`tag:a AND tag:b OR tag:c`, Or{Terms: []Expr{
+			And{Terms: []Expr{Tag{Name: "a"}, Tag{Name: "b"}}},
+			Tag{Name: "c"},
+		}}},
+		{`tag:a and tag:b and tag:c`, And{Terms: []Expr{
+			Tag{Name: "a"}, Tag{Name: "b"}, Tag{Name: "c"},
+		}}},
+
+		// NOT binds tighter than AND; parentheses override precedence
+		{`NOT tag:a AND tag:b`, And{Terms: []Expr{
+			Not{Term: Tag{Name: "a"}},
+			Tag{Name: "b"},
+		}}},
+		{`NOT (tag:a OR tag:b)`, Not{Term: Or{Terms: []Expr{Tag{Name: "a"}, Tag{Name: "b"}}}}},
+		{`not not tag:a`, Not{Term: Not{Term: Tag{Name: "a"}}}},
+		{`(tag:a OR tag:b) AND tag:c`, And{Terms: []Expr{
+			Or{Terms: []Expr{Tag{Name: "a"}, Tag{Name: "b"}}},
+			Tag{Name: "c"},
+		}}},
+		{`((tag:a))`, Tag{Name: "a"}},
+
+		// Metadata comparisons; empty strings match devices that did not
+		// report the field
+		{`platform = ios`, Compare{Field: "platform", Op: OpEq, Value: "ios"}},
+		{`Platform != "macos"`, Compare{Field: "platform", Op: OpNe, Value: "macos"}},
+		{`push_authorization = denied`, Compare{Field: "push_authorization", Op: OpEq, Value: "denied"}},
+		{`model = ""`, Compare{Field: "model", Op: OpEq, Value: ""}},
+		{`locale != ""`, Compare{Field: "locale", Op: OpNe, Value: ""}},
+		{`timezone == "Europe/Berlin"`, Compare{Field: "timezone", Op: OpEq, Value: "Europe/Berlin"}},
+
+		// Versions compare by component, ignoring trailing zeros
+		{`app_version >= 2.3.0`, Compare{Field: "app_version", Op: OpGe, Value: "2.3.0", Version: []int32{2, 3}}},
+		{`os_version < "17.10"`, Compare{Field: "os_version", Op: OpLt, Value: "17.10", Version: []int32{17, 10}}},
+		{`app_build = 0`, Compare{Field: "app_build", Op: OpEq, Value: "0", Version: []int32{0}}},
+	}
+
+	for _, tt := range tests {
+		got, err := Parse(tt.input)
+		if err != nil {
+			t.Errorf("Parse(%q) returned error: %v", tt.input, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("Parse(%q) = %#v, want %#v", tt.input, got, tt.want)
+		}
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		input string
+		want  string
+	}{
+		{``, "expression is empty"},
+		{`   `, "expression is empty"},
+		{strings.Repeat("a", MaxLength+1), "at most 2000 characters"},
+		{`tag:a AND`, "unexpected end of expression"},
+		{`tag:a OR OR tag:b`, `unknown field "OR" at position 10`},
+		{`(tag:a`, "expected ) at position 7"},
+		{`tag:a)`, `unexpected ")" at position 6`},
+		{`tag:a tag:b`, `unexpected "tag:b" at position 7`},
+		{`()`, `unexpected ")" at position 2`},
+		{`NOT`, "unexpected end of expression"},
+		{`tag:`, "missing value for tag: at position 1"},
+		{`color:red`, "unknown condition color: at position 1"},
+		{`device:nope`, `invalid device ID "nope"`},
+		{`seen_within:0d`, `invalid duration "0d"`},
+		{`seen_within:-1h`, `invalid duration "-1h"`},
+		{`seen_within:3651d`, `invalid duration "3651d"`},
+		{`seen_within:soon`, `invalid duration "soon"`},
+		{`carrier = x`, `unknown field "carrier" at position 1`},
+		{`app_version`, "expected a comparison after app_version at position 12"},
+		{`app_version >=`, "expected a value after app_version >= at position 15"},
+		{`app_version >= (`, "expected a value after app_version >= at position 16"},
+		{`model > x`, "model only supports = and != at position 7"},
+		{`platform = android`, `invalid platform "android"`},
+		{`platform = ""`, `invalid platform ""`},
+		{`push_authorization = maybe`, `invalid push authorization "maybe"`},
+		{`app_version >= 2.x`, `invalid version "2.x"`},
+		{`app_version = ""`, `invalid version ""`},
+		{strings.Repeat("NOT ", maxDepth+2) + "tag:a", "nested too deeply"},
+		{strings.Repeat("(", maxDepth+2) + "tag:a" + strings.Repeat(")", maxDepth+2), "nested too deeply"},
+		{strings.TrimSuffix(strings.Repeat("tag:a OR ", maxTerms+1), " OR "), "at most 100 conditions"},
+	}
+
+	for _, tt := range tests {
+		_, err := Parse(tt.input)
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("Parse(%q) error = %v, want %q", tt.input, err, tt.want)
+		}
+	}
+}
+
+func TestParseVersion(t *testing.T) {
+	tests := []struct {
+		input string
+		want  []int32
+	}{
+		{"2", []int32{2}},
+		{"2.3", []int32{2, 3}},
+		{"2.3.0", []int32{2, 3}},
+		{"2.3.0.0", []int32{2, 3}},
+		{"2.0.1", []int32{2, 0, 1}},
+		{"17.10", []int32{17, 10}},
+		{"0", []int32{0}},
+		{"0.0", []int32{0}},
+		{"007.1", []int32{7, 1}},
+		{"999999999", []int32{999999999}},
+	}
+
+	for _, tt := range tests {
+		got, err := ParseVersion(tt.input)
+		if err != nil {
+			t.Errorf("ParseVersion(%q) returned error: %v", tt.input, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("ParseVersion(%q) = %v, want %v", tt.input, got, tt.want)
+		}
+	}
+
+	for _, input := range []string{"", ".", "2.", ".2", "2..3", "-1", "2.x", "v2", "2.3-beta", "1234567890"} {
+		if got, err := ParseVersion(input); err == nil {
+			t.Errorf("ParseVersion(%q) = %v, want error", input, got)
+		}
+	}
+}
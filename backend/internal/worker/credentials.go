@@ -0,0 +1,92 @@
+package worker
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/pushlab/backend/internal/apns"
+)
+
+// CredentialChannel is the Postgres NOTIFY channel emitted by the
+// apns_credentials trigger
+const CredentialChannel = "apns_credentials_changed"
+
+type credentialChange struct {
+	Operation      string    `json:"operation"`
+	CredentialID   uuid.UUID `json:"credential_id"`
+	PrivateKeyPath string    `json:"private_key_path"`
+}
+
+// CredentialWatcher evicts cached APNs clients when their credentials are
+// updated, deleted or re-uploaded
+type CredentialWatcher struct {
+	db             *pgxpool.Pool
+	apnsClient     *apns.Client
+	reconnectDelay time.Duration
+}
+
+func NewCredentialWatcher(db *pgxpool.Pool, apnsClient *apns.Client, reconnectDelay time.Duration) *CredentialWatcher {
+	if reconnectDelay <= 0 {
+		reconnectDelay = 5 * time.Second
+	}
+	return &CredentialWatcher{
+		db:             db,
+		apnsClient:     apnsClient,
+		reconnectDelay: reconnectDelay,
+	}
+}
+
+// Start listens for credential changes in the background until ctx is cancelled
+func (w *CredentialWatcher) Start(ctx context.Context) {
+	go func() {
+		for {
+			if err := w.listen(ctx); err != nil && ctx.Err() == nil {
+				log.Printf("Credential watcher error: %v. Reconnecting...", err)
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(w.reconnectDelay):
+			}
+		}
+	}()
+}
+
+func (w *CredentialWatcher) listen(ctx context.Context) error {
+	conn, err := w.db.Acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Release()
+
+	if _, err := conn.Exec(ctx, "LISTEN "+CredentialChannel); err != nil {
+		return err
+	}
+
+	// Anything cached before we started listening may be stale
+	w.apnsClient.Close()
+	log.Printf("Listening for APNs credential changes")
+
+	for {
+		notification, err := conn.Conn().WaitForNotification(ctx)
+		if err != nil {
+			return err
+		}
+
+		var change credentialChange
+		if err := json.Unmarshal([]byte(notification.Payload), &change); err != nil {
+			log.Printf("Invalid credential change payload: %v", err)
+			continue
+		}
+
+		if n := w.apnsClient.Evict(change.CredentialID, change.PrivateKeyPath); n > 0 {
+			log.Printf("Evicted %d APNs clients after %s of credential %s",
+				n, change.Operation, change.CredentialID)
+		}
+	}
+}
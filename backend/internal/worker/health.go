@@ -0,0 +1,105 @@
+package worker
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/pushlab/backend/internal/config"
+	"github.com/pushlab/backend/internal/models"
+	"github.com/pushlab/backend/internal/repository"
+)
+
+// CertificateMonitor periodically alerts owners whose APNs certificates are
+// about to expire or have expired
+type CertificateMonitor struct {
+	apnsRepo *repository.APNsRepository
+	notifier *OwnerNotifier
+	cfg      config.CredentialHealthConfig
+}
+
+func NewCertificateMonitor(apnsRepo *repository.APNsRepository, notifier *OwnerNotifier, cfg config.CredentialHealthConfig) *CertificateMonitor {
+	return &CertificateMonitor{
+		apnsRepo: apnsRepo,
+		notifier: notifier,
+		cfg:      cfg,
+	}
+}
+
+// Start runs the check immediately and then every check interval until ctx is
+// cancelled
+func (m *CertificateMonitor) Start(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(m.cfg.CheckInterval)
+		defer ticker.Stop()
+
+		for {
+			m.check(ctx)
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+func (m *CertificateMonitor) check(ctx context.Context) {
+	creds, err := m.apnsRepo.GetCertificatesToAlert(ctx, m.cfg.ExpiryWarning)
+	if err != nil {
+		log.Printf("Failed to check certificate expiry: %v", err)
+		return
+	}
+
+	for i := range creds {
+		cred := &creds[i]
+		expiresAt := *cred.CertificateExpiresAt
+
+		var body string
+		if time.Now().After(expiresAt) {
+			body = fmt.Sprintf("The APNs certificate for %s (%s) expired on %s. Notifications to this app are failing until a new certificate is uploaded.",
+				cred.BundleID, cred.Environment, expiresAt.Format("2006-01-02"))
+		} else {
+			body = fmt.Sprintf("The APNs certificate for %s (%s) expires on %s. Upload a renewed certificate before then.",
+				cred.BundleID, cred.Environment, expiresAt.Format("2006-01-02"))
+		}
+
+		log.Printf("Alerting organization %s about certificate expiry of credential %s (%v)", cred.OrgID, cred.ID, expiresAt)
+
+		if err := m.notifier.Notify(ctx, OwnerAlert{
+			OrgID:          cred.OrgID,
+			UserID:         cred.UserID,
+			Title:          "APNs certificate expiring",
+			Body:           body,
+			Data:           credentialAlertData(cred, "certificate_expiry"),
+			SkipCredential: expiredCredential(cred),
+		}); err != nil {
+			log.Printf("Failed to alert organization %s: %v", cred.OrgID, err)
+			continue
+		}
+
+		if err := m.apnsRepo.MarkExpiryAlerted(ctx, cred.ID); err != nil {
+			log.Printf("Failed to mark credential %s alerted: %v", cred.ID, err)
+		}
+	}
+}
+
+// expiredCredential returns cred if its certificate can no longer be used to
+// deliver the alert itself
+func expiredCredential(cred *models.APNsCredential) *models.APNsCredential {
+	if cred.CertificateExpiresAt != nil && time.Now().After(*cred.CertificateExpiresAt) {
+		return cred
+	}
+	return nil
+}
+
+func credentialAlertData(cred *models.APNsCredential, alert string) map[string]interface{} {
+	return map[string]interface{}{
+		"pushlab_alert": alert,
+		"credential_id": cred.ID.String(),
+		"bundle_id":     cred.BundleID,
+		"environment":   cred.Environment,
+	}
+}
@@ -0,0 +1,90 @@
+package worker
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/pushlab/backend/internal/config"
+	"github.com/pushlab/backend/internal/models"
+	"github.com/pushlab/backend/internal/repository"
+)
+
+// HeartbeatMonitor alerts owners on their other devices when a monitored
+// device misses its heartbeat window, and again once it checks in
+type HeartbeatMonitor struct {
+	deviceRepo *repository.DeviceRepository
+	notifier   *OwnerNotifier
+	cfg        config.HeartbeatMonitorConfig
+}
+
+func NewHeartbeatMonitor(deviceRepo *repository.DeviceRepository, notifier *OwnerNotifier, cfg config.HeartbeatMonitorConfig) *HeartbeatMonitor {
+	return &HeartbeatMonitor{
+		deviceRepo: deviceRepo,
+		notifier:   notifier,
+		cfg:        cfg,
+	}
+}
+
+// Start runs the check immediately and then every check interval until ctx is
+// cancelled
+func (m *HeartbeatMonitor) Start(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(m.cfg.CheckInterval)
+		defer ticker.Stop()
+
+		for {
+			m.check(ctx)
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+func (m *HeartbeatMonitor) check(ctx context.Context) {
+	offline, err := m.deviceRepo.MarkOffline(ctx)
+	if err != nil {
+		log.Printf("Failed to check device heartbeats: %v", err)
+	}
+	for i := range offline {
+		device := &offline[i]
+		body := fmt.Sprintf("%s has never checked in.", device.DeviceName)
+		if device.LastSeenAt != nil {
+			body = fmt.Sprintf("%s has not checked in since %s.", device.DeviceName, device.LastSeenAt.Format("2006-01-02 15:04"))
+		}
+		log.Printf("Device %s missed its heartbeat", device.ID)
+		m.alert(ctx, device, "device_offline", "Device offline", body)
+	}
+
+	online, err := m.deviceRepo.MarkBackOnline(ctx)
+	if err != nil {
+		log.Printf("Failed to check device heartbeats: %v", err)
+	}
+	for i := range online {
+		device := &online[i]
+		log.Printf("Device %s is back online", device.ID)
+		m.alert(ctx, device, "device_online", "Device back online", fmt.Sprintf("%s checked in again.", device.DeviceName))
+	}
+}
+
+func (m *HeartbeatMonitor) alert(ctx context.Context, device *models.LifecycleDevice, kind, title, body string) {
+	if err := m.notifier.NotifyUser(ctx, UserAlert{
+		OrgID:  device.OrgID,
+		UserID: device.UserID,
+		Title:  title,
+		Body:   body,
+		Data: map[string]interface{}{
+			"pushlab_alert": kind,
+			"device_id":     device.ID.String(),
+		},
+		SkipDevices: []uuid.UUID{device.ID},
+	}); err != nil {
+		log.Printf("Failed to alert user %s about device %s: %v", device.UserID, device.ID, err)
+	}
+}
@@ -0,0 +1,184 @@
+package worker
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/pushlab/backend/internal/config"
+	"github.com/pushlab/backend/internal/models"
+	"github.com/pushlab/backend/internal/repository"
+)
+
+// janitorBatchSize bounds the devices handled per statement, so a large
+// backlog does not hold locks for long
+const janitorBatchSize = 500
+
+// DeviceJanitor applies the device lifecycle policy: it marks devices stale
+// that stopped checking in and deletes devices whose tokens have all been
+// invalid for a while, alerting their owners on their other devices
+type DeviceJanitor struct {
+	deviceRepo *repository.DeviceRepository
+	auditRepo  *repository.AuditRepository
+	notifier   *OwnerNotifier
+	cfg        config.DeviceLifecycleConfig
+}
+
+func NewDeviceJanitor(
+	deviceRepo *repository.DeviceRepository,
+	auditRepo *repository.AuditRepository,
+	notifier *OwnerNotifier,
+	cfg config.DeviceLifecycleConfig,
+) *DeviceJanitor {
+	return &DeviceJanitor{
+		deviceRepo: deviceRepo,
+		auditRepo:  auditRepo,
+		notifier:   notifier,
+		cfg:        cfg,
+	}
+}
+
+// Start runs the janitor immediately and then every check interval until ctx
+// is cancelled
+func (j *DeviceJanitor) Start(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(j.cfg.CheckInterval)
+		defer ticker.Stop()
+
+		for {
+			j.run(ctx)
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+func (j *DeviceJanitor) run(ctx context.Context) {
+	staleCutoff := time.Now().AddDate(0, 0, -j.cfg.StaleAfterDays)
+	stale, err := j.sweep(ctx, func() ([]models.LifecycleDevice, error) {
+		return j.deviceRepo.MarkStale(ctx, staleCutoff, janitorBatchSize)
+	})
+	if err != nil {
+		log.Printf("Failed to mark stale devices: %v", err)
+	}
+	if len(stale) > 0 {
+		log.Printf("Marked %d devices stale", len(stale))
+		j.alert(ctx, stale, "devices_stale", "Devices stopped checking in",
+			fmt.Sprintf("Not checked in for %d days", j.cfg.StaleAfterDays))
+	}
+
+	deleteCutoff := time.Now().AddDate(0, 0, -j.cfg.DeleteInvalidAfterDays)
+	deleted, err := j.sweep(ctx, func() ([]models.LifecycleDevice, error) {
+		return j.deviceRepo.DeleteInvalid(ctx, deleteCutoff, janitorBatchSize)
+	})
+	if err != nil {
+		log.Printf("Failed to delete invalid devices: %v", err)
+	}
+	if len(deleted) > 0 {
+		log.Printf("Deleted %d devices without a valid token", len(deleted))
+		j.audit(ctx, deleted)
+		j.alert(ctx, deleted, "devices_deleted", "Devices removed",
+			fmt.Sprintf("Removed after %d days without a working push token", j.cfg.DeleteInvalidAfterDays))
+	}
+}
+
+// sweep repeats batch until it handles fewer than a full batch, returning
+// everything handled so far if it fails
+func (j *DeviceJanitor) sweep(ctx context.Context, batch func() ([]models.LifecycleDevice, error)) ([]models.LifecycleDevice, error) {
+	var all []models.LifecycleDevice
+	for ctx.Err() == nil {
+		devices, err := batch()
+		if err != nil {
+			return all, err
+		}
+		all = append(all, devices...)
+		if len(devices) < janitorBatchSize {
+			break
+		}
+	}
+	return all, nil
+}
+
+// audit records the deletions in the organizations' audit logs, without an
+// actor
+func (j *DeviceJanitor) audit(ctx context.Context, devices []models.LifecycleDevice) {
+	for i := range devices {
+		device := &devices[i]
+		before, err := json.Marshal(device)
+		if err != nil {
+			continue
+		}
+		targetID := device.ID.String()
+		event := &models.AuditEvent{
+			OrgID:      &device.OrgID,
+			Action:     models.AuditDevicePruned,
+			TargetType: models.AuditTargetDevice,
+			TargetID:   &targetID,
+			Before:     before,
+		}
+		if err := j.auditRepo.Create(ctx, event); err != nil {
+			log.Printf("Failed to record audit event %s on device %s: %v", event.Action, targetID, err)
+		}
+	}
+}
+
+// alert tells each owner which of their devices were affected, once per
+// organization
+func (j *DeviceJanitor) alert(ctx context.Context, devices []models.LifecycleDevice, kind, title, reason string) {
+	type owner struct{ orgID, userID uuid.UUID }
+	byOwner := make(map[owner][]models.LifecycleDevice)
+	var owners []owner
+	for _, device := range devices {
+		o := owner{device.OrgID, device.UserID}
+		if _, ok := byOwner[o]; !ok {
+			owners = append(owners, o)
+		}
+		byOwner[o] = append(byOwner[o], device)
+	}
+
+	for _, o := range owners {
+		owned := byOwner[o]
+		ids := make([]uuid.UUID, len(owned))
+		names := make([]string, len(owned))
+		deviceIDs := make([]string, len(owned))
+		for i, device := range owned {
+			ids[i] = device.ID
+			names[i] = device.DeviceName
+			deviceIDs[i] = device.ID.String()
+		}
+
+		if err := j.notifier.NotifyUser(ctx, UserAlert{
+			OrgID:  o.orgID,
+			UserID: o.userID,
+			Title:  title,
+			Body:   fmt.Sprintf("%s: %s.", reason, deviceList(names)),
+			Data: map[string]interface{}{
+				"pushlab_alert": kind,
+				"device_ids":    deviceIDs,
+			},
+			SkipDevices: ids,
+		}); err != nil {
+			log.Printf("Failed to alert user %s about %s: %v", o.userID, kind, err)
+		}
+	}
+}
+
+// deviceList names up to three devices and counts the rest
+func deviceList(names []string) string {
+	const shown = 3
+	if len(names) <= shown {
+		if len(names) == 1 {
+			return names[0]
+		}
+		return strings.Join(names[:len(names)-1], ", ") + " and " + names[len(names)-1]
+	}
+	return fmt.Sprintf("%s and %d other devices", strings.Join(names[:shown], ", "), len(names)-shown)
+}
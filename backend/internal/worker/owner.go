@@ -0,0 +1,152 @@
+package worker
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+
+	"github.com/google/uuid"
+	"github.com/pushlab/backend/internal/models"
+	"github.com/pushlab/backend/internal/queue"
+	"github.com/pushlab/backend/internal/repository"
+)
+
+// OwnerAlert is an operational notification sent to the devices of an
+// organization's owners and admins, e.g. when one of its APNs credentials
+// stops working
+type OwnerAlert struct {
+	OrgID uuid.UUID
+	// UserID is recorded as the sender of the alert notification
+	UserID uuid.UUID
+	Title  string
+	Body   string
+	Data   map[string]interface{}
+	// SkipCredential excludes devices that would be reached through this
+	// credential, since it is the one that is broken
+	SkipCredential *models.APNsCredential
+}
+
+// OwnerNotifier queues alerts to owners' and admins' devices through the normal
+// notification pipeline, so they show up in the notification history
+type OwnerNotifier struct {
+	notifRepo  *repository.NotificationRepository
+	deviceRepo *repository.DeviceRepository
+	publisher  *queue.Publisher
+}
+
+func NewOwnerNotifier(
+	notifRepo *repository.NotificationRepository,
+	deviceRepo *repository.DeviceRepository,
+	publisher *queue.Publisher,
+) *OwnerNotifier {
+	return &OwnerNotifier{
+		notifRepo:  notifRepo,
+		deviceRepo: deviceRepo,
+		publisher:  publisher,
+	}
+}
+
+// Notify queues the alert; it returns without error when no owner or admin
+// has a reachable device
+func (n *OwnerNotifier) Notify(ctx context.Context, alert OwnerAlert) error {
+	tokens, err := n.deviceRepo.GetTokensForOrgAdmins(ctx, alert.OrgID)
+	if err != nil {
+		return fmt.Errorf("failed to get owner device tokens: %w", err)
+	}
+
+	var tokenIDs []uuid.UUID
+	for _, token := range tokens {
+		if skip := alert.SkipCredential; skip != nil &&
+			token.BundleID == skip.BundleID && token.Environment == skip.Environment {
+			continue
+		}
+		tokenIDs = append(tokenIDs, token.ID)
+	}
+
+	if len(tokenIDs) == 0 {
+		log.Printf("No reachable devices to alert organization %s: %s", alert.OrgID, alert.Title)
+		return nil
+	}
+
+	return n.queue(ctx, alert.OrgID, alert.UserID, alert.Title, alert.Body, alert.Data, tokenIDs)
+}
+
+// UserAlert is an operational notification sent to a user's own devices in
+// an organization, e.g. when some of their devices stopped checking in
+type UserAlert struct {
+	OrgID  uuid.UUID
+	UserID uuid.UUID
+	Title  string
+	Body   string
+	Data   map[string]interface{}
+	// SkipDevices excludes the devices the alert is about
+	SkipDevices []uuid.UUID
+}
+
+// NotifyUser queues the alert to the user's other devices; it returns without
+// error when the user has none that is reachable
+func (n *OwnerNotifier) NotifyUser(ctx context.Context, alert UserAlert) error {
+	tokens, err := n.deviceRepo.GetTokensByOrgAndUser(ctx, alert.OrgID, alert.UserID)
+	if err != nil {
+		return fmt.Errorf("failed to get user device tokens: %w", err)
+	}
+
+	skip := make(map[uuid.UUID]bool, len(alert.SkipDevices))
+	for _, id := range alert.SkipDevices {
+		skip[id] = true
+	}
+	var tokenIDs []uuid.UUID
+	for _, token := range tokens {
+		if !skip[token.DeviceID] {
+			tokenIDs = append(tokenIDs, token.ID)
+		}
+	}
+
+	if len(tokenIDs) == 0 {
+		log.Printf("No reachable devices to alert user %s in organization %s: %s", alert.UserID, alert.OrgID, alert.Title)
+		return nil
+	}
+
+	return n.queue(ctx, alert.OrgID, alert.UserID, alert.Title, alert.Body, alert.Data, tokenIDs)
+}
+
+// queue records the alert in the notification history and publishes it to
+// the tokens
+func (n *OwnerNotifier) queue(ctx context.Context, orgID, userID uuid.UUID, title, body string, data map[string]interface{}, tokenIDs []uuid.UUID) error {
+	dataJSON, _ := json.Marshal(data)
+	notification := &models.Notification{
+		OrgID:    orgID,
+		UserID:   userID,
+		Title:    &title,
+		Body:     body,
+		Data:     dataJSON,
+		Sound:    "default",
+		Priority: "high",
+		Status:   "queued",
+	}
+
+	if err := n.notifRepo.Create(ctx, notification); err != nil {
+		return fmt.Errorf("failed to create alert notification: %w", err)
+	}
+
+	job := &models.NotificationJob{
+		NotificationID: notification.ID,
+		OrgID:          orgID,
+		UserID:         userID,
+		DeviceTokenIDs: tokenIDs,
+		Payload: models.NotificationPayload{
+			Title:    &title,
+			Body:     body,
+			Sound:    "default",
+			Priority: "high",
+			Data:     data,
+		},
+	}
+
+	if err := n.publisher.PublishNotification(ctx, job); err != nil {
+		return fmt.Errorf("failed to queue alert notification: %w", err)
+	}
+
+	return nil
+}
@@ -2,6 +2,7 @@ package worker
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
 	"time"
@@ -9,7 +10,10 @@ import (
 	"github.com/google/uuid"
 	"github.com/jackc/pgx/v5/pgxpool"
 	"github.com/pushlab/backend/internal/apns"
+	"github.com/pushlab/backend/internal/config"
+	"github.com/pushlab/backend/internal/events"
 	"github.com/pushlab/backend/internal/models"
+	"github.com/pushlab/backend/internal/queue"
 	"github.com/pushlab/backend/internal/repository"
 )
 
@@ -17,23 +21,42 @@ type Processor struct {
 	db             *pgxpool.Pool
 	apnsClient     *apns.Client
 	sender         *apns.Sender
+	publisher      *queue.Publisher
+	events         *events.Dispatcher
+	owner          *OwnerNotifier
+	cfg            config.APNsConfig
 	notifRepo      *repository.NotificationRepository
 	deviceRepo     *repository.DeviceRepository
 	apnsRepo       *repository.APNsRepository
+	circuitRepo    *repository.CircuitRepository
 }
 
 func NewProcessor(
 	db *pgxpool.Pool,
 	apnsClient *apns.Client,
+	breaker *apns.CircuitBreaker,
+	publisher *queue.Publisher,
+	cfg config.APNsConfig,
 ) *Processor {
-	return &Processor{
-		db:         db,
-		apnsClient: apnsClient,
-		sender:     apns.NewSender(apnsClient),
-		notifRepo:  repository.NewNotificationRepository(db),
-		deviceRepo: repository.NewDeviceRepository(db),
-		apnsRepo:   repository.NewAPNsRepository(db),
+	notifRepo := repository.NewNotificationRepository(db)
+	deviceRepo := repository.NewDeviceRepository(db)
+
+	p := &Processor{
+		db:          db,
+		apnsClient:  apnsClient,
+		sender:      apns.NewSender(apnsClient, breaker),
+		publisher:   publisher,
+		events:      events.NewDispatcher(repository.NewWebhookRepository(db)),
+		owner:       NewOwnerNotifier(notifRepo, deviceRepo, publisher),
+		cfg:         cfg,
+		notifRepo:   notifRepo,
+		deviceRepo:  deviceRepo,
+		apnsRepo:    repository.NewAPNsRepository(db),
+		circuitRepo: repository.NewCircuitRepository(db),
 	}
+	breaker.OnStateChange(p.saveCircuitState)
+	p.restoreCircuits(breaker)
+	return p
 }
 
 func (p *Processor) ProcessNotification(ctx context.Context, job *models.NotificationJob) error {
@@ -47,9 +70,14 @@ func (p *Processor) ProcessNotification(ctx context.Context, job *models.Notific
 
 	successCount := 0
 	failureCount := 0
+	var deferred []uuid.UUID
 
 	for _, tokenID := range job.DeviceTokenIDs {
 		if err := p.processDeviceToken(ctx, job, tokenID); err != nil {
+			if errors.Is(err, apns.ErrCircuitOpen) {
+				deferred = append(deferred, tokenID)
+				continue
+			}
 			log.Printf("Failed to process device token %s: %v", tokenID, err)
 			failureCount++
 		} else {
@@ -57,24 +85,61 @@ func (p *Processor) ProcessNotification(ctx context.Context, job *models.Notific
 		}
 	}
 
-	// Update final status
-	finalStatus := "delivered"
-	if failureCount > 0 && successCount == 0 {
-		finalStatus = "failed"
+	// Tokens whose circuit is open go back on the queue instead of failing
+	if len(deferred) > 0 {
+		deferredJob := *job
+		deferredJob.DeviceTokenIDs = deferred
+		deferredJob.Deferrals = job.Deferrals + 1
+		if err := p.publisher.PublishNotificationDelayed(ctx, &deferredJob, p.cfg.CircuitBreaker.DeferDelay); err != nil {
+			return fmt.Errorf("failed to defer %d device tokens: %w", len(deferred), err)
+		}
+		log.Printf("Notification %s: deferred %d device tokens for %v (APNs circuit open, deferral %d of %d)",
+			job.NotificationID, len(deferred), p.cfg.CircuitBreaker.DeferDelay,
+			deferredJob.Deferrals, p.cfg.CircuitBreaker.MaxDeferrals)
 	}
 
-	if err := p.notifRepo.UpdateStatus(ctx, job.NotificationID, finalStatus); err != nil {
+	// Update final status from every delivery, including earlier passes
+	finalStatus, err := p.notificationStatus(ctx, job.NotificationID)
+	if err != nil {
+		log.Printf("Failed to get deliveries for notification %s: %v", job.NotificationID, err)
+	} else if err := p.notifRepo.UpdateStatus(ctx, job.NotificationID, finalStatus); err != nil {
 		log.Printf("Failed to update final notification status: %v", err)
 	}
 
-	log.Printf("Notification %s processed: %d succeeded, %d failed",
-		job.NotificationID, successCount, failureCount)
+	log.Printf("Notification %s processed: %d succeeded, %d failed, %d deferred",
+		job.NotificationID, successCount, failureCount, len(deferred))
 
 	return nil
 }
 
+// notificationStatus derives the notification's status from all of its
+// deliveries: 'sent' while any is still pending or deferred, 'failed' if none
+// was delivered
+func (p *Processor) notificationStatus(ctx context.Context, notificationID uuid.UUID) (string, error) {
+	deliveries, err := p.notifRepo.GetDeliveriesByNotificationID(ctx, notificationID)
+	if err != nil {
+		return "", err
+	}
+
+	delivered, failed := 0, 0
+	for _, delivery := range deliveries {
+		switch delivery.DeliveryStatus {
+		case "delivered":
+			delivered++
+		case "failed":
+			failed++
+		default:
+			return "sent", nil
+		}
+	}
+	if failed > 0 && delivered == 0 {
+		return "failed", nil
+	}
+	return "delivered", nil
+}
+
 func (p *Processor) processDeviceToken(ctx context.Context, job *models.NotificationJob, tokenID uuid.UUID) error {
-	// Create delivery record
+	// Create delivery record, or reuse the one from an earlier deferred pass
 	delivery := &models.NotificationDelivery{
 		NotificationID: job.NotificationID,
 		DeviceTokenID:  tokenID,
@@ -82,13 +147,16 @@ func (p *Processor) processDeviceToken(ctx context.Context, job *models.Notifica
 		AttemptCount:   0,
 	}
 
-	if err := p.notifRepo.CreateDelivery(ctx, delivery); err != nil {
+	if err := p.notifRepo.GetOrCreateDelivery(ctx, delivery); err != nil {
 		return fmt.Errorf("failed to create delivery record: %w", err)
 	}
 
 	// Get device token details
 	deviceToken, err := p.getDeviceTokenByID(ctx, tokenID)
 	if err != nil {
+		delivery.DeliveryStatus = "failed"
+		delivery.APNsErrorReason = strPtr("Device token not found")
+		p.notifRepo.UpdateDeliveryStatus(ctx, delivery)
 		return fmt.Errorf("failed to get device token: %w", err)
 	}
 
@@ -102,11 +170,14 @@ func (p *Processor) processDeviceToken(ctx context.Context, job *models.Notifica
 	// Get device to find user and get APNs credentials
 	device, err := p.deviceRepo.GetByID(ctx, deviceToken.DeviceID)
 	if err != nil {
+		delivery.DeliveryStatus = "failed"
+		delivery.APNsErrorReason = strPtr("Device not found")
+		p.notifRepo.UpdateDeliveryStatus(ctx, delivery)
 		return fmt.Errorf("failed to get device: %w", err)
 	}
 
 	// Get APNs credentials
-	cred, err := p.apnsRepo.GetByUserAndBundle(ctx, device.UserID, deviceToken.BundleID, deviceToken.Environment)
+	cred, err := p.apnsRepo.GetByOrgAndBundle(ctx, device.OrgID, deviceToken.BundleID, deviceToken.Environment)
 	if err != nil {
 		delivery.DeliveryStatus = "failed"
 		delivery.APNsErrorReason = strPtr("APNs credentials not found")
@@ -121,40 +192,50 @@ func (p *Processor) processDeviceToken(ctx context.Context, job *models.Notifica
 	delivery.AttemptCount = 1
 	result, err := p.sender.SendWithRetry(
 		ctx,
+		cred,
 		deviceToken.Token,
-		deviceToken.BundleID,
-		deviceToken.Environment,
-		cred.PrivateKeyPath,
-		cred.KeyID,
-		cred.TeamID,
 		notification,
 		3, // max retries
 	)
 
+	if errors.Is(err, apns.ErrCircuitOpen) && job.Deferrals >= p.cfg.CircuitBreaker.MaxDeferrals {
+		delivery.DeliveryStatus = "failed"
+		delivery.APNsErrorReason = strPtr(fmt.Sprintf("APNs circuit still open after %d deferrals", job.Deferrals))
+		p.notifRepo.UpdateDeliveryStatus(ctx, delivery)
+		return fmt.Errorf("APNs circuit still open after %d deferrals", job.Deferrals)
+	}
+
+	if errors.Is(err, apns.ErrCircuitOpen) {
+		delivery.DeliveryStatus = "deferred"
+		delivery.APNsErrorReason = strPtr("APNs circuit open")
+		p.notifRepo.UpdateDeliveryStatus(ctx, delivery)
+		return err
+	}
+
 	if err != nil {
 		delivery.DeliveryStatus = "failed"
 		delivery.APNsErrorReason = strPtr(err.Error())
 		p.notifRepo.UpdateDeliveryStatus(ctx, delivery)
+		p.recordCredentialError(ctx, cred, err.Error())
 		return err
 	}
 
+	p.recordCredentialResult(ctx, cred, result)
+
 	// Update delivery status based on result
 	delivery.APNsResponseCode = &result.StatusCode
 	delivery.AttemptCount = 3 // Assuming max retries were used
 
 	if result.Success {
 		delivery.DeliveryStatus = "delivered"
+		delivery.APNsErrorReason = nil
 		now := time.Now()
 		delivery.DeliveredAt = &now
 		p.deviceRepo.UpdateTokenLastUsed(ctx, tokenID)
 	} else {
 		delivery.DeliveryStatus = "failed"
 		delivery.APNsErrorReason = &result.Reason
-
-		// Handle invalid token (410 status)
-		if result.StatusCode == 410 {
-			p.deviceRepo.MarkTokenInvalid(ctx, tokenID, result.Reason)
-		}
+		p.handleTokenFailure(ctx, device, deviceToken, result)
 	}
 
 	if err := p.notifRepo.UpdateDeliveryStatus(ctx, delivery); err != nil {
@@ -164,6 +245,114 @@ func (p *Processor) processDeviceToken(ctx context.Context, job *models.Notifica
 	return nil
 }
 
+// handleTokenFailure decides whether a failed delivery means the device token
+// should no longer be used
+func (p *Processor) handleTokenFailure(ctx context.Context, device *models.Device, token *models.DeviceToken, result *apns.SendResult) {
+	switch {
+	case apns.RejectsDeviceToken(result.StatusCode, result.Reason):
+		p.invalidateToken(ctx, device, token, result.Reason)
+
+	case result.StatusCode == 410:
+		// Apple: stop sending unless the token was registered again after the
+		// time APNs confirmed it was no longer valid
+		if result.UnregisteredAt != nil && token.IssuedAt.After(*result.UnregisteredAt) {
+			log.Printf("Ignoring %s for device token %s: re-registered after %v",
+				result.Reason, token.ID, *result.UnregisteredAt)
+			return
+		}
+		p.invalidateToken(ctx, device, token, result.Reason)
+
+	case apns.BlamesDeviceToken(result.Reason):
+		errorCount, err := p.deviceRepo.RecordTokenError(ctx, token.ID, result.Reason)
+		if err != nil {
+			log.Printf("Failed to record error for device token %s: %v", token.ID, err)
+			return
+		}
+		if errorCount >= p.cfg.TokenFailureThreshold {
+			reason := fmt.Sprintf("%d consecutive failures, last: %s", errorCount, result.Reason)
+			p.invalidateToken(ctx, device, token, reason)
+		}
+
+	default:
+		// Provider, payload, request and server errors are not the token's
+		// fault
+	}
+}
+
+// invalidateToken marks the token invalid and tells the owner's webhooks so
+// the app can prompt the device to re-register
+func (p *Processor) invalidateToken(ctx context.Context, device *models.Device, token *models.DeviceToken, reason string) {
+	if err := p.deviceRepo.MarkTokenInvalid(ctx, token.ID, reason); err != nil {
+		log.Printf("Failed to mark device token %s invalid: %v", token.ID, err)
+		return
+	}
+
+	log.Printf("Device token %s for device %s marked invalid: %s", token.ID, device.ID, reason)
+
+	p.events.Dispatch(device.OrgID, events.DeviceTokenInvalidated, map[string]interface{}{
+		"device_id":         device.ID,
+		"device_name":       device.DeviceName,
+		"device_identifier": device.DeviceIdentifier,
+		"device_token_id":   token.ID,
+		"bundle_id":         token.BundleID,
+		"environment":       token.Environment,
+		"reason":            reason,
+	})
+}
+
+// recordCredentialResult updates the credential's health from an APNs
+// response. Any response other than a provider error or a server error means
+// the credential authenticated successfully.
+func (p *Processor) recordCredentialResult(ctx context.Context, cred *models.APNsCredential, result *apns.SendResult) {
+	switch {
+	case apns.IsProviderError(result.Reason):
+		first, err := p.apnsRepo.RecordProviderError(ctx, cred.ID, result.Reason)
+		if err != nil {
+			log.Printf("Failed to record provider error for credential %s: %v", cred.ID, err)
+			return
+		}
+		if first {
+			log.Printf("APNs credential %s rejected by Apple: %s", cred.ID, result.Reason)
+			p.alertCredentialFailing(ctx, cred, "Apple rejected the credential: "+result.Reason)
+		}
+
+	case result.StatusCode >= 500:
+		p.recordCredentialError(ctx, cred, fmt.Sprintf("APNs returned %d %s", result.StatusCode, result.Reason))
+
+	default:
+		if err := p.apnsRepo.RecordSuccess(ctx, cred.ID); err != nil {
+			log.Printf("Failed to record success for credential %s: %v", cred.ID, err)
+		}
+	}
+}
+
+// recordCredentialError counts an error against the credential and alerts the
+// owner when the error threshold is reached
+func (p *Processor) recordCredentialError(ctx context.Context, cred *models.APNsCredential, reason string) {
+	errorCount, err := p.apnsRepo.RecordError(ctx, cred.ID, reason)
+	if err != nil {
+		log.Printf("Failed to record error for credential %s: %v", cred.ID, err)
+		return
+	}
+	if errorCount == p.cfg.CredentialHealth.ErrorThreshold {
+		p.alertCredentialFailing(ctx, cred, fmt.Sprintf("%d consecutive errors, last: %s", errorCount, reason))
+	}
+}
+
+func (p *Processor) alertCredentialFailing(ctx context.Context, cred *models.APNsCredential, reason string) {
+	err := p.owner.Notify(ctx, OwnerAlert{
+		OrgID:          cred.OrgID,
+		UserID:         cred.UserID,
+		Title:          "APNs credential failing",
+		Body:           fmt.Sprintf("Notifications for %s (%s) are failing. %s", cred.BundleID, cred.Environment, reason),
+		Data:           credentialAlertData(cred, "credential_failing"),
+		SkipCredential: cred,
+	})
+	if err != nil {
+		log.Printf("Failed to alert organization %s about credential %s: %v", cred.OrgID, cred.ID, err)
+	}
+}
+
 func (p *Processor) getDeviceTokenByID(ctx context.Context, tokenID uuid.UUID) (*models.DeviceToken, error) {
 	var token models.DeviceToken
 	query := `
@@ -179,6 +368,63 @@ func (p *Processor) getDeviceTokenByID(ctx context.Context, tokenID uuid.UUID) (
 	return &token, err
 }
 
+// restoreCircuits seeds the breaker with the circuits that were still open
+// when the workers last reported, so they are not forgotten on restart
+func (p *Processor) restoreCircuits(breaker *apns.CircuitBreaker) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	states, err := p.circuitRepo.GetActive(ctx)
+	if err != nil {
+		log.Printf("Failed to restore circuit states: %v", err)
+		return
+	}
+
+	snapshots := make([]apns.CircuitSnapshot, len(states))
+	for i, state := range states {
+		snapshots[i] = apns.CircuitSnapshot{
+			CredentialID:        state.CredentialID,
+			Environment:         state.Environment,
+			State:               apns.CircuitState(state.State),
+			ConsecutiveFailures: state.ConsecutiveFailures,
+			OpenedAt:            state.OpenedAt,
+			UpdatedAt:           state.UpdatedAt,
+		}
+	}
+	breaker.Restore(snapshots)
+	if len(snapshots) > 0 {
+		log.Printf("Restored %d open APNs circuits", len(snapshots))
+	}
+}
+
+// saveCircuitState persists breaker transitions so the API can report them.
+// Open and half-open states expire unless refreshed by a later transition.
+func (p *Processor) saveCircuitState(snapshot apns.CircuitSnapshot) {
+	state := &models.APNsCircuitState{
+		CredentialID:        snapshot.CredentialID,
+		Environment:         snapshot.Environment,
+		State:               string(snapshot.State),
+		ConsecutiveFailures: snapshot.ConsecutiveFailures,
+		OpenedAt:            snapshot.OpenedAt,
+		UpdatedAt:           snapshot.UpdatedAt,
+	}
+	if snapshot.State != apns.CircuitClosed {
+		expiresAt := snapshot.UpdatedAt.Add(p.cfg.CircuitBreaker.StateTTL)
+		state.ExpiresAt = &expiresAt
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := p.circuitRepo.Upsert(ctx, state); err != nil {
+		log.Printf("Failed to save circuit state for credential %s: %v", snapshot.CredentialID, err)
+		return
+	}
+
+	log.Printf("APNs circuit for credential %s (%s) is now %s",
+		snapshot.CredentialID, snapshot.Environment, snapshot.State)
+}
+
 func strPtr(s string) *string {
 	return &s
 }
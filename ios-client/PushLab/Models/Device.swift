@@ -6,6 +6,14 @@ struct Device: Codable, Identifiable {
     let deviceName: String
     let deviceIdentifier: String
     let tags: [String]
+    let platform: String?
+    let osVersion: String?
+    let appVersion: String?
+    let appBuild: String?
+    let model: String?
+    let timezone: String?
+    let locale: String?
+    let pushAuthorization: String?
     let createdAt: Date
     let updatedAt: Date
     let lastSeenAt: Date?
@@ -16,6 +24,14 @@ struct Device: Codable, Identifiable {
         case deviceName = "device_name"
         case deviceIdentifier = "device_identifier"
         case tags
+        case platform
+        case osVersion = "os_version"
+        case appVersion = "app_version"
+        case appBuild = "app_build"
+        case model
+        case timezone
+        case locale
+        case pushAuthorization = "push_authorization"
         case createdAt = "created_at"
         case updatedAt = "updated_at"
         case lastSeenAt = "last_seen_at"
@@ -1,4 +1,6 @@
 import Foundation
+import UIKit
+import UserNotifications
 
 class APIService {
     static let shared = APIService()
@@ -9,7 +11,7 @@ class APIService {
 
     // MARK: - Authentication
 
-    func register(username: String, email: String, password: String) async throws -> (token: String, user: User) {
+    func register(username: String, email: String, password: String) async throws -> LoginResponse {
         let url = URL(string: "\(baseURL)/api/v1/auth/register")!
         var request = URLRequest(url: url)
         request.httpMethod = "POST"
@@ -28,11 +30,10 @@ class APIService {
             throw APIError.invalidResponse
         }
 
-        let loginResponse = try JSONDecoder().decode(LoginResponse.self, from: data)
-        return (loginResponse.token, loginResponse.user)
+        return try JSONDecoder().decode(LoginResponse.self, from: data)
     }
 
-    func login(username: String, password: String) async throws -> (token: String, user: User) {
+    func login(username: String, password: String) async throws -> LoginResponse {
         let url = URL(string: "\(baseURL)/api/v1/auth/login")!
         var request = URLRequest(url: url)
         request.httpMethod = "POST"
@@ -50,26 +51,112 @@ class APIService {
             throw APIError.unauthorized
         }
 
-        let loginResponse = try JSONDecoder().decode(LoginResponse.self, from: data)
-        return (loginResponse.token, loginResponse.user)
+        // Accounts with two-factor authentication get a challenge instead of tokens
+        if let challenge = try? JSONDecoder().decode(MFAChallengeResponse.self, from: data), challenge.mfaRequired {
+            throw APIError.mfaRequired(mfaToken: challenge.mfaToken)
+        }
+
+        return try JSONDecoder().decode(LoginResponse.self, from: data)
+    }
+
+    /// Completes a login that requires two-factor authentication with a code
+    /// from the authenticator app or a recovery code.
+    func verifyMFA(mfaToken: String, code: String) async throws -> LoginResponse {
+        let url = URL(string: "\(baseURL)/api/v1/auth/mfa/verify")!
+        var request = URLRequest(url: url)
+        request.httpMethod = "POST"
+        request.setValue("application/json", forHTTPHeaderField: "Content-Type")
+
+        // Recovery codes look like xxxxx-xxxxx, TOTP codes are six digits
+        let codeField = code.contains("-") ? "recovery_code" : "code"
+        let body = [
+            "mfa_token": mfaToken,
+            codeField: code
+        ]
+        request.httpBody = try JSONEncoder().encode(body)
+
+        let (data, response) = try await URLSession.shared.data(for: request)
+
+        guard let httpResponse = response as? HTTPURLResponse, httpResponse.statusCode == 200 else {
+            throw APIError.unauthorized
+        }
+
+        return try JSONDecoder().decode(LoginResponse.self, from: data)
+    }
+
+    // MARK: - Sessions
+
+    /// Exchanges the stored refresh token for a new access token. Refresh
+    /// tokens are single-use, so the replacement is stored as well.
+    func refreshSession() async throws {
+        guard let refreshToken = KeychainHelper.getRefreshToken() else {
+            throw APIError.unauthorized
+        }
+
+        let url = URL(string: "\(baseURL)/api/v1/auth/refresh")!
+        var request = URLRequest(url: url)
+        request.httpMethod = "POST"
+        request.setValue("application/json", forHTTPHeaderField: "Content-Type")
+        request.httpBody = try JSONEncoder().encode(["refresh_token": refreshToken])
+
+        let (data, response) = try await URLSession.shared.data(for: request)
+
+        guard let httpResponse = response as? HTTPURLResponse, httpResponse.statusCode == 200 else {
+            throw APIError.unauthorized
+        }
+
+        let refreshResponse = try JSONDecoder().decode(RefreshResponse.self, from: data)
+        KeychainHelper.saveToken(refreshResponse.token)
+        KeychainHelper.saveRefreshToken(refreshResponse.refreshToken)
+    }
+
+    /// Revokes the current session on the server
+    func logout() async {
+        let url = URL(string: "\(baseURL)/api/v1/auth/logout")!
+        var request = URLRequest(url: url)
+        request.httpMethod = "POST"
+
+        _ = try? await authorizedData(for: request)
+    }
+
+    /// Sends a request with the stored access token. If the token has
+    /// expired, the session is refreshed and the request retried once.
+    private func authorizedData(for request: URLRequest) async throws -> (Data, URLResponse) {
+        guard let token = KeychainHelper.getToken() else {
+            throw APIError.unauthorized
+        }
+
+        var request = request
+        request.setValue("Bearer \(token)", forHTTPHeaderField: "Authorization")
+
+        let (data, response) = try await URLSession.shared.data(for: request)
+        guard let httpResponse = response as? HTTPURLResponse, httpResponse.statusCode == 401 else {
+            return (data, response)
+        }
+
+        try await refreshSession()
+        guard let refreshed = KeychainHelper.getToken() else {
+            throw APIError.unauthorized
+        }
+        request.setValue("Bearer \(refreshed)", forHTTPHeaderField: "Authorization")
+        return try await URLSession.shared.data(for: request)
     }
 
     // MARK: - Device Management
 
     func registerDevice(deviceToken: String) async {
-        guard let token = KeychainHelper.getToken() else { return }
+        guard KeychainHelper.getToken() != nil else { return }
 
         let url = URL(string: "\(baseURL)/api/v1/devices")!
         var request = URLRequest(url: url)
         request.httpMethod = "POST"
         request.setValue("application/json", forHTTPHeaderField: "Content-Type")
-        request.setValue("Bearer \(token)", forHTTPHeaderField: "Authorization")
 
         let deviceName = UIDevice.current.name
         let deviceIdentifier = UIDevice.current.identifierForVendor?.uuidString ?? UUID().uuidString
         let tags = UserDefaults.standard.stringArray(forKey: "deviceTags") ?? []
 
-        let body: [String: Any] = [
+        var body: [String: Any] = [
             "device_name": deviceName,
             "device_identifier": deviceIdentifier,
             "device_token": deviceToken,
@@ -77,11 +164,12 @@ class APIService {
             "environment": Constants.apnsEnvironment,
             "tags": tags
         ]
+        body.merge(await deviceMetadata()) { current, _ in current }
 
         request.httpBody = try? JSONSerialization.data(withJSONObject: body)
 
         do {
-            let (_, response) = try await URLSession.shared.data(for: request)
+            let (_, response) = try await authorizedData(for: request)
             if let httpResponse = response as? HTTPURLResponse, httpResponse.statusCode == 200 || httpResponse.statusCode == 201 {
                 print("Device registered successfully")
             }
@@ -90,29 +178,51 @@ class APIService {
         }
     }
 
-    func fetchDevices() async throws -> [Device] {
-        guard let token = KeychainHelper.getToken() else {
-            throw APIError.unauthorized
+    private func deviceMetadata() async -> [String: Any] {
+        let device = UIDevice.current
+        let info = Bundle.main.infoDictionary
+        let settings = await UNUserNotificationCenter.current().notificationSettings()
+
+        var systemInfo = utsname()
+        uname(&systemInfo)
+        let model = withUnsafeBytes(of: &systemInfo.machine) { buffer in
+            String(decoding: buffer.prefix(while: { $0 != 0 }), as: UTF8.self)
+        }
+
+        let authorization: String
+        switch settings.authorizationStatus {
+        case .authorized: authorization = "authorized"
+        case .denied: authorization = "denied"
+        case .provisional: authorization = "provisional"
+        case .ephemeral: authorization = "ephemeral"
+        default: authorization = "not_determined"
         }
 
+        return [
+            "platform": device.userInterfaceIdiom == .pad ? "ipados" : "ios",
+            "os_version": device.systemVersion,
+            "app_version": info?["CFBundleShortVersionString"] as? String ?? "",
+            "app_build": info?["CFBundleVersion"] as? String ?? "",
+            "model": model,
+            "timezone": TimeZone.current.identifier,
+            "locale": Locale.current.identifier,
+            "push_authorization": authorization
+        ]
+    }
+
+    func fetchDevices() async throws -> [Device] {
         let url = URL(string: "\(baseURL)/api/v1/devices")!
-        var request = URLRequest(url: url)
-        request.setValue("Bearer \(token)", forHTTPHeaderField: "Authorization")
+        let request = URLRequest(url: url)
 
-        let (data, _) = try await URLSession.shared.data(for: request)
+        let (data, _) = try await authorizedData(for: request)
         return try JSONDecoder().decode([Device].self, from: data)
     }
 
     func updateDevice(id: String, name: String?, tags: [String]?) async throws {
-        guard let token = KeychainHelper.getToken() else {
-            throw APIError.unauthorized
-        }
-
         let url = URL(string: "\(baseURL)/api/v1/devices/\(id)")!
         var request = URLRequest(url: url)
         request.httpMethod = "PUT"
         request.setValue("application/json", forHTTPHeaderField: "Content-Type")
-        request.setValue("Bearer \(token)", forHTTPHeaderField: "Authorization")
 
         var body: [String: Any] = [:]
         if let name = name { body["device_name"] = name }
@@ -120,21 +230,16 @@ class APIService {
 
         request.httpBody = try? JSONSerialization.data(withJSONObject: body)
 
-        let (_, _) = try await URLSession.shared.data(for: request)
+        let (_, _) = try await authorizedData(for: request)
     }
 
     // MARK: - Notifications
 
     func fetchNotifications(limit: Int = 50, offset: Int = 0) async throws -> [PushNotification] {
-        guard let token = KeychainHelper.getToken() else {
-            throw APIError.unauthorized
-        }
-
         let url = URL(string: "\(baseURL)/api/v1/notifications?limit=\(limit)&offset=\(offset)")!
-        var request = URLRequest(url: url)
-        request.setValue("Bearer \(token)", forHTTPHeaderField: "Authorization")
+        let request = URLRequest(url: url)
 
-        let (data, _) = try await URLSession.shared.data(for: request)
+        let (data, _) = try await authorizedData(for: request)
         return try JSONDecoder().decode([PushNotification].self, from: data)
     }
 }
@@ -145,9 +250,36 @@ enum APIError: Error {
     case invalidResponse
     case unauthorized
     case networkError
+    case mfaRequired(mfaToken: String)
 }
 
 struct LoginResponse: Codable {
     let token: String
+    let refreshToken: String
     let user: User
+
+    enum CodingKeys: String, CodingKey {
+        case token, user
+        case refreshToken = "refresh_token"
+    }
+}
+
+struct MFAChallengeResponse: Codable {
+    let mfaRequired: Bool
+    let mfaToken: String
+
+    enum CodingKeys: String, CodingKey {
+        case mfaRequired = "mfa_required"
+        case mfaToken = "mfa_token"
+    }
+}
+
+struct RefreshResponse: Codable {
+    let token: String
+    let refreshToken: String
+
+    enum CodingKeys: String, CodingKey {
+        case token
+        case refreshToken = "refresh_token"
+    }
 }
@@ -14,13 +14,24 @@ class AuthService: ObservableObject {
         }
     }
 
+    /// Throws `APIError.mfaRequired` when the account uses two-factor
+    /// authentication; finish the login with `verifyMFA`.
     func login(username: String, password: String) async throws {
-        let (token, user) = try await APIService.shared.login(username: username, password: password)
+        let response = try await APIService.shared.login(username: username, password: password)
+        await completeLogin(response)
+    }
+
+    func verifyMFA(mfaToken: String, code: String) async throws {
+        let response = try await APIService.shared.verifyMFA(mfaToken: mfaToken, code: code)
+        await completeLogin(response)
+    }
 
-        KeychainHelper.saveToken(token)
+    private func completeLogin(_ response: LoginResponse) async {
+        KeychainHelper.saveToken(response.token)
+        KeychainHelper.saveRefreshToken(response.refreshToken)
 
         await MainActor.run {
-            self.currentUser = user
+            self.currentUser = response.user
             self.isAuthenticated = true
         }
 
@@ -31,12 +42,13 @@ class AuthService: ObservableObject {
     }
 
     func register(username: String, email: String, password: String) async throws {
-        let (token, user) = try await APIService.shared.register(username: username, email: email, password: password)
+        let response = try await APIService.shared.register(username: username, email: email, password: password)
 
-        KeychainHelper.saveToken(token)
+        KeychainHelper.saveToken(response.token)
+        KeychainHelper.saveRefreshToken(response.refreshToken)
 
         await MainActor.run {
-            self.currentUser = user
+            self.currentUser = response.user
             self.isAuthenticated = true
         }
 
@@ -47,7 +59,11 @@ class AuthService: ObservableObject {
     }
 
     func logout() {
-        KeychainHelper.deleteToken()
+        Task {
+            await APIService.shared.logout()
+            KeychainHelper.deleteToken()
+            KeychainHelper.deleteRefreshToken()
+        }
         currentUser = nil
         isAuthenticated = false
     }
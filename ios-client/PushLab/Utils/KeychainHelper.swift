@@ -4,14 +4,39 @@ import Security
 class KeychainHelper {
     private static let service = "com.pushlab.app"
     private static let tokenKey = "authToken"
+    private static let refreshTokenKey = "refreshToken"
 
     static func saveToken(_ token: String) {
-        let data = Data(token.utf8)
+        save(token, account: tokenKey)
+    }
+
+    static func getToken() -> String? {
+        return read(account: tokenKey)
+    }
+
+    static func deleteToken() {
+        delete(account: tokenKey)
+    }
+
+    static func saveRefreshToken(_ token: String) {
+        save(token, account: refreshTokenKey)
+    }
+
+    static func getRefreshToken() -> String? {
+        return read(account: refreshTokenKey)
+    }
+
+    static func deleteRefreshToken() {
+        delete(account: refreshTokenKey)
+    }
+
+    private static func save(_ value: String, account: String) {
+        let data = Data(value.utf8)
 
         let query: [String: Any] = [
             kSecClass as String: kSecClassGenericPassword,
             kSecAttrService as String: service,
-            kSecAttrAccount as String: tokenKey,
+            kSecAttrAccount as String: account,
             kSecValueData as String: data
         ]
 
@@ -22,11 +47,11 @@ class KeychainHelper {
         SecItemAdd(query as CFDictionary, nil)
     }
 
-    static func getToken() -> String? {
+    private static func read(account: String) -> String? {
         let query: [String: Any] = [
             kSecClass as String: kSecClassGenericPassword,
             kSecAttrService as String: service,
-            kSecAttrAccount as String: tokenKey,
+            kSecAttrAccount as String: account,
             kSecReturnData as String: true
         ]
 
@@ -35,18 +60,18 @@ class KeychainHelper {
 
         guard status == errSecSuccess,
               let data = result as? Data,
-              let token = String(data: data, encoding: .utf8) else {
+              let value = String(data: data, encoding: .utf8) else {
             return nil
         }
 
-        return token
+        return value
     }
 
-    static func deleteToken() {
+    private static func delete(account: String) {
         let query: [String: Any] = [
             kSecClass as String: kSecClassGenericPassword,
             kSecAttrService as String: service,
-            kSecAttrAccount as String: tokenKey
+            kSecAttrAccount as String: account
         ]
 
         SecItemDelete(query as CFDictionary)
@@ -7,6 +7,8 @@ struct LoginView: View {
     @State private var isLoading = false
     @State private var errorMessage: String?
     @State private var showingRegister = false
+    @State private var mfaToken: String?
+    @State private var mfaCode = ""
 
     var body: some View {
         NavigationView {
@@ -29,6 +31,14 @@ struct LoginView: View {
                     .textFieldStyle(.roundedBorder)
                     .padding(.horizontal)
 
+                if mfaToken != nil {
+                    TextField("Authentication code", text: $mfaCode)
+                        .textFieldStyle(.roundedBorder)
+                        .textContentType(.oneTimeCode)
+                        .autocapitalization(.none)
+                        .padding(.horizontal)
+                }
+
                 if let error = errorMessage {
                     Text(error)
                         .foregroundColor(.red)
@@ -40,7 +50,7 @@ struct LoginView: View {
                         ProgressView()
                             .progressViewStyle(CircularProgressViewStyle(tint: .white))
                     } else {
-                        Text("Login")
+                        Text(mfaToken == nil ? "Login" : "Verify")
                             .bold()
                     }
                 }
@@ -50,7 +60,7 @@ struct LoginView: View {
                 .foregroundColor(.white)
                 .cornerRadius(10)
                 .padding(.horizontal)
-                .disabled(isLoading || username.isEmpty || password.isEmpty)
+                .disabled(isLoading || username.isEmpty || password.isEmpty || (mfaToken != nil && mfaCode.isEmpty))
 
                 Button("Create Account") {
                     showingRegister = true
@@ -73,10 +83,26 @@ struct LoginView: View {
 
         Task {
             do {
-                try await authService.login(username: username, password: password)
+                if let token = mfaToken {
+                    try await authService.verifyMFA(mfaToken: token, code: mfaCode)
+                } else {
+                    try await authService.login(username: username, password: password)
+                }
+            } catch APIError.mfaRequired(let token) {
+                await MainActor.run {
+                    mfaToken = token
+                    errorMessage = "Enter the code from your authenticator app."
+                }
             } catch {
                 await MainActor.run {
-                    errorMessage = "Login failed. Please check your credentials."
+                    if mfaToken != nil {
+                        // The MFA token may have expired; start over with the password
+                        mfaToken = nil
+                        mfaCode = ""
+                        errorMessage = "Verification failed. Please log in again."
+                    } else {
+                        errorMessage = "Login failed. Please check your credentials."
+                    }
                 }
             }
 
@@ -0,0 +1,13 @@
+-- APNs circuit breaker state, written by workers and read by the API
+
+CREATE TABLE apns_circuit_states (
+    credential_id UUID NOT NULL REFERENCES apns_credentials(id) ON DELETE CASCADE,
+    environment VARCHAR(20) NOT NULL CHECK (environment IN ('sandbox', 'production')),
+    state VARCHAR(20) NOT NULL DEFAULT 'closed' CHECK (state IN ('closed', 'open', 'half_open')),
+    consecutive_failures INT DEFAULT 0,
+    opened_at TIMESTAMP,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (credential_id, environment)
+);
+
+CREATE INDEX idx_apns_circuit_states_state ON apns_circuit_states(state);
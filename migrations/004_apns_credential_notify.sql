@@ -0,0 +1,26 @@
+-- Notify workers when APNs credentials change so cached clients are evicted
+
+CREATE OR REPLACE FUNCTION notify_apns_credentials_changed()
+RETURNS TRIGGER AS $$
+DECLARE
+    rec apns_credentials;
+BEGIN
+    IF TG_OP = 'DELETE' THEN
+        rec := OLD;
+    ELSE
+        rec := NEW;
+    END IF;
+
+    PERFORM pg_notify('apns_credentials_changed', json_build_object(
+        'operation', TG_OP,
+        'credential_id', rec.id,
+        'private_key_path', rec.private_key_path
+    )::text);
+
+    RETURN rec;
+END;
+$$ language 'plpgsql';
+
+CREATE TRIGGER notify_apns_credentials_changed
+    AFTER INSERT OR UPDATE OR DELETE ON apns_credentials
+    FOR EACH ROW EXECUTE FUNCTION notify_apns_credentials_changed();
@@ -0,0 +1,10 @@
+-- Store APNs private keys encrypted in the database (envelope encryption).
+-- private_key_path is kept for keys uploaded before this migration; import
+-- them with `pushlab keys import-files`.
+
+ALTER TABLE apns_credentials
+    ADD COLUMN private_key_ciphertext BYTEA,
+    ADD COLUMN private_key_dek BYTEA,
+    ADD COLUMN kek_id VARCHAR(16);
+
+ALTER TABLE apns_credentials ALTER COLUMN private_key_path SET DEFAULT '';
@@ -0,0 +1,8 @@
+-- Certificate-based (.p12) APNs authentication alongside token (.p8) keys
+
+ALTER TABLE apns_credentials
+    ADD COLUMN auth_type VARCHAR(20) NOT NULL DEFAULT 'token' CHECK (auth_type IN ('token', 'certificate')),
+    ADD COLUMN certificate_expires_at TIMESTAMP;
+
+CREATE INDEX idx_apns_credentials_cert_expiry ON apns_credentials(certificate_expires_at)
+    WHERE auth_type = 'certificate' AND is_active = true;
@@ -0,0 +1,11 @@
+-- Credential health: last successful use, consecutive errors, provider token
+-- errors reported by Apple, and when the owner was last alerted
+
+ALTER TABLE apns_credentials
+    ADD COLUMN last_success_at TIMESTAMP,
+    ADD COLUMN last_error_at TIMESTAMP,
+    ADD COLUMN last_error TEXT,
+    ADD COLUMN error_count INTEGER NOT NULL DEFAULT 0,
+    ADD COLUMN provider_error VARCHAR(64),
+    ADD COLUMN provider_error_at TIMESTAMP,
+    ADD COLUMN expiry_alerted_at TIMESTAMP;
@@ -0,0 +1,25 @@
+-- Multiple named, revocable API keys per user, stored as SHA-256 hashes.
+-- Keys are looked up by their non-secret prefix: the part between "pl_" and
+-- the second "_" for new keys, or the first 12 characters of legacy keys.
+
+CREATE TABLE api_keys (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    name VARCHAR(255) NOT NULL,
+    prefix VARCHAR(16) UNIQUE NOT NULL,
+    key_hash BYTEA NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    last_used_at TIMESTAMP,
+    expires_at TIMESTAMP,
+    revoked_at TIMESTAMP
+);
+
+CREATE INDEX idx_api_keys_user_id ON api_keys(user_id);
+
+-- Existing plaintext keys keep working
+INSERT INTO api_keys (user_id, name, prefix, key_hash, created_at)
+SELECT id, 'Default', left(api_key, 12), digest(api_key, 'sha256'), created_at
+FROM users;
+
+DROP INDEX IF EXISTS idx_users_api_key;
+ALTER TABLE users DROP COLUMN api_key;
@@ -0,0 +1,12 @@
+-- Least-privilege API keys: permission scopes, allowed notification tags and
+-- allowed source addresses (CIDRs). Empty tag/IP lists mean unrestricted.
+
+ALTER TABLE api_keys
+    ADD COLUMN scopes TEXT[] NOT NULL DEFAULT '{}',
+    ADD COLUMN allowed_tags TEXT[] NOT NULL DEFAULT '{}',
+    ADD COLUMN allowed_ips TEXT[] NOT NULL DEFAULT '{}';
+
+-- Existing keys keep full access
+UPDATE api_keys
+SET scopes = ARRAY['notify:send', 'notify:read', 'devices:read', 'devices:write',
+                   'credentials:admin', 'webhooks:admin', 'keys:admin'];
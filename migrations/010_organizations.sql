@@ -0,0 +1,87 @@
+-- Organizations with role-based memberships. Devices, APNs credentials,
+-- notifications, webhooks and API keys belong to an organization; their
+-- user_id column records who created them. Every existing user gets a
+-- personal organization holding their current resources.
+
+CREATE TABLE organizations (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    name VARCHAR(255) NOT NULL,
+    personal BOOLEAN NOT NULL DEFAULT false,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TRIGGER update_organizations_updated_at BEFORE UPDATE ON organizations
+    FOR EACH ROW EXECUTE FUNCTION update_updated_at_column();
+
+CREATE TABLE org_memberships (
+    org_id UUID NOT NULL REFERENCES organizations(id) ON DELETE CASCADE,
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    role VARCHAR(20) NOT NULL CHECK (role IN ('owner', 'admin', 'sender', 'viewer')),
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (org_id, user_id)
+);
+
+CREATE INDEX idx_org_memberships_user ON org_memberships(user_id);
+
+CREATE TABLE org_invitations (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    org_id UUID NOT NULL REFERENCES organizations(id) ON DELETE CASCADE,
+    email VARCHAR(255) NOT NULL,
+    role VARCHAR(20) NOT NULL CHECK (role IN ('owner', 'admin', 'sender', 'viewer')),
+    token_hash BYTEA UNIQUE NOT NULL,
+    invited_by UUID REFERENCES users(id) ON DELETE SET NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    expires_at TIMESTAMP NOT NULL,
+    accepted_at TIMESTAMP,
+    accepted_by UUID REFERENCES users(id) ON DELETE SET NULL
+);
+
+CREATE INDEX idx_org_invitations_org ON org_invitations(org_id);
+
+-- Personal organizations for existing users
+ALTER TABLE users ADD COLUMN default_org_id UUID;
+UPDATE users SET default_org_id = gen_random_uuid();
+
+INSERT INTO organizations (id, name, personal, created_at)
+SELECT default_org_id, username, true, created_at FROM users;
+
+INSERT INTO org_memberships (org_id, user_id, role, created_at)
+SELECT default_org_id, id, 'owner', created_at FROM users;
+
+ALTER TABLE users ADD CONSTRAINT users_default_org_id_fkey
+    FOREIGN KEY (default_org_id) REFERENCES organizations(id) ON DELETE SET NULL;
+
+-- Devices
+ALTER TABLE devices ADD COLUMN org_id UUID REFERENCES organizations(id) ON DELETE CASCADE;
+UPDATE devices d SET org_id = u.default_org_id FROM users u WHERE d.user_id = u.id;
+ALTER TABLE devices ALTER COLUMN org_id SET NOT NULL;
+ALTER TABLE devices DROP CONSTRAINT devices_user_id_device_identifier_key;
+ALTER TABLE devices ADD CONSTRAINT devices_org_id_device_identifier_key UNIQUE (org_id, device_identifier);
+CREATE INDEX idx_devices_org_id ON devices(org_id);
+
+-- APNs credentials
+ALTER TABLE apns_credentials ADD COLUMN org_id UUID REFERENCES organizations(id) ON DELETE CASCADE;
+UPDATE apns_credentials c SET org_id = u.default_org_id FROM users u WHERE c.user_id = u.id;
+ALTER TABLE apns_credentials ALTER COLUMN org_id SET NOT NULL;
+ALTER TABLE apns_credentials DROP CONSTRAINT apns_credentials_user_id_bundle_id_environment_key;
+ALTER TABLE apns_credentials ADD CONSTRAINT apns_credentials_org_id_bundle_id_environment_key
+    UNIQUE (org_id, bundle_id, environment);
+CREATE INDEX idx_apns_credentials_org ON apns_credentials(org_id, is_active);
+
+-- Notifications
+ALTER TABLE notifications ADD COLUMN org_id UUID REFERENCES organizations(id) ON DELETE CASCADE;
+UPDATE notifications n SET org_id = u.default_org_id FROM users u WHERE n.user_id = u.id;
+ALTER TABLE notifications ALTER COLUMN org_id SET NOT NULL;
+CREATE INDEX idx_notifications_org_id ON notifications(org_id, created_at);
+
+-- Webhooks
+ALTER TABLE webhooks ADD COLUMN org_id UUID REFERENCES organizations(id) ON DELETE CASCADE;
+UPDATE webhooks w SET org_id = u.default_org_id FROM users u WHERE w.user_id = u.id;
+ALTER TABLE webhooks ALTER COLUMN org_id SET NOT NULL;
+CREATE INDEX idx_webhooks_org ON webhooks(org_id, is_active);
+
+-- API keys act within one organization
+ALTER TABLE api_keys ADD COLUMN org_id UUID REFERENCES organizations(id) ON DELETE CASCADE;
+UPDATE api_keys k SET org_id = u.default_org_id FROM users u WHERE k.user_id = u.id;
+ALTER TABLE api_keys ALTER COLUMN org_id SET NOT NULL;
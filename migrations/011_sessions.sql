@@ -0,0 +1,26 @@
+-- Rotating refresh tokens and server-side revocation of access tokens.
+-- Refresh tokens are stored as SHA-256 hashes. Each login starts a family
+-- (session); presenting an already used token revokes the whole family.
+-- Access tokens carry their family ID and stop working once it is revoked.
+
+CREATE TABLE refresh_tokens (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    family_id UUID NOT NULL,
+    token_hash BYTEA UNIQUE NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    expires_at TIMESTAMP NOT NULL,
+    used_at TIMESTAMP,
+    revoked_at TIMESTAMP
+);
+
+CREATE INDEX idx_refresh_tokens_user ON refresh_tokens(user_id);
+CREATE INDEX idx_refresh_tokens_family ON refresh_tokens(family_id);
+
+-- Access tokens revoked before they expire, by jti
+CREATE TABLE revoked_access_tokens (
+    jti UUID PRIMARY KEY,
+    expires_at TIMESTAMP NOT NULL
+);
+
+CREATE INDEX idx_revoked_access_tokens_expires ON revoked_access_tokens(expires_at);
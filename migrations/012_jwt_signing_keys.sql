@@ -0,0 +1,18 @@
+-- Asymmetric JWT signing keys. Private keys are encrypted with the master key
+-- like APNs keys. A new key is published (JWKS) before it activates so every
+-- API instance and external verifier knows it by the time tokens use it;
+-- retired keys are kept until tokens signed with them have expired.
+
+CREATE TABLE jwt_signing_keys (
+    kid VARCHAR(64) PRIMARY KEY,
+    algorithm VARCHAR(10) NOT NULL CHECK (algorithm IN ('RS256', 'ES256')),
+    public_key BYTEA NOT NULL,
+    private_key_ciphertext BYTEA NOT NULL,
+    private_key_dek BYTEA NOT NULL,
+    kek_id VARCHAR(16) NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    activates_at TIMESTAMP NOT NULL,
+    retired_at TIMESTAMP
+);
+
+CREATE INDEX idx_jwt_signing_keys_retired ON jwt_signing_keys(retired_at);
@@ -0,0 +1,27 @@
+-- OpenID Connect single sign-on. Users provisioned through an identity
+-- provider have no PushLab password.
+
+ALTER TABLE users ALTER COLUMN password_hash DROP NOT NULL;
+
+-- External identities linked to PushLab users, by issuer and subject
+CREATE TABLE user_identities (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    issuer VARCHAR(512) NOT NULL,
+    subject VARCHAR(255) NOT NULL,
+    email VARCHAR(255),
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    last_login_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE(issuer, subject)
+);
+
+CREATE INDEX idx_user_identities_user ON user_identities(user_id);
+
+-- In-flight authorization requests: state, nonce and PKCE verifier
+CREATE TABLE oidc_login_states (
+    state_hash BYTEA PRIMARY KEY,
+    code_verifier VARCHAR(128) NOT NULL,
+    nonce VARCHAR(128) NOT NULL,
+    redirect_uri TEXT,
+    expires_at TIMESTAMP NOT NULL
+);
@@ -0,0 +1,30 @@
+-- TOTP two-factor authentication for password logins. The TOTP secret is
+-- encrypted with the master key; recovery codes are stored hashed.
+
+CREATE TABLE user_totp (
+    user_id UUID PRIMARY KEY REFERENCES users(id) ON DELETE CASCADE,
+    secret_ciphertext BYTEA NOT NULL,
+    secret_dek BYTEA NOT NULL,
+    kek_id VARCHAR(16) NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    -- NULL until the user confirms enrollment with a valid code
+    enabled_at TIMESTAMP,
+    -- Time step of the last accepted code, so a code cannot be replayed
+    last_used_step BIGINT
+);
+
+CREATE TABLE mfa_recovery_codes (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    code_hash BYTEA NOT NULL,
+    used_at TIMESTAMP,
+    UNIQUE(user_id, code_hash)
+);
+
+-- Logins waiting for the second factor
+CREATE TABLE mfa_challenges (
+    token_hash BYTEA PRIMARY KEY,
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    attempts INTEGER NOT NULL DEFAULT 0,
+    expires_at TIMESTAMP NOT NULL
+);
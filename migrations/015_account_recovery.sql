@@ -0,0 +1,37 @@
+-- Email verification, password reset and login lockout. Tokens are stored as
+-- SHA-256 hashes and can be used once.
+
+-- NULL until the user confirms the address. Existing users have to verify
+-- their address too, since it was never checked.
+ALTER TABLE users ADD COLUMN email_verified_at TIMESTAMP;
+
+CREATE TABLE email_verification_tokens (
+    token_hash BYTEA PRIMARY KEY,
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    -- The address the token was sent to; changing the email invalidates it
+    email VARCHAR(255) NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    expires_at TIMESTAMP NOT NULL
+);
+
+CREATE INDEX idx_email_verification_tokens_user ON email_verification_tokens(user_id);
+
+CREATE TABLE password_reset_tokens (
+    token_hash BYTEA PRIMARY KEY,
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    expires_at TIMESTAMP NOT NULL
+);
+
+CREATE INDEX idx_password_reset_tokens_user ON password_reset_tokens(user_id);
+
+-- Failed logins, counted per username and per client IP over a sliding window
+CREATE TABLE login_failures (
+    id BIGSERIAL PRIMARY KEY,
+    username VARCHAR(255) NOT NULL,
+    ip VARCHAR(45) NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX idx_login_failures_username ON login_failures(username, created_at);
+CREATE INDEX idx_login_failures_ip ON login_failures(ip, created_at);
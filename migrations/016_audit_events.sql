@@ -0,0 +1,39 @@
+-- Append-only audit log of security-relevant and administrative actions.
+-- Actors and targets are not foreign keys, so events outlive the users,
+-- organizations and resources they mention.
+
+CREATE TABLE audit_events (
+    id BIGSERIAL PRIMARY KEY,
+    -- NULL for account events such as logins
+    org_id UUID,
+    actor_user_id UUID,
+    actor_username VARCHAR(255),
+    actor_api_key_id UUID,
+    action VARCHAR(64) NOT NULL,
+    target_type VARCHAR(32) NOT NULL,
+    target_id VARCHAR(255),
+    ip VARCHAR(45),
+    user_agent TEXT,
+    -- Changed fields before and after the action; NULL when the target was
+    -- created or deleted
+    before JSONB,
+    after JSONB,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX idx_audit_events_org ON audit_events(org_id, id);
+CREATE INDEX idx_audit_events_target ON audit_events(target_type, target_id, id);
+
+CREATE FUNCTION audit_events_append_only() RETURNS trigger AS $$
+BEGIN
+    RAISE EXCEPTION 'audit_events is append-only';
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER audit_events_no_update
+    BEFORE UPDATE OR DELETE ON audit_events
+    FOR EACH ROW EXECUTE FUNCTION audit_events_append_only();
+
+CREATE TRIGGER audit_events_no_truncate
+    BEFORE TRUNCATE ON audit_events
+    FOR EACH STATEMENT EXECUTE FUNCTION audit_events_append_only();
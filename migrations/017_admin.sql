@@ -0,0 +1,6 @@
+-- Instance administrators, who manage users across organizations. Grant the
+-- first one with `pushlab users grant-admin <username>`.
+
+ALTER TABLE users ADD COLUMN is_admin BOOLEAN NOT NULL DEFAULT FALSE;
+
+CREATE INDEX idx_users_created_at ON users(created_at);
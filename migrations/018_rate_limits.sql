@@ -0,0 +1,21 @@
+-- Per-user overrides of the configured rate limits and send quotas, set by
+-- instance admins. NULL keeps the configured default; a quota of 0 means
+-- unlimited.
+
+CREATE TABLE user_limits (
+    user_id UUID PRIMARY KEY REFERENCES users(id) ON DELETE CASCADE,
+    requests_per_minute INT CHECK (requests_per_minute > 0),
+    burst INT CHECK (burst > 0),
+    daily_quota BIGINT CHECK (daily_quota >= 0),
+    monthly_quota BIGINT CHECK (monthly_quota >= 0),
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Pushes sent per user and UTC day or month, counted against the quotas
+CREATE TABLE send_counters (
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    period VARCHAR(5) NOT NULL CHECK (period IN ('day', 'month')),
+    period_start DATE NOT NULL,
+    sent BIGINT NOT NULL DEFAULT 0,
+    PRIMARY KEY (user_id, period, period_start)
+);
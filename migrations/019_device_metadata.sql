@@ -0,0 +1,17 @@
+-- Device and app details reported by the app at registration, refreshed on
+-- every re-registration. Empty strings are unknown.
+
+ALTER TABLE devices
+    ADD COLUMN platform VARCHAR(16) NOT NULL DEFAULT ''
+        CHECK (platform IN ('', 'ios', 'ipados', 'macos', 'watchos', 'tvos', 'visionos')),
+    ADD COLUMN os_version VARCHAR(64) NOT NULL DEFAULT '',
+    ADD COLUMN app_version VARCHAR(64) NOT NULL DEFAULT '',
+    ADD COLUMN app_build VARCHAR(64) NOT NULL DEFAULT '',
+    ADD COLUMN model VARCHAR(64) NOT NULL DEFAULT '',
+    ADD COLUMN timezone VARCHAR(64) NOT NULL DEFAULT '',
+    ADD COLUMN locale VARCHAR(64) NOT NULL DEFAULT '',
+    ADD COLUMN push_authorization VARCHAR(20) NOT NULL DEFAULT ''
+        CHECK (push_authorization IN ('', 'authorized', 'denied', 'provisional', 'ephemeral', 'not_determined'));
+
+CREATE INDEX idx_devices_org_app_version ON devices(org_id, app_version);
+CREATE INDEX idx_devices_org_os_version ON devices(org_id, os_version);
@@ -0,0 +1,17 @@
+-- Audience targeting by filter expression
+
+-- version_key turns a dotted version into its numeric components without
+-- trailing zero components, so that versions compare as arrays and 2.3 equals
+-- 2.3.0. Anything after the leading numeric part is ignored; versions that do
+-- not start with a number yield NULL.
+CREATE OR REPLACE FUNCTION version_key(version TEXT) RETURNS INT[] AS $$
+    SELECT string_to_array(
+        regexp_replace(substring(version FROM '^[0-9]{1,9}(?:\.[0-9]{1,9})*'), '(\.0+)+$', ''),
+        '.'
+    )::INT[]
+$$ LANGUAGE SQL IMMUTABLE;
+
+CREATE INDEX idx_devices_org_app_version_key ON devices(org_id, version_key(app_version));
+
+-- The target expression a notification was sent to, if any
+ALTER TABLE notifications ADD COLUMN target TEXT;
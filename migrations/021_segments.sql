@@ -0,0 +1,19 @@
+-- Saved audience segments: named target expressions, evaluated at send time
+
+CREATE TABLE segments (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    org_id UUID NOT NULL REFERENCES organizations(id) ON DELETE CASCADE,
+    user_id UUID REFERENCES users(id) ON DELETE SET NULL,
+    name VARCHAR(100) NOT NULL,
+    description TEXT NOT NULL DEFAULT '',
+    expression TEXT NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE (org_id, name)
+);
+
+CREATE TRIGGER update_segments_updated_at BEFORE UPDATE ON segments
+    FOR EACH ROW EXECUTE FUNCTION update_updated_at_column();
+
+-- The segment a notification was sent to, if any, by name at send time
+ALTER TABLE notifications ADD COLUMN segment VARCHAR(100);
@@ -0,0 +1,43 @@
+-- Publish/subscribe topics: devices opt in to named topics, senders publish
+-- to a topic without knowing its subscribers
+
+CREATE TABLE topics (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    org_id UUID NOT NULL REFERENCES organizations(id) ON DELETE CASCADE,
+    name VARCHAR(64) NOT NULL,
+    description TEXT NOT NULL DEFAULT '',
+    -- Access of members without an ACL entry
+    default_access VARCHAR(10) NOT NULL DEFAULT 'read-write'
+        CHECK (default_access IN ('read-write', 'read-only', 'write-only', 'deny')),
+    -- How long published messages are kept in the topic's history
+    message_retention_hours INT NOT NULL DEFAULT 168 CHECK (message_retention_hours > 0),
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE (org_id, name)
+);
+
+CREATE TRIGGER update_topics_updated_at BEFORE UPDATE ON topics
+    FOR EACH ROW EXECUTE FUNCTION update_updated_at_column();
+
+-- Per-member access to a topic; read covers subscribing and the history,
+-- write covers publishing
+CREATE TABLE topic_acl (
+    topic_id UUID NOT NULL REFERENCES topics(id) ON DELETE CASCADE,
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    access VARCHAR(10) NOT NULL CHECK (access IN ('read-write', 'read-only', 'write-only', 'deny')),
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (topic_id, user_id)
+);
+
+CREATE TABLE topic_subscriptions (
+    topic_id UUID NOT NULL REFERENCES topics(id) ON DELETE CASCADE,
+    device_id UUID NOT NULL REFERENCES devices(id) ON DELETE CASCADE,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (topic_id, device_id)
+);
+
+CREATE INDEX idx_topic_subscriptions_device_id ON topic_subscriptions(device_id);
+
+-- Messages published to a topic form its history
+ALTER TABLE notifications ADD COLUMN topic_id UUID REFERENCES topics(id) ON DELETE SET NULL;
+CREATE INDEX idx_notifications_topic_id ON notifications(topic_id, created_at) WHERE topic_id IS NOT NULL;
@@ -0,0 +1,25 @@
+-- Device token history and multiple active tokens per device.
+--
+-- A device has at most one active token per bundle ID and environment, e.g.
+-- for the app and an extension, or sandbox and production builds. Replaced
+-- tokens stay as history, so a token only has to be unique among the active
+-- ones and can come back later, or move to another device.
+
+ALTER TABLE device_tokens DROP CONSTRAINT IF EXISTS device_tokens_token_key;
+
+CREATE UNIQUE INDEX idx_device_tokens_active_token ON device_tokens(token) WHERE is_valid;
+CREATE UNIQUE INDEX idx_device_tokens_active_slot ON device_tokens(device_id, bundle_id, environment) WHERE is_valid;
+
+-- Why and when a token stopped being active: replaced by a newer token for
+-- the same slot, moved to another device of the same user, transferred to
+-- another user's device, rejected by APNs, or removed through the API
+ALTER TABLE device_tokens
+    ADD COLUMN invalidated_at TIMESTAMP,
+    ADD COLUMN invalidated_reason VARCHAR(20)
+        CHECK (invalidated_reason IN ('replaced', 'moved', 'transferred', 'rejected', 'removed'));
+
+UPDATE device_tokens SET invalidated_at = updated_at, invalidated_reason = 'rejected'
+WHERE NOT is_valid AND last_error IS NOT NULL;
+
+UPDATE device_tokens SET invalidated_at = updated_at, invalidated_reason = 'replaced'
+WHERE NOT is_valid AND invalidated_reason IS NULL;
@@ -0,0 +1,8 @@
+-- Device lifecycle: the worker marks devices stale that stopped checking in,
+-- and deletes devices whose tokens have all been invalid for a long time
+
+-- When the device was marked stale; cleared when it is seen again
+ALTER TABLE devices ADD COLUMN stale_at TIMESTAMP;
+
+CREATE INDEX idx_devices_unseen ON devices(COALESCE(last_seen_at, created_at)) WHERE stale_at IS NULL;
+CREATE INDEX idx_device_tokens_invalidated_at ON device_tokens(device_id, invalidated_at);
@@ -0,0 +1,17 @@
+-- Device check-ins: a device-scoped token lets a device report that it is
+-- alive, and the worker alerts the owner when a monitored device misses its
+-- heartbeat window
+
+-- SHA-256 of the device's heartbeat token
+ALTER TABLE devices ADD COLUMN heartbeat_token_hash BYTEA;
+
+-- How long the device may go without checking in before its owner is
+-- alerted; NULL leaves the device unmonitored
+ALTER TABLE devices ADD COLUMN heartbeat_window_minutes INT
+    CHECK (heartbeat_window_minutes > 0);
+
+-- When the owner was alerted that the device went offline; cleared once it
+-- is back
+ALTER TABLE devices ADD COLUMN offline_alerted_at TIMESTAMP;
+
+CREATE INDEX idx_devices_heartbeat_monitored ON devices(last_seen_at) WHERE heartbeat_window_minutes IS NOT NULL;
@@ -0,0 +1,22 @@
+-- Only notify workers about credential changes that affect the cached APNs
+-- client. Health bookkeeping (last_success_at, error_count, ...) is written
+-- on every push and must not evict clients, which would rebuild the HTTP/2
+-- connection and provider token each time.
+
+DROP TRIGGER IF EXISTS notify_apns_credentials_changed ON apns_credentials;
+
+CREATE TRIGGER notify_apns_credentials_changed
+    AFTER INSERT OR DELETE ON apns_credentials
+    FOR EACH ROW EXECUTE FUNCTION notify_apns_credentials_changed();
+
+CREATE TRIGGER notify_apns_credentials_updated
+    AFTER UPDATE OF team_id, key_id, bundle_id, environment, auth_type, is_active,
+                    private_key_path, private_key_ciphertext, private_key_dek, kek_id
+    ON apns_credentials
+    FOR EACH ROW
+    WHEN ((OLD.team_id, OLD.key_id, OLD.bundle_id, OLD.environment, OLD.auth_type, OLD.is_active,
+           OLD.private_key_path, OLD.private_key_ciphertext, OLD.private_key_dek, OLD.kek_id)
+          IS DISTINCT FROM
+          (NEW.team_id, NEW.key_id, NEW.bundle_id, NEW.environment, NEW.auth_type, NEW.is_active,
+           NEW.private_key_path, NEW.private_key_ciphertext, NEW.private_key_dek, NEW.kek_id))
+    EXECUTE FUNCTION notify_apns_credentials_changed();
@@ -0,0 +1,10 @@
+-- Open and half-open circuit states expire unless a worker refreshes them, so
+-- states left behind by a worker that stopped, or that only another worker
+-- saw recover, do not report APNs as degraded forever. Closed states never
+-- expire.
+
+ALTER TABLE apns_circuit_states ADD COLUMN expires_at TIMESTAMPTZ;
+
+-- States written before now may be orphaned; workers restore the ones that
+-- are still open when they start
+UPDATE apns_circuit_states SET expires_at = NOW() WHERE state <> 'closed';
@@ -0,0 +1,19 @@
+-- Migration 009 gave existing keys every scope that existed then. The later
+-- topics:admin and audit:read scopes were never granted to those keys, so
+-- full-access keys of organization owners and admins silently lost topic
+-- administration and audit log access. Grant the new scopes to unrevoked keys
+-- that hold every earlier scope, where the owner's role allows them.
+
+UPDATE api_keys k
+SET scopes = ARRAY(
+    SELECT DISTINCT scope
+    FROM unnest(k.scopes || ARRAY['topics:admin', 'audit:read']) AS scope
+    ORDER BY scope
+)
+FROM org_memberships m
+WHERE m.org_id = k.org_id
+  AND m.user_id = k.user_id
+  AND m.role IN ('owner', 'admin')
+  AND k.revoked_at IS NULL
+  AND k.scopes @> ARRAY['notify:send', 'notify:read', 'devices:read', 'devices:write',
+                        'credentials:admin', 'webhooks:admin', 'keys:admin'];